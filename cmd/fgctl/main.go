@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `usage: fgctl [-gateway http://localhost:8080] <command>
+
+commands:
+  rebalance           start a rebalance
+  rebalance-status    progress of the running or the last rebalance
+  gc [dry-run] [repair]
+                      start a garbage collection, dry-run only reports what would be deleted
+                      and repair writes missing chunks and chunks of the wrong size again
+  gc-status           report of the running or the last garbage collection
+  drain <server id>   stop placing chunks on the server and move its chunks away
+  drain-status <id>   whether the draining server is safe to remove
+`
+
+func main() {
+	gateway := flag.String("gateway", "http://localhost:8080", "address of the file gateway")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	base := strings.TrimRight(*gateway, "/")
+	var method, path string
+	switch {
+	case args[0] == "rebalance" && len(args) == 1:
+		method, path = http.MethodPost, "/admin/rebalance"
+	case args[0] == "rebalance-status" && len(args) == 1:
+		method, path = http.MethodGet, "/admin/rebalance"
+	case args[0] == "gc" && len(args) <= 3:
+		query, ok := gcQuery(args[1:])
+		if !ok {
+			flag.Usage()
+			os.Exit(2)
+		}
+		method, path = http.MethodPost, "/admin/gc"+query
+	case args[0] == "gc-status" && len(args) == 1:
+		method, path = http.MethodGet, "/admin/gc"
+	case args[0] == "drain" && len(args) == 2:
+		method, path = http.MethodPost, "/admin/servers/"+args[1]+"/drain"
+	case args[0] == "drain-status" && len(args) == 2:
+		method, path = http.MethodGet, "/admin/servers/"+args[1]+"/drain"
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := call(method, base+path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// gcQuery - query of a garbage collection started with the dry-run and repair arguments
+func gcQuery(args []string) (string, bool) {
+	params := url.Values{}
+	for _, arg := range args {
+		switch arg {
+		case "dry-run":
+			params.Set("dry_run", "true")
+		case "repair":
+			params.Set("repair", "true")
+		default:
+			return "", false
+		}
+	}
+	if len(params) == 0 {
+		return "", true
+	}
+	return "?" + params.Encode(), true
+}
+
+// call - sends the request and prints the response body, a status other than 2xx is an error
+func call(method, url string) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach the gateway: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read the response: %w", err)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if len(body) == 0 {
+		fmt.Println(resp.Status)
+		return nil
+	}
+	fmt.Print(string(body))
+	return nil
+}
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/caarlos0/env"
 	"github.com/denismitr/shardstore/internal/common/closer"
 	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/buckets"
 	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/deleter"
 	"github.com/denismitr/shardstore/internal/filegateway/downloader"
+	"github.com/denismitr/shardstore/internal/filegateway/gc"
 	"github.com/denismitr/shardstore/internal/filegateway/httpserver"
 	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/rebalancer"
 	"github.com/denismitr/shardstore/internal/filegateway/remotestore"
 	"github.com/denismitr/shardstore/internal/filegateway/shardmanager"
+	"github.com/denismitr/shardstore/internal/filegateway/topology"
 	"github.com/denismitr/shardstore/internal/filegateway/uploader"
 	"log"
 	"os"
@@ -25,19 +33,31 @@ func main() {
 
 	defer closer.CloseAll()
 
-	shardManager, err := shardmanager.NewShardManager(cfg, lg)
+	grpcRemoteStore, err := remotestore.NewGRPCStore(cfg, lg)
 	if err != nil {
 		lg.Error(err)
 		os.Exit(1)
 	}
 
-	grpcRemoteStore, err := remotestore.NewGRPCStore(cfg, lg)
+	topologyStore, err := topology.NewFileStore(cfg.AppName)
+	if err != nil {
+		lg.Error(err)
+		os.Exit(1)
+	}
+
+	topo, err := currentTopology(cfg, grpcRemoteStore, topologyStore)
+	if err != nil {
+		lg.Error(err)
+		os.Exit(1)
+	}
+
+	shardManager, err := shardmanager.NewShardManager(cfg, topo.Servers, lg)
 	if err != nil {
 		lg.Error(err)
 		os.Exit(1)
 	}
 
-	metaStore, err := metastore.NewTmpMetaStore(cfg.AppName, lg)
+	metaStore, err := newMetaStore(cfg, lg)
 	if err != nil {
 		lg.Error(err)
 		os.Exit(1)
@@ -45,10 +65,84 @@ func main() {
 
 	fileUploader := uploader.NewUploader(cfg, shardManager, grpcRemoteStore, metaStore, lg)
 	fileDownloader := downloader.NewDownloader(cfg, grpcRemoteStore, metaStore, lg)
+	fileDeleter := deleter.NewDeleter(cfg, grpcRemoteStore, metaStore, lg)
+	bucketManager := buckets.NewManager(metaStore, lg)
+	clusterRebalancer := rebalancer.NewRebalancer(cfg, shardManager, grpcRemoteStore, metaStore, topologyStore, lg)
+	collector := gc.NewCollector(cfg, shardManager, grpcRemoteStore, metaStore, lg)
 
-	server := httpserver.NewServer(cfg, lg, fileUploader, fileDownloader)
+	ctx, cancel := context.WithCancel(context.Background())
+	closer.Add(func() error {
+		cancel()
+		return nil
+	})
+	go fileDeleter.RunCleanup(ctx)
+	go clusterRebalancer.RunBackground(ctx)
+	go fileUploader.RunResumableExpiry(ctx)
+	go fileUploader.RunPendingUploadsCleanup(ctx)
+	go collector.RunBackground(ctx)
+
+	if topo.RebalancePending {
+		lg.Debugf("cluster topology changed to version %d, rebalancing", topo.Version)
+		_ = clusterRebalancer.Trigger()
+	}
+
+	if cfg.S3AccessKey != "" {
+		s3Server := httpserver.NewS3Server(cfg, lg, fileUploader, fileDownloader, fileDeleter, bucketManager)
+		go func() {
+			if err := s3Server.Start(); err != nil {
+				lg.Error(err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	server := httpserver.NewServer(cfg, lg, fileUploader, fileDownloader, fileDeleter, bucketManager, clusterRebalancer, collector)
 	if err := server.Start(); err != nil {
 		lg.Error(err)
 		os.Exit(1)
 	}
 }
+
+// newMetaStore - the meta store chosen by FG_META_STORE
+func newMetaStore(cfg *config.Config, lg logger.Logger) (metastore.MetaStore, error) {
+	switch cfg.MetaStore {
+	case "tmp":
+		return metastore.NewTmpMetaStore(cfg.AppName, lg)
+	case "bolt":
+		store, err := metastore.NewBoltMetaStore(cfg.MetaStoreFile(), lg)
+		if err != nil {
+			return nil, err
+		}
+		closer.Add(store.Close)
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown meta store %q, expected bolt or tmp", cfg.MetaStore)
+	}
+}
+
+// currentTopology - the topology of the connected servers, saved as the successor of the previous one
+func currentTopology(cfg *config.Config, rs *remotestore.GRPCStore, ts *topology.FileStore) (*topology.Topology, error) {
+	ctx := context.Background()
+
+	prev, err := ts.Load(ctx)
+	if err != nil && !errors.Is(err, topology.ErrNotFound) {
+		return nil, err
+	}
+
+	connected := rs.Servers()
+	servers := make([]topology.Server, len(connected))
+	for i, s := range connected {
+		servers[i] = topology.Server{ID: s.ID, Addr: s.Addr}
+	}
+
+	topo, err := topology.New(servers, cfg.StorageServerWeights)
+	if err != nil {
+		return nil, err
+	}
+
+	topo.Follow(prev)
+	if err := ts.Save(ctx, topo); err != nil {
+		return nil, err
+	}
+	return topo, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/caarlos0/env"
+	"github.com/denismitr/shardstore/internal/common/closer"
 	"github.com/denismitr/shardstore/internal/common/logger"
 	"github.com/denismitr/shardstore/internal/filestore/config"
 	"github.com/denismitr/shardstore/internal/filestore/grpcserver"
@@ -17,9 +18,16 @@ func main() {
 	}
 
 	lg := logger.NewStdoutLogger(logger.Env(cfg.AppEnv), cfg.AppName)
-	kd := tfs.NewKeyDir()
+	defer closer.CloseAll()
 
-	fileSrv := grpcserver.NewFileServer(cfg, lg, kd)
+	kd, err := tfs.NewKeyDir(cfg, lg)
+	if err != nil {
+		lg.Error(err)
+		os.Exit(1)
+	}
+	closer.Add(kd.Close)
+
+	fileSrv := grpcserver.NewFileServer(cfg, lg, kd, kd)
 	if err := grpcserver.StartGRPCServer(cfg, lg, fileSrv); err != nil {
 		lg.Error(err)
 		os.Exit(1)
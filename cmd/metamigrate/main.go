@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/caarlos0/env"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"log"
+	"os"
+	"strings"
+)
+
+// imports the json buckets, shard plans, pending deletions and upload records of a TmpMetaStore into the bolt meta store,
+// with -keys moves the plans in the bolt meta store from keys of the previous key scheme to the current ones,
+// -names is a file of tab separated old keys and original names of plans stored before names were recorded,
+// the gateway has to be stopped while it runs since the bolt file can only be opened once
+func main() {
+	cfg := &config.Config{}
+	if err := env.Parse(cfg); err != nil {
+		log.Fatalf("failed to retrieve env variables, %v", err)
+	}
+
+	app := flag.String("app", cfg.AppName, "app name the json meta store was kept under, tmp/<app>/metastore")
+	db := flag.String("db", cfg.MetaStoreFile(), "bolt meta store file to import into")
+	keys := flag.Bool("keys", false, "migrate keys of the previous key scheme instead of importing")
+	names := flag.String("names", "", "file of tab separated old keys and original names of files stored before names were recorded")
+	flag.Parse()
+
+	lg := logger.NewStdoutLogger(logger.Env(cfg.AppEnv), "metamigrate")
+
+	to, err := metastore.NewBoltMetaStore(*db, lg)
+	if err != nil {
+		log.Fatalf("could not open the bolt meta store: %v", err)
+	}
+
+	if *keys {
+		err = migrateKeys(to, *names)
+	} else {
+		err = importTmpMetaStore(*app, to, lg)
+	}
+	if closeErr := to.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func importTmpMetaStore(app string, to *metastore.BoltMetaStore, lg logger.Logger) error {
+	from, err := metastore.NewTmpMetaStore(app, lg)
+	if err != nil {
+		return err
+	}
+
+	stats, err := metastore.MigrateMetaStore(context.Background(), from, to)
+	if err != nil {
+		log.Printf("import stopped after %d shard plans", stats.Plans)
+		return err
+	}
+
+	log.Printf(
+		"imported %d buckets, %d shard plans, %d pending deletions, %d pending uploads, %d multipart uploads and %d resumable uploads",
+		stats.Buckets, stats.Plans, stats.PendingDeletions, stats.PendingUploads, stats.MultipartUploads, stats.ResumableUploads,
+	)
+	return nil
+}
+
+func migrateKeys(store *metastore.BoltMetaStore, namesFile string) error {
+	names, err := readNames(namesFile)
+	if err != nil {
+		return err
+	}
+
+	stats, err := metastore.MigrateKeys(context.Background(), store, names)
+	if err != nil {
+		log.Printf("key migration stopped after %d shard plans", stats.Moved)
+		return err
+	}
+
+	for _, key := range stats.Conflicts {
+		log.Printf("%s is left as it is, another file is stored under its new key", key)
+	}
+	for _, key := range stats.Unnamed {
+		log.Printf("%s is left as it is, its original name is unknown, give it with -names", key)
+	}
+	log.Printf("moved %d shard plans to their new keys, %d left without a name", stats.Moved, len(stats.Unnamed))
+	return nil
+}
+
+// readNames - original names by the old keys of their files, one tab separated pair per line
+func readNames(path string) (map[multishard.Key]string, error) {
+	names := make(map[multishard.Key]string)
+	if path == "" {
+		return names, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open names: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		key, name, ok := strings.Cut(sc.Text(), "\t")
+		if !ok || key == "" || name == "" {
+			return nil, fmt.Errorf("line %d of %s is not an old key and a name separated by a tab", line, path)
+		}
+		names[multishard.Key(key)] = name
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("could not read names: %w", err)
+	}
+	return names, nil
+}
@@ -0,0 +1,43 @@
+package throttle
+
+import (
+	"context"
+	"time"
+)
+
+// Throttle - keeps background I/O under a given rate in bytes per second,
+// so that compaction or moving chunks around does not starve uploads and downloads
+type Throttle struct {
+	rate    int64
+	started time.Time
+	done    int64
+}
+
+// New - a throttle of the rate, zero or less does not limit anything
+func New(bytesPerSecond int64) *Throttle {
+	return &Throttle{rate: bytesPerSecond, started: time.Now()}
+}
+
+// Wait - accounts n processed bytes and sleeps if the rate is exceeded
+func (t *Throttle) Wait(ctx context.Context, n int) error {
+	if t.rate <= 0 {
+		return ctx.Err()
+	}
+
+	t.done += int64(n)
+	expected := time.Duration(float64(t.done) / float64(t.rate) * float64(time.Second))
+	ahead := expected - time.Since(t.started)
+	if ahead <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,33 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestThrottle_WaitKeepsTheRate(t *testing.T) {
+	th := New(1000)
+	started := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := th.Wait(context.Background(), 20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed < 90*time.Millisecond {
+		t.Errorf("100 bytes at 1000 bytes per second took %s", elapsed)
+	}
+}
+
+func TestThrottle_WaitStopsWithTheContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := New(1).Wait(ctx, 1000); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() error = %v, want %v", err, context.Canceled)
+	}
+	if err := New(0).Wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("expected no limit without a rate, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package buckets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/uploader"
+	"mime"
+	"time"
+)
+
+var ErrInvalidSettings = errors.New("invalid bucket settings")
+
+const (
+	// MaxChunkSize - a whole chunk is held in memory while it is erasure coded
+	MaxChunkSize = 256 * 1024 * 1024
+	// maxErasureShards - the most data and parity fragments a chunk can be coded into
+	maxErasureShards = 256
+)
+
+// metaStorage - where buckets are kept along with the shard plans of their files
+type metaStorage interface {
+	CreateBucket(ctx context.Context, b *metastore.Bucket) error
+	GetBucket(ctx context.Context, name string) (*metastore.Bucket, error)
+	UpdateBucket(ctx context.Context, name string, update func(b *metastore.Bucket) (*metastore.Bucket, error)) error
+	ListBuckets(ctx context.Context) ([]*metastore.Bucket, error)
+	DeleteBucket(ctx context.Context, name string) error
+}
+
+// Manager - creates and removes buckets and keeps their settings
+type Manager struct {
+	lg        logger.Logger
+	metaStore metaStorage
+}
+
+func NewManager(metaStore metaStorage, lg logger.Logger) *Manager {
+	return &Manager{lg: lg, metaStore: metaStore}
+}
+
+// Create - fails with metastore.ErrAlreadyExists when the bucket exists
+func (m *Manager) Create(ctx context.Context, name string, settings metastore.BucketSettings) (*metastore.Bucket, error) {
+	if err := multishard.ValidateBucketName(name); err != nil {
+		return nil, err
+	}
+	if err := ValidateSettings(settings); err != nil {
+		return nil, err
+	}
+
+	b := &metastore.Bucket{Name: name, CreatedAt: time.Now().UTC(), Settings: settings}
+	if err := m.metaStore.CreateBucket(ctx, b); err != nil {
+		return nil, fmt.Errorf("could not create bucket %s: %w", name, err)
+	}
+
+	m.lg.Debugf("bucket %s created", name)
+	return b, nil
+}
+
+// Get - fails with metastore.ErrNotFound when there is no such bucket
+func (m *Manager) Get(ctx context.Context, name string) (*metastore.Bucket, error) {
+	if err := multishard.ValidateBucketName(name); err != nil {
+		return nil, err
+	}
+	return m.metaStore.GetBucket(ctx, name)
+}
+
+func (m *Manager) List(ctx context.Context) ([]*metastore.Bucket, error) {
+	return m.metaStore.ListBuckets(ctx)
+}
+
+// UpdateSettings - replaces the settings of the bucket, files that are already stored keep their chunks
+// as they were uploaded, only later uploads follow the new settings
+func (m *Manager) UpdateSettings(ctx context.Context, name string, settings metastore.BucketSettings) (*metastore.Bucket, error) {
+	if err := multishard.ValidateBucketName(name); err != nil {
+		return nil, err
+	}
+	if err := ValidateSettings(settings); err != nil {
+		return nil, err
+	}
+
+	var updated *metastore.Bucket
+	err := m.metaStore.UpdateBucket(ctx, name, func(b *metastore.Bucket) (*metastore.Bucket, error) {
+		b.Settings = settings
+		updated = b
+		return b, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not update settings of bucket %s: %w", name, err)
+	}
+	return updated, nil
+}
+
+// Delete - only an empty bucket can be deleted, fails with metastore.ErrNotEmpty otherwise
+func (m *Manager) Delete(ctx context.Context, name string) error {
+	if err := multishard.ValidateBucketName(name); err != nil {
+		return err
+	}
+	if err := m.metaStore.DeleteBucket(ctx, name); err != nil {
+		return fmt.Errorf("could not delete bucket %s: %w", name, err)
+	}
+
+	m.lg.Debugf("bucket %s deleted", name)
+	return nil
+}
+
+// ValidateSettings - zero values are valid, they fall back to the configuration
+func ValidateSettings(s metastore.BucketSettings) error {
+	switch {
+	case s.ChunkSize < 0 || s.ChunkSize > MaxChunkSize:
+		return fmt.Errorf("chunk size %d is out of 0..%d: %w", s.ChunkSize, MaxChunkSize, ErrInvalidSettings)
+	case s.Redundancy != "" && s.Redundancy != string(uploader.Replication) && s.Redundancy != string(uploader.ErasureCoding):
+		return fmt.Errorf("redundancy %q: %w", s.Redundancy, ErrInvalidSettings)
+	case s.Replicas < 0:
+		return fmt.Errorf("replicas %d: %w", s.Replicas, ErrInvalidSettings)
+	case s.ErasureDataShards < 0 || s.ErasureParityShards < 0 || s.ErasureDataShards+s.ErasureParityShards > maxErasureShards:
+		return fmt.Errorf("%d data and %d parity shards: %w", s.ErasureDataShards, s.ErasureParityShards, ErrInvalidSettings)
+	case s.MaxObjectSize < 0:
+		return fmt.Errorf("max object size %d: %w", s.MaxObjectSize, ErrInvalidSettings)
+	}
+
+	if s.DefaultContentType != "" {
+		if _, _, err := mime.ParseMediaType(s.DefaultContentType); err != nil {
+			return fmt.Errorf("default content type %q: %w", s.DefaultContentType, ErrInvalidSettings)
+		}
+	}
+	return nil
+}
+
+// UploadOptions - how a file is uploaded to the bucket
+func UploadOptions(b *metastore.Bucket) uploader.UploadOptions {
+	return uploader.UploadOptions{
+		Redundancy:          uploader.Redundancy(b.Settings.Redundancy),
+		ChunkSize:           b.Settings.ChunkSize,
+		Replicas:            b.Settings.Replicas,
+		ErasureDataShards:   b.Settings.ErasureDataShards,
+		ErasureParityShards: b.Settings.ErasureParityShards,
+		ContentType:         b.Settings.DefaultContentType,
+	}
+}
@@ -0,0 +1,84 @@
+package buckets
+
+import (
+	"context"
+	"errors"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"path/filepath"
+	"testing"
+)
+
+func newTestManager(t *testing.T) (*Manager, *metastore.BoltMetaStore) {
+	t.Helper()
+	lg := logger.NewStdoutLogger(logger.Dev, "test")
+	ms, err := metastore.NewBoltMetaStore(filepath.Join(t.TempDir(), "meta.db"), lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ms.Close() })
+	return NewManager(ms, lg), ms
+}
+
+func TestManager_CreateUpdateAndDelete(t *testing.T) {
+	m, ms := newTestManager(t)
+	ctx := context.Background()
+
+	settings := metastore.BucketSettings{ChunkSize: 1024, Redundancy: "erasure", DefaultContentType: "image/png"}
+	if _, err := m.Create(ctx, "photos", settings); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Create(ctx, "photos", metastore.BucketSettings{}); !errors.Is(err, metastore.ErrAlreadyExists) {
+		t.Errorf("expected ErrAlreadyExists, got %v", err)
+	}
+
+	updated, err := m.UpdateSettings(ctx, "photos", metastore.BucketSettings{Replicas: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Settings.Replicas != 2 || updated.Settings.ChunkSize != 0 || updated.CreatedAt.IsZero() {
+		t.Errorf("expected the settings to be replaced and the rest kept, got %+v", updated)
+	}
+
+	key, _ := multishard.ObjectKey("photos", "a.png")
+	plan := &metastore.ShardPlan{OriginalSize: 1, Shards: []metastore.Shard{{Size: 1}}}
+	if err := ms.Store(ctx, key, plan); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(ctx, "photos"); !errors.Is(err, metastore.ErrNotEmpty) {
+		t.Errorf("expected ErrNotEmpty, got %v", err)
+	}
+	if err := ms.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(ctx, "photos"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(ctx, "photos"); !errors.Is(err, metastore.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestManager_RejectsInvalidNamesAndSettings(t *testing.T) {
+	m, _ := newTestManager(t)
+	ctx := context.Background()
+
+	if _, err := m.Create(ctx, "Photos", metastore.BucketSettings{}); !errors.Is(err, multishard.ErrInvalidBucket) {
+		t.Errorf("expected ErrInvalidBucket, got %v", err)
+	}
+
+	for _, s := range []metastore.BucketSettings{
+		{ChunkSize: -1},
+		{ChunkSize: MaxChunkSize + 1},
+		{Redundancy: "mirroring"},
+		{Replicas: -1},
+		{ErasureDataShards: 200, ErasureParityShards: 100},
+		{MaxObjectSize: -1},
+		{DefaultContentType: "not a type;"},
+	} {
+		if _, err := m.Create(ctx, "photos", s); !errors.Is(err, ErrInvalidSettings) {
+			t.Errorf("settings %+v: expected ErrInvalidSettings, got %v", s, err)
+		}
+	}
+}
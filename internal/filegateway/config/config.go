@@ -1,13 +1,55 @@
 package config
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 type Config struct {
-	AppName              string        `env:"FG_APP_NAME" envDefault:"filegateway"`
-	AppEnv               string        `env:"FG_APP_ENV"  envDefault:"local"`
-	HTTPPort             uint          `env:"FG_HTTP_PORT" envDefault:"8080"`
-	MaxFileSize          int64         `env:"FG_MAX_FILE_SIZE" envDefault:"10485760"` // 10Mb
-	NumberOfChunks       int64         `env:"FG_NUMBER_OF_CHUNKS" envDefault:"3"`
-	StorageServers       []string      `env:"FG_STORAGE_SERVERS" envSeparator:";" envDefault:"localhost:9000;localhost:9001;localhost:9002"`
-	StorageServerTimeout time.Duration `env:"FG_STORAGE_SERVER_TIMEOUT" envDefault:"10s"`
+	AppName               string        `env:"FG_APP_NAME" envDefault:"filegateway"`
+	AppEnv                string        `env:"FG_APP_ENV"  envDefault:"local"`
+	MetaStore             string        `env:"FG_META_STORE" envDefault:"bolt"` // bolt or tmp
+	MetaStorePath         string        `env:"FG_META_STORE_PATH"`              // defaults to tmp/<FG_APP_NAME>/meta.db
+	HTTPPort              uint          `env:"FG_HTTP_PORT" envDefault:"8080"`
+	MaxFileSize           int64         `env:"FG_MAX_FILE_SIZE" envDefault:"0"`    // 0 means unlimited
+	ChunkSize             int64         `env:"FG_CHUNK_SIZE" envDefault:"4194304"` // 4Mb
+	Replicas              int           `env:"FG_REPLICAS" envDefault:"1"`
+	WriteQuorum           int           `env:"FG_WRITE_QUORUM" envDefault:"1"`
+	Redundancy            string        `env:"FG_REDUNDANCY" envDefault:"replication"` // replication or erasure
+	ErasureDataShards     int           `env:"FG_EC_DATA_SHARDS" envDefault:"2"`
+	ErasureParityShards   int           `env:"FG_EC_PARITY_SHARDS" envDefault:"1"`
+	DownloadWorkers       int           `env:"FG_DOWNLOAD_WORKERS" envDefault:"4"`
+	DownloadMemoryBudget  int64         `env:"FG_DOWNLOAD_MEMORY_BUDGET" envDefault:"67108864"` // 64Mb per download
+	StorageServers        []string      `env:"FG_STORAGE_SERVERS" envSeparator:";" envDefault:"localhost:9000;localhost:9001;localhost:9002"`
+	StorageServerWeights  []int         `env:"FG_STORAGE_SERVER_WEIGHTS" envSeparator:";"` // one per server, all 1 when empty
+	VirtualNodes          int           `env:"FG_VIRTUAL_NODES" envDefault:"128"`          // per unit of weight
+	StorageServerTimeout  time.Duration `env:"FG_STORAGE_SERVER_TIMEOUT" envDefault:"10s"`
+	CleanupInterval       time.Duration `env:"FG_CLEANUP_INTERVAL" envDefault:"1m"`
+	PendingUploadGrace    time.Duration `env:"FG_PENDING_UPLOAD_GRACE" envDefault:"1h"`     // how long a stalled upload may still go on, 0 means forever
+	RebalanceRate         int64         `env:"FG_REBALANCE_RATE" envDefault:"8388608"`      // 8Mb per second, 0 means unlimited
+	GCInterval            time.Duration `env:"FG_GC_INTERVAL" envDefault:"24h"`             // 0 means only when started over the admin API
+	GCSafetyWindow        time.Duration `env:"FG_GC_SAFETY_WINDOW" envDefault:"24h"`        // unreferenced chunks younger than this are kept
+	GCRepair              bool          `env:"FG_GC_REPAIR" envDefault:"false"`             // whether scheduled runs repair broken chunks
+	ResumableUploadDir    string        `env:"FG_RESUMABLE_UPLOAD_DIR"`                     // defaults to tmp/<FG_APP_NAME>/resumable
+	ResumableUploadExpiry time.Duration `env:"FG_RESUMABLE_UPLOAD_EXPIRY" envDefault:"24h"` // 0 means never
+	S3Port                uint          `env:"FG_S3_PORT" envDefault:"9090"`
+	S3Region              string        `env:"FG_S3_REGION" envDefault:"us-east-1"`
+	S3AccessKey           string        `env:"FG_S3_ACCESS_KEY"` // the S3 API is not served without it
+	S3SecretKey           string        `env:"FG_S3_SECRET_KEY"`
+}
+
+// MetaStoreFile - where the bolt meta store keeps its data
+func (c *Config) MetaStoreFile() string {
+	if c.MetaStorePath != "" {
+		return c.MetaStorePath
+	}
+	return fmt.Sprintf("tmp/%s/meta.db", c.AppName)
+}
+
+// ResumableUploadPath - where the bytes of resumable uploads wait until they fill a chunk
+func (c *Config) ResumableUploadPath() string {
+	if c.ResumableUploadDir != "" {
+		return c.ResumableUploadDir
+	}
+	return fmt.Sprintf("tmp/%s/resumable", c.AppName)
 }
@@ -0,0 +1,226 @@
+package deleter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"sync"
+	"time"
+)
+
+// ErrConflict - the file was stored again while it was being deleted
+var ErrConflict = errors.New("file changed while it was being deleted")
+
+type remoteStorage interface {
+	Delete(
+		ctx context.Context,
+		key multishard.Key,
+		serverID multishard.ServerIdx,
+	) error
+}
+
+type metaStorage interface {
+	GetShardPlan(ctx context.Context, key multishard.Key) (*metastore.ShardPlan, error)
+	DeleteShardPlan(ctx context.Context, key multishard.Key, check func(plan *metastore.ShardPlan) error) error
+	StorePendingDeletion(ctx context.Context, pd *metastore.PendingDeletion) error
+	ListPendingDeletions(ctx context.Context) ([]*metastore.PendingDeletion, error)
+	RemovePendingDeletion(ctx context.Context, id string) error
+	ListPendingUploads(ctx context.Context) ([]*metastore.PendingUpload, error)
+}
+
+type Deleter struct {
+	cfg         *config.Config
+	lg          logger.Logger
+	remoteStore remoteStorage
+	metaStore   metaStorage
+}
+
+func NewDeleter(
+	cfg *config.Config,
+	remoteStore remoteStorage,
+	metaStore metaStorage,
+	lg logger.Logger,
+) *Deleter {
+	return &Deleter{cfg: cfg, remoteStore: remoteStore, metaStore: metaStore, lg: lg}
+}
+
+// Delete - removes every chunk of the file from its server and then the shard plan itself,
+// chunks that could not be removed are recorded as a pending deletion for the cleanup
+// and false is returned in that case. The plan is only removed if it is still the one whose chunks
+// were removed, a plan an upload committed meanwhile is kept and ErrConflict is returned
+func (d *Deleter) Delete(ctx context.Context, bucket, fileName string) (bool, error) {
+	key, err := multishard.ObjectKey(bucket, fileName)
+	if err != nil {
+		return false, err
+	}
+
+	plan, err := d.metaStore.GetShardPlan(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("could not get shard plan of %s: %w", fileName, err)
+	}
+
+	remaining := d.deleteLocations(ctx, key, plan.Locations(key))
+
+	// every upload commits its plan with a modification time of its own
+	var current *metastore.ShardPlan
+	errDelete := d.metaStore.DeleteShardPlan(ctx, key, func(p *metastore.ShardPlan) error {
+		if !p.ModifiedAt.Equal(plan.ModifiedAt) {
+			return ErrConflict
+		}
+		current = p
+		return nil
+	})
+	if errDelete == nil {
+		// replicas the upload added after it returned, while the chunks were being removed
+		if late := plan.Unreferenced(key, current.Locations(key)); len(late) > 0 {
+			remaining = append(remaining, d.deleteLocations(ctx, key, late)...)
+		}
+	}
+
+	// the chunks that were removed are not referenced by the plan of a newer upload either
+	if len(remaining) > 0 {
+		if err := d.metaStore.StorePendingDeletion(ctx, metastore.NewPendingDeletion(key, remaining)); err != nil {
+			return false, fmt.Errorf("could not record %d chunks of %s left behind: %w", len(remaining), fileName, err)
+		}
+	}
+
+	if errDelete != nil {
+		return false, fmt.Errorf("could not delete shard plan of %s: %w", fileName, errDelete)
+	}
+
+	return len(remaining) == 0, nil
+}
+
+// deleteLocations - removes chunk copies and fragments in parallel and returns the ones that failed
+func (d *Deleter) deleteLocations(ctx context.Context, key multishard.Key, locations []metastore.Location) []metastore.Location {
+	var mx sync.Mutex
+	var remaining []metastore.Location
+	var wg sync.WaitGroup
+
+	for _, loc := range locations {
+		wg.Add(1)
+		go func(loc metastore.Location) {
+			defer wg.Done()
+
+			if err := d.remoteStore.Delete(ctx, loc.Key, multishard.ServerIdx(loc.ServerIdx)); err != nil {
+				d.lg.Error(fmt.Errorf("could not delete %s of %s from server %d: %w", loc.Key, key, loc.ServerIdx, err))
+				mx.Lock()
+				remaining = append(remaining, loc)
+				mx.Unlock()
+			}
+		}(loc)
+	}
+
+	wg.Wait()
+	return remaining
+}
+
+// RetryPending - makes another attempt to remove chunks left behind by earlier deletions,
+// chunks that a newer upload of the same file has taken over are skipped and chunks that a running upload
+// is writing are left for a later attempt, the uploader records chunks replaced by an upload here as well
+func (d *Deleter) RetryPending(ctx context.Context) error {
+	pending, err := d.metaStore.ListPendingDeletions(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// listed before the plans are looked at, an upload that commits meanwhile is seen in its plan
+	uploading, err := d.uploadingLocations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, pd := range pending {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		locations, err := d.orphanedLocations(ctx, pd)
+		if err != nil {
+			d.lg.Error(err)
+			continue
+		}
+
+		var busy, orphaned []metastore.Location
+		for _, loc := range locations {
+			if _, ok := uploading[loc]; ok {
+				busy = append(busy, loc)
+				continue
+			}
+			orphaned = append(orphaned, loc)
+		}
+
+		remaining := append(busy, d.deleteLocations(ctx, pd.Key, orphaned)...)
+		if len(remaining) == 0 {
+			if err := d.metaStore.RemovePendingDeletion(ctx, pd.ID); err != nil {
+				d.lg.Error(err)
+			}
+			continue
+		}
+
+		pd.Locations = remaining
+		pd.Shards = nil
+		if err := d.metaStore.StorePendingDeletion(ctx, pd); err != nil {
+			d.lg.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// uploadingLocations - every location a running upload is about to write or has written
+func (d *Deleter) uploadingLocations(ctx context.Context) (map[metastore.Location]struct{}, error) {
+	uploads, err := d.metaStore.ListPendingUploads(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list pending uploads: %w", err)
+	}
+
+	result := make(map[metastore.Location]struct{})
+	for _, pu := range uploads {
+		for _, loc := range pu.Locations {
+			result[loc] = struct{}{}
+		}
+	}
+	return result, nil
+}
+
+// orphanedLocations - pending locations the current plan of the file does not reference
+func (d *Deleter) orphanedLocations(ctx context.Context, pd *metastore.PendingDeletion) ([]metastore.Location, error) {
+	plan, err := d.metaStore.GetShardPlan(ctx, pd.Key)
+	if err != nil {
+		if errors.Is(err, metastore.ErrNotFound) {
+			return pd.Pending(), nil
+		}
+		return nil, fmt.Errorf("could not check shard plan of %s: %w", pd.Key, err)
+	}
+
+	return plan.Unreferenced(pd.Key, pd.Pending()), nil
+}
+
+// RunCleanup - retries pending deletions every cleanup interval until the context is done
+func (d *Deleter) RunCleanup(ctx context.Context) {
+	if d.cfg.CleanupInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(d.cfg.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.RetryPending(ctx); err != nil && ctx.Err() == nil {
+				d.lg.Error(fmt.Errorf("pending deletions cleanup failed: %w", err))
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package deleter
+
+import (
+	"context"
+	"errors"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errServerDown = errors.New("server is down")
+
+type fakeRemoteStore struct {
+	mx     sync.Mutex
+	chunks map[metastore.Location]bool
+	down   map[int]bool
+}
+
+func (s *fakeRemoteStore) Delete(_ context.Context, key multishard.Key, serverID multishard.ServerIdx) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.down[int(serverID)] {
+		return errServerDown
+	}
+	delete(s.chunks, metastore.Location{Key: key, ServerIdx: int(serverID)})
+	return nil
+}
+
+func (s *fakeRemoteStore) has(key multishard.Key, serverIdx int) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.chunks[metastore.Location{Key: key, ServerIdx: serverIdx}]
+}
+
+// fakeMetaStore - beforeDelete runs as the deletion of a plan begins, as an upload that commits meanwhile would
+type fakeMetaStore struct {
+	plans        map[multishard.Key]*metastore.ShardPlan
+	pending      map[string]*metastore.PendingDeletion
+	uploads      []*metastore.PendingUpload
+	beforeDelete func()
+}
+
+func (s *fakeMetaStore) GetShardPlan(_ context.Context, key multishard.Key) (*metastore.ShardPlan, error) {
+	plan, ok := s.plans[key]
+	if !ok {
+		return nil, metastore.ErrNotFound
+	}
+	return plan, nil
+}
+
+func (s *fakeMetaStore) DeleteShardPlan(_ context.Context, key multishard.Key, check func(plan *metastore.ShardPlan) error) error {
+	if s.beforeDelete != nil {
+		s.beforeDelete()
+	}
+	plan, ok := s.plans[key]
+	if !ok {
+		return metastore.ErrNotFound
+	}
+	if err := check(plan); err != nil {
+		return err
+	}
+	delete(s.plans, key)
+	return nil
+}
+
+func (s *fakeMetaStore) StorePendingDeletion(_ context.Context, pd *metastore.PendingDeletion) error {
+	s.pending[pd.ID] = pd
+	return nil
+}
+
+func (s *fakeMetaStore) ListPendingDeletions(context.Context) ([]*metastore.PendingDeletion, error) {
+	var result []*metastore.PendingDeletion
+	for _, pd := range s.pending {
+		result = append(result, pd)
+	}
+	return result, nil
+}
+
+func (s *fakeMetaStore) RemovePendingDeletion(_ context.Context, id string) error {
+	delete(s.pending, id)
+	return nil
+}
+
+func (s *fakeMetaStore) ListPendingUploads(context.Context) ([]*metastore.PendingUpload, error) {
+	return s.uploads, nil
+}
+
+func newTestDeleter() (*Deleter, *fakeRemoteStore, *fakeMetaStore) {
+	rs := &fakeRemoteStore{chunks: map[metastore.Location]bool{}, down: map[int]bool{}}
+	ms := &fakeMetaStore{plans: map[multishard.Key]*metastore.ShardPlan{}, pending: map[string]*metastore.PendingDeletion{}}
+	d := NewDeleter(&config.Config{}, rs, ms, logger.NewStdoutLogger(logger.Dev, "test"))
+	return d, rs, ms
+}
+
+// storePlan - a plan of one chunk per generation key with a copy on every server
+func storePlan(rs *fakeRemoteStore, ms *fakeMetaStore, key multishard.Key, generation string, servers ...int) *metastore.ShardPlan {
+	chunkKey := multishard.UploadChunkKey(key, generation, 0)
+	for _, server := range servers {
+		rs.chunks[metastore.Location{Key: chunkKey, ServerIdx: server}] = true
+	}
+	plan := &metastore.ShardPlan{
+		OriginalSize: 4,
+		Shards:       []metastore.Shard{{ChunkIdx: 0, ServerIdx: servers[0], Size: 4, Key: chunkKey, Replicas: servers}},
+	}
+	ms.plans[key] = plan
+	return plan
+}
+
+func TestDeleter_DeleteRecordsChunksThatCouldNotBeRemoved(t *testing.T) {
+	d, rs, ms := newTestDeleter()
+	ctx := context.Background()
+	storePlan(rs, ms, "file.txt", "1f", 0, 1)
+	rs.down[1] = true
+
+	complete, err := d.Delete(ctx, "", "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete {
+		t.Errorf("expected the delete to be reported as incomplete")
+	}
+	if _, ok := ms.plans["file.txt"]; ok {
+		t.Errorf("expected the shard plan to be deleted")
+	}
+	if rs.has("file.txt/0.1f", 0) {
+		t.Errorf("expected the copy on the server that is up to be deleted")
+	}
+
+	if len(ms.pending) != 1 {
+		t.Fatalf("pending deletions = %+v, want one", ms.pending)
+	}
+	for _, pd := range ms.pending {
+		if len(pd.Locations) != 1 || pd.Locations[0] != (metastore.Location{Key: "file.txt/0.1f", ServerIdx: 1}) {
+			t.Errorf("pending locations = %+v, want the copy on server 1", pd.Locations)
+		}
+	}
+
+	rs.down[1] = false
+	if err := d.RetryPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rs.has("file.txt/0.1f", 1) || len(ms.pending) != 0 {
+		t.Errorf("expected the retry to delete the copy and its record, pending %+v", ms.pending)
+	}
+}
+
+func TestDeleter_RetryPendingSkipsChunksOfTheCurrentPlan(t *testing.T) {
+	d, rs, ms := newTestDeleter()
+	ctx := context.Background()
+
+	prev := storePlan(rs, ms, "file.txt", "1f", 0)
+	current := storePlan(rs, ms, "file.txt", "2e", 1)
+	stale := append(prev.Locations("file.txt"), current.Locations("file.txt")...)
+	pd := metastore.NewPendingDeletion("file.txt", stale)
+	ms.pending[pd.ID] = pd
+
+	if err := d.RetryPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rs.has("file.txt/0.1f", 0) {
+		t.Errorf("expected the chunk of the previous upload to be deleted")
+	}
+	if !rs.has("file.txt/0.2e", 1) {
+		t.Errorf("expected the chunk of the current plan to be kept")
+	}
+	if len(ms.pending) != 0 {
+		t.Errorf("expected the pending deletion to be done, got %+v", ms.pending)
+	}
+}
+
+func TestDeleter_RetryPendingLeavesChunksOfRunningUploads(t *testing.T) {
+	d, rs, ms := newTestDeleter()
+	ctx := context.Background()
+
+	// the file was deleted with a copy left behind and is being uploaded again to the same location
+	reused := metastore.Location{Key: "file.txt/0", ServerIdx: 0}
+	left := metastore.Location{Key: "file.txt/1", ServerIdx: 0}
+	rs.chunks[reused], rs.chunks[left] = true, true
+	pd := metastore.NewPendingDeletion("file.txt", []metastore.Location{reused, left})
+	ms.pending[pd.ID] = pd
+	running := metastore.NewPendingUpload("file.txt")
+	running.Locations = []metastore.Location{reused}
+	ms.uploads = []*metastore.PendingUpload{running}
+
+	if err := d.RetryPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !rs.has(reused.Key, reused.ServerIdx) {
+		t.Errorf("expected the chunk of the running upload to be kept")
+	}
+	if rs.has(left.Key, left.ServerIdx) {
+		t.Errorf("expected the chunk nothing references to be deleted")
+	}
+	if got := ms.pending[pd.ID]; got == nil || len(got.Locations) != 1 || got.Locations[0] != reused {
+		t.Errorf("expected the chunk of the running upload to be left for a later attempt, got %+v", got)
+	}
+}
+
+func TestDeleter_DeleteKeepsThePlanOfAnUploadCommittedMeanwhile(t *testing.T) {
+	d, rs, ms := newTestDeleter()
+	ctx := context.Background()
+	storePlan(rs, ms, "file.txt", "1f", 0, 1)
+
+	var uploaded *metastore.ShardPlan
+	ms.beforeDelete = func() {
+		ms.beforeDelete = nil
+		uploaded = storePlan(rs, ms, "file.txt", "2f", 0, 1)
+		uploaded.ModifiedAt = time.Now()
+	}
+
+	if _, err := d.Delete(ctx, "", "file.txt"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Delete() error = %v, want %v", err, ErrConflict)
+	}
+	if ms.plans["file.txt"] != uploaded {
+		t.Errorf("expected the plan of the new upload to be kept")
+	}
+	if !rs.has("file.txt/0.2f", 0) || !rs.has("file.txt/0.2f", 1) {
+		t.Errorf("expected the chunks of the new upload to be kept")
+	}
+	if rs.has("file.txt/0.1f", 0) || rs.has("file.txt/0.1f", 1) {
+		t.Errorf("expected the chunks of the deleted upload to be removed")
+	}
+}
+
+func TestDeleter_DeleteRemovesReplicasAddedMeanwhile(t *testing.T) {
+	d, rs, ms := newTestDeleter()
+	ctx := context.Background()
+	plan := storePlan(rs, ms, "file.txt", "1f", 0, 1)
+
+	// the replica on server 2 finished after the upload returned
+	ms.beforeDelete = func() {
+		settled := *plan
+		settled.Shards = []metastore.Shard{plan.Shards[0]}
+		settled.Shards[0].Replicas = []int{0, 1, 2}
+		rs.chunks[metastore.Location{Key: "file.txt/0.1f", ServerIdx: 2}] = true
+		ms.plans["file.txt"] = &settled
+	}
+
+	complete, err := d.Delete(ctx, "", "file.txt")
+	if err != nil || !complete {
+		t.Fatalf("Delete() = %v, %v, want a complete delete", complete, err)
+	}
+	if _, ok := ms.plans["file.txt"]; ok {
+		t.Errorf("expected the shard plan to be deleted")
+	}
+	if rs.has("file.txt/0.1f", 2) {
+		t.Errorf("expected the replica added meanwhile to be removed")
+	}
+}
@@ -1,16 +1,33 @@
 package downloader
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	hash "github.com/cespare/xxhash/v2"
 	"github.com/denismitr/shardstore/internal/common/logger"
 	"github.com/denismitr/shardstore/internal/filegateway/config"
 	"github.com/denismitr/shardstore/internal/filegateway/metastore"
 	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/remotestore"
 	"io"
+	"mime"
+	"path"
+	"time"
+)
+
+const defaultContentType = "application/octet-stream"
+
+var (
+	ErrChecksumMismatch = errors.New("chunk does not match its checksum")
+	ErrInvalidRange     = errors.New("invalid range")
 )
 
 type metaStorage interface {
 	GetShardPlan(ctx context.Context, key multishard.Key) (*metastore.ShardPlan, error)
+	ScanNames(ctx context.Context, bucket, prefix, after string, fn metastore.ScanFunc) error
 }
 
 type remoteStorage interface {
@@ -20,6 +37,37 @@ type remoteStorage interface {
 		serverID multishard.ServerIdx,
 		w io.Writer,
 	) (int, error)
+	GetRange(
+		ctx context.Context,
+		key multishard.Key,
+		serverID multishard.ServerIdx,
+		offset, length int64,
+		w io.Writer,
+	) (int, error)
+	Stat(
+		ctx context.Context,
+		key multishard.Key,
+		serverID multishard.ServerIdx,
+	) (*remotestore.ChunkStat, error)
+}
+
+// FileInfo - what is known about a stored file before its content is transferred,
+// the shard plan it was resolved from is kept so that the content matches the description
+type FileInfo struct {
+	Name        string
+	Size        int64
+	ContentType string
+	ModifiedAt  time.Time
+	ETag        string
+
+	// CreatedAt - zero for files uploaded before it was recorded
+	CreatedAt time.Time
+	// ContentHash - hex encoded SHA-256 of the content, empty for files uploaded before it was recorded
+	ContentHash string
+	UserMeta    map[string]string
+
+	key  multishard.Key
+	plan *metastore.ShardPlan
 }
 
 type Downloader struct {
@@ -38,30 +86,374 @@ func NewDownloader(
 	return &Downloader{cfg: cfg, remoteStore: remoteStore, metaStore: metaStore, lg: lg}
 }
 
-func (d *Downloader) Download(
-	ctx context.Context,
-	fileName string,
-	w io.Writer,
-) (int, error) {
-	key, err := multishard.ResolveKey(fileName)
+// Stat - describes the file from its shard plan, plans stored before
+// the modification time was recorded fall back to the chunks stats
+func (d *Downloader) Stat(ctx context.Context, bucket, fileName string) (*FileInfo, error) {
+	key, err := multishard.ObjectKey(bucket, fileName)
 	if err != nil {
-		return 0, err // todo: wrap
+		return nil, err
 	}
 
 	plan, err := d.metaStore.GetShardPlan(ctx, key)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("could not get shard plan of %s: %w", fileName, err)
 	}
 
-	totalDownloaded := 0
+	modifiedAt := plan.ModifiedAt
+	if modifiedAt.IsZero() {
+		modifiedAt, err = d.chunksModifiedAt(ctx, key, plan)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &FileInfo{
+		Name:        fileName,
+		Size:        int64(plan.OriginalSize),
+		ContentType: contentType(fileName, plan),
+		ModifiedAt:  modifiedAt.UTC(),
+		ETag:        etag(plan, modifiedAt),
+		CreatedAt:   plan.CreatedAt.UTC(),
+		ContentHash: plan.ContentHash,
+		UserMeta:    plan.UserMeta,
+		key:         key,
+		plan:        plan,
+	}, nil
+}
+
+// contentType - the one sent with the upload or else the one of the file extension
+func contentType(fileName string, plan *metastore.ShardPlan) string {
+	if plan.ContentType != "" {
+		return plan.ContentType
+	}
+	if ct := mime.TypeByExtension(path.Ext(fileName)); ct != "" {
+		return ct
+	}
+	return defaultContentType
+}
+
+// chunksModifiedAt - the latest modification time among the chunks of the plan
+func (d *Downloader) chunksModifiedAt(ctx context.Context, key multishard.Key, plan *metastore.ShardPlan) (time.Time, error) {
+	var latest time.Time
 	for _, shard := range plan.Shards {
-		d.lg.Debugf("getting shard for chunk %d from server %d", shard.ChunkIdx, shard.ServerIdx)
-		n, err := d.remoteStore.Get(ctx, key, multishard.ServerIdx(shard.ServerIdx), w)
+		st, err := d.statChunk(ctx, key, shard)
 		if err != nil {
-			return totalDownloaded, err // todo: wrap
+			return time.Time{}, err
+		}
+		if st.ModifiedAt.After(latest) {
+			latest = st.ModifiedAt
+		}
+	}
+	return latest, nil
+}
+
+// statChunk - stats the chunk on the first replica that answers
+func (d *Downloader) statChunk(ctx context.Context, key multishard.Key, shard metastore.Shard) (*remotestore.ChunkStat, error) {
+	var lastErr error
+	for _, loc := range shard.Locations(key) {
+		st, err := d.remoteStore.Stat(ctx, loc.Key, multishard.ServerIdx(loc.ServerIdx))
+		if err == nil {
+			return st, nil
 		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("could not stat chunk %d of %s: %w", shard.ChunkIdx, key, lastErr)
+}
+
+// etag - changes whenever the file is uploaded again,
+// but not when its chunks are moved to other servers
+func etag(plan *metastore.ShardPlan, modifiedAt time.Time) string {
+	h := hash.New()
+	buf := make([]byte, 8)
+	put := func(v uint64) {
+		binary.BigEndian.PutUint64(buf, v)
+		_, _ = h.Write(buf)
+	}
+
+	put(uint64(plan.OriginalSize))
+	put(uint64(modifiedAt.UnixNano()))
+	for _, shard := range plan.Shards {
+		put(uint64(shard.ChunkIdx))
+		put(uint64(shard.Size))
+		put(uint64(shard.Checksum))
+	}
+
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// Download - writes the content of the file described by Stat
+func (d *Downloader) Download(
+	ctx context.Context,
+	info *FileInfo,
+	w io.Writer,
+) (int, error) {
+	return d.download(ctx, info, info.pieces(0, info.Size), w)
+}
+
+// DownloadRange - writes length bytes of the content of the file described by Stat starting at offset,
+// only the chunks the range spans are fetched
+func (d *Downloader) DownloadRange(
+	ctx context.Context,
+	info *FileInfo,
+	offset, length int64,
+	w io.Writer,
+) (int, error) {
+	if offset < 0 || length <= 0 || offset+length > info.Size {
+		return 0, fmt.Errorf("%d bytes at %d of %s with %d bytes: %w", length, offset, info.Name, info.Size, ErrInvalidRange)
+	}
+	return d.download(ctx, info, info.pieces(offset, length), w)
+}
+
+// download - the first piece is streamed, the ones after it are fetched in parallel while it is
+// or, with a single worker, one after another into a buffer that is reused for every piece,
+// pieces larger than the memory budget are streamed as well
+func (d *Downloader) download(ctx context.Context, info *FileInfo, pieces []piece, w io.Writer) (int, error) {
+	if len(pieces) == 0 {
+		return 0, nil
+	}
+	if len(pieces) > 1 && d.cfg.DownloadWorkers > 1 {
+		return d.downloadParallel(ctx, info, pieces, w)
+	}
+
+	totalDownloaded, err := d.getPiece(ctx, info, pieces[0], w)
+	if err != nil {
+		return totalDownloaded, err
+	}
+
+	var buf bytes.Buffer
+	for _, p := range pieces[1:] {
+		if d.streamed(p) {
+			n, err := d.getPiece(ctx, info, p, w)
+			totalDownloaded += n
+			if err != nil {
+				return totalDownloaded, err
+			}
+			continue
+		}
+
+		buf.Reset()
+		if err := d.fetchPiece(ctx, info, p, &buf); err != nil {
+			return totalDownloaded, err
+		}
+		n, err := w.Write(buf.Bytes())
 		totalDownloaded += n
+		if err != nil {
+			return totalDownloaded, fmt.Errorf("could not write chunk %d of %s: %w", p.shard.ChunkIdx, info.key, err)
+		}
 	}
 
 	return totalDownloaded, nil
 }
+
+// piece - the part of a chunk a download needs
+type piece struct {
+	shard  metastore.Shard
+	offset int
+	length int
+}
+
+func (p piece) whole() bool {
+	return p.offset == 0 && p.length == p.shard.Size
+}
+
+// pieces - maps the byte range of the file onto its chunks using their sizes from the plan
+func (info *FileInfo) pieces(offset, length int64) []piece {
+	var result []piece
+	var chunkStart int64
+	end := offset + length
+	for _, shard := range info.plan.Shards {
+		chunkEnd := chunkStart + int64(shard.Size)
+		if chunkEnd > offset && chunkStart < end {
+			from, to := offset, end
+			if from < chunkStart {
+				from = chunkStart
+			}
+			if to > chunkEnd {
+				to = chunkEnd
+			}
+			result = append(result, piece{shard: shard, offset: int(from - chunkStart), length: int(to - from)})
+		}
+		chunkStart = chunkEnd
+	}
+	return result
+}
+
+// fetchPiece - downloads the piece into the buffer, a whole chunk is verified before it is kept there
+// so a corrupted replica is skipped, the buffer is the only copy of the piece the download holds
+func (d *Downloader) fetchPiece(ctx context.Context, info *FileInfo, p piece, buf *bytes.Buffer) error {
+	if p.whole() && len(p.shard.Fragments) == 0 && info.plan.ChecksumAlgo == multishard.ChecksumAlgo {
+		return d.fetchVerifiedChunk(ctx, info.key, p.shard, buf)
+	}
+	_, err := d.getPiece(ctx, info, p, buf)
+	return err
+}
+
+// getPiece - streams the piece of the chunk, a whole chunk is verified against its checksum,
+// a part of an erasure coded chunk is cut out of the whole chunk
+func (d *Downloader) getPiece(ctx context.Context, info *FileInfo, p piece, w io.Writer) (int, error) {
+	if p.whole() {
+		return d.getShard(ctx, info, p.shard, w)
+	}
+
+	if len(p.shard.Fragments) > 0 {
+		buf := bytes.NewBuffer(make([]byte, 0, p.shard.Size))
+		if _, err := d.getStripe(ctx, info.plan.Erasure, info.key, p.shard, buf); err != nil {
+			return 0, err
+		}
+		return w.Write(buf.Bytes()[p.offset : p.offset+p.length])
+	}
+
+	return d.getChunkRange(ctx, info.key, p, w)
+}
+
+// getShard - writes the chunk of the shard the way its plan stores it
+func (d *Downloader) getShard(ctx context.Context, info *FileInfo, shard metastore.Shard, w io.Writer) (int, error) {
+	switch {
+	case len(shard.Fragments) > 0:
+		return d.getStripe(ctx, info.plan.Erasure, info.key, shard, w)
+	case info.plan.ChecksumAlgo == multishard.ChecksumAlgo:
+		return d.streamVerifiedChunk(ctx, info.key, shard, w)
+	default:
+		return d.getChunk(ctx, info.key, shard, w)
+	}
+}
+
+// getChunk - downloads the chunk from its replicas in order, when a replica fails midway
+// the next one picks up where it stopped
+func (d *Downloader) getChunk(ctx context.Context, key multishard.Key, shard metastore.Shard, w io.Writer) (int, error) {
+	written := 0
+	var lastErr error
+	for _, serverIdx := range shard.Servers() {
+		d.lg.Debugf("getting shard for chunk %d from server %d", shard.ChunkIdx, serverIdx)
+		sw := &skipWriter{w: w, skip: written}
+		_, err := d.remoteStore.Get(ctx, shard.StorageKey(key), multishard.ServerIdx(serverIdx), sw)
+		written += sw.written
+		if err == nil {
+			return written, nil
+		}
+		if sw.err != nil {
+			return written, sw.err
+		}
+		if ctx.Err() != nil {
+			return written, ctx.Err()
+		}
+
+		d.lg.Error(fmt.Errorf("could not get chunk %d of %s from server %d: %w", shard.ChunkIdx, key, serverIdx, err))
+		lastErr = err
+	}
+
+	return written, fmt.Errorf("chunk %d of %s is unavailable on all its replicas: %w", shard.ChunkIdx, key, lastErr)
+}
+
+// getChunkRange - downloads the piece of the chunk from its replicas in order,
+// when a replica fails midway the next one picks up where it stopped
+func (d *Downloader) getChunkRange(ctx context.Context, key multishard.Key, p piece, w io.Writer) (int, error) {
+	written := 0
+	var lastErr error
+	for _, serverIdx := range p.shard.Servers() {
+		sw := &skipWriter{w: w, skip: written}
+		_, err := d.remoteStore.GetRange(
+			ctx, p.shard.StorageKey(key), multishard.ServerIdx(serverIdx), int64(p.offset), int64(p.length), sw,
+		)
+		written += sw.written
+		if err == nil {
+			return written, nil
+		}
+		if sw.err != nil {
+			return written, sw.err
+		}
+		if ctx.Err() != nil {
+			return written, ctx.Err()
+		}
+
+		d.lg.Error(fmt.Errorf("could not get a range of chunk %d of %s from server %d: %w", p.shard.ChunkIdx, key, serverIdx, err))
+		lastErr = err
+	}
+
+	return written, fmt.Errorf("chunk %d of %s is unavailable on all its replicas: %w", p.shard.ChunkIdx, key, lastErr)
+}
+
+// streamVerifiedChunk - streams the chunk the way getChunk does and checks what was written against
+// the size and checksum of the chunk at the end, the bytes are gone by then, so a corrupted chunk
+// fails the download instead of being fetched from another replica
+func (d *Downloader) streamVerifiedChunk(ctx context.Context, key multishard.Key, shard metastore.Shard, w io.Writer) (int, error) {
+	h := multishard.NewChecksum()
+	written, err := d.getChunk(ctx, key, shard, io.MultiWriter(w, h))
+	if err != nil {
+		return written, err
+	}
+
+	if written != shard.Size {
+		return written, fmt.Errorf("chunk %d of %s has %d bytes, expected %d: %w", shard.ChunkIdx, key, written, shard.Size, ErrChecksumMismatch)
+	}
+	if checksum := h.Sum32(); checksum != shard.Checksum {
+		return written, fmt.Errorf("chunk %d of %s has checksum %08x, expected %08x: %w", shard.ChunkIdx, key, checksum, shard.Checksum, ErrChecksumMismatch)
+	}
+	return written, nil
+}
+
+// fetchVerifiedChunk - downloads the chunk from its replicas in order into the buffer until one
+// matches its size and checksum, a corrupted replica is skipped like an unavailable one
+func (d *Downloader) fetchVerifiedChunk(ctx context.Context, key multishard.Key, shard metastore.Shard, buf *bytes.Buffer) error {
+	var lastErr error
+	for _, serverIdx := range shard.Servers() {
+		buf.Reset()
+		_, err := d.remoteStore.Get(ctx, shard.StorageKey(key), multishard.ServerIdx(serverIdx), buf)
+		if err == nil {
+			err = verifyChunk(shard, buf.Bytes())
+		}
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		d.lg.Error(fmt.Errorf("could not get chunk %d of %s from server %d: %w", shard.ChunkIdx, key, serverIdx, err))
+		lastErr = err
+	}
+
+	return fmt.Errorf("chunk %d of %s is unavailable on all its replicas: %w", shard.ChunkIdx, key, lastErr)
+}
+
+// verifyChunk - checks the downloaded chunk against its shard
+func verifyChunk(shard metastore.Shard, data []byte) error {
+	if len(data) != shard.Size {
+		return fmt.Errorf("got %d bytes, expected %d: %w", len(data), shard.Size, ErrChecksumMismatch)
+	}
+	if checksum := multishard.Checksum(data); checksum != shard.Checksum {
+		return fmt.Errorf("got checksum %08x, expected %08x: %w", checksum, shard.Checksum, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// skipWriter - drops the bytes that were already written from another replica
+type skipWriter struct {
+	w       io.Writer
+	skip    int
+	written int
+	err     error
+}
+
+func (sw *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if sw.skip > 0 {
+		dropped := sw.skip
+		if dropped > len(p) {
+			dropped = len(p)
+		}
+		sw.skip -= dropped
+		p = p[dropped:]
+	}
+
+	if len(p) > 0 {
+		written, err := sw.w.Write(p)
+		sw.written += written
+		if err != nil {
+			sw.err = err
+			return n, err
+		}
+	}
+
+	return n, nil
+}
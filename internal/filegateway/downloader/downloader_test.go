@@ -0,0 +1,454 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/remotestore"
+	"github.com/klauspost/reedsolomon"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMetaStore struct {
+	plan *metastore.ShardPlan
+}
+
+func (s *fakeMetaStore) GetShardPlan(_ context.Context, _ multishard.Key) (*metastore.ShardPlan, error) {
+	return s.plan, nil
+}
+
+func (s *fakeMetaStore) ScanNames(_ context.Context, _, _, _ string, fn metastore.ScanFunc) error {
+	if s.plan == nil {
+		return nil
+	}
+	_, err := fn("file", s.plan)
+	return err
+}
+
+// fakeRemoteStore - every server holds the same chunks,
+// a flaky server breaks off after sending a few bytes and a corrupted one flips a byte
+type fakeRemoteStore struct {
+	chunks    map[multishard.Key][]byte
+	flaky     map[multishard.ServerIdx]int
+	corrupted map[multishard.ServerIdx]bool
+	delays    map[multishard.Key]time.Duration
+
+	mx          sync.Mutex
+	fetched     []multishard.Key
+	inFlight    int
+	maxInFlight int
+}
+
+var errBrokenStream = errors.New("stream broke off")
+
+func (s *fakeRemoteStore) Get(ctx context.Context, key multishard.Key, serverID multishard.ServerIdx, w io.Writer) (int, error) {
+	return s.GetRange(ctx, key, serverID, 0, 0, w)
+}
+
+func (s *fakeRemoteStore) GetRange(
+	_ context.Context,
+	key multishard.Key,
+	serverID multishard.ServerIdx,
+	offset, length int64,
+	w io.Writer,
+) (int, error) {
+	s.mx.Lock()
+	s.fetched = append(s.fetched, key)
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.mx.Unlock()
+	defer func() {
+		s.mx.Lock()
+		s.inFlight--
+		s.mx.Unlock()
+	}()
+
+	time.Sleep(s.delays[key])
+	chunk := s.chunks[key]
+	if s.corrupted[serverID] {
+		chunk = append([]byte(nil), chunk...)
+		chunk[0] ^= 0xff
+	}
+	if length == 0 {
+		length = int64(len(chunk)) - offset
+	}
+	chunk = chunk[offset : offset+length]
+	if limit, ok := s.flaky[serverID]; ok {
+		if limit > len(chunk) {
+			limit = len(chunk)
+		}
+		n, err := w.Write(chunk[:limit])
+		if err != nil {
+			return n, err
+		}
+		return n, errBrokenStream
+	}
+	return w.Write(chunk)
+}
+
+func (s *fakeRemoteStore) Stat(_ context.Context, key multishard.Key, _ multishard.ServerIdx) (*remotestore.ChunkStat, error) {
+	return &remotestore.ChunkStat{Size: int64(len(s.chunks[key]))}, nil
+}
+
+func TestDownloader_DownloadFailsOverToAnotherReplica(t *testing.T) {
+	rs := &fakeRemoteStore{
+		chunks: map[multishard.Key][]byte{"file_txt/0": []byte("first "), "file_txt/1": []byte("second")},
+		flaky:  map[multishard.ServerIdx]int{0: 3},
+	}
+	ms := &fakeMetaStore{plan: &metastore.ShardPlan{
+		OriginalSize: 12,
+		Shards: []metastore.Shard{
+			{ChunkIdx: 0, ServerIdx: 0, Size: 6, Key: "file_txt/0", Replicas: []int{0, 1}},
+			{ChunkIdx: 1, ServerIdx: 1, Size: 6, Key: "file_txt/1", Replicas: []int{1, 0}},
+		},
+	}}
+	d := NewDownloader(&config.Config{}, rs, ms, logger.NewStdoutLogger(logger.Dev, "test"))
+
+	info, err := d.Stat(context.Background(), "", "file.txt")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	n, err := d.Download(context.Background(), info, &buf)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if n != 12 || buf.String() != "first second" {
+		t.Errorf("Download() = %d bytes %q, want 12 bytes %q", n, buf.String(), "first second")
+	}
+}
+
+func TestDownloader_DownloadEmptyFile(t *testing.T) {
+	rs := &fakeRemoteStore{}
+	ms := &fakeMetaStore{plan: &metastore.ShardPlan{Name: "empty.txt"}}
+	d := NewDownloader(&config.Config{}, rs, ms, logger.NewStdoutLogger(logger.Dev, "test"))
+
+	info, err := d.Stat(context.Background(), "", "empty.txt")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Size != 0 {
+		t.Errorf("Stat() size = %d, want 0", info.Size)
+	}
+
+	var buf bytes.Buffer
+	n, err := d.Download(context.Background(), info, &buf)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if n != 0 || buf.Len() != 0 || len(rs.fetched) != 0 {
+		t.Errorf("Download() = %d bytes %q after fetching %v, want nothing", n, buf.String(), rs.fetched)
+	}
+}
+
+func TestDownloader_DownloadFailsWhenAllReplicasFail(t *testing.T) {
+	rs := &fakeRemoteStore{
+		chunks: map[multishard.Key][]byte{"file_txt/0": []byte("first")},
+		flaky:  map[multishard.ServerIdx]int{0: 2, 1: 2},
+	}
+	ms := &fakeMetaStore{plan: &metastore.ShardPlan{
+		OriginalSize: 5,
+		Shards:       []metastore.Shard{{ChunkIdx: 0, ServerIdx: 0, Size: 5, Key: "file_txt/0", Replicas: []int{0, 1}}},
+	}}
+	d := NewDownloader(&config.Config{}, rs, ms, logger.NewStdoutLogger(logger.Dev, "test"))
+
+	info, err := d.Stat(context.Background(), "", "file.txt")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := d.Download(context.Background(), info, &buf); !errors.Is(err, errBrokenStream) {
+		t.Fatalf("Download() error = %v, want %v", err, errBrokenStream)
+	}
+	if buf.String() != "fi" {
+		t.Errorf("Download() wrote %q, want only the bytes received before the failure", buf.String())
+	}
+}
+
+func TestDownloader_DownloadSkipsCorruptedReplica(t *testing.T) {
+	first, second := []byte("first "), []byte("second")
+	rs := &fakeRemoteStore{
+		chunks:    map[multishard.Key][]byte{"file_txt/0": first, "file_txt/1": second},
+		corrupted: map[multishard.ServerIdx]bool{1: true},
+	}
+	ms := &fakeMetaStore{plan: &metastore.ShardPlan{
+		OriginalSize: 12,
+		ModifiedAt:   time.Now(),
+		ChecksumAlgo: multishard.ChecksumAlgo,
+		Shards: []metastore.Shard{
+			{ChunkIdx: 0, ServerIdx: 0, Size: 6, Checksum: multishard.Checksum(first), Key: "file_txt/0", Replicas: []int{0, 1}},
+			{ChunkIdx: 1, ServerIdx: 1, Size: 6, Checksum: multishard.Checksum(second), Key: "file_txt/1", Replicas: []int{1, 2}},
+		},
+	}}
+	d := NewDownloader(&config.Config{DownloadMemoryBudget: 1024}, rs, ms, logger.NewStdoutLogger(logger.Dev, "test"))
+
+	info, err := d.Stat(context.Background(), "", "file.txt")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	n, err := d.Download(context.Background(), info, &buf)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if n != 12 || buf.String() != "first second" {
+		t.Errorf("Download() = %d bytes %q, want 12 bytes %q", n, buf.String(), "first second")
+	}
+
+	// the first chunk is streamed as it arrives, a corrupted copy of it fails the download
+	rs.corrupted[0] = true
+	buf.Reset()
+	if _, err := d.Download(context.Background(), info, &buf); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Download() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+	if buf.Len() > len(first) {
+		t.Errorf("Download() went on after a corrupted first chunk and wrote %q", buf.String())
+	}
+
+	// a later chunk is verified before it is written, nothing of it is written when every replica is corrupted
+	rs.corrupted[0], rs.corrupted[2] = false, true
+	buf.Reset()
+	if _, err := d.Download(context.Background(), info, &buf); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Download() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+	if buf.String() != string(first) {
+		t.Errorf("Download() wrote %q, want only the first chunk", buf.String())
+	}
+}
+
+func TestDownloader_DownloadReconstructsErasureCodedChunk(t *testing.T) {
+	content := []byte("erasure coded chunk")
+	enc, err := reedsolomon.New(2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragments, err := enc.Split(append([]byte(nil), content...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(fragments); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := &fakeRemoteStore{chunks: map[multishard.Key][]byte{}, flaky: map[multishard.ServerIdx]int{0: 0}}
+	shard := metastore.Shard{ChunkIdx: 0, ServerIdx: 0, Size: len(content)}
+	for i, fragment := range fragments {
+		key := multishard.FragmentKey("file_txt", "1f", 0, i)
+		shard.Fragments = append(shard.Fragments, metastore.Fragment{
+			Idx:       i,
+			ServerIdx: i,
+			Key:       key,
+			Size:      len(fragment),
+			Checksum:  multishard.Checksum(fragment),
+		})
+		rs.chunks[key] = fragment
+	}
+	// the first data fragment is on a server that is down and the second one is corrupted
+	rs.chunks[multishard.FragmentKey("file_txt", "1f", 0, 1)] = bytes.Repeat([]byte{'x'}, len(fragments[1]))
+
+	ms := &fakeMetaStore{plan: &metastore.ShardPlan{
+		OriginalSize: len(content),
+		ModifiedAt:   time.Now(),
+		Erasure:      &metastore.ErasureCoding{DataShards: 2, ParityShards: 2},
+		Shards:       []metastore.Shard{shard},
+	}}
+	d := NewDownloader(&config.Config{}, rs, ms, logger.NewStdoutLogger(logger.Dev, "test"))
+
+	info, err := d.Stat(context.Background(), "", "file.txt")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	n, err := d.Download(context.Background(), info, &buf)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if n != len(content) || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("Download() = %d bytes %q, want %q", n, buf.String(), content)
+	}
+
+	// with a parity fragment gone as well there is not enough left
+	rs.flaky[2] = 0
+	if _, err := d.Download(context.Background(), info, &buf); !errors.Is(err, ErrNotEnoughFragments) {
+		t.Errorf("Download() error = %v, want %v", err, ErrNotEnoughFragments)
+	}
+}
+
+func TestDownloader_DownloadFetchesChunksInParallelInOrder(t *testing.T) {
+	const chunks = 8
+	rs := &fakeRemoteStore{chunks: map[multishard.Key][]byte{}, delays: map[multishard.Key]time.Duration{}}
+	plan := &metastore.ShardPlan{ModifiedAt: time.Now(), ChecksumAlgo: multishard.ChecksumAlgo}
+	var want strings.Builder
+	for i := 0; i < chunks; i++ {
+		key := multishard.ChunkKey("file_txt", multishard.ChunkIdx(i))
+		chunk := []byte(fmt.Sprintf("chunk-%d;", i))
+		rs.chunks[key] = chunk
+		// earlier chunks take longer, so they arrive after later ones
+		rs.delays[key] = time.Duration(chunks-i) * 5 * time.Millisecond
+		plan.Shards = append(plan.Shards, metastore.Shard{
+			ChunkIdx: i, ServerIdx: 0, Size: len(chunk), Checksum: multishard.Checksum(chunk), Key: key,
+		})
+		plan.OriginalSize += len(chunk)
+		want.Write(chunk)
+	}
+	ms := &fakeMetaStore{plan: plan}
+
+	tt := []struct {
+		name        string
+		budget      int64
+		maxInFlight int
+	}{
+		{name: "budget for all chunks", budget: 1024, maxInFlight: 1 + 3},
+		// one chunk waiting for its turn at most, besides the first one being streamed
+		{name: "budget for a single chunk", budget: 8, maxInFlight: 2},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			rs.maxInFlight = 0
+			cfg := &config.Config{DownloadWorkers: 3, DownloadMemoryBudget: tc.budget}
+			d := NewDownloader(cfg, rs, ms, logger.NewStdoutLogger(logger.Dev, "test"))
+
+			info, err := d.Stat(context.Background(), "", "file.txt")
+			if err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+
+			var buf bytes.Buffer
+			n, err := d.Download(context.Background(), info, &buf)
+			if err != nil {
+				t.Fatalf("Download() error = %v", err)
+			}
+			if n != plan.OriginalSize || buf.String() != want.String() {
+				t.Errorf("Download() = %d bytes %q, want %q", n, buf.String(), want.String())
+			}
+			if rs.maxInFlight < 2 || rs.maxInFlight > tc.maxInFlight {
+				t.Errorf("%d chunks were fetched at once, want between 2 and %d", rs.maxInFlight, tc.maxInFlight)
+			}
+		})
+	}
+}
+
+func TestDownloader_DownloadStaysWithinTheMemoryBudget(t *testing.T) {
+	const chunks, chunkSize, budget = 8, 256 << 10, 64 << 10
+	rs := &fakeRemoteStore{chunks: map[multishard.Key][]byte{}}
+	plan := &metastore.ShardPlan{ModifiedAt: time.Now(), ChecksumAlgo: multishard.ChecksumAlgo}
+	for i := 0; i < chunks; i++ {
+		key := multishard.ChunkKey("file_txt", multishard.ChunkIdx(i))
+		chunk := bytes.Repeat([]byte{byte(i)}, chunkSize)
+		rs.chunks[key] = chunk
+		plan.Shards = append(plan.Shards, metastore.Shard{
+			ChunkIdx: i, ServerIdx: 0, Size: chunkSize, Checksum: multishard.Checksum(chunk), Key: key,
+		})
+		plan.OriginalSize += chunkSize
+	}
+	ms := &fakeMetaStore{plan: plan}
+
+	for _, workers := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			cfg := &config.Config{ChunkSize: chunkSize, DownloadWorkers: workers, DownloadMemoryBudget: budget}
+			d := NewDownloader(cfg, rs, ms, logger.NewStdoutLogger(logger.Dev, "test"))
+			info, err := d.Stat(context.Background(), "", "file.txt")
+			if err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			n, err := d.Download(context.Background(), info, io.Discard)
+			runtime.ReadMemStats(&after)
+			if err != nil || n != plan.OriginalSize {
+				t.Fatalf("Download() = %d, %v, want %d bytes", n, err, plan.OriginalSize)
+			}
+
+			// chunks larger than the budget are streamed, none of them is held in memory
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > budget {
+				t.Errorf("Download() allocated %d bytes, want at most the budget of %d", allocated, budget)
+			}
+		})
+	}
+}
+
+func TestDownloader_DownloadRange(t *testing.T) {
+	chunks := []string{"0123", "4567", "89"}
+	rs := &fakeRemoteStore{chunks: map[multishard.Key][]byte{}, flaky: map[multishard.ServerIdx]int{0: 1}}
+	plan := &metastore.ShardPlan{ModifiedAt: time.Now(), ChecksumAlgo: multishard.ChecksumAlgo}
+	for i, chunk := range chunks {
+		key := multishard.ChunkKey("file_txt", multishard.ChunkIdx(i))
+		rs.chunks[key] = []byte(chunk)
+		plan.Shards = append(plan.Shards, metastore.Shard{
+			ChunkIdx: i, ServerIdx: 0, Size: len(chunk), Checksum: multishard.Checksum([]byte(chunk)), Key: key, Replicas: []int{0, 1},
+		})
+		plan.OriginalSize += len(chunk)
+	}
+	ms := &fakeMetaStore{plan: plan}
+
+	tt := []struct {
+		name           string
+		offset, length int64
+		want           string
+		fetched        int
+	}{
+		{name: "within a chunk", offset: 5, length: 2, want: "56", fetched: 1},
+		{name: "across chunks", offset: 2, length: 7, want: "2345678", fetched: 3},
+		{name: "whole chunk", offset: 4, length: 4, want: "4567", fetched: 1},
+		{name: "suffix", offset: 9, length: 1, want: "9", fetched: 1},
+	}
+
+	for _, tc := range tt {
+		for _, workers := range []int{1, 3} {
+			t.Run(fmt.Sprintf("%s with %d workers", tc.name, workers), func(t *testing.T) {
+				cfg := &config.Config{DownloadWorkers: workers, DownloadMemoryBudget: 1024}
+				d := NewDownloader(cfg, rs, ms, logger.NewStdoutLogger(logger.Dev, "test"))
+				info, err := d.Stat(context.Background(), "", "file.txt")
+				if err != nil {
+					t.Fatalf("Stat() error = %v", err)
+				}
+
+				rs.fetched = nil
+				var buf bytes.Buffer
+				n, err := d.DownloadRange(context.Background(), info, tc.offset, tc.length, &buf)
+				if err != nil {
+					t.Fatalf("DownloadRange() error = %v", err)
+				}
+				if n != len(tc.want) || buf.String() != tc.want {
+					t.Errorf("DownloadRange() = %d bytes %q, want %q", n, buf.String(), tc.want)
+				}
+
+				chunksFetched := map[multishard.Key]bool{}
+				for _, key := range rs.fetched {
+					chunksFetched[key] = true
+				}
+				if len(chunksFetched) != tc.fetched {
+					t.Errorf("DownloadRange() fetched chunks %v, want %d of them", rs.fetched, tc.fetched)
+				}
+			})
+		}
+	}
+
+	d := NewDownloader(&config.Config{}, rs, ms, logger.NewStdoutLogger(logger.Dev, "test"))
+	info, err := d.Stat(context.Background(), "", "file.txt")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if _, err := d.DownloadRange(context.Background(), info, 8, 3, io.Discard); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("DownloadRange() error = %v, want %v", err, ErrInvalidRange)
+	}
+}
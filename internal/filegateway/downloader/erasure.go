@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/klauspost/reedsolomon"
+	"io"
+	"sync"
+)
+
+var ErrNotEnoughFragments = errors.New("not enough fragments to restore the chunk")
+
+// getStripe - fetches the data fragments of an erasure coded chunk and falls back
+// to parity fragments for every data fragment that is unavailable or corrupted
+func (d *Downloader) getStripe(
+	ctx context.Context,
+	ec *metastore.ErasureCoding,
+	key multishard.Key,
+	shard metastore.Shard,
+	w io.Writer,
+) (int, error) {
+	if ec == nil || len(shard.Fragments) != ec.DataShards+ec.ParityShards {
+		return 0, fmt.Errorf("chunk %d of %s does not match the erasure coding of its plan", shard.ChunkIdx, key)
+	}
+
+	enc, err := reedsolomon.New(ec.DataShards, ec.ParityShards)
+	if err != nil {
+		return 0, fmt.Errorf("invalid erasure coding of %s: %w", key, err)
+	}
+
+	fragments := make([][]byte, len(shard.Fragments))
+	available := d.fetchFragments(ctx, shard.Fragments[:ec.DataShards], fragments)
+	for next := ec.DataShards; available < ec.DataShards && next < len(shard.Fragments); {
+		end := next + ec.DataShards - available
+		if end > len(shard.Fragments) {
+			end = len(shard.Fragments)
+		}
+		available += d.fetchFragments(ctx, shard.Fragments[next:end], fragments)
+		next = end
+	}
+
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if available < ec.DataShards {
+		return 0, fmt.Errorf("chunk %d of %s has %d of %d required fragments: %w", shard.ChunkIdx, key, available, ec.DataShards, ErrNotEnoughFragments)
+	}
+
+	if available < len(fragments) {
+		if err := enc.ReconstructData(fragments); err != nil {
+			return 0, fmt.Errorf("could not reconstruct chunk %d of %s: %w", shard.ChunkIdx, key, err)
+		}
+	}
+
+	cw := &countingWriter{w: w}
+	if err := enc.Join(cw, fragments, shard.Size); err != nil {
+		return cw.n, fmt.Errorf("could not write chunk %d of %s: %w", shard.ChunkIdx, key, err)
+	}
+
+	return cw.n, nil
+}
+
+// fetchFragments - downloads the fragments in parallel into their slots,
+// fragments that fail or do not match their size and checksum are left empty,
+// returns the number of fragments that were fetched
+func (d *Downloader) fetchFragments(ctx context.Context, frags []metastore.Fragment, out [][]byte) int {
+	var mx sync.Mutex
+	var wg sync.WaitGroup
+	fetched := 0
+
+	for _, f := range frags {
+		wg.Add(1)
+		go func(f metastore.Fragment) {
+			defer wg.Done()
+
+			var buf bytes.Buffer
+			buf.Grow(f.Size)
+			if _, err := d.remoteStore.Get(ctx, f.Key, multishard.ServerIdx(f.ServerIdx), &buf); err != nil {
+				d.lg.Error(fmt.Errorf("could not get fragment %s from server %d: %w", f.Key, f.ServerIdx, err))
+				return
+			}
+			if buf.Len() != f.Size || multishard.Checksum(buf.Bytes()) != f.Checksum {
+				d.lg.Error(fmt.Errorf("fragment %s from server %d is corrupted", f.Key, f.ServerIdx))
+				return
+			}
+
+			mx.Lock()
+			out[f.Idx] = buf.Bytes()
+			fetched++
+			mx.Unlock()
+		}(f)
+	}
+
+	wg.Wait()
+	return fetched
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
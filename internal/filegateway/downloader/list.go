@@ -0,0 +1,168 @@
+package downloader
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"strings"
+	"time"
+)
+
+// MaxListLimit - the most files and common prefixes a single listing returns
+const MaxListLimit = 1000
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListOptions - what to list, names up to the first delimiter after the prefix are rolled up
+// into a single common prefix when the delimiter is set
+type ListOptions struct {
+	// Bucket - files outside of buckets are listed when it is empty
+	Bucket    string
+	Prefix    string
+	Delimiter string
+	Limit     int
+	Cursor    string
+	// StartAfter - only names that sort after it are listed, the cursor takes precedence
+	StartAfter string
+}
+
+// ListEntry - a listed file
+type ListEntry struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	ETag        string    `json:"etag"`
+	ModifiedAt  time.Time `json:"modified_at"`
+}
+
+// ListResult - a page of files and common prefixes in the byte order of their names,
+// NextCursor continues the listing when it is truncated
+type ListResult struct {
+	Files          []ListEntry `json:"files"`
+	CommonPrefixes []string    `json:"common_prefixes"`
+	Truncated      bool        `json:"truncated"`
+	NextCursor     string      `json:"next_cursor,omitempty"`
+}
+
+// cursor - the name the listing stopped at, a position rather than an offset,
+// so files stored or deleted meanwhile neither shift nor repeat what is listed next
+type cursor struct {
+	After     string `json:"a"`
+	Bucket    string `json:"b,omitempty"`
+	Prefix    string `json:"p"`
+	Delimiter string `json:"d"`
+}
+
+// List - a page of the stored files in the byte order of their names, which is the order
+// of S3 listings, keys escape some of the bytes and sort differently
+func (d *Downloader) List(ctx context.Context, opts ListOptions) (*ListResult, error) {
+	limit := opts.Limit
+	if limit <= 0 || limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	var after string
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if c.Bucket != opts.Bucket || c.Prefix != opts.Prefix || c.Delimiter != opts.Delimiter {
+			return nil, fmt.Errorf("cursor of another listing: %w", ErrInvalidCursor)
+		}
+		after = c.After
+	}
+
+	if opts.Bucket != "" {
+		if err := multishard.ValidateBucketName(opts.Bucket); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Cursor == "" {
+		after = opts.StartAfter
+	}
+
+	result := &ListResult{Files: []ListEntry{}, CommonPrefixes: []string{}}
+	var last string
+	var lastCommonPrefix string
+	scan := func(key multishard.Key, plan *metastore.ShardPlan) (bool, error) {
+		name := metastore.FileName(key, plan)
+
+		// a plan left under a key of the previous scheme next to the one it conflicts with
+		if name == last {
+			return true, nil
+		}
+
+		if cp, ok := commonPrefix(name, opts.Prefix, opts.Delimiter); ok {
+			// the rest of an already listed common prefix
+			if cp == lastCommonPrefix {
+				last = name
+				return true, nil
+			}
+			if len(result.Files)+len(result.CommonPrefixes) == limit {
+				result.Truncated = true
+				return false, nil
+			}
+			result.CommonPrefixes = append(result.CommonPrefixes, cp)
+			lastCommonPrefix = cp
+			last = name
+			return true, nil
+		}
+
+		if len(result.Files)+len(result.CommonPrefixes) == limit {
+			result.Truncated = true
+			return false, nil
+		}
+		result.Files = append(result.Files, ListEntry{
+			Name:        name,
+			Size:        int64(plan.OriginalSize),
+			ContentType: contentType(name, plan),
+			ETag:        etag(plan, plan.ModifiedAt),
+			ModifiedAt:  plan.ModifiedAt.UTC(),
+		})
+		last = name
+		return true, nil
+	}
+
+	if err := d.metaStore.ScanNames(ctx, opts.Bucket, opts.Prefix, after, scan); err != nil {
+		return nil, fmt.Errorf("could not list files with prefix %q: %w", opts.Prefix, err)
+	}
+
+	if result.Truncated {
+		result.NextCursor = encodeCursor(cursor{After: last, Bucket: opts.Bucket, Prefix: opts.Prefix, Delimiter: opts.Delimiter})
+	}
+	return result, nil
+}
+
+// commonPrefix - the name up to and including the first delimiter after the prefix
+func commonPrefix(name, prefix, delimiter string) (string, bool) {
+	if delimiter == "" {
+		return "", false
+	}
+	i := strings.Index(name[len(prefix):], delimiter)
+	if i < 0 {
+		return "", false
+	}
+	return name[:len(prefix)+i+len(delimiter)], true
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("%v: %w", err, ErrInvalidCursor)
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("%v: %w", err, ErrInvalidCursor)
+	}
+	return c, nil
+}
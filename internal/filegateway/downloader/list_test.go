@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newListTestDownloader(t *testing.T, names ...string) (*Downloader, *metastore.BoltMetaStore) {
+	t.Helper()
+	lg := logger.NewStdoutLogger(logger.Dev, "test")
+	ms, err := metastore.NewBoltMetaStore(filepath.Join(t.TempDir(), "meta.db"), lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ms.Close() })
+
+	for _, name := range names {
+		storeTestPlan(t, ms, "", name)
+	}
+	return NewDownloader(&config.Config{}, &fakeRemoteStore{}, ms, lg), ms
+}
+
+func storeTestPlan(t *testing.T, ms *metastore.BoltMetaStore, bucket, name string) {
+	t.Helper()
+	key, err := multishard.ObjectKey(bucket, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := &metastore.ShardPlan{
+		Name:         name,
+		OriginalSize: 3,
+		ModifiedAt:   time.Now().UTC(),
+		Shards:       []metastore.Shard{{ChunkIdx: 0, ServerIdx: 1, Size: 3}},
+	}
+	if err := ms.Store(context.Background(), key, plan); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listNames(result *ListResult) []string {
+	names := []string{}
+	for _, f := range result.Files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestDownloader_ListPrefixAndDelimiter(t *testing.T) {
+	d, _ := newListTestDownloader(t, "docs-a", "docs-b-1", "docs-b-2", "docs-c", "img", "readme")
+
+	result, err := d.List(context.Background(), ListOptions{Prefix: "docs-", Delimiter: "-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(result); !reflect.DeepEqual(names, []string{"docs-a", "docs-c"}) {
+		t.Errorf("files = %v, want docs-a and docs-c", names)
+	}
+	if !reflect.DeepEqual(result.CommonPrefixes, []string{"docs-b-"}) {
+		t.Errorf("common prefixes = %v, want docs-b-", result.CommonPrefixes)
+	}
+	if result.Truncated || result.NextCursor != "" {
+		t.Errorf("listing should not be truncated, got %+v", result)
+	}
+	if f := result.Files[0]; f.Size != 3 || f.ETag == "" || f.ContentType != defaultContentType {
+		t.Errorf("entry = %+v, want size, etag and content type", f)
+	}
+}
+
+func TestDownloader_ListPagesAreStableAcrossWrites(t *testing.T) {
+	d, ms := newListTestDownloader(t, "a", "b-1", "b-2", "b-3", "c", "d")
+	ctx := context.Background()
+
+	page, err := d.List(ctx, ListOptions{Delimiter: "-", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(page); !reflect.DeepEqual(names, []string{"a"}) || !reflect.DeepEqual(page.CommonPrefixes, []string{"b-"}) {
+		t.Fatalf("first page = %+v, want a and b-", page)
+	}
+	if !page.Truncated || page.NextCursor == "" {
+		t.Fatalf("first page should be truncated, got %+v", page)
+	}
+
+	next := page.NextCursor
+
+	// files before the cursor do not shift the next page
+	storeTestPlan(t, ms, "", "0")
+	storeTestPlan(t, ms, "", "b-0")
+	if err := ms.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err = d.List(ctx, ListOptions{Delimiter: "-", Limit: 2, Cursor: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(page); !reflect.DeepEqual(names, []string{"c", "d"}) || len(page.CommonPrefixes) != 0 {
+		t.Errorf("second page = %+v, want c and d", page)
+	}
+	if page.Truncated {
+		t.Errorf("second page should be the last one, got %+v", page)
+	}
+
+	if _, err := d.List(ctx, ListOptions{Prefix: "b", Cursor: next}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor for a cursor of another listing, got %v", err)
+	}
+	if _, err := d.List(ctx, ListOptions{Cursor: "not a cursor"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor for a malformed cursor, got %v", err)
+	}
+}
+
+func TestDownloader_ListPagesInNameOrder(t *testing.T) {
+	// their keys escape some of the bytes and sort in another order
+	names := []string{"a/b", "a-b", "a b", "a%", "a~", "aé", "a.b", "a\\b", ".a", "-a"}
+	d, _ := newListTestDownloader(t, names...)
+	sort.Strings(names)
+
+	var listed []string
+	var cursor string
+	for {
+		result, err := d.List(context.Background(), ListOptions{Limit: 3, Cursor: cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed = append(listed, listNames(result)...)
+		if !result.Truncated {
+			break
+		}
+		cursor = result.NextCursor
+	}
+	if !reflect.DeepEqual(listed, names) {
+		t.Errorf("files = %q, want %q", listed, names)
+	}
+
+	result, err := d.List(context.Background(), ListOptions{Prefix: "a", Delimiter: "/", StartAfter: "a%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(result); !reflect.DeepEqual(names, []string{"a-b", "a.b", "a\\b", "a~", "aé"}) {
+		t.Errorf("files after a%% = %q, want the ones that sort after it", names)
+	}
+	if !reflect.DeepEqual(result.CommonPrefixes, []string{"a/"}) {
+		t.Errorf("common prefixes = %v, want a/", result.CommonPrefixes)
+	}
+}
+
+func TestDownloader_ListKeepsBucketsApart(t *testing.T) {
+	// the names sort before, among and after the keys of files in buckets
+	d, ms := newListTestDownloader(t, "-a", "0", "z")
+	storeTestPlan(t, ms, "photos", "a")
+	storeTestPlan(t, ms, "photos", "b")
+	storeTestPlan(t, ms, "photos2", "c")
+	ctx := context.Background()
+
+	var names []string
+	var cursor string
+	for {
+		result, err := d.List(ctx, ListOptions{Limit: 1, Cursor: cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, listNames(result)...)
+		if !result.Truncated {
+			break
+		}
+		cursor = result.NextCursor
+	}
+	if !reflect.DeepEqual(names, []string{"-a", "0", "z"}) {
+		t.Errorf("files outside of buckets = %v, want -a, 0 and z", names)
+	}
+
+	result, err := d.List(ctx, ListOptions{Bucket: "photos"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(result); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("files in photos = %v, want a and b", names)
+	}
+
+	if _, err := d.List(ctx, ListOptions{Bucket: "photos2", Cursor: cursor}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected the cursor of another bucket to be refused, got %v", err)
+	}
+}
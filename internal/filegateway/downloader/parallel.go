@@ -0,0 +1,121 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"golang.org/x/sync/semaphore"
+	"io"
+	"sync"
+)
+
+// fetchedChunk - a piece of a chunk that was downloaded ahead of its turn
+type fetchedChunk struct {
+	data []byte
+	err  error
+}
+
+// downloadParallel - streams the first piece straight to the writer while workers fetch the rest,
+// fetched pieces wait in memory for their turn and are written in chunk order,
+// once the memory budget is taken no more pieces are fetched until earlier ones are written.
+// Pieces larger than the whole budget are never held, they are streamed as well when their turn comes
+func (d *Downloader) downloadParallel(ctx context.Context, info *FileInfo, pieces []piece, w io.Writer) (int, error) {
+	mem := semaphore.NewWeighted(d.memoryBudget())
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	results := make([]chan fetchedChunk, len(pieces))
+	for i := range results {
+		results[i] = make(chan fetchedChunk, 1)
+	}
+
+	// memory is reserved in chunk order, so the piece the writer waits for
+	// never starves behind the ones that come after it
+	jobs := make(chan int)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for i := 1; i < len(pieces); i++ {
+			if d.streamed(pieces[i]) {
+				continue
+			}
+			if err := mem.Acquire(ctx, int64(pieces[i].length)); err != nil {
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				mem.Release(int64(pieces[i].length))
+				return
+			}
+		}
+	}()
+
+	for n := 0; n < d.cfg.DownloadWorkers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// the memory reserved for the piece, it is downloaded and verified in place
+				buf := bytes.NewBuffer(make([]byte, 0, pieces[i].length))
+				err := d.fetchPiece(ctx, info, pieces[i], buf)
+				results[i] <- fetchedChunk{data: buf.Bytes(), err: err}
+			}
+		}()
+	}
+
+	totalDownloaded, err := d.getPiece(ctx, info, pieces[0], w)
+	if err != nil {
+		return totalDownloaded, err
+	}
+
+	for i := 1; i < len(pieces); i++ {
+		if d.streamed(pieces[i]) {
+			n, err := d.getPiece(ctx, info, pieces[i], w)
+			totalDownloaded += n
+			if err != nil {
+				return totalDownloaded, err
+			}
+			continue
+		}
+
+		var chunk fetchedChunk
+		select {
+		case chunk = <-results[i]:
+		case <-ctx.Done():
+			return totalDownloaded, ctx.Err()
+		}
+		if chunk.err != nil {
+			return totalDownloaded, chunk.err
+		}
+
+		n, err := w.Write(chunk.data)
+		totalDownloaded += n
+		mem.Release(int64(pieces[i].length))
+		if err != nil {
+			return totalDownloaded, fmt.Errorf("could not write chunk %d of %s: %w", pieces[i].shard.ChunkIdx, info.key, err)
+		}
+	}
+
+	return totalDownloaded, nil
+}
+
+// memoryBudget - bytes a single download may hold in pieces waiting for their turn
+func (d *Downloader) memoryBudget() int64 {
+	if d.cfg.DownloadMemoryBudget <= 0 {
+		return d.cfg.ChunkSize
+	}
+	return d.cfg.DownloadMemoryBudget
+}
+
+// streamed - the piece does not fit into the memory budget, so it is written as it is downloaded
+// instead of being verified first, a replica that turns out to be corrupted fails the download
+func (d *Downloader) streamed(p piece) bool {
+	return int64(p.length) > d.memoryBudget()
+}
@@ -0,0 +1,561 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/remotestore"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrAlreadyRunning = errors.New("garbage collection is already running")
+
+// maxReportedProblems - problems listed in the report, the rest are only counted
+const maxReportedProblems = 100
+
+// unknownSize - chunks of running uploads are referenced before their size is known
+const unknownSize = -1
+
+const (
+	ProblemMissing         = "missing"
+	ProblemWrongSize       = "wrong_size"
+	ProblemUnderReplicated = "under_replicated"
+)
+
+type shardManager interface {
+	ResolveReplicas(key multishard.Key, chunkIdx multishard.ChunkIdx) ([]multishard.ServerIdx, error)
+	ResolveServers(key multishard.Key, chunkIdx multishard.ChunkIdx, n int) ([]multishard.ServerIdx, error)
+}
+
+type remoteStorage interface {
+	Servers() []remotestore.Server
+	List(ctx context.Context, serverID multishard.ServerIdx, prefix multishard.Key, fn func(chunk remotestore.ListedChunk) error) error
+	Stat(ctx context.Context, key multishard.Key, serverID multishard.ServerIdx) (*remotestore.ChunkStat, error)
+	Get(ctx context.Context, key multishard.Key, serverID multishard.ServerIdx, w io.Writer) (int, error)
+	Put(ctx context.Context, key multishard.Key, serverID multishard.ServerIdx, r io.Reader) (uint32, error)
+	Delete(ctx context.Context, key multishard.Key, serverID multishard.ServerIdx) error
+}
+
+type metaStorage interface {
+	Scan(ctx context.Context, prefix, after multishard.Key, fn metastore.ScanFunc) error
+	GetShardPlan(ctx context.Context, key multishard.Key) (*metastore.ShardPlan, error)
+	UpdateShardPlan(ctx context.Context, key multishard.Key, update func(plan *metastore.ShardPlan) (*metastore.ShardPlan, error)) error
+	ListPendingUploads(ctx context.Context) ([]*metastore.PendingUpload, error)
+}
+
+// Options - what a collection is allowed to change
+type Options struct {
+	// DryRun - only reports what would be deleted, nothing is deleted or repaired
+	DryRun bool `json:"dry_run"`
+
+	// Repair - writes missing chunks and chunks of the wrong size again from intact replicas or fragments
+	// and copies chunks stored with fewer replicas than their plan asks for to the servers that own them
+	Repair bool `json:"repair"`
+}
+
+// Problem - a chunk a plan references that its server does not hold as the plan expects
+// or that the plan lists fewer replicas of than it should have
+type Problem struct {
+	File       multishard.Key `json:"file"`
+	Key        multishard.Key `json:"key"`
+	ServerIdx  int            `json:"server_idx"`
+	Kind       string         `json:"kind"` // missing, wrong_size or under_replicated
+	Size       int64          `json:"size"`
+	StoredSize int64          `json:"stored_size,omitempty"`
+	Replicas   int            `json:"replicas,omitempty"` // copies the plan lists of an under replicated chunk
+	Repaired   bool           `json:"repaired"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// Report - what the current or the last collection found and did
+type Report struct {
+	Options
+	Running           bool      `json:"running"`
+	StartedAt         time.Time `json:"started_at"`
+	FinishedAt        time.Time `json:"finished_at"`
+	Plans             int       `json:"plans"`
+	Servers           int       `json:"servers"`
+	Scanned           int       `json:"scanned"`
+	Unreferenced      int       `json:"unreferenced"`
+	UnreferencedBytes int64     `json:"unreferenced_bytes"`
+	Deleted           int       `json:"deleted"`
+	DeletedBytes      int64     `json:"deleted_bytes"`
+	Missing           int       `json:"missing"`
+	WrongSize         int       `json:"wrong_size"`
+	UnderReplicated   int       `json:"under_replicated"`
+	Repaired          int       `json:"repaired"`
+	Failed            int       `json:"failed"`
+	Problems          []Problem `json:"problems,omitempty"` // the first maxReportedProblems of them
+	Error             string    `json:"error,omitempty"`
+}
+
+// reference - what a plan expects to be stored at a location
+type reference struct {
+	file multishard.Key
+	size int64
+}
+
+// chunkRef - a chunk of a file
+type chunkRef struct {
+	file     multishard.Key
+	chunkIdx int
+}
+
+// Collector - walks the chunks of every file server and cross-references them with the shard plans,
+// deletes chunks no plan references and reports the ones plans reference that are missing or the wrong size
+type Collector struct {
+	cfg          *config.Config
+	lg           logger.Logger
+	shardManager shardManager
+	remoteStore  remoteStorage
+	metaStore    metaStorage
+	trigger      chan Options
+
+	mx      sync.Mutex
+	current Report
+}
+
+func NewCollector(
+	cfg *config.Config,
+	shardManager shardManager,
+	remoteStore remoteStorage,
+	metaStore metaStorage,
+	lg logger.Logger,
+) *Collector {
+	return &Collector{
+		cfg:          cfg,
+		lg:           lg,
+		shardManager: shardManager,
+		remoteStore:  remoteStore,
+		metaStore:    metaStore,
+		trigger:      make(chan Options, 1),
+	}
+}
+
+// Trigger - asks the background loop to start a collection
+func (c *Collector) Trigger(opts Options) error {
+	if c.Report().Running {
+		return ErrAlreadyRunning
+	}
+
+	select {
+	case c.trigger <- opts:
+	default:
+		// one is already queued
+	}
+	return nil
+}
+
+// RunBackground - runs a collection every FG_GC_INTERVAL and every time one is triggered until the context is done
+func (c *Collector) RunBackground(ctx context.Context) {
+	var tick <-chan time.Time
+	if c.cfg.GCInterval > 0 {
+		ticker := time.NewTicker(c.cfg.GCInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		var opts Options
+		select {
+		case <-ctx.Done():
+			return
+		case opts = <-c.trigger:
+		case <-tick:
+			opts = Options{Repair: c.cfg.GCRepair}
+		}
+
+		if _, err := c.Run(ctx, opts); err != nil && ctx.Err() == nil && !errors.Is(err, ErrAlreadyRunning) {
+			c.lg.Error(fmt.Errorf("garbage collection failed: %w", err))
+		}
+	}
+}
+
+// Report - a snapshot of the report of the current or the last collection
+func (c *Collector) Report() Report {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	report := c.current
+	report.Problems = append([]Problem(nil), c.current.Problems...)
+	return report
+}
+
+func (c *Collector) update(f func(r *Report)) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	f(&c.current)
+}
+
+// Run - lists the chunks of every server, deletes the ones no plan or running upload references
+// and that were not written for FG_GC_SAFETY_WINDOW, then checks the referenced chunks
+// that were missing from the listing or had another size than their plan expects
+// and the chunks whose plan lists fewer replicas than it should
+func (c *Collector) Run(ctx context.Context, opts Options) (Report, error) {
+	c.mx.Lock()
+	if c.current.Running {
+		c.mx.Unlock()
+		return Report{}, ErrAlreadyRunning
+	}
+	c.current = Report{Options: opts, Running: true, StartedAt: time.Now().UTC()}
+	c.mx.Unlock()
+
+	err := c.run(ctx, opts)
+
+	c.update(func(r *Report) {
+		r.Running = false
+		r.FinishedAt = time.Now().UTC()
+		if err != nil {
+			r.Error = err.Error()
+		}
+	})
+
+	report := c.Report()
+	c.lg.Debugf(
+		"garbage collection finished: %d chunks of %d servers scanned, %d unreferenced, %d deleted, %d missing, %d of the wrong size, %d under replicated, %d repaired, %d failed",
+		report.Scanned, report.Servers, report.Unreferenced, report.Deleted, report.Missing, report.WrongSize, report.UnderReplicated, report.Repaired, report.Failed,
+	)
+
+	return report, err
+}
+
+func (c *Collector) run(ctx context.Context, opts Options) error {
+	cutoff := time.Now().Add(-c.cfg.GCSafetyWindow)
+
+	refs, underReplicated, plans, err := c.references(ctx)
+	if err != nil {
+		return err
+	}
+	c.update(func(r *Report) { r.Plans = plans })
+
+	var unreferenced, suspects []metastore.Location
+	found := make(map[metastore.Location]struct{}, len(refs))
+	listed := make(map[int]bool)
+	for _, server := range c.remoteStore.Servers() {
+		err := c.remoteStore.List(ctx, server.ID, "", func(chunk remotestore.ListedChunk) error {
+			c.update(func(r *Report) { r.Scanned++ })
+
+			loc := metastore.Location{Key: chunk.Key, ServerIdx: int(server.ID)}
+			ref, ok := refs[loc]
+			if !ok {
+				if chunk.ModifiedAt.Before(cutoff) {
+					unreferenced = append(unreferenced, loc)
+				}
+				return nil
+			}
+
+			found[loc] = struct{}{}
+			if ref.size != unknownSize && chunk.Size != ref.size {
+				suspects = append(suspects, loc)
+			}
+			return nil
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// chunks of a server that was not listed to the end cannot be taken for missing
+			c.lg.Error(fmt.Errorf("could not list chunks of server %d: %w", server.ID, err))
+			c.update(func(r *Report) { r.Failed++ })
+			continue
+		}
+
+		listed[int(server.ID)] = true
+		c.update(func(r *Report) { r.Servers++ })
+	}
+
+	for loc, ref := range refs {
+		if _, ok := found[loc]; !ok && ref.size != unknownSize && listed[loc.ServerIdx] {
+			suspects = append(suspects, loc)
+		}
+	}
+	sortLocations(suspects)
+
+	for _, loc := range suspects {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.check(ctx, opts, refs[loc].file, loc)
+	}
+
+	for _, chunk := range underReplicated {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.checkReplicas(ctx, opts, chunk)
+	}
+
+	return c.collect(ctx, opts, cutoff, unreferenced)
+}
+
+// references - locations of every chunk the plans reference along with their expected size
+// and the chunks whose plan lists fewer replicas than it should, chunks of running uploads
+// are referenced as well, they are written before their plan is stored
+func (c *Collector) references(ctx context.Context) (map[metastore.Location]reference, []chunkRef, int, error) {
+	refs := make(map[metastore.Location]reference)
+	var underReplicated []chunkRef
+	plans := 0
+	err := c.metaStore.Scan(ctx, "", "", func(key multishard.Key, plan *metastore.ShardPlan) (bool, error) {
+		plans++
+		for _, shard := range plan.Shards {
+			for _, f := range shard.Fragments {
+				refs[metastore.Location{Key: f.Key, ServerIdx: f.ServerIdx}] = reference{file: key, size: int64(f.Size)}
+			}
+			if len(shard.Fragments) > 0 {
+				continue
+			}
+			for _, loc := range shard.Locations(key) {
+				refs[loc] = reference{file: key, size: int64(shard.Size)}
+			}
+			if len(shard.Servers()) < c.replicas(plan) {
+				underReplicated = append(underReplicated, chunkRef{file: key, chunkIdx: shard.ChunkIdx})
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("could not scan shard plans: %w", err)
+	}
+
+	uploads, err := c.metaStore.ListPendingUploads(ctx)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("could not list pending uploads: %w", err)
+	}
+	for _, pu := range uploads {
+		for _, loc := range pu.Locations {
+			if _, ok := refs[loc]; !ok {
+				refs[loc] = reference{file: pu.Key, size: unknownSize}
+			}
+		}
+	}
+
+	return refs, underReplicated, plans, nil
+}
+
+// replicas - copies of every chunk the plan should have, as many as the file was uploaded with
+func (c *Collector) replicas(plan *metastore.ShardPlan) int {
+	if plan.Replicas > 0 {
+		return plan.Replicas
+	}
+	return c.cfg.Replicas
+}
+
+// check - looks at a referenced chunk that did not show up as expected once more, the plan could have changed
+// or the chunk could have been written again since the servers were listed, reports it if it is still broken
+// and repairs it when asked to
+func (c *Collector) check(ctx context.Context, opts Options, file multishard.Key, loc metastore.Location) {
+	problem, plan, err := c.confirm(ctx, file, loc)
+	if err != nil {
+		c.lg.Error(fmt.Errorf("could not check %s of %s on server %d: %w", loc.Key, file, loc.ServerIdx, err))
+		c.update(func(r *Report) { r.Failed++ })
+		return
+	}
+	if problem == nil {
+		return
+	}
+
+	if opts.Repair && !opts.DryRun {
+		if err := c.repair(ctx, file, plan, loc); err != nil {
+			c.lg.Error(fmt.Errorf("could not repair %s of %s on server %d: %w", loc.Key, file, loc.ServerIdx, err))
+			problem.Error = err.Error()
+		} else {
+			problem.Repaired = true
+		}
+	}
+
+	c.lg.Debugf("%s of %s on server %d is %s, repaired: %t", loc.Key, file, loc.ServerIdx, problem.Kind, problem.Repaired)
+	c.record(problem)
+}
+
+// checkReplicas - looks at the replicas the current plan lists for the chunk once more, a plan stored
+// by an upload gets only the replicas that acknowledged in time, reports the chunk if it still has
+// fewer of them than it should and copies it to the servers that own it when asked to
+func (c *Collector) checkReplicas(ctx context.Context, opts Options, chunk chunkRef) {
+	plan, err := c.metaStore.GetShardPlan(ctx, chunk.file)
+	if err != nil {
+		if !errors.Is(err, metastore.ErrNotFound) {
+			c.lg.Error(fmt.Errorf("could not check replicas of chunk %d of %s: %w", chunk.chunkIdx, chunk.file, err))
+			c.update(func(r *Report) { r.Failed++ })
+		}
+		return
+	}
+
+	shard, ok := replicatedShard(plan, chunk.chunkIdx)
+	if !ok || len(shard.Servers()) >= c.replicas(plan) {
+		return
+	}
+
+	problem := &Problem{
+		File:      chunk.file,
+		Key:       shard.StorageKey(chunk.file),
+		ServerIdx: shard.ServerIdx,
+		Kind:      ProblemUnderReplicated,
+		Size:      int64(shard.Size),
+		Replicas:  len(shard.Servers()),
+	}
+
+	if opts.Repair && !opts.DryRun {
+		if err := c.replicate(ctx, chunk.file, plan, shard); err != nil {
+			c.lg.Error(fmt.Errorf("could not replicate chunk %d of %s: %w", chunk.chunkIdx, chunk.file, err))
+			problem.Error = err.Error()
+		} else {
+			problem.Repaired = true
+		}
+	}
+
+	c.lg.Debugf("chunk %d of %s has %d of %d replicas, repaired: %t", chunk.chunkIdx, chunk.file, problem.Replicas, c.replicas(plan), problem.Repaired)
+	c.record(problem)
+}
+
+func (c *Collector) record(problem *Problem) {
+	c.update(func(r *Report) {
+		switch problem.Kind {
+		case ProblemMissing:
+			r.Missing++
+		case ProblemWrongSize:
+			r.WrongSize++
+		case ProblemUnderReplicated:
+			r.UnderReplicated++
+		}
+		if problem.Repaired {
+			r.Repaired++
+		} else if problem.Error != "" {
+			r.Failed++
+		}
+		if len(r.Problems) < maxReportedProblems {
+			r.Problems = append(r.Problems, *problem)
+		}
+	})
+}
+
+// confirm - the problem of the chunk at the location if the current plan of the file
+// still references it and its server does not hold it as the plan expects
+func (c *Collector) confirm(ctx context.Context, file multishard.Key, loc metastore.Location) (*Problem, *metastore.ShardPlan, error) {
+	plan, err := c.metaStore.GetShardPlan(ctx, file)
+	if err != nil {
+		if errors.Is(err, metastore.ErrNotFound) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	size, ok := expectedSize(file, plan, loc)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	problem := &Problem{File: file, Key: loc.Key, ServerIdx: loc.ServerIdx, Size: size}
+	st, err := c.remoteStore.Stat(ctx, loc.Key, multishard.ServerIdx(loc.ServerIdx))
+	switch {
+	case errors.Is(err, remotestore.ErrChunkNotFound):
+		problem.Kind = ProblemMissing
+	case err != nil:
+		return nil, nil, err
+	case st.Size != size:
+		problem.Kind = ProblemWrongSize
+		problem.StoredSize = st.Size
+	default:
+		return nil, nil, nil
+	}
+
+	return problem, plan, nil
+}
+
+// collect - deletes the unreferenced chunks unless a plan committed or an upload started
+// since the servers were listed references them or they were written again meanwhile
+func (c *Collector) collect(ctx context.Context, opts Options, cutoff time.Time, unreferenced []metastore.Location) error {
+	if len(unreferenced) == 0 {
+		return nil
+	}
+
+	refs, _, _, err := c.references(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, loc := range unreferenced {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, ok := refs[loc]; ok {
+			continue
+		}
+
+		st, err := c.remoteStore.Stat(ctx, loc.Key, multishard.ServerIdx(loc.ServerIdx))
+		if err != nil {
+			if !errors.Is(err, remotestore.ErrChunkNotFound) {
+				c.lg.Error(err)
+				c.update(func(r *Report) { r.Failed++ })
+			}
+			continue
+		}
+		if !st.ModifiedAt.Before(cutoff) {
+			continue
+		}
+
+		c.update(func(r *Report) {
+			r.Unreferenced++
+			r.UnreferencedBytes += st.Size
+		})
+		if opts.DryRun {
+			continue
+		}
+
+		if err := c.remoteStore.Delete(ctx, loc.Key, multishard.ServerIdx(loc.ServerIdx)); err != nil {
+			c.lg.Error(fmt.Errorf("could not delete unreferenced %s from server %d: %w", loc.Key, loc.ServerIdx, err))
+			c.update(func(r *Report) { r.Failed++ })
+			continue
+		}
+		c.update(func(r *Report) {
+			r.Deleted++
+			r.DeletedBytes += st.Size
+		})
+	}
+
+	return nil
+}
+
+// expectedSize - size of the chunk or fragment the plan stores at the location
+func expectedSize(file multishard.Key, plan *metastore.ShardPlan, loc metastore.Location) (int64, bool) {
+	for _, shard := range plan.Shards {
+		for _, f := range shard.Fragments {
+			if f.Key == loc.Key && f.ServerIdx == loc.ServerIdx {
+				return int64(f.Size), true
+			}
+		}
+		if len(shard.Fragments) > 0 {
+			continue
+		}
+		for _, l := range shard.Locations(file) {
+			if l == loc {
+				return int64(shard.Size), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// replicatedShard - the shard of the chunk if the plan stores copies of it
+func replicatedShard(plan *metastore.ShardPlan, chunkIdx int) (metastore.Shard, bool) {
+	for _, shard := range plan.Shards {
+		if shard.ChunkIdx == chunkIdx && len(shard.Fragments) == 0 {
+			return shard, true
+		}
+	}
+	return metastore.Shard{}, false
+}
+
+func sortLocations(locations []metastore.Location) {
+	sort.Slice(locations, func(i, j int) bool {
+		if locations[i].ServerIdx != locations[j].ServerIdx {
+			return locations[i].ServerIdx < locations[j].ServerIdx
+		}
+		return locations[i].Key < locations[j].Key
+	})
+}
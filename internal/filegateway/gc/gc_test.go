@@ -0,0 +1,387 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/remotestore"
+	"github.com/klauspost/reedsolomon"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type location struct {
+	key    multishard.Key
+	server multishard.ServerIdx
+}
+
+type storedChunk struct {
+	data       []byte
+	modifiedAt time.Time
+}
+
+type fakeRemoteStore struct {
+	mx      sync.Mutex
+	servers int
+	chunks  map[location]storedChunk
+}
+
+func (s *fakeRemoteStore) Servers() []remotestore.Server {
+	servers := make([]remotestore.Server, s.servers)
+	for i := range servers {
+		servers[i] = remotestore.Server{ID: multishard.ServerIdx(i), Addr: fmt.Sprintf("server-%d", i)}
+	}
+	return servers
+}
+
+func (s *fakeRemoteStore) List(_ context.Context, serverID multishard.ServerIdx, prefix multishard.Key, fn func(chunk remotestore.ListedChunk) error) error {
+	s.mx.Lock()
+	var listed []remotestore.ListedChunk
+	for loc, c := range s.chunks {
+		if loc.server == serverID && strings.HasPrefix(string(loc.key), string(prefix)) {
+			listed = append(listed, remotestore.ListedChunk{
+				Key:       loc.key,
+				ChunkStat: remotestore.ChunkStat{Size: int64(len(c.data)), Checksum: multishard.Checksum(c.data), ModifiedAt: c.modifiedAt},
+			})
+		}
+	}
+	s.mx.Unlock()
+
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Key < listed[j].Key })
+	for _, chunk := range listed {
+		if err := fn(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeRemoteStore) Stat(_ context.Context, key multishard.Key, serverID multishard.ServerIdx) (*remotestore.ChunkStat, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	c, ok := s.chunks[location{key, serverID}]
+	if !ok {
+		return nil, remotestore.ErrChunkNotFound
+	}
+	return &remotestore.ChunkStat{Size: int64(len(c.data)), Checksum: multishard.Checksum(c.data), ModifiedAt: c.modifiedAt}, nil
+}
+
+func (s *fakeRemoteStore) Get(_ context.Context, key multishard.Key, serverID multishard.ServerIdx, w io.Writer) (int, error) {
+	s.mx.Lock()
+	c, ok := s.chunks[location{key, serverID}]
+	s.mx.Unlock()
+	if !ok {
+		return 0, errors.New("no such chunk")
+	}
+	return w.Write(c.data)
+}
+
+func (s *fakeRemoteStore) Put(_ context.Context, key multishard.Key, serverID multishard.ServerIdx, r io.Reader) (uint32, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	s.put(key, serverID, data, time.Now())
+	return multishard.Checksum(data), nil
+}
+
+func (s *fakeRemoteStore) Delete(_ context.Context, key multishard.Key, serverID multishard.ServerIdx) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.chunks, location{key, serverID})
+	return nil
+}
+
+func (s *fakeRemoteStore) put(key multishard.Key, serverID multishard.ServerIdx, data []byte, modifiedAt time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.chunks[location{key, serverID}] = storedChunk{data: data, modifiedAt: modifiedAt}
+}
+
+func (s *fakeRemoteStore) get(key multishard.Key, serverID multishard.ServerIdx) []byte {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	c, ok := s.chunks[location{key, serverID}]
+	if !ok {
+		return nil
+	}
+	return c.data
+}
+
+// fakeShardManager - the owners of every chunk are the first servers
+type fakeShardManager struct {
+	replicas int
+}
+
+func (sm fakeShardManager) ResolveReplicas(key multishard.Key, chunkIdx multishard.ChunkIdx) ([]multishard.ServerIdx, error) {
+	return sm.ResolveServers(key, chunkIdx, sm.replicas)
+}
+
+func (sm fakeShardManager) ResolveServers(_ multishard.Key, _ multishard.ChunkIdx, n int) ([]multishard.ServerIdx, error) {
+	servers := make([]multishard.ServerIdx, n)
+	for i := range servers {
+		servers[i] = multishard.ServerIdx(i)
+	}
+	return servers, nil
+}
+
+type fakeMetaStore struct {
+	plans   map[multishard.Key]*metastore.ShardPlan
+	uploads []*metastore.PendingUpload
+}
+
+func (s *fakeMetaStore) Scan(_ context.Context, prefix, after multishard.Key, fn metastore.ScanFunc) error {
+	var keys []multishard.Key
+	for key := range s.plans {
+		if strings.HasPrefix(string(key), string(prefix)) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, key := range keys {
+		if next, err := fn(key, s.plans[key]); err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeMetaStore) GetShardPlan(_ context.Context, key multishard.Key) (*metastore.ShardPlan, error) {
+	plan, ok := s.plans[key]
+	if !ok {
+		return nil, metastore.ErrNotFound
+	}
+	return plan, nil
+}
+
+func (s *fakeMetaStore) UpdateShardPlan(_ context.Context, key multishard.Key, update func(plan *metastore.ShardPlan) (*metastore.ShardPlan, error)) error {
+	plan, ok := s.plans[key]
+	if !ok {
+		return metastore.ErrNotFound
+	}
+	next, err := update(plan)
+	if err != nil {
+		return err
+	}
+	s.plans[key] = next
+	return nil
+}
+
+func (s *fakeMetaStore) ListPendingUploads(_ context.Context) ([]*metastore.PendingUpload, error) {
+	return s.uploads, nil
+}
+
+func newTestCollector(servers int) (*Collector, *fakeRemoteStore, *fakeMetaStore) {
+	rs := &fakeRemoteStore{servers: servers, chunks: map[location]storedChunk{}}
+	ms := &fakeMetaStore{plans: map[multishard.Key]*metastore.ShardPlan{}}
+	c := NewCollector(
+		&config.Config{GCSafetyWindow: time.Hour},
+		fakeShardManager{},
+		rs,
+		ms,
+		logger.NewStdoutLogger(logger.Dev, "test"),
+	)
+	return c, rs, ms
+}
+
+// storeReplicated - a plan of the chunks with a copy of each on every server
+func storeReplicated(rs *fakeRemoteStore, ms *fakeMetaStore, key multishard.Key, servers []int, chunks ...[]byte) {
+	plan := &metastore.ShardPlan{ChecksumAlgo: multishard.ChecksumAlgo}
+	for i, data := range chunks {
+		chunkKey := multishard.ChunkKey(key, multishard.ChunkIdx(i))
+		plan.Shards = append(plan.Shards, metastore.Shard{
+			ChunkIdx:  i,
+			ServerIdx: servers[0],
+			Size:      len(data),
+			Checksum:  multishard.Checksum(data),
+			Key:       chunkKey,
+			Replicas:  servers,
+		})
+		plan.OriginalSize += len(data)
+		for _, server := range servers {
+			rs.put(chunkKey, multishard.ServerIdx(server), data, time.Now().Add(-2*time.Hour))
+		}
+	}
+	ms.plans[key] = plan
+}
+
+func TestCollector_DeletesOnlyOldUnreferencedChunks(t *testing.T) {
+	c, rs, ms := newTestCollector(3)
+	ctx := context.Background()
+	old := time.Now().Add(-2 * time.Hour)
+
+	storeReplicated(rs, ms, "kept.txt", []int{0, 1}, []byte("abcd"))
+	rs.put("orphan.txt/0", 1, []byte("orphan"), old)
+	rs.put("recent.txt/0", 0, []byte("recent"), time.Now())
+	rs.put("uploading.txt/0", 2, []byte("uploading"), old)
+	running := metastore.NewPendingUpload("uploading.txt")
+	running.Locations = []metastore.Location{{Key: "uploading.txt/0", ServerIdx: 2}}
+	ms.uploads = []*metastore.PendingUpload{running}
+
+	report, err := c.Run(ctx, Options{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Unreferenced != 1 || report.UnreferencedBytes != 6 || report.Deleted != 0 || rs.get("orphan.txt/0", 1) == nil {
+		t.Fatalf("expected a dry run to only report the orphan, got %+v", report)
+	}
+
+	report, err = c.Run(ctx, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Plans != 1 || report.Servers != 3 || report.Scanned != 5 {
+		t.Errorf("expected 5 chunks of 1 plan on 3 servers to be scanned, got %+v", report)
+	}
+	if report.Deleted != 1 || report.DeletedBytes != 6 || rs.get("orphan.txt/0", 1) != nil {
+		t.Errorf("expected the old unreferenced chunk to be deleted, got %+v", report)
+	}
+	for _, loc := range []location{{"kept.txt/0", 0}, {"kept.txt/0", 1}, {"recent.txt/0", 0}, {"uploading.txt/0", 2}} {
+		if rs.get(loc.key, loc.server) == nil {
+			t.Errorf("%s on server %d was deleted", loc.key, loc.server)
+		}
+	}
+	if report.Missing != 0 || report.WrongSize != 0 || report.Failed != 0 {
+		t.Errorf("expected no problems, got %+v", report)
+	}
+}
+
+func TestCollector_ReportsAndRepairsBrokenReplicas(t *testing.T) {
+	c, rs, ms := newTestCollector(3)
+	ctx := context.Background()
+
+	storeReplicated(rs, ms, "file.txt", []int{0, 1}, []byte("abcd"), []byte("efgh"))
+	_ = rs.Delete(ctx, "file.txt/0", 1)
+	rs.put("file.txt/1", 0, []byte("ef"), time.Now())
+
+	report, err := c.Run(ctx, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Missing != 1 || report.WrongSize != 1 || report.Repaired != 0 || len(report.Problems) != 2 {
+		t.Fatalf("expected a missing chunk and one of the wrong size, got %+v", report)
+	}
+	want := []Problem{
+		{File: "file.txt", Key: "file.txt/1", ServerIdx: 0, Kind: ProblemWrongSize, Size: 4, StoredSize: 2},
+		{File: "file.txt", Key: "file.txt/0", ServerIdx: 1, Kind: ProblemMissing, Size: 4},
+	}
+	for i := range want {
+		if report.Problems[i] != want[i] {
+			t.Errorf("problem %d = %+v, want %+v", i, report.Problems[i], want[i])
+		}
+	}
+
+	report, err = c.Run(ctx, Options{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired != 2 || report.Failed != 0 {
+		t.Fatalf("expected both chunks to be repaired, got %+v", report)
+	}
+	if got := rs.get("file.txt/0", 1); !bytes.Equal(got, []byte("abcd")) {
+		t.Errorf("repaired chunk 0 = %q", got)
+	}
+	if got := rs.get("file.txt/1", 0); !bytes.Equal(got, []byte("efgh")) {
+		t.Errorf("repaired chunk 1 = %q", got)
+	}
+}
+
+func TestCollector_RebuildsMissingFragment(t *testing.T) {
+	c, rs, ms := newTestCollector(3)
+	ctx := context.Background()
+
+	enc, err := reedsolomon.New(2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("erasure coded chunk")
+	fragments, err := enc.Split(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(fragments); err != nil {
+		t.Fatal(err)
+	}
+
+	shard := metastore.Shard{ChunkIdx: 0, Size: len(content)}
+	for i, data := range fragments {
+		key := multishard.FragmentKey("file.bin", "1f", 0, i)
+		shard.Fragments = append(shard.Fragments, metastore.Fragment{
+			Idx:       i,
+			ServerIdx: i,
+			Key:       key,
+			Size:      len(data),
+			Checksum:  multishard.Checksum(data),
+		})
+		rs.put(key, multishard.ServerIdx(i), data, time.Now().Add(-2*time.Hour))
+	}
+	ms.plans["file.bin"] = &metastore.ShardPlan{
+		OriginalSize: len(content),
+		Erasure:      &metastore.ErasureCoding{DataShards: 2, ParityShards: 1},
+		Shards:       []metastore.Shard{shard},
+	}
+
+	lost := shard.Fragments[1]
+	_ = rs.Delete(ctx, lost.Key, multishard.ServerIdx(lost.ServerIdx))
+
+	report, err := c.Run(ctx, Options{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Missing != 1 || report.Repaired != 1 {
+		t.Fatalf("expected the missing fragment to be rebuilt, got %+v", report)
+	}
+	if got := rs.get(lost.Key, multishard.ServerIdx(lost.ServerIdx)); !bytes.Equal(got, fragments[1]) {
+		t.Errorf("rebuilt fragment = %q, want %q", got, fragments[1])
+	}
+}
+
+func TestCollector_ReplicatesChunksStoredWithoutEveryReplica(t *testing.T) {
+	c, rs, ms := newTestCollector(3)
+	ctx := context.Background()
+
+	// the upload was acknowledged by two of three replicas, the third did not finish in time
+	storeReplicated(rs, ms, "file.txt", []int{1, 2}, []byte("abcd"))
+	ms.plans["file.txt"].Replicas = 3
+
+	report, err := c.Run(ctx, Options{DryRun: true, Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Problem{File: "file.txt", Key: "file.txt/0", ServerIdx: 1, Kind: ProblemUnderReplicated, Size: 4, Replicas: 2}
+	if report.UnderReplicated != 1 || report.Repaired != 0 || len(report.Problems) != 1 || report.Problems[0] != want {
+		t.Fatalf("expected a dry run to only report the chunk, got %+v", report)
+	}
+
+	report, err = c.Run(ctx, Options{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.UnderReplicated != 1 || report.Repaired != 1 || report.Failed != 0 {
+		t.Fatalf("expected the chunk to be replicated, got %+v", report)
+	}
+	if got := rs.get("file.txt/0", 0); !bytes.Equal(got, []byte("abcd")) {
+		t.Errorf("new replica = %q", got)
+	}
+	if got := ms.plans["file.txt"].Shards[0].Replicas; len(got) != 3 || got[2] != 0 {
+		t.Errorf("replicas in the plan = %v, want the new one on server 0 added", got)
+	}
+
+	report, err = c.Run(ctx, Options{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.UnderReplicated != 0 || report.Deleted != 0 {
+		t.Errorf("expected nothing to be left to do, got %+v", report)
+	}
+}
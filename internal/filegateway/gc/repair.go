@@ -0,0 +1,229 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/klauspost/reedsolomon"
+)
+
+var (
+	ErrNoIntactCopy       = errors.New("no intact copy of the chunk")
+	ErrNotEnoughFragments = errors.New("not enough fragments to rebuild the fragment")
+
+	errChunkChanged = errors.New("chunk was moved or uploaded again")
+)
+
+// repair - writes the chunk at the location again, a copy of a replicated chunk is taken
+// from one of its other replicas and a fragment is rebuilt from the other fragments of its chunk
+func (c *Collector) repair(ctx context.Context, file multishard.Key, plan *metastore.ShardPlan, loc metastore.Location) error {
+	for _, shard := range plan.Shards {
+		for _, f := range shard.Fragments {
+			if f.Key == loc.Key && f.ServerIdx == loc.ServerIdx {
+				return c.rebuildFragment(ctx, file, plan.Erasure, shard, f)
+			}
+		}
+		if len(shard.Fragments) > 0 {
+			continue
+		}
+		for _, l := range shard.Locations(file) {
+			if l == loc {
+				return c.copyReplica(ctx, file, plan, shard, loc)
+			}
+		}
+	}
+	return fmt.Errorf("%s on server %d is not referenced by the plan of %s", loc.Key, loc.ServerIdx, file)
+}
+
+// copyReplica - copies the chunk from the first of its other replicas that has an intact copy
+func (c *Collector) copyReplica(
+	ctx context.Context,
+	file multishard.Key,
+	plan *metastore.ShardPlan,
+	shard metastore.Shard,
+	loc metastore.Location,
+) error {
+	data, err := c.intactCopy(ctx, file, plan, shard, loc.ServerIdx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.remoteStore.Put(ctx, loc.Key, multishard.ServerIdx(loc.ServerIdx), bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("could not copy chunk %d of %s to server %d: %w", shard.ChunkIdx, file, loc.ServerIdx, err)
+	}
+	return nil
+}
+
+// replicate - copies the chunk to the servers that own it and have no copy of it
+// until it has as many replicas as the plan should have, then adds them to the plan
+// unless the chunk was moved or uploaded again meanwhile, copies the plan
+// does not get are left to the next collection
+func (c *Collector) replicate(ctx context.Context, file multishard.Key, plan *metastore.ShardPlan, shard metastore.Shard) error {
+	replicas := c.replicas(plan)
+	owners, err := c.shardManager.ResolveServers(file, multishard.ChunkIdx(shard.ChunkIdx), replicas)
+	if err != nil {
+		return fmt.Errorf("could not resolve the servers of chunk %d: %w", shard.ChunkIdx, err)
+	}
+
+	current := make(map[int]bool, len(shard.Servers()))
+	for _, server := range shard.Servers() {
+		current[server] = true
+	}
+	var missing []int
+	for _, owner := range owners {
+		if len(current)+len(missing) == replicas {
+			break
+		}
+		if !current[int(owner)] {
+			missing = append(missing, int(owner))
+		}
+	}
+	if len(missing) == 0 {
+		return fmt.Errorf("chunk %d has a copy on every server that owns it", shard.ChunkIdx)
+	}
+
+	data, err := c.intactCopy(ctx, file, plan, shard, -1)
+	if err != nil {
+		return err
+	}
+
+	key := shard.StorageKey(file)
+	var copied []int
+	for _, server := range missing {
+		if _, err := c.remoteStore.Put(ctx, key, multishard.ServerIdx(server), bytes.NewReader(data)); err != nil {
+			c.lg.Error(fmt.Errorf("could not copy chunk %d of %s to server %d: %w", shard.ChunkIdx, file, server, err))
+			continue
+		}
+		copied = append(copied, server)
+	}
+	if len(copied) == 0 {
+		return fmt.Errorf("could not copy chunk %d to any of servers %v", shard.ChunkIdx, missing)
+	}
+
+	err = c.metaStore.UpdateShardPlan(ctx, file, func(current *metastore.ShardPlan) (*metastore.ShardPlan, error) {
+		next := *current
+		next.Shards = append([]metastore.Shard(nil), current.Shards...)
+		for i, s := range next.Shards {
+			if s.ChunkIdx != shard.ChunkIdx {
+				continue
+			}
+			if len(s.Fragments) > 0 || s.StorageKey(file) != key || !sameServers(s.Servers(), shard.Servers()) {
+				return nil, errChunkChanged
+			}
+			next.Shards[i].Replicas = append(append([]int(nil), s.Servers()...), copied...)
+			return &next, nil
+		}
+		return nil, errChunkChanged
+	})
+	if err != nil {
+		return fmt.Errorf("could not add the replicas of chunk %d to the plan: %w", shard.ChunkIdx, err)
+	}
+	if len(copied) < len(missing) {
+		return fmt.Errorf("chunk %d was copied to servers %v of %v", shard.ChunkIdx, copied, missing)
+	}
+	return nil
+}
+
+// intactCopy - the chunk from the first of its replicas but the skipped server that has an intact copy
+func (c *Collector) intactCopy(
+	ctx context.Context,
+	file multishard.Key,
+	plan *metastore.ShardPlan,
+	shard metastore.Shard,
+	skip int,
+) ([]byte, error) {
+	for _, server := range shard.Servers() {
+		if server == skip {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if _, err := c.remoteStore.Get(ctx, shard.StorageKey(file), multishard.ServerIdx(server), &buf); err != nil {
+			c.lg.Error(fmt.Errorf("could not get %s from server %d: %w", shard.StorageKey(file), server, err))
+			continue
+		}
+		if buf.Len() != shard.Size {
+			continue
+		}
+		if plan.ChecksumAlgo == multishard.ChecksumAlgo && multishard.Checksum(buf.Bytes()) != shard.Checksum {
+			continue
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("chunk %d of %s: %w", shard.ChunkIdx, file, ErrNoIntactCopy)
+}
+
+// rebuildFragment - reconstructs the fragment from the intact fragments of its chunk
+// and writes it to its server
+func (c *Collector) rebuildFragment(
+	ctx context.Context,
+	file multishard.Key,
+	ec *metastore.ErasureCoding,
+	shard metastore.Shard,
+	broken metastore.Fragment,
+) error {
+	if ec == nil || len(shard.Fragments) != ec.DataShards+ec.ParityShards {
+		return fmt.Errorf("chunk %d of %s does not match the erasure coding of its plan", shard.ChunkIdx, file)
+	}
+
+	enc, err := reedsolomon.New(ec.DataShards, ec.ParityShards)
+	if err != nil {
+		return fmt.Errorf("invalid erasure coding of %s: %w", file, err)
+	}
+
+	fragments := make([][]byte, len(shard.Fragments))
+	available := 0
+	for _, f := range shard.Fragments {
+		if available == ec.DataShards {
+			break
+		}
+		if f.Idx == broken.Idx {
+			continue
+		}
+
+		var buf bytes.Buffer
+		buf.Grow(f.Size)
+		if _, err := c.remoteStore.Get(ctx, f.Key, multishard.ServerIdx(f.ServerIdx), &buf); err != nil {
+			c.lg.Error(fmt.Errorf("could not get fragment %s from server %d: %w", f.Key, f.ServerIdx, err))
+			continue
+		}
+		if buf.Len() != f.Size || multishard.Checksum(buf.Bytes()) != f.Checksum {
+			continue
+		}
+		fragments[f.Idx] = buf.Bytes()
+		available++
+	}
+
+	if available < ec.DataShards {
+		return fmt.Errorf("chunk %d of %s has %d of %d required fragments: %w", shard.ChunkIdx, file, available, ec.DataShards, ErrNotEnoughFragments)
+	}
+
+	if err := enc.Reconstruct(fragments); err != nil {
+		return fmt.Errorf("could not reconstruct chunk %d of %s: %w", shard.ChunkIdx, file, err)
+	}
+
+	rebuilt := fragments[broken.Idx]
+	if len(rebuilt) != broken.Size || multishard.Checksum(rebuilt) != broken.Checksum {
+		return fmt.Errorf("rebuilt fragment %s does not match its checksum", broken.Key)
+	}
+
+	if _, err := c.remoteStore.Put(ctx, broken.Key, multishard.ServerIdx(broken.ServerIdx), bytes.NewReader(rebuilt)); err != nil {
+		return fmt.Errorf("could not write fragment %s to server %d: %w", broken.Key, broken.ServerIdx, err)
+	}
+	return nil
+}
+
+func sameServers(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
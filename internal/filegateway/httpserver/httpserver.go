@@ -2,38 +2,109 @@ package httpserver
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/buckets"
 	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/deleter"
+	"github.com/denismitr/shardstore/internal/filegateway/downloader"
+	"github.com/denismitr/shardstore/internal/filegateway/gc"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/rebalancer"
+	"github.com/denismitr/shardstore/internal/filegateway/topology"
+	"github.com/denismitr/shardstore/internal/filegateway/uploader"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	userMetaPrefix    = "X-Meta-"
+	createdAtHeader   = "X-Created-At"
+	contentHashHeader = "X-Content-Sha256"
 )
 
 type fileUploader interface {
 	Upload(
 		ctx context.Context,
-		f multipart.File,
-		h *multipart.FileHeader,
+		bucket string,
+		fileName string,
+		r io.Reader,
+		opts uploader.UploadOptions,
 	) error
+	UpdateUserMeta(ctx context.Context, bucket, fileName string, meta map[string]string) error
+	CreateResumableUpload(
+		ctx context.Context,
+		bucket, fileName string,
+		length int64,
+		metadata string,
+		opts uploader.UploadOptions,
+	) (*metastore.ResumableUpload, error)
+	GetResumableUpload(ctx context.Context, uploadID string) (*metastore.ResumableUpload, int64, error)
+	WriteResumable(ctx context.Context, uploadID string, offset int64, r io.Reader) (int64, error)
+	TerminateResumableUpload(ctx context.Context, uploadID string) error
 }
 
 type fileDownloader interface {
+	Stat(ctx context.Context, bucket, fileName string) (*downloader.FileInfo, error)
+	List(ctx context.Context, opts downloader.ListOptions) (*downloader.ListResult, error)
 	Download(
 		ctx context.Context,
-		fileName string,
+		info *downloader.FileInfo,
+		w io.Writer,
+	) (int, error)
+	DownloadRange(
+		ctx context.Context,
+		info *downloader.FileInfo,
+		offset, length int64,
 		w io.Writer,
 	) (int, error)
 }
 
+type fileDeleter interface {
+	Delete(ctx context.Context, bucket, fileName string) (bool, error)
+}
+
+type bucketManager interface {
+	Create(ctx context.Context, name string, settings metastore.BucketSettings) (*metastore.Bucket, error)
+	Get(ctx context.Context, name string) (*metastore.Bucket, error)
+	List(ctx context.Context) ([]*metastore.Bucket, error)
+	UpdateSettings(ctx context.Context, name string, settings metastore.BucketSettings) (*metastore.Bucket, error)
+	Delete(ctx context.Context, name string) error
+}
+
+type clusterRebalancer interface {
+	Trigger() error
+	Progress() rebalancer.Progress
+	Drain(ctx context.Context, server multishard.ServerIdx) error
+	DrainStatus(ctx context.Context, server multishard.ServerIdx) (*rebalancer.DrainStatus, error)
+}
+
+type garbageCollector interface {
+	Trigger(opts gc.Options) error
+	Report() gc.Report
+}
+
 type Server struct {
 	cfg        *config.Config
 	lg         logger.Logger
 	router     *chi.Mux
 	uploader   fileUploader
 	downloader fileDownloader
+	deleter    fileDeleter
+	buckets    bucketManager
+	rebalancer clusterRebalancer
+	collector  garbageCollector
 }
 
 func NewServer(
@@ -41,35 +112,215 @@ func NewServer(
 	lg logger.Logger,
 	fu fileUploader,
 	fd fileDownloader,
+	fdel fileDeleter,
+	bm bucketManager,
+	rb clusterRebalancer,
+	col garbageCollector,
 ) *Server {
-	s := &Server{cfg: cfg, uploader: fu, lg: lg, downloader: fd}
+	s := &Server{cfg: cfg, uploader: fu, lg: lg, downloader: fd, deleter: fdel, buckets: bm, rebalancer: rb, collector: col}
 	s.setupRoutes()
 	return s
 }
 
+// statFile - resolves the file for GET and HEAD, responds on its own when it cannot
+func (s *Server) statFile(w http.ResponseWriter, r *http.Request) (*downloader.FileInfo, bool) {
+	file := fileParam(r)
+
+	info, err := s.downloader.Stat(r.Context(), chi.URLParam(r, "bucket"), file)
+	if err != nil {
+		if errors.Is(err, metastore.ErrNotFound) {
+			http.Error(w, http.StatusText(404), 404)
+			return nil, false
+		}
+		if invalidName(err) {
+			http.Error(w, http.StatusText(400), 400)
+			return nil, false
+		}
+		s.lg.Error(fmt.Errorf("error resolving file %s: %w", file, err))
+		http.Error(w, http.StatusText(500), 500)
+		return nil, false
+	}
+
+	return info, true
+}
+
+// setFileHeaders - headers have to be set before the status is written
+func setFileHeaders(w http.ResponseWriter, info *downloader.FileInfo) {
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Last-Modified", info.ModifiedAt.Format(http.TimeFormat))
+	w.Header().Set("ETag", info.ETag)
+	w.Header().Set("Accept-Ranges", "bytes")
+	if !info.CreatedAt.IsZero() {
+		w.Header().Set(createdAtHeader, info.CreatedAt.Format(http.TimeFormat))
+	}
+	if info.ContentHash != "" {
+		w.Header().Set(contentHashHeader, info.ContentHash)
+	}
+	for k, v := range info.UserMeta {
+		w.Header().Set(userMetaPrefix+k, v)
+	}
+}
+
+func (s *Server) headFile(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.statFile(w, r)
+	if !ok {
+		return
+	}
+
+	setFileHeaders(w, info)
+	w.WriteHeader(http.StatusOK)
+}
+
+// downloadFile - sends the whole file or, when the Range header asks for it,
+// a single range or several of them as multipart/byteranges with 206
 func (s *Server) downloadFile(w http.ResponseWriter, r *http.Request) {
-	file := chi.URLParam(r, "file")
-	w.WriteHeader(200)
-	w.Header().Set("content-type", "application/force-download") // todo: maybe to store mime types
-	w.Header().Set("content-disposition", `attachment; filename="`+file+`"`)
-	//w.Header().Set("content-length", fmt.Sprintf("%d", downloaded))
+	info, ok := s.statFile(w, r)
+	if !ok {
+		return
+	}
+
+	ranges, err := requestedRanges(r, info)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		http.Error(w, http.StatusText(416), 416)
+		return
+	}
+
+	setFileHeaders(w, info)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(info.Name)}))
+
+	switch len(ranges) {
+	case 0:
+		w.WriteHeader(http.StatusOK)
+		_, err = s.downloader.Download(r.Context(), info, w)
+	case 1:
+		w.Header().Set("Content-Range", ranges[0].contentRange(info.Size))
+		w.Header().Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		_, err = s.downloader.DownloadRange(r.Context(), info, ranges[0].start, ranges[0].length, w)
+	default:
+		err = s.downloadRanges(w, r, info, ranges)
+	}
+
+	if err != nil {
+		// the status is already sent, the client can only learn
+		// about the failure from the connection being cut short
+		s.lg.Error(fmt.Errorf("error downloading file %s: %w", info.Name, err))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// downloadRanges - sends every range as a part of a multipart/byteranges body
+func (s *Server) downloadRanges(w http.ResponseWriter, r *http.Request, info *downloader.FileInfo, ranges []byteRange) error {
+	boundary := multipart.NewWriter(nil).Boundary()
+	length, err := multipartRangesLength(boundary, info, ranges)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	return multipartRanges(w, boundary, info, ranges, func(br byteRange, pw io.Writer) error {
+		_, err := s.downloader.DownloadRange(r.Context(), info, br.start, br.length, pw)
+		return err
+	})
+}
+
+// listFiles - a page of stored files and common prefixes,
+// the next_cursor of a truncated page is passed as cursor to get the next one
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := downloader.ListOptions{
+		Bucket:    chi.URLParam(r, "bucket"),
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		Cursor:    q.Get("cursor"),
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		opts.Limit = n
+	}
+
+	if opts.Bucket != "" {
+		if _, ok := s.bucket(w, r); !ok {
+			return
+		}
+	}
+
+	result, err := s.downloader.List(r.Context(), opts)
+	if err != nil {
+		if errors.Is(err, downloader.ErrInvalidCursor) || invalidName(err) {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		s.lg.Error(fmt.Errorf("error listing files: %w", err))
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// deleteFile - responds with 204 once the file and all its chunks are gone,
+// with 202 if some chunks are left for the cleanup to remove and with 409 if the file was uploaded meanwhile
+func (s *Server) deleteFile(w http.ResponseWriter, r *http.Request) {
+	file := fileParam(r)
 
-	_, err := s.downloader.Download(r.Context(), file, w)
+	complete, err := s.deleter.Delete(r.Context(), chi.URLParam(r, "bucket"), file)
 	if err != nil {
-		// todo: check not found error
+		if errors.Is(err, metastore.ErrNotFound) {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+		if invalidName(err) {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		if errors.Is(err, deleter.ErrConflict) {
+			http.Error(w, http.StatusText(409), 409)
+			return
+		}
+		s.lg.Error(fmt.Errorf("error deleting file %s: %w", file, err))
 		http.Error(w, http.StatusText(500), 500)
 		return
 	}
+
+	if !complete {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
+// uploadFile - streams the "file" part of the multipart body straight to the uploader,
+// the body is never buffered as a whole, the optional redundancy query parameter
+// picks replication or erasure coding for this upload
 func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(s.cfg.MaxFileSize); err != nil {
-		s.lg.Error(fmt.Errorf("error parsing updloaded file: %w", err))
+	opts := uploader.UploadOptions{
+		Redundancy: uploader.Redundancy(r.URL.Query().Get("redundancy")),
+		UserMeta:   userMeta(r.Header),
+	}
+
+	if s.cfg.MaxFileSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxFileSize)
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		s.lg.Error(fmt.Errorf("error reading multipart body: %w", err))
 		http.Error(w, http.StatusText(400), 400)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	part, err := nextFilePart(mr)
 	if err != nil {
 		s.lg.Error(fmt.Errorf("error retrieving updloaded file: %w", err))
 		http.Error(w, http.StatusText(400), 400)
@@ -77,30 +328,402 @@ func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer func() {
-		if err := file.Close(); err != nil {
+		if err := part.Close(); err != nil {
 			s.lg.Error(err)
 		}
 	}()
 
-	s.lg.Debugf("uploaded file name: %s\n", header.Filename)
-	s.lg.Debugf("file size: %d\n", header.Size)
-	s.lg.Debugf("MIME header: %+v\n", header.Header)
+	s.lg.Debugf("uploaded file name: %s\n", part.FileName())
+	s.lg.Debugf("MIME header: %+v\n", part.Header)
+	opts.ContentType = part.Header.Get("Content-Type")
 
-	if err := s.uploader.Upload(r.Context(), file, header); err != nil {
-		http.Error(w, http.StatusText(500), 500)
-		s.lg.Error(fmt.Errorf("error processing updloaded file: %w", err))
+	if err := s.uploader.Upload(r.Context(), "", part.FileName(), part, opts); err != nil {
+		s.uploadFailed(w, err)
 		return
 	}
 
 	s.lg.Debugf("successfully uploaded file")
 }
 
+// uploadBucketFile - streams the raw body to the uploader as a file of the bucket,
+// the settings of the bucket decide how it is stored and how large it can be
+func (s *Server) uploadBucketFile(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.bucket(w, r)
+	if !ok {
+		return
+	}
+
+	opts := buckets.UploadOptions(b)
+	opts.UserMeta = userMeta(r.Header)
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		opts.ContentType = ct
+	}
+
+	if limit := s.uploadLimit(b); limit > 0 {
+		if r.ContentLength > limit {
+			http.Error(w, http.StatusText(413), 413)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	if err := s.uploader.Upload(r.Context(), b.Name, fileParam(r), r.Body, opts); err != nil {
+		s.uploadFailed(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// uploadLimit - the largest file the bucket takes, 0 for unlimited
+func (s *Server) uploadLimit(b *metastore.Bucket) int64 {
+	limit := s.cfg.MaxFileSize
+	if max := b.Settings.MaxObjectSize; max > 0 && (limit <= 0 || max < limit) {
+		limit = max
+	}
+	return limit
+}
+
+// uploadFailed - responds to an upload that could not be completed
+func (s *Server) uploadFailed(w http.ResponseWriter, err error) {
+	s.lg.Error(fmt.Errorf("error processing updloaded file: %w", err))
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		http.Error(w, http.StatusText(413), 413)
+	case errors.Is(err, uploader.ErrInvalidRedundancy),
+		errors.Is(err, uploader.ErrInvalidMetadata),
+		invalidName(err):
+		http.Error(w, http.StatusText(400), 400)
+	default:
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
+
+// invalidName - the file or the bucket name of the request cannot be stored
+func invalidName(err error) bool {
+	return errors.Is(err, multishard.ErrInvalidFilename) || errors.Is(err, multishard.ErrInvalidBucket)
+}
+
+// fileParam - the name of the file, it can have slashes of its own
+func fileParam(r *http.Request) string {
+	name := chi.URLParam(r, "*")
+	// routing is done on the escaped path when unescaping it would be ambiguous
+	if r.URL.RawPath != "" {
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			return unescaped
+		}
+	}
+	return name
+}
+
+// updateUserMeta - replaces the user metadata of the file with the X-Meta-* headers of the request,
+// a request without them removes it
+func (s *Server) updateUserMeta(w http.ResponseWriter, r *http.Request) {
+	file := fileParam(r)
+
+	if err := s.uploader.UpdateUserMeta(r.Context(), chi.URLParam(r, "bucket"), file, userMeta(r.Header)); err != nil {
+		switch {
+		case errors.Is(err, metastore.ErrNotFound):
+			http.Error(w, http.StatusText(404), 404)
+		case errors.Is(err, uploader.ErrInvalidMetadata), invalidName(err):
+			http.Error(w, http.StatusText(400), 400)
+		default:
+			s.lg.Error(fmt.Errorf("error updating metadata of file %s: %w", file, err))
+			http.Error(w, http.StatusText(500), 500)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userMeta - X-Meta-* headers keyed by the lowercase rest of their names
+func userMeta(h http.Header) map[string]string {
+	var meta map[string]string
+	for name, values := range h {
+		if len(name) <= len(userMetaPrefix) || !strings.EqualFold(name[:len(userMetaPrefix)], userMetaPrefix) {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.ToLower(name[len(userMetaPrefix):])] = strings.Join(values, ",")
+	}
+	return meta
+}
+
+// nextFilePart - skips parts of the multipart body until the "file" one
+func nextFilePart(mr *multipart.Reader) (*multipart.Part, error) {
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("no file field in the multipart body")
+			}
+			return nil, err
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			return part, nil
+		}
+		if err := part.Close(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// bucket - resolves the bucket of the request, responds on its own when it cannot
+func (s *Server) bucket(w http.ResponseWriter, r *http.Request) (*metastore.Bucket, bool) {
+	name := chi.URLParam(r, "bucket")
+
+	b, err := s.buckets.Get(r.Context(), name)
+	if err != nil {
+		s.bucketFailed(w, name, err)
+		return nil, false
+	}
+	return b, true
+}
+
+// bucketFailed - responds to a bucket request that could not be completed
+func (s *Server) bucketFailed(w http.ResponseWriter, name string, err error) {
+	switch {
+	case errors.Is(err, metastore.ErrNotFound):
+		http.Error(w, http.StatusText(404), 404)
+	case errors.Is(err, metastore.ErrAlreadyExists), errors.Is(err, metastore.ErrNotEmpty):
+		http.Error(w, err.Error(), 409)
+	case errors.Is(err, multishard.ErrInvalidBucket), errors.Is(err, buckets.ErrInvalidSettings):
+		http.Error(w, err.Error(), 400)
+	default:
+		s.lg.Error(fmt.Errorf("error handling bucket %s: %w", name, err))
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter, r *http.Request) {
+	result, err := s.buckets.List(r.Context())
+	if err != nil {
+		s.lg.Error(fmt.Errorf("error listing buckets: %w", err))
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"buckets": result})
+}
+
+// createBucket - the body holds the settings of the bucket, an empty one leaves all of them to the configuration
+func (s *Server) createBucket(w http.ResponseWriter, r *http.Request) {
+	settings, ok := bucketSettings(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := s.buckets.Create(r.Context(), chi.URLParam(r, "bucket"), settings)
+	if err != nil {
+		s.bucketFailed(w, chi.URLParam(r, "bucket"), err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, b)
+}
+
+func (s *Server) getBucket(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.bucket(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, b)
+}
+
+// updateBucket - replaces the settings of the bucket, stored files are not changed
+func (s *Server) updateBucket(w http.ResponseWriter, r *http.Request) {
+	settings, ok := bucketSettings(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := s.buckets.UpdateSettings(r.Context(), chi.URLParam(r, "bucket"), settings)
+	if err != nil {
+		s.bucketFailed(w, chi.URLParam(r, "bucket"), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, b)
+}
+
+// deleteBucket - responds with 409 while the bucket has files
+func (s *Server) deleteBucket(w http.ResponseWriter, r *http.Request) {
+	if err := s.buckets.Delete(r.Context(), chi.URLParam(r, "bucket")); err != nil {
+		s.bucketFailed(w, chi.URLParam(r, "bucket"), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func bucketSettings(w http.ResponseWriter, r *http.Request) (metastore.BucketSettings, bool) {
+	var settings metastore.BucketSettings
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&settings); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("invalid bucket settings: %v", err), 400)
+		return settings, false
+	}
+	return settings, true
+}
+
+// rebalanceProgress - reports how far the current or the last rebalance got
+func (s *Server) rebalanceProgress(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.rebalancer.Progress())
+}
+
+// startRebalance - starts moving chunks to their owners in the background,
+// responds with 409 when a rebalance is already running
+func (s *Server) startRebalance(w http.ResponseWriter, _ *http.Request) {
+	if err := s.rebalancer.Trigger(); err != nil {
+		if errors.Is(err, rebalancer.ErrAlreadyRunning) {
+			http.Error(w, http.StatusText(409), 409)
+			return
+		}
+		s.lg.Error(fmt.Errorf("error starting rebalance: %w", err))
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// gcReport - reports what the current or the last garbage collection found and did
+func (s *Server) gcReport(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.collector.Report())
+}
+
+// startGC - starts a garbage collection in the background, dry_run=true only reports
+// and repair=true writes broken chunks again, responds with 409 when one is already running
+func (s *Server) startGC(w http.ResponseWriter, r *http.Request) {
+	var opts gc.Options
+	for name, v := range map[string]*bool{"dry_run": &opts.DryRun, "repair": &opts.Repair} {
+		if param := r.URL.Query().Get(name); param != "" {
+			b, err := strconv.ParseBool(param)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s", name), 400)
+				return
+			}
+			*v = b
+		}
+	}
+
+	if err := s.collector.Trigger(opts); err != nil {
+		if errors.Is(err, gc.ErrAlreadyRunning) {
+			http.Error(w, http.StatusText(409), 409)
+			return
+		}
+		s.lg.Error(fmt.Errorf("error starting garbage collection: %w", err))
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// drainServer - stops placing chunks on the server and moves its chunks away in the background,
+// responds with 409 when too few servers would be left for the chunks
+func (s *Server) drainServer(w http.ResponseWriter, r *http.Request) {
+	server, ok := serverParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.rebalancer.Drain(r.Context(), server); err != nil {
+		switch {
+		case errors.Is(err, topology.ErrUnknownServer):
+			http.Error(w, http.StatusText(404), 404)
+		case errors.Is(err, rebalancer.ErrCannotDrain):
+			http.Error(w, err.Error(), 409)
+		default:
+			s.lg.Error(fmt.Errorf("error draining server %d: %w", server, err))
+			http.Error(w, http.StatusText(500), 500)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// drainStatus - reports whether the draining server is still referenced and can be removed
+func (s *Server) drainStatus(w http.ResponseWriter, r *http.Request) {
+	server, ok := serverParam(w, r)
+	if !ok {
+		return
+	}
+
+	status, err := s.rebalancer.DrainStatus(r.Context(), server)
+	if err != nil {
+		if errors.Is(err, topology.ErrUnknownServer) || errors.Is(err, rebalancer.ErrNotDraining) {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+		s.lg.Error(fmt.Errorf("error checking drain of server %d: %w", server, err))
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func serverParam(w http.ResponseWriter, r *http.Request) (multishard.ServerIdx, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "server"), 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return 0, false
+	}
+	return multishard.ServerIdx(id), true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
 func (s *Server) setupRoutes() {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Put("/files/upload", s.uploadFile)
-	r.Get("/files/{file}", s.downloadFile)
+	r.Get("/files", s.listFiles)
+	r.Get("/files/*", s.downloadFile)
+	r.Head("/files/*", s.headFile)
+	r.Delete("/files/*", s.deleteFile)
+	r.Patch("/files/*", s.updateUserMeta)
+	r.Get("/buckets", s.listBuckets)
+	r.Route("/buckets/{bucket}", func(r chi.Router) {
+		r.Get("/", s.getBucket)
+		r.Put("/", s.createBucket)
+		r.Patch("/", s.updateBucket)
+		r.Delete("/", s.deleteBucket)
+		r.Get("/files", s.listFiles)
+		r.Put("/files/*", s.uploadBucketFile)
+		r.Get("/files/*", s.downloadFile)
+		r.Head("/files/*", s.headFile)
+		r.Delete("/files/*", s.deleteFile)
+		r.Patch("/files/*", s.updateUserMeta)
+		r.With(tusResumable).Post("/resumable", s.createResumable)
+	})
+	r.Route("/resumable", func(r chi.Router) {
+		r.Use(tusResumable)
+		r.Options("/", s.tusOptions)
+		r.Post("/", s.createResumable)
+		r.Head("/{upload}", s.headResumable)
+		r.Patch("/{upload}", s.patchResumable)
+		r.Delete("/{upload}", s.terminateResumable)
+	})
+	r.Get("/admin/rebalance", s.rebalanceProgress)
+	r.Post("/admin/rebalance", s.startRebalance)
+	r.Get("/admin/gc", s.gcReport)
+	r.Post("/admin/gc", s.startGC)
+	r.Get("/admin/servers/{server}/drain", s.drainStatus)
+	r.Post("/admin/servers/{server}/drain", s.drainServer)
 	s.router = r
 }
 
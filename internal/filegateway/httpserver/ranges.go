@@ -0,0 +1,187 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/downloader"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errUnsatisfiableRange = errors.New("none of the ranges overlap the file")
+
+// byteRange - a range of the file that was asked for, length is never zero
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+// requestedRanges - ranges of the Range header that apply to the file,
+// none when the whole file has to be sent: there is no Range header, it is malformed,
+// the If-Range condition does not hold or the ranges add up to more than the file
+func requestedRanges(r *http.Request, info *downloader.FileInfo) ([]byteRange, error) {
+	header := r.Header.Get("Range")
+	if header == "" || !ifRangeHolds(r.Header.Get("If-Range"), info) {
+		return nil, nil
+	}
+
+	ranges, err := parseRange(header, info.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, br := range ranges {
+		total += br.length
+	}
+	if total > info.Size {
+		return nil, nil
+	}
+
+	return ranges, nil
+}
+
+// ifRangeHolds - the If-Range header is either a strong ETag or a date the file must still match
+func ifRangeHolds(ifRange string, info *downloader.FileInfo) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return ifRange == info.ETag
+	}
+
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	return info.ModifiedAt.Truncate(time.Second).Equal(t)
+}
+
+// parseRange - parses "bytes=" ranges of the Range header against the size of the file,
+// ranges that start past the end are dropped, if none is left the request cannot be satisfied,
+// a malformed header yields no ranges and no error, so it is ignored
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	for _, rs := range strings.Split(spec, ",") {
+		rs = strings.TrimSpace(rs)
+		if rs == "" {
+			continue
+		}
+
+		first, last, ok := strings.Cut(rs, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		if first == "" {
+			// suffix range, the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			ranges = append(ranges, byteRange{start: size - n, length: n})
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, nil
+		}
+		end := size - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, nil
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+
+	return ranges, nil
+}
+
+// multipartRanges - writes the ranges as a multipart/byteranges body, with a nil download func
+// only the framing is written, which is how the length of the body is known upfront
+func multipartRanges(
+	w io.Writer,
+	boundary string,
+	info *downloader.FileInfo,
+	ranges []byteRange,
+	download func(br byteRange, w io.Writer) error,
+) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	for _, br := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {info.ContentType},
+			"Content-Range": {br.contentRange(info.Size)},
+		})
+		if err != nil {
+			return err
+		}
+		if download != nil {
+			if err := download(br, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	return mw.Close()
+}
+
+// multipartRangesLength - the length of the multipart/byteranges body of the ranges
+func multipartRangesLength(boundary string, info *downloader.FileInfo, ranges []byteRange) (int64, error) {
+	cw := &countingWriter{}
+	if err := multipartRanges(cw, boundary, info, ranges, nil); err != nil {
+		return 0, err
+	}
+
+	length := cw.n
+	for _, br := range ranges {
+		length += br.length
+	}
+	return length, nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,104 @@
+package httpserver
+
+import (
+	"bytes"
+	"errors"
+	"github.com/denismitr/shardstore/internal/filegateway/downloader"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tt := []struct {
+		header string
+		want   []byteRange
+		err    error
+	}{
+		{header: "bytes=0-4", want: []byteRange{{start: 0, length: 5}}},
+		{header: "bytes=5-", want: []byteRange{{start: 5, length: 5}}},
+		{header: "bytes=-3", want: []byteRange{{start: 7, length: 3}}},
+		{header: "bytes=-30", want: []byteRange{{start: 0, length: 10}}},
+		{header: "bytes=8-20", want: []byteRange{{start: 8, length: 2}}},
+		{header: "bytes=0-1, 4-5,-1", want: []byteRange{{start: 0, length: 2}, {start: 4, length: 2}, {start: 9, length: 1}}},
+		{header: "bytes=0-1,10-12", want: []byteRange{{start: 0, length: 2}}},
+		{header: "bytes=10-12", err: errUnsatisfiableRange},
+		{header: "bytes=-0", err: errUnsatisfiableRange},
+		{header: "bytes=5-4"},
+		{header: "bytes=abc"},
+		{header: "items=0-4"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.header, func(t *testing.T) {
+			got, err := parseRange(tc.header, 10)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("parseRange() error = %v, want %v", err, tc.err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseRange() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequestedRanges_IfRange(t *testing.T) {
+	modifiedAt := time.Date(2023, 3, 1, 10, 0, 0, 500, time.UTC)
+	info := &downloader.FileInfo{Size: 10, ETag: `"abc"`, ModifiedAt: modifiedAt}
+
+	tt := []struct {
+		name    string
+		ifRange string
+		ranged  bool
+	}{
+		{name: "no condition", ranged: true},
+		{name: "matching etag", ifRange: `"abc"`, ranged: true},
+		{name: "changed etag", ifRange: `"def"`},
+		{name: "weak etag", ifRange: `W/"abc"`},
+		{name: "matching date", ifRange: modifiedAt.Format(http.TimeFormat), ranged: true},
+		{name: "older date", ifRange: modifiedAt.Add(-time.Hour).Format(http.TimeFormat)},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/files/file.txt", nil)
+			r.Header.Set("Range", "bytes=0-4")
+			if tc.ifRange != "" {
+				r.Header.Set("If-Range", tc.ifRange)
+			}
+
+			ranges, err := requestedRanges(r, info)
+			if err != nil {
+				t.Fatalf("requestedRanges() error = %v", err)
+			}
+			if got := len(ranges) == 1; got != tc.ranged {
+				t.Errorf("requestedRanges() = %+v, want ranged %v", ranges, tc.ranged)
+			}
+		})
+	}
+}
+
+func TestMultipartRangesLength(t *testing.T) {
+	content := []byte("0123456789")
+	info := &downloader.FileInfo{Size: int64(len(content)), ContentType: "text/plain"}
+	ranges := []byteRange{{start: 0, length: 2}, {start: 7, length: 3}}
+
+	length, err := multipartRangesLength("boundary", info, ranges)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = multipartRanges(&buf, "boundary", info, ranges, func(br byteRange, w io.Writer) error {
+		_, err := w.Write(content[br.start : br.start+br.length])
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(buf.Len()) != length {
+		t.Errorf("multipartRangesLength() = %d, the body has %d bytes", length, buf.Len())
+	}
+}
@@ -0,0 +1,642 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/buckets"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/deleter"
+	"github.com/denismitr/shardstore/internal/filegateway/downloader"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/uploader"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	amzMetaPrefix   = "X-Amz-Meta-"
+	maxS3ListKeys   = 1000
+	listTypeV2      = "2"
+	urlEncodingType = "url"
+)
+
+type s3Uploader interface {
+	fileUploader
+	CreateMultipartUpload(ctx context.Context, bucket, fileName string, opts uploader.UploadOptions) (*metastore.MultipartUpload, error)
+	GetMultipartUpload(ctx context.Context, uploadID string) (*metastore.MultipartUpload, error)
+	UploadPart(ctx context.Context, uploadID string, partNumber int, r io.Reader, opts uploader.UploadOptions) (*metastore.ShardPlan, error)
+	CompleteMultipartUpload(ctx context.Context, uploadID string, parts []uploader.CompletedPart) (*metastore.ShardPlan, error)
+	AbortMultipartUpload(ctx context.Context, uploadID string) error
+}
+
+type signingContextKey struct{}
+
+// S3Server - serves a subset of the S3 API on a port of its own, path-style only, /{bucket}/{key},
+// every request has to be signed with AWS Signature Version 4 by the configured key pair
+type S3Server struct {
+	cfg        *config.Config
+	lg         logger.Logger
+	router     *chi.Mux
+	uploader   s3Uploader
+	downloader fileDownloader
+	deleter    fileDeleter
+	buckets    bucketManager
+	auth       *sigV4Verifier
+}
+
+func NewS3Server(
+	cfg *config.Config,
+	lg logger.Logger,
+	fu s3Uploader,
+	fd fileDownloader,
+	fdel fileDeleter,
+	bm bucketManager,
+) *S3Server {
+	s := &S3Server{
+		cfg:        cfg,
+		lg:         lg,
+		uploader:   fu,
+		downloader: fd,
+		deleter:    fdel,
+		buckets:    bm,
+		auth: &sigV4Verifier{
+			accessKey: cfg.S3AccessKey,
+			secretKey: cfg.S3SecretKey,
+			region:    cfg.S3Region,
+			now:       time.Now,
+		},
+	}
+	s.setupRoutes()
+	return s
+}
+
+// authenticate - every response carries the request id, only signed requests get past it
+func (s *S3Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(requestIDHeader, middleware.GetReqID(r.Context()))
+
+		sc, err := s.auth.verify(r)
+		if err != nil {
+			s.failed(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signingContextKey{}, sc)))
+	})
+}
+
+// failed - responds with the S3 error the failure maps to
+func (s *S3Server) failed(w http.ResponseWriter, r *http.Request, err error) {
+	var s3Err *s3Error
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &s3Err):
+	case errors.As(err, &maxBytesErr):
+		s3Err = errEntityTooLarge
+	case errors.Is(err, multishard.ErrInvalidBucket):
+		s3Err = errInvalidBucketName
+	case errors.Is(err, multishard.ErrInvalidFilename):
+		s3Err = errInvalidKey
+	case errors.Is(err, uploader.ErrInvalidMetadata):
+		s3Err = errMetadataTooLarge
+	case errors.Is(err, uploader.ErrNoSuchUpload):
+		s3Err = errNoSuchUpload
+	case errors.Is(err, uploader.ErrInvalidPart):
+		s3Err = s3Errorf(errInvalidPart, "%v", err)
+	case errors.Is(err, deleter.ErrConflict):
+		s3Err = errOperationAborted
+	default:
+		s.lg.Error(fmt.Errorf("error handling s3 request %s %s: %w", r.Method, r.URL.Path, err))
+		s3Err = errInternal
+	}
+
+	writeS3Error(w, r, s3Err)
+}
+
+// bucket - resolves the bucket of the request, responds on its own when it cannot
+func (s *S3Server) bucket(w http.ResponseWriter, r *http.Request) (*metastore.Bucket, bool) {
+	b, err := s.buckets.Get(r.Context(), chi.URLParam(r, "bucket"))
+	if err != nil {
+		if errors.Is(err, metastore.ErrNotFound) {
+			err = errNoSuchBucket
+		}
+		s.failed(w, r, err)
+		return nil, false
+	}
+	return b, true
+}
+
+// body - the verified content of the request, limited by the configuration and the settings of the bucket
+func (s *S3Server) body(w http.ResponseWriter, r *http.Request, b *metastore.Bucket) (io.Reader, bool) {
+	body, length, err := s3Body(r, r.Context().Value(signingContextKey{}).(*signingContext))
+	if err != nil {
+		s.failed(w, r, err)
+		return nil, false
+	}
+
+	limit := s.cfg.MaxFileSize
+	if max := b.Settings.MaxObjectSize; max > 0 && (limit <= 0 || max < limit) {
+		limit = max
+	}
+	if limit > 0 {
+		if length > limit {
+			s.failed(w, r, errEntityTooLarge)
+			return nil, false
+		}
+		body = http.MaxBytesReader(w, io.NopCloser(body), limit)
+	}
+
+	return body, true
+}
+
+// uploadOptions - the settings of the bucket with the content type and the metadata of the request
+func uploadOptions(r *http.Request, b *metastore.Bucket) uploader.UploadOptions {
+	opts := buckets.UploadOptions(b)
+	opts.UserMeta = amzMeta(r.Header)
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		opts.ContentType = ct
+	}
+	return opts
+}
+
+// amzMeta - x-amz-meta-* headers keyed by the lowercase rest of their names
+func amzMeta(h http.Header) map[string]string {
+	var meta map[string]string
+	for name, values := range h {
+		if len(name) <= len(amzMetaPrefix) || !strings.EqualFold(name[:len(amzMetaPrefix)], amzMetaPrefix) {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.ToLower(name[len(amzMetaPrefix):])] = strings.Join(values, ",")
+	}
+	return meta
+}
+
+func (s *S3Server) listBuckets(w http.ResponseWriter, r *http.Request) {
+	list, err := s.buckets.List(r.Context())
+	if err != nil {
+		s.failed(w, r, err)
+		return
+	}
+
+	result := &listAllMyBucketsResult{Owner: s3Owner{ID: s.cfg.S3AccessKey, DisplayName: s.cfg.AppName}}
+	for _, b := range list {
+		result.Buckets = append(result.Buckets, s3Bucket{Name: b.Name, CreationDate: s3Time(b.CreatedAt)})
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+// createBucket - the bucket gets the settings of the configuration, the location constraint is ignored
+func (s *S3Server) createBucket(w http.ResponseWriter, r *http.Request) {
+	if len(r.URL.Query()) > 0 {
+		s.failed(w, r, errNotImplemented)
+		return
+	}
+
+	name := chi.URLParam(r, "bucket")
+	if _, err := s.buckets.Create(r.Context(), name, metastore.BucketSettings{}); err != nil {
+		if errors.Is(err, metastore.ErrAlreadyExists) {
+			err = errBucketAlreadyOwnedByYou
+		}
+		s.failed(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", "/"+name)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3Server) headBucket(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.bucket(w, r); !ok {
+		return
+	}
+
+	w.Header().Set("X-Amz-Bucket-Region", s.cfg.S3Region)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3Server) deleteBucket(w http.ResponseWriter, r *http.Request) {
+	if len(r.URL.Query()) > 0 {
+		s.failed(w, r, errNotImplemented)
+		return
+	}
+
+	if err := s.buckets.Delete(r.Context(), chi.URLParam(r, "bucket")); err != nil {
+		switch {
+		case errors.Is(err, metastore.ErrNotFound):
+			err = errNoSuchBucket
+		case errors.Is(err, metastore.ErrNotEmpty):
+			err = errBucketNotEmpty
+		}
+		s.failed(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getBucket - ListObjectsV2 and the location of the bucket, other subresources are not implemented
+func (s *S3Server) getBucket(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch {
+	case q.Has("location"):
+		if _, ok := s.bucket(w, r); !ok {
+			return
+		}
+		// us-east-1 is the one region without a location constraint
+		location := s.cfg.S3Region
+		if location == "us-east-1" {
+			location = ""
+		}
+		writeXML(w, http.StatusOK, &locationConstraint{Location: location})
+	case q.Get("list-type") == listTypeV2:
+		s.listObjects(w, r)
+	default:
+		s.failed(w, r, errNotImplemented)
+	}
+}
+
+// listObjects - ListObjectsV2, the continuation token is the cursor of the downloader listing
+func (s *S3Server) listObjects(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	b, ok := s.bucket(w, r)
+	if !ok {
+		return
+	}
+
+	encodingType := q.Get("encoding-type")
+	if encodingType != "" && encodingType != urlEncodingType {
+		s.failed(w, r, s3Errorf(errInvalidArgument, "invalid encoding type %q", encodingType))
+		return
+	}
+
+	maxKeys := maxS3ListKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s.failed(w, r, s3Errorf(errInvalidArgument, "max-keys has to be a non negative number"))
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	encode := func(v string) string {
+		if encodingType == urlEncodingType {
+			return url.QueryEscape(v)
+		}
+		return v
+	}
+
+	result := &listBucketResultV2{
+		Name:              b.Name,
+		Prefix:            encode(q.Get("prefix")),
+		Delimiter:         encode(q.Get("delimiter")),
+		StartAfter:        encode(q.Get("start-after")),
+		EncodingType:      encodingType,
+		MaxKeys:           maxKeys,
+		ContinuationToken: q.Get("continuation-token"),
+	}
+	if maxKeys == 0 {
+		writeXML(w, http.StatusOK, result)
+		return
+	}
+
+	list, err := s.downloader.List(r.Context(), downloader.ListOptions{
+		Bucket:     b.Name,
+		Prefix:     q.Get("prefix"),
+		Delimiter:  q.Get("delimiter"),
+		Limit:      maxKeys,
+		Cursor:     q.Get("continuation-token"),
+		StartAfter: q.Get("start-after"),
+	})
+	if err != nil {
+		if errors.Is(err, downloader.ErrInvalidCursor) {
+			err = s3Errorf(errInvalidArgument, "the continuation token provided is incorrect")
+		}
+		s.failed(w, r, err)
+		return
+	}
+
+	for _, f := range list.Files {
+		result.Contents = append(result.Contents, s3Object{
+			Key:          encode(f.Name),
+			LastModified: s3Time(f.ModifiedAt),
+			ETag:         f.ETag,
+			Size:         f.Size,
+			StorageClass: s3StorageClass,
+		})
+	}
+	for _, prefix := range list.CommonPrefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(prefix)})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	result.IsTruncated = list.Truncated
+	result.NextContinuationToken = list.NextCursor
+
+	writeXML(w, http.StatusOK, result)
+}
+
+// putObject - PutObject, or UploadPart when the query names the upload and the part
+func (s *S3Server) putObject(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		s.failed(w, r, s3Errorf(errNotImplemented, "copying objects is not implemented"))
+		return
+	}
+	if q.Has("uploadId") || q.Has("partNumber") {
+		s.uploadPart(w, r)
+		return
+	}
+	if len(q) > 0 {
+		s.failed(w, r, errNotImplemented)
+		return
+	}
+
+	b, ok := s.bucket(w, r)
+	if !ok {
+		return
+	}
+	body, ok := s.body(w, r, b)
+	if !ok {
+		return
+	}
+
+	key := fileParam(r)
+	if err := s.uploader.Upload(r.Context(), b.Name, key, body, uploadOptions(r, b)); err != nil {
+		s.failed(w, r, err)
+		return
+	}
+
+	info, err := s.downloader.Stat(r.Context(), b.Name, key)
+	if err != nil {
+		s.failed(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", info.ETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// statObject - resolves the object for GET and HEAD, responds on its own when it cannot
+func (s *S3Server) statObject(w http.ResponseWriter, r *http.Request) (*downloader.FileInfo, bool) {
+	b, ok := s.bucket(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	info, err := s.downloader.Stat(r.Context(), b.Name, fileParam(r))
+	if err != nil {
+		if errors.Is(err, metastore.ErrNotFound) {
+			err = errNoSuchKey
+		}
+		s.failed(w, r, err)
+		return nil, false
+	}
+	return info, true
+}
+
+// setObjectHeaders - headers have to be set before the status is written
+func setObjectHeaders(w http.ResponseWriter, info *downloader.FileInfo) {
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Last-Modified", info.ModifiedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", info.ETag)
+	w.Header().Set("Accept-Ranges", "bytes")
+	for k, v := range info.UserMeta {
+		w.Header().Set(amzMetaPrefix+k, v)
+	}
+}
+
+func (s *S3Server) headObject(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.statObject(w, r)
+	if !ok {
+		return
+	}
+
+	setObjectHeaders(w, info)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getObject - the whole object or a single range of it, several ranges are not supported by S3 either
+// so the whole object is sent for them
+func (s *S3Server) getObject(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.statObject(w, r)
+	if !ok {
+		return
+	}
+
+	ranges, err := requestedRanges(r, info)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		s.failed(w, r, errInvalidRange)
+		return
+	}
+
+	setObjectHeaders(w, info)
+	if len(ranges) == 1 {
+		w.Header().Set("Content-Range", ranges[0].contentRange(info.Size))
+		w.Header().Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		_, err = s.downloader.DownloadRange(r.Context(), info, ranges[0].start, ranges[0].length, w)
+	} else {
+		w.WriteHeader(http.StatusOK)
+		_, err = s.downloader.Download(r.Context(), info, w)
+	}
+
+	if err != nil {
+		// the status is already sent, the client can only learn
+		// about the failure from the connection being cut short
+		s.lg.Error(fmt.Errorf("error downloading object %s: %w", info.Name, err))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// deleteObject - DeleteObject succeeds for objects that do not exist, AbortMultipartUpload when the query names an upload
+func (s *S3Server) deleteObject(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("uploadId") {
+		s.abortMultipartUpload(w, r)
+		return
+	}
+
+	b, ok := s.bucket(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := s.deleter.Delete(r.Context(), b.Name, fileParam(r)); err != nil && !errors.Is(err, metastore.ErrNotFound) {
+		s.failed(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postObject - CreateMultipartUpload with ?uploads and CompleteMultipartUpload with ?uploadId
+func (s *S3Server) postObject(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch {
+	case q.Has("uploads"):
+		s.createMultipartUpload(w, r)
+	case q.Has("uploadId"):
+		s.completeMultipartUpload(w, r)
+	default:
+		s.failed(w, r, errNotImplemented)
+	}
+}
+
+func (s *S3Server) createMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.bucket(w, r)
+	if !ok {
+		return
+	}
+
+	key := fileParam(r)
+	mu, err := s.uploader.CreateMultipartUpload(r.Context(), b.Name, key, uploadOptions(r, b))
+	if err != nil {
+		s.failed(w, r, err)
+		return
+	}
+
+	writeXML(w, http.StatusOK, &initiateMultipartUploadResult{Bucket: b.Name, Key: key, UploadID: mu.ID})
+}
+
+// multipartUpload - resolves the upload of the query, it has to be an upload of the object of the path
+func (s *S3Server) multipartUpload(w http.ResponseWriter, r *http.Request) (*metastore.Bucket, *metastore.MultipartUpload, bool) {
+	b, ok := s.bucket(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	mu, err := s.uploader.GetMultipartUpload(r.Context(), r.URL.Query().Get("uploadId"))
+	if err != nil {
+		s.failed(w, r, err)
+		return nil, nil, false
+	}
+	if mu.Bucket != b.Name || mu.Name != fileParam(r) {
+		s.failed(w, r, errNoSuchUpload)
+		return nil, nil, false
+	}
+	return b, mu, true
+}
+
+func (s *S3Server) uploadPart(w http.ResponseWriter, r *http.Request) {
+	b, mu, ok := s.multipartUpload(w, r)
+	if !ok {
+		return
+	}
+
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > uploader.MaxPartNumber {
+		s.failed(w, r, s3Errorf(errInvalidArgument, "part number must be an integer between 1 and %d", uploader.MaxPartNumber))
+		return
+	}
+
+	body, ok := s.body(w, r, b)
+	if !ok {
+		return
+	}
+
+	plan, err := s.uploader.UploadPart(r.Context(), mu.ID, partNumber, body, buckets.UploadOptions(b))
+	if err != nil {
+		s.failed(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", uploader.PartETag(plan))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	b, mu, ok := s.multipartUpload(w, r)
+	if !ok {
+		return
+	}
+
+	var req completeMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(r.Body, maxS3RequestBody)).Decode(&req); err != nil {
+		s.failed(w, r, errMalformedXML)
+		return
+	}
+
+	parts := make([]uploader.CompletedPart, len(req.Parts))
+	for i, p := range req.Parts {
+		parts[i] = uploader.CompletedPart{Number: p.PartNumber, ETag: p.ETag}
+	}
+
+	if _, err := s.uploader.CompleteMultipartUpload(r.Context(), mu.ID, parts); err != nil {
+		s.failed(w, r, err)
+		return
+	}
+
+	info, err := s.downloader.Stat(r.Context(), b.Name, mu.Name)
+	if err != nil {
+		s.failed(w, r, err)
+		return
+	}
+
+	writeXML(w, http.StatusOK, &completeMultipartUploadResult{
+		Location: "/" + b.Name + "/" + mu.Name,
+		Bucket:   b.Name,
+		Key:      mu.Name,
+		ETag:     info.ETag,
+	})
+}
+
+func (s *S3Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	_, mu, ok := s.multipartUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.uploader.AbortMultipartUpload(r.Context(), mu.ID); err != nil {
+		s.failed(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *S3Server) setupRoutes() {
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(middleware.Logger)
+	r.Use(middleware.Recoverer)
+	r.Use(s.authenticate)
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeS3Error(w, r, errNotImplemented)
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeS3Error(w, r, errMethodNotAllowed)
+	})
+	r.Get("/", s.listBuckets)
+	r.Route("/{bucket}", func(r chi.Router) {
+		r.Put("/", s.createBucket)
+		r.Head("/", s.headBucket)
+		r.Get("/", s.getBucket)
+		r.Delete("/", s.deleteBucket)
+		r.Put("/*", s.putObject)
+		r.Get("/*", s.getObject)
+		r.Head("/*", s.headObject)
+		r.Delete("/*", s.deleteObject)
+		r.Post("/*", s.postObject)
+	})
+	s.router = r
+}
+
+func (s *S3Server) Start() error {
+	return http.ListenAndServe(fmt.Sprintf(":%d", s.cfg.S3Port), s.router)
+}
@@ -0,0 +1,299 @@
+package httpserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	scopeDateFormat = "20060102"
+	s3Service       = "s3"
+	scopeTerminator = "aws4_request"
+	maxClockSkew    = 15 * time.Minute
+	maxPresignedAge = 7 * 24 * time.Hour
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256              = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// sigV4Verifier - checks AWS Signature Version 4 of requests signed in the Authorization header
+// or in the query of a presigned url, with the single key pair of the configuration
+type sigV4Verifier struct {
+	accessKey string
+	secretKey string
+	region    string
+	now       func() time.Time
+}
+
+// signingContext - what a verified request was signed with, signatures of streamed chunks are chained to it
+type signingContext struct {
+	date      time.Time
+	scope     string
+	key       []byte
+	signature string
+	// payload - the x-amz-content-sha256 of the request, what the body is checked against
+	payload string
+}
+
+// sigV4Request - the signature parts of a request, wherever they were sent
+type sigV4Request struct {
+	accessKey     string
+	scopeDate     string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	date          time.Time
+	payload       string
+	presigned     bool
+}
+
+func (v *sigV4Verifier) verify(r *http.Request) (*signingContext, error) {
+	var req *sigV4Request
+	var err error
+	if r.URL.Query().Has("X-Amz-Signature") {
+		req, err = v.parsePresigned(r)
+	} else {
+		req, err = v.parseAuthorization(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if req.accessKey != v.accessKey {
+		return nil, s3Errorf(errInvalidAccessKeyID, "the access key %s does not exist", req.accessKey)
+	}
+	if req.service != s3Service || req.region != v.region || req.scopeDate != req.date.Format(scopeDateFormat) {
+		return nil, s3Errorf(errAuthorizationMalformed, "the credential scope %s/%s/%s is wrong, expecting %s/%s/%s",
+			req.scopeDate, req.region, req.service, req.date.Format(scopeDateFormat), v.region, s3Service)
+	}
+	if !containsString(req.signedHeaders, "host") {
+		return nil, s3Errorf(errAuthorizationMalformed, "the host header has to be signed")
+	}
+
+	scope := strings.Join([]string{req.scopeDate, req.region, req.service, scopeTerminator}, "/")
+	canonical := canonicalRequest(r, req.signedHeaders, req.payload, req.presigned)
+	stringToSign := strings.Join([]string{sigV4Algorithm, req.date.Format(amzDateFormat), scope, hexSHA256([]byte(canonical))}, "\n")
+	key := signingKey(v.secretKey, req.scopeDate, req.region, req.service)
+
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(req.signature)) {
+		return nil, s3Errorf(errSignatureDoesNotMatch, "the request signature does not match the one calculated with the secret key")
+	}
+
+	return &signingContext{date: req.date, scope: scope, key: key, signature: req.signature, payload: req.payload}, nil
+}
+
+// parseAuthorization - AWS4-HMAC-SHA256 Credential=<key>/<date>/<region>/s3/aws4_request, SignedHeaders=<a;b>, Signature=<hex>
+func (v *sigV4Verifier) parseAuthorization(r *http.Request) (*sigV4Request, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, s3Errorf(errAccessDenied, "anonymous access is not allowed")
+	}
+
+	algorithm, fields, _ := strings.Cut(auth, " ")
+	if algorithm != sigV4Algorithm {
+		return nil, s3Errorf(errAuthorizationMalformed, "only %s is supported", sigV4Algorithm)
+	}
+
+	req := &sigV4Request{}
+	for _, field := range strings.Split(fields, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch name {
+		case "Credential":
+			if err := req.parseCredential(value); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			req.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			req.signature = value
+		}
+	}
+	if req.accessKey == "" || len(req.signedHeaders) == 0 || req.signature == "" {
+		return nil, s3Errorf(errAuthorizationMalformed, "the authorization header lacks the credential, signed headers or signature")
+	}
+
+	date, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, s3Errorf(errAccessDenied, "a valid x-amz-date header is required")
+	}
+	if skew := v.now().Sub(date); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, s3Errorf(errRequestTimeTooSkewed, "the difference between the request time and the server time is too large")
+	}
+	req.date = date
+
+	req.payload = r.Header.Get("X-Amz-Content-Sha256")
+	if req.payload == "" {
+		return nil, s3Errorf(errInvalidRequest, "the x-amz-content-sha256 header is required")
+	}
+
+	return req, nil
+}
+
+// parsePresigned - the signature and the credential are query parameters, the payload is never signed
+func (v *sigV4Verifier) parsePresigned(r *http.Request) (*sigV4Request, error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, s3Errorf(errAuthorizationQueryMalformed, "only %s is supported", sigV4Algorithm)
+	}
+
+	req := &sigV4Request{
+		signedHeaders: strings.Split(q.Get("X-Amz-SignedHeaders"), ";"),
+		signature:     q.Get("X-Amz-Signature"),
+		payload:       unsignedPayload,
+		presigned:     true,
+	}
+	if err := req.parseCredential(q.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+
+	date, err := time.Parse(amzDateFormat, q.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, s3Errorf(errAuthorizationQueryMalformed, "X-Amz-Date is not a valid date")
+	}
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expires <= 0 || time.Duration(expires)*time.Second > maxPresignedAge {
+		return nil, s3Errorf(errAuthorizationQueryMalformed, "X-Amz-Expires has to be 1 to %d seconds", int(maxPresignedAge.Seconds()))
+	}
+	now := v.now()
+	if date.Sub(now) > maxClockSkew {
+		return nil, s3Errorf(errRequestTimeTooSkewed, "the request is dated in the future")
+	}
+	if now.After(date.Add(time.Duration(expires) * time.Second)) {
+		return nil, s3Errorf(errAccessDenied, "the request has expired")
+	}
+	req.date = date
+
+	if payload := r.Header.Get("X-Amz-Content-Sha256"); payload != "" {
+		req.payload = payload
+	}
+
+	return req, nil
+}
+
+// parseCredential - <key>/<date>/<region>/<service>/aws4_request
+func (req *sigV4Request) parseCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != scopeTerminator {
+		return s3Errorf(errAuthorizationMalformed, "the credential %q is malformed", credential)
+	}
+	req.accessKey, req.scopeDate, req.region, req.service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+// canonicalRequest - the request the way the client saw it when signing,
+// the path is encoded as the client encodes it since S3 keys are not encoded twice
+func canonicalRequest(r *http.Request, signedHeaders []string, payload string, presigned bool) string {
+	var sb strings.Builder
+	sb.WriteString(r.Method)
+	sb.WriteByte('\n')
+	sb.WriteString(awsURIEncode(r.URL.Path, false))
+	sb.WriteByte('\n')
+	sb.WriteString(canonicalQuery(r.URL.Query(), presigned))
+	sb.WriteByte('\n')
+	for _, name := range signedHeaders {
+		sb.WriteString(name)
+		sb.WriteByte(':')
+		sb.WriteString(canonicalHeaderValue(r, name))
+		sb.WriteByte('\n')
+	}
+	sb.WriteByte('\n')
+	sb.WriteString(strings.Join(signedHeaders, ";"))
+	sb.WriteByte('\n')
+	sb.WriteString(payload)
+	return sb.String()
+}
+
+// canonicalQuery - parameters sorted by name and value, both encoded, without the signature of a presigned url
+func canonicalQuery(q url.Values, presigned bool) string {
+	var params []string
+	for name, values := range q {
+		if presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// canonicalHeaderValue - values trimmed, with inner runs of spaces collapsed, and joined with commas
+func canonicalHeaderValue(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		values = []string{r.Host}
+	case "content-length":
+		values = r.Header.Values(name)
+		if len(values) == 0 {
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		}
+	default:
+		values = r.Header.Values(name)
+	}
+
+	for i, v := range values {
+		values[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+// awsURIEncode - every byte but unreserved characters is percent-encoded, slashes too unless it is a path
+func awsURIEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, scopeTerminator)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
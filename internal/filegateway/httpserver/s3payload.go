@@ -0,0 +1,322 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	checksumHeaderPrefix = "x-amz-checksum-"
+	maxAWSChunkSize      = 16 << 20
+	maxAWSChunkLine      = 4096
+)
+
+// s3Body - the content of the request and its length, -1 when unknown, checked against what it was signed with:
+// a hex SHA-256 of the payload, aws-chunked streams of signed chunks or of a trailing checksum, or nothing at all.
+// A mismatch fails the read that reaches the end of the body, so the upload is never committed
+func s3Body(r *http.Request, sc *signingContext) (io.Reader, int64, error) {
+	var body io.Reader
+	var length int64
+
+	switch sc.payload {
+	case unsignedPayload:
+		body, length = r.Body, r.ContentLength
+	case streamingPayload, streamingPayloadTrailer, streamingUnsignedTrailer:
+		decoded, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil || decoded < 0 {
+			return nil, 0, errMissingContentLength
+		}
+		cr := &awsChunkedReader{
+			br:        bufio.NewReader(r.Body),
+			sc:        sc,
+			signed:    sc.payload != streamingUnsignedTrailer,
+			trailer:   sc.payload != streamingPayload,
+			prevSig:   sc.signature,
+			remaining: decoded,
+		}
+		if cr.trailer {
+			cr.checksumName = strings.ToLower(strings.TrimSpace(r.Header.Get("X-Amz-Trailer")))
+			cr.checksum = checksumHash(cr.checksumName)
+		}
+		body, length = cr, decoded
+	default:
+		expected, err := hex.DecodeString(sc.payload)
+		if err != nil || len(expected) != sha256.Size {
+			return nil, 0, s3Errorf(errInvalidArgument, "x-amz-content-sha256 must be %s, a streaming payload or a hex SHA-256", unsignedPayload)
+		}
+		body = &verifyingReader{r: r.Body, h: sha256.New(), expected: expected, err: errContentSHA256Mismatch}
+		length = r.ContentLength
+	}
+
+	if md5Header := r.Header.Get("Content-Md5"); md5Header != "" {
+		expected, err := base64.StdEncoding.DecodeString(md5Header)
+		if err != nil || len(expected) != md5.Size {
+			return nil, 0, errInvalidDigest
+		}
+		body = &verifyingReader{r: body, h: md5.New(), expected: expected, err: errBadDigest}
+	}
+
+	// checksums sent as headers rather than in a trailer
+	for name := range r.Header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, checksumHeaderPrefix) {
+			continue
+		}
+		h := checksumHash(name)
+		if h == nil {
+			continue
+		}
+		expected, err := base64.StdEncoding.DecodeString(r.Header.Get(name))
+		if err != nil {
+			return nil, 0, errInvalidDigest
+		}
+		body = &verifyingReader{r: body, h: h, expected: expected, err: errBadDigest}
+	}
+
+	return body, length, nil
+}
+
+// checksumHash - the hash of an x-amz-checksum-* header or trailer, nil for the ones that are not verified
+func checksumHash(name string) hash.Hash {
+	switch name {
+	case checksumHeaderPrefix + "crc32":
+		return crc32.NewIEEE()
+	case checksumHeaderPrefix + "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case checksumHeaderPrefix + "sha1":
+		return sha1.New()
+	case checksumHeaderPrefix + "sha256":
+		return sha256.New()
+	default:
+		return nil
+	}
+}
+
+// verifyingReader - fails the read that reaches the end of the body when the digest of what was read
+// differs from the expected one
+type verifyingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected []byte
+	err      *s3Error
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	vr.h.Write(p[:n])
+	if errors.Is(err, io.EOF) && !bytes.Equal(vr.h.Sum(nil), vr.expected) {
+		return n, vr.err
+	}
+	return n, err
+}
+
+// awsChunkedReader - decodes an aws-chunked body, <hex size>[;chunk-signature=<sig>]\r\n<data>\r\n per chunk
+// and an empty chunk at the end, optionally followed by trailing headers.
+// Signatures of chunks are chained to the signature of the request and to each other,
+// so chunks can neither be altered nor reordered, the checksum of a trailer is verified against the decoded content
+type awsChunkedReader struct {
+	br      *bufio.Reader
+	sc      *signingContext
+	signed  bool
+	trailer bool
+	prevSig string
+
+	checksumName string
+	checksum     hash.Hash
+
+	// remaining - what is left of the decoded length, it has to come down to zero exactly
+	remaining int64
+	chunk     []byte
+	done      bool
+	err       error
+}
+
+func (cr *awsChunkedReader) Read(p []byte) (int, error) {
+	for len(cr.chunk) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.nextChunk(); err != nil {
+			cr.err = err
+		}
+	}
+
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+func (cr *awsChunkedReader) nextChunk() error {
+	line, err := cr.readLine()
+	if err != nil {
+		return err
+	}
+
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeHex), 16, 64)
+	if err != nil || size < 0 || size > maxAWSChunkSize {
+		return s3Errorf(errIncompleteBody, "invalid chunk size %q", sizeHex)
+	}
+	if size > cr.remaining {
+		return errIncompleteBody
+	}
+
+	var signature string
+	if cr.signed {
+		var ok bool
+		if signature, ok = strings.CutPrefix(ext, "chunk-signature="); !ok {
+			return s3Errorf(errSignatureDoesNotMatch, "the chunk signature is missing")
+		}
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(cr.br, data); err != nil {
+		return errIncompleteBody
+	}
+	if size > 0 {
+		if err := cr.readCRLF(); err != nil {
+			return err
+		}
+	}
+
+	if cr.signed {
+		stringToSign := strings.Join([]string{
+			sigV4Algorithm + "-PAYLOAD",
+			cr.sc.date.Format(amzDateFormat),
+			cr.sc.scope,
+			cr.prevSig,
+			emptySHA256,
+			hexSHA256(data),
+		}, "\n")
+		if err := cr.verifySignature(stringToSign, signature); err != nil {
+			return err
+		}
+	}
+
+	if cr.checksum != nil {
+		cr.checksum.Write(data)
+	}
+	cr.remaining -= size
+	cr.chunk = data
+
+	if size == 0 {
+		if cr.remaining != 0 {
+			return errIncompleteBody
+		}
+		if err := cr.readTrailer(); err != nil {
+			return err
+		}
+		cr.done = true
+	}
+	return nil
+}
+
+// readTrailer - the trailing headers up to an empty line, the checksum and, for signed streams, the trailer signature
+func (cr *awsChunkedReader) readTrailer() error {
+	var checksum, signature, signed string
+	for {
+		line, err := cr.readLine()
+		if err != nil {
+			// the empty line after the trailer is left out by some clients
+			if errors.Is(err, io.EOF) && cr.trailer {
+				break
+			}
+			return err
+		}
+		if line == "" {
+			break
+		}
+
+		name, value, _ := strings.Cut(line, ":")
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		switch {
+		case name == "x-amz-trailer-signature":
+			signature = value
+		case strings.HasPrefix(name, checksumHeaderPrefix):
+			if name == cr.checksumName {
+				checksum = value
+			}
+			signed += name + ":" + value + "\n"
+		}
+	}
+
+	if !cr.trailer {
+		return nil
+	}
+	if cr.signed {
+		stringToSign := strings.Join([]string{
+			sigV4Algorithm + "-TRAILER",
+			cr.sc.date.Format(amzDateFormat),
+			cr.sc.scope,
+			cr.prevSig,
+			hexSHA256([]byte(signed)),
+		}, "\n")
+		if err := cr.verifySignature(stringToSign, signature); err != nil {
+			return err
+		}
+	}
+	if cr.checksum != nil {
+		expected, err := base64.StdEncoding.DecodeString(checksum)
+		if err != nil || !bytes.Equal(cr.checksum.Sum(nil), expected) {
+			return errBadDigest
+		}
+	}
+	return nil
+}
+
+func (cr *awsChunkedReader) verifySignature(stringToSign, signature string) error {
+	expected := hex.EncodeToString(hmacSHA256(cr.sc.key, stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return s3Errorf(errSignatureDoesNotMatch, "the chunk signature does not match the one calculated with the secret key")
+	}
+	cr.prevSig = signature
+	return nil
+}
+
+// readLine - a line without its CRLF, lines of the chunk framing are short
+func (cr *awsChunkedReader) readLine() (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := cr.br.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) && sb.Len() == 0 {
+				return "", io.EOF
+			}
+			return "", errIncompleteBody
+		}
+		if b == '\n' {
+			return strings.TrimSuffix(sb.String(), "\r"), nil
+		}
+		if sb.Len() >= maxAWSChunkLine {
+			return "", s3Errorf(errIncompleteBody, "chunk framing line is too long")
+		}
+		sb.WriteByte(b)
+	}
+}
+
+func (cr *awsChunkedReader) readCRLF() error {
+	line, err := cr.readLine()
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return s3Errorf(errIncompleteBody, "chunk data is longer than its size")
+	}
+	return nil
+}
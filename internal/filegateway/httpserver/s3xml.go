@@ -0,0 +1,165 @@
+package httpserver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	"net/http"
+	"time"
+)
+
+const (
+	s3TimeFormat     = "2006-01-02T15:04:05.000Z"
+	requestIDHeader  = "X-Amz-Request-Id"
+	s3StorageClass   = "STANDARD"
+	maxS3RequestBody = 1 << 20
+)
+
+// s3Error - an error of the S3 API, sent as an XML body with the status of its code
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied                = &s3Error{Code: "AccessDenied", Message: "Access Denied", Status: http.StatusForbidden}
+	errInvalidAccessKeyID          = &s3Error{Code: "InvalidAccessKeyId", Status: http.StatusForbidden}
+	errSignatureDoesNotMatch       = &s3Error{Code: "SignatureDoesNotMatch", Status: http.StatusForbidden}
+	errRequestTimeTooSkewed        = &s3Error{Code: "RequestTimeTooSkewed", Status: http.StatusForbidden}
+	errAuthorizationMalformed      = &s3Error{Code: "AuthorizationHeaderMalformed", Status: http.StatusBadRequest}
+	errAuthorizationQueryMalformed = &s3Error{Code: "AuthorizationQueryParametersError", Status: http.StatusBadRequest}
+	errInvalidRequest              = &s3Error{Code: "InvalidRequest", Status: http.StatusBadRequest}
+	errInvalidArgument             = &s3Error{Code: "InvalidArgument", Status: http.StatusBadRequest}
+	errContentSHA256Mismatch       = &s3Error{Code: "XAmzContentSHA256Mismatch", Message: "The provided x-amz-content-sha256 does not match what was computed", Status: http.StatusBadRequest}
+	errBadDigest                   = &s3Error{Code: "BadDigest", Message: "The digest you specified did not match what we received", Status: http.StatusBadRequest}
+	errInvalidDigest               = &s3Error{Code: "InvalidDigest", Message: "The digest you specified is not valid", Status: http.StatusBadRequest}
+	errIncompleteBody              = &s3Error{Code: "IncompleteBody", Message: "You did not provide the number of bytes specified by the Content-Length HTTP header", Status: http.StatusBadRequest}
+	errMissingContentLength        = &s3Error{Code: "MissingContentLength", Message: "You must provide the Content-Length HTTP header", Status: http.StatusLengthRequired}
+	errMalformedXML                = &s3Error{Code: "MalformedXML", Message: "The XML you provided was not well-formed or did not validate against our published schema", Status: http.StatusBadRequest}
+	errEntityTooLarge              = &s3Error{Code: "EntityTooLarge", Message: "Your proposed upload exceeds the maximum allowed object size", Status: http.StatusBadRequest}
+	errMetadataTooLarge            = &s3Error{Code: "MetadataTooLarge", Message: "Your metadata headers exceed the maximum allowed metadata size", Status: http.StatusBadRequest}
+	errInvalidBucketName           = &s3Error{Code: "InvalidBucketName", Message: "The specified bucket is not valid", Status: http.StatusBadRequest}
+	errInvalidKey                  = &s3Error{Code: "KeyTooLongError", Message: "The specified key cannot be stored", Status: http.StatusBadRequest}
+	errNoSuchBucket                = &s3Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist", Status: http.StatusNotFound}
+	errNoSuchKey                   = &s3Error{Code: "NoSuchKey", Message: "The specified key does not exist", Status: http.StatusNotFound}
+	errNoSuchUpload                = &s3Error{Code: "NoSuchUpload", Message: "The specified multipart upload does not exist", Status: http.StatusNotFound}
+	errInvalidPart                 = &s3Error{Code: "InvalidPart", Message: "One or more of the specified parts could not be found or its entity tag did not match", Status: http.StatusBadRequest}
+	errBucketNotEmpty              = &s3Error{Code: "BucketNotEmpty", Message: "The bucket you tried to delete is not empty", Status: http.StatusConflict}
+	errBucketAlreadyOwnedByYou     = &s3Error{Code: "BucketAlreadyOwnedByYou", Message: "Your previous request to create the named bucket succeeded and you already own it", Status: http.StatusConflict}
+	errOperationAborted            = &s3Error{Code: "OperationAborted", Message: "A conflicting conditional operation is currently in progress against this resource. Please try again.", Status: http.StatusConflict}
+	errInvalidRange                = &s3Error{Code: "InvalidRange", Message: "The requested range is not satisfiable", Status: http.StatusRequestedRangeNotSatisfiable}
+	errMethodNotAllowed            = &s3Error{Code: "MethodNotAllowed", Message: "The specified method is not allowed against this resource", Status: http.StatusMethodNotAllowed}
+	errNotImplemented              = &s3Error{Code: "NotImplemented", Message: "A header or query you provided implies functionality that is not implemented", Status: http.StatusNotImplemented}
+	errInternal                    = &s3Error{Code: "InternalError", Message: "We encountered an internal error, please try again", Status: http.StatusInternalServerError}
+)
+
+// s3Errorf - the error with a message of its own
+func s3Errorf(e *s3Error, format string, args ...any) *s3Error {
+	return &s3Error{Code: e.Code, Message: fmt.Sprintf(format, args...), Status: e.Status}
+}
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// writeS3Error - responses to HEAD requests carry the status only
+func writeS3Error(w http.ResponseWriter, r *http.Request, e *s3Error) {
+	writeXML(w, e.Status, &s3ErrorResponse{
+		Code:      e.Code,
+		Message:   e.Message,
+		Resource:  r.URL.Path,
+		RequestID: middleware.GetReqID(r.Context()),
+	})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format(s3TimeFormat)
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResultV2 struct {
+	XMLName               xml.Name         `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type locationConstraint struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
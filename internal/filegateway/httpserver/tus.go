@@ -0,0 +1,222 @@
+package httpserver
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/buckets"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/uploader"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the tus resumable upload protocol, https://tus.io/protocols/resumable-upload
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,expiration,termination"
+	tusOffsetContentType  = "application/offset+octet-stream"
+	tusResumableHeader    = "Tus-Resumable"
+	tusUploadOffsetHeader = "Upload-Offset"
+	tusUploadLengthHeader = "Upload-Length"
+	tusMetadataHeader     = "Upload-Metadata"
+	tusExpiresHeader      = "Upload-Expires"
+)
+
+// tusResumable - every response names the version of the protocol,
+// requests of other versions are refused, OPTIONS is how clients find out the version
+func tusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(tusResumableHeader, tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get(tusResumableHeader) != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, http.StatusText(412), 412)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) tusOptions(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if s.cfg.MaxFileSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.cfg.MaxFileSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createResumable - starts an upload of Upload-Length bytes, the filename of Upload-Metadata is the name of the file
+// and its filetype the content type, the X-Meta-* headers are the user metadata of the file
+func (s *Server) createResumable(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get(tusUploadLengthHeader), 10, 64)
+	if err != nil || length < 0 {
+		// deferred length is not supported, the chunks are planned from the length
+		http.Error(w, "Upload-Length is required", 400)
+		return
+	}
+
+	metadata := r.Header.Get(tusMetadataHeader)
+	meta, err := tusMetadata(metadata)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	fileName := meta["filename"]
+	if fileName == "" {
+		http.Error(w, "filename of Upload-Metadata is required", 400)
+		return
+	}
+
+	var opts uploader.UploadOptions
+	limit := s.cfg.MaxFileSize
+	bucket := chi.URLParam(r, "bucket")
+	if bucket != "" {
+		b, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+		opts = buckets.UploadOptions(b)
+		limit = s.uploadLimit(b)
+	}
+	opts.UserMeta = userMeta(r.Header)
+	if ct := meta["filetype"]; ct != "" {
+		opts.ContentType = ct
+	}
+
+	if limit > 0 && length > limit {
+		http.Error(w, http.StatusText(413), 413)
+		return
+	}
+
+	ru, err := s.uploader.CreateResumableUpload(r.Context(), bucket, fileName, length, metadata, opts)
+	if err != nil {
+		s.resumableFailed(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/resumable/"+ru.ID)
+	setUploadExpires(w, ru)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// headResumable - reports how many bytes of the upload were received, the client resumes from there
+func (s *Server) headResumable(w http.ResponseWriter, r *http.Request) {
+	ru, offset, err := s.uploader.GetResumableUpload(r.Context(), chi.URLParam(r, "upload"))
+	if err != nil {
+		s.resumableFailed(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(tusUploadOffsetHeader, strconv.FormatInt(offset, 10))
+	w.Header().Set(tusUploadLengthHeader, strconv.FormatInt(ru.Length, 10))
+	if ru.Metadata != "" {
+		w.Header().Set(tusMetadataHeader, ru.Metadata)
+	}
+	setUploadExpires(w, ru)
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchResumable - appends the body at Upload-Offset, which has to be the offset HEAD reports,
+// the file is there to download once the response to its last byte is sent
+func (s *Server) patchResumable(w http.ResponseWriter, r *http.Request) {
+	if ct, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(ct) != tusOffsetContentType {
+		http.Error(w, http.StatusText(415), 415)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get(tusUploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset is required", 400)
+		return
+	}
+
+	uploadID := chi.URLParam(r, "upload")
+	ru, _, err := s.uploader.GetResumableUpload(r.Context(), uploadID)
+	if err != nil {
+		s.resumableFailed(w, err)
+		return
+	}
+	if r.ContentLength > 0 && offset+r.ContentLength > ru.Length {
+		http.Error(w, http.StatusText(413), 413)
+		return
+	}
+
+	next, err := s.uploader.WriteResumable(r.Context(), uploadID, offset, r.Body)
+	if err != nil {
+		s.resumableFailed(w, err)
+		return
+	}
+
+	w.Header().Set(tusUploadOffsetHeader, strconv.FormatInt(next, 10))
+	if next < ru.Length {
+		setUploadExpires(w, ru)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// terminateResumable - drops the upload along with what was received of it
+func (s *Server) terminateResumable(w http.ResponseWriter, r *http.Request) {
+	if err := s.uploader.TerminateResumableUpload(r.Context(), chi.URLParam(r, "upload")); err != nil {
+		s.resumableFailed(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resumableFailed - responds to a resumable upload request that could not be completed
+func (s *Server) resumableFailed(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, uploader.ErrNoSuchUpload):
+		http.Error(w, http.StatusText(404), 404)
+	case errors.Is(err, uploader.ErrExpired):
+		http.Error(w, http.StatusText(410), 410)
+	case errors.Is(err, uploader.ErrOffsetMismatch):
+		http.Error(w, http.StatusText(409), 409)
+	case errors.Is(err, uploader.ErrUploadLocked):
+		http.Error(w, http.StatusText(423), 423)
+	case errors.Is(err, uploader.ErrInvalidLength),
+		errors.Is(err, uploader.ErrInvalidRedundancy),
+		errors.Is(err, uploader.ErrInvalidMetadata),
+		invalidName(err):
+		http.Error(w, http.StatusText(400), 400)
+	default:
+		s.lg.Error(fmt.Errorf("error processing resumable upload: %w", err))
+		http.Error(w, http.StatusText(500), 500)
+	}
+}
+
+func setUploadExpires(w http.ResponseWriter, ru *metastore.ResumableUpload) {
+	if !ru.ExpiresAt.IsZero() {
+		w.Header().Set(tusExpiresHeader, ru.ExpiresAt.Format(http.TimeFormat))
+	}
+}
+
+// tusMetadata - decodes the comma separated pairs of a key and a base64 value of Upload-Metadata,
+// the value can be left out
+func tusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata pair %q", pair)
+		}
+		if _, ok := meta[key]; ok {
+			return nil, fmt.Errorf("Upload-Metadata key %q is given twice", key)
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value of %q: %w", key, err)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
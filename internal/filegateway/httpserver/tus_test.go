@@ -0,0 +1,24 @@
+package httpserver
+
+import (
+	"testing"
+)
+
+func TestTusMetadata(t *testing.T) {
+	meta, err := tusMetadata("filename cGhvdG9zL2EucG5n, filetype aW1hZ2UvcG5n,is_confidential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["filename"] != "photos/a.png" || meta["filetype"] != "image/png" {
+		t.Errorf("tusMetadata() = %v, want the decoded name and type", meta)
+	}
+	if v, ok := meta["is_confidential"]; !ok || v != "" {
+		t.Errorf("expected a key without a value to be kept empty, got %q, %v", v, ok)
+	}
+
+	for _, header := range []string{"filename not-base64!", "filename YQ==,filename Yg==", " , filetype YQ=="} {
+		if _, err := tusMetadata(header); err == nil {
+			t.Errorf("expected %q to be refused", header)
+		}
+	}
+}
@@ -0,0 +1,748 @@
+package metastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	plansBucket     = []byte("plans")
+	serversBucket   = []byte("servers")
+	deletionsBucket = []byte("pending_deletions")
+	pendingBucket   = []byte("pending_uploads")
+	bucketsBucket   = []byte("buckets")
+	uploadsBucket   = []byte("multipart_uploads")
+	resumableBucket = []byte("resumable_uploads")
+	namesBucket     = []byte("names")
+)
+
+// BoltMetaStore - keeps everything in a single bbolt file, every change is a transaction
+// that is synced to disk before it returns, so a crash leaves either the old or the new state.
+// Shard plans are indexed by the servers they reference, under 8 bytes of the server id followed by the file key,
+// and by the names of their files, under the bucket, the name and the file key separated by zero bytes
+type BoltMetaStore struct {
+	lg logger.Logger
+	db *bolt.DB
+}
+
+// NewBoltMetaStore - opens or creates the database at the path
+func NewBoltMetaStore(path string, lg logger.Logger) (*BoltMetaStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open meta store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{plansBucket, serversBucket, deletionsBucket, pendingBucket, bucketsBucket, uploadsBucket, resumableBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(namesBucket) == nil {
+			return indexNames(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("could not create meta store buckets: %w", err)
+	}
+
+	return &BoltMetaStore{lg: lg, db: db}, nil
+}
+
+func (s *BoltMetaStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltMetaStore) Store(ctx context.Context, key multishard.Key, plan *ShardPlan) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putPlan(tx, key, plan)
+	})
+}
+
+// UpdateShardPlan - replaces the plan of the key with what update makes of the current one
+// within a single transaction, an error from update leaves the plan as it is
+func (s *BoltMetaStore) UpdateShardPlan(
+	ctx context.Context,
+	key multishard.Key,
+	update func(plan *ShardPlan) (*ShardPlan, error),
+) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		current, err := getPlan(tx, key)
+		if err != nil {
+			return err
+		}
+
+		updated, err := update(current)
+		if err != nil {
+			return err
+		}
+
+		return putPlan(tx, key, updated)
+	})
+}
+
+func (s *BoltMetaStore) GetShardPlan(ctx context.Context, key multishard.Key) (*ShardPlan, error) {
+	var plan *ShardPlan
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		plan, err = getPlan(tx, key)
+		return err
+	})
+	return plan, err
+}
+
+// Delete - removes the shard plan of the key along with its index entries
+func (s *BoltMetaStore) Delete(ctx context.Context, key multishard.Key) error {
+	return s.DeleteShardPlan(ctx, key, func(*ShardPlan) error { return nil })
+}
+
+// DeleteShardPlan - removes the shard plan of the key along with its index entries within a single transaction
+// unless check returns an error for the current plan, which leaves the plan as it is
+func (s *BoltMetaStore) DeleteShardPlan(ctx context.Context, key multishard.Key, check func(plan *ShardPlan) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		plan, err := getPlan(tx, key)
+		if err != nil {
+			return err
+		}
+		if err := check(plan); err != nil {
+			return err
+		}
+
+		if err := unindex(tx, key, plan); err != nil {
+			return err
+		}
+		if err := tx.Bucket(plansBucket).Delete([]byte(key)); err != nil {
+			return fmt.Errorf("could not delete shard plan for key %s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+// MoveShardPlan - stores the plan under another key and removes the old one in a single transaction,
+// fails with ErrAlreadyExists when the other key has a plan
+func (s *BoltMetaStore) MoveShardPlan(ctx context.Context, from, to multishard.Key, plan *ShardPlan) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		prev, err := getPlan(tx, from)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(plansBucket).Get([]byte(to)) != nil {
+			return fmt.Errorf("shard plan for key %s: %w", to, ErrAlreadyExists)
+		}
+
+		if err := unindex(tx, from, prev); err != nil {
+			return err
+		}
+		if err := tx.Bucket(plansBucket).Delete([]byte(from)); err != nil {
+			return fmt.Errorf("could not delete shard plan for key %s: %w", from, err)
+		}
+		return putPlan(tx, to, plan)
+	})
+}
+
+// ListKeys - keys of all stored shard plans in ascending order
+func (s *BoltMetaStore) ListKeys(ctx context.Context) ([]multishard.Key, error) {
+	return s.ListPrefix(ctx, "", "", 0)
+}
+
+// ListPrefix - keys starting with the prefix that sort after the given key, in ascending order,
+// at most limit of them unless it is 0
+func (s *BoltMetaStore) ListPrefix(ctx context.Context, prefix, after multishard.Key, limit int) ([]multishard.Key, error) {
+	var result []multishard.Key
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return scanPrefix(tx, prefix, after, func(k, _ []byte) (bool, error) {
+			result = append(result, multishard.Key(k))
+			return limit <= 0 || len(result) < limit, nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list keys with prefix %s: %w", prefix, err)
+	}
+	return result, nil
+}
+
+// Scan - calls fn with the plans of the keys starting with the prefix that sort after the given key,
+// all of them are read from a single snapshot, fn must not use the store
+func (s *BoltMetaStore) Scan(ctx context.Context, prefix, after multishard.Key, fn ScanFunc) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return scanPrefix(tx, prefix, after, func(k, v []byte) (bool, error) {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+
+			var plan ShardPlan
+			if err := json.Unmarshal(v, &plan); err != nil {
+				return false, fmt.Errorf("could not unmarshal shard plan for key %s: %w", k, err)
+			}
+			return fn(multishard.Key(k), &plan)
+		})
+	})
+}
+
+// ScanNames - calls fn with the plans of the files in the bucket, or outside of buckets when it is empty,
+// whose names start with the prefix and sort after the given name, in the byte order of the names.
+// All of them are read from a single snapshot, fn must not use the store
+func (s *BoltMetaStore) ScanNames(ctx context.Context, bucket, prefix, after string, fn ScanFunc) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		plans := tx.Bucket(plansBucket)
+		start := nameIndexPrefix(bucket, prefix)
+		if after != "" && after >= prefix {
+			// every file named after sorts before it
+			start = append(nameIndexPrefix(bucket, after), 1)
+		}
+
+		c := tx.Bucket(namesBucket).Cursor()
+		end := nameIndexPrefix(bucket, prefix)
+		for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, end); k, v = c.Next() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			b := plans.Get(v)
+			if b == nil {
+				return fmt.Errorf("name index refers to the missing shard plan of key %s", v)
+			}
+			var plan ShardPlan
+			if err := json.Unmarshal(b, &plan); err != nil {
+				return fmt.Errorf("could not unmarshal shard plan for key %s: %w", v, err)
+			}
+			if more, err := fn(multishard.Key(v), &plan); err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scanPrefix - walks the plans of the keys starting with the prefix that sort after the given key
+func scanPrefix(tx *bolt.Tx, prefix, after multishard.Key, fn func(k, v []byte) (bool, error)) error {
+	c := tx.Bucket(plansBucket).Cursor()
+
+	start := []byte(prefix)
+	if after >= prefix {
+		start = []byte(after)
+	}
+
+	k, v := c.Seek(start)
+	if k != nil && after != "" && bytes.Equal(k, []byte(after)) {
+		k, v = c.Next()
+	}
+	for ; k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+		more, err := fn(k, v)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeysByServer - keys of the files with chunks or fragments on the server, read from the index
+func (s *BoltMetaStore) KeysByServer(ctx context.Context, server multishard.ServerIdx) ([]multishard.Key, error) {
+	var result []multishard.Key
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := serverPrefix(server)
+		c := tx.Bucket(serversBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			result = append(result, multishard.Key(k[len(prefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list keys on server %d: %w", server, err)
+	}
+	return result, nil
+}
+
+// StorePendingDeletion - records chunks that still have to be removed from their servers,
+// replaces the previous record with the same id
+func (s *BoltMetaStore) StorePendingDeletion(ctx context.Context, pd *PendingDeletion) error {
+	b, err := json.Marshal(pd)
+	if err != nil {
+		return fmt.Errorf("could not marshal pending deletion for key %s: %w", pd.Key, err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(deletionsBucket).Put([]byte(pd.ID), b); err != nil {
+			return fmt.Errorf("could not store pending deletion for key %s: %w", pd.Key, err)
+		}
+		return nil
+	})
+}
+
+// ListPendingDeletions - all recorded pending deletions
+func (s *BoltMetaStore) ListPendingDeletions(ctx context.Context) ([]*PendingDeletion, error) {
+	var result []*PendingDeletion
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deletionsBucket).ForEach(func(k, v []byte) error {
+			var pd PendingDeletion
+			if err := json.Unmarshal(v, &pd); err != nil {
+				s.lg.Error(fmt.Errorf("skipping malformed pending deletion %s: %w", k, err))
+				return nil
+			}
+			result = append(result, &pd)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read pending deletions: %w", err)
+	}
+	return result, nil
+}
+
+// RemovePendingDeletion - forgets the pending deletion once all its chunks are gone
+func (s *BoltMetaStore) RemovePendingDeletion(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(deletionsBucket).Delete([]byte(id)); err != nil {
+			return fmt.Errorf("could not remove pending deletion %s: %w", id, err)
+		}
+		return nil
+	})
+}
+
+// StorePendingUpload - records the chunks of an upload that is running, replaces the previous record with the same id
+func (s *BoltMetaStore) StorePendingUpload(ctx context.Context, pu *PendingUpload) error {
+	b, err := json.Marshal(pu)
+	if err != nil {
+		return fmt.Errorf("could not marshal pending upload for key %s: %w", pu.Key, err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(pendingBucket).Put([]byte(pu.ID), b); err != nil {
+			return fmt.Errorf("could not store pending upload for key %s: %w", pu.Key, err)
+		}
+		return nil
+	})
+}
+
+// ListPendingUploads - all recorded pending uploads
+func (s *BoltMetaStore) ListPendingUploads(ctx context.Context) ([]*PendingUpload, error) {
+	var result []*PendingUpload
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingBucket).ForEach(func(k, v []byte) error {
+			var pu PendingUpload
+			if err := json.Unmarshal(v, &pu); err != nil {
+				s.lg.Error(fmt.Errorf("skipping malformed pending upload %s: %w", k, err))
+				return nil
+			}
+			result = append(result, &pu)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read pending uploads: %w", err)
+	}
+	return result, nil
+}
+
+// RemovePendingUpload - forgets the pending upload once it is committed or its chunks are taken care of
+func (s *BoltMetaStore) RemovePendingUpload(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(pendingBucket).Delete([]byte(id)); err != nil {
+			return fmt.Errorf("could not remove pending upload %s: %w", id, err)
+		}
+		return nil
+	})
+}
+
+// CreateBucket - fails with ErrAlreadyExists when the bucket exists
+func (s *BoltMetaStore) CreateBucket(ctx context.Context, b *Bucket) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketsBucket).Get([]byte(b.Name)) != nil {
+			return fmt.Errorf("bucket %s: %w", b.Name, ErrAlreadyExists)
+		}
+		return putBucket(tx, b)
+	})
+}
+
+func (s *BoltMetaStore) GetBucket(ctx context.Context, name string) (*Bucket, error) {
+	var b *Bucket
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		b, err = getBucket(tx, name)
+		return err
+	})
+	return b, err
+}
+
+// UpdateBucket - replaces the bucket with what update makes of the current one within a single transaction
+func (s *BoltMetaStore) UpdateBucket(ctx context.Context, name string, update func(b *Bucket) (*Bucket, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		current, err := getBucket(tx, name)
+		if err != nil {
+			return err
+		}
+		updated, err := update(current)
+		if err != nil {
+			return err
+		}
+		updated.Name = name
+		return putBucket(tx, updated)
+	})
+}
+
+// ListBuckets - all buckets in name order
+func (s *BoltMetaStore) ListBuckets(ctx context.Context) ([]*Bucket, error) {
+	result := []*Bucket{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketsBucket).ForEach(func(k, v []byte) error {
+			var b Bucket
+			if err := json.Unmarshal(v, &b); err != nil {
+				return fmt.Errorf("could not unmarshal bucket %s: %w", k, err)
+			}
+			result = append(result, &b)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read buckets: %w", err)
+	}
+	return result, nil
+}
+
+// DeleteBucket - fails with ErrNotEmpty while files are stored in the bucket,
+// the check and the removal are a single transaction, so no upload can complete in between
+func (s *BoltMetaStore) DeleteBucket(ctx context.Context, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketsBucket).Get([]byte(name)) == nil {
+			return fmt.Errorf("bucket %s: %w", name, ErrNotFound)
+		}
+
+		empty := true
+		err := scanPrefix(tx, multishard.BucketPrefix(name), "", func(_, _ []byte) (bool, error) {
+			empty = false
+			return false, nil
+		})
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("bucket %s: %w", name, ErrNotEmpty)
+		}
+
+		if err := tx.Bucket(bucketsBucket).Delete([]byte(name)); err != nil {
+			return fmt.Errorf("could not delete bucket %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// CreateMultipartUpload - fails with ErrAlreadyExists when an upload with the id exists
+func (s *BoltMetaStore) CreateMultipartUpload(ctx context.Context, mu *MultipartUpload) error {
+	b, err := json.Marshal(mu)
+	if err != nil {
+		return fmt.Errorf("could not marshal multipart upload %s: %w", mu.ID, err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		uploads := tx.Bucket(uploadsBucket)
+		if uploads.Get([]byte(mu.ID)) != nil {
+			return fmt.Errorf("multipart upload %s: %w", mu.ID, ErrAlreadyExists)
+		}
+		if err := uploads.Put([]byte(mu.ID), b); err != nil {
+			return fmt.Errorf("could not store multipart upload %s: %w", mu.ID, err)
+		}
+		return nil
+	})
+}
+
+func (s *BoltMetaStore) GetMultipartUpload(ctx context.Context, id string) (*MultipartUpload, error) {
+	var mu MultipartUpload
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(uploadsBucket).Get([]byte(id))
+		if b == nil {
+			return fmt.Errorf("multipart upload %s: %w", id, ErrNotFound)
+		}
+		if err := json.Unmarshal(b, &mu); err != nil {
+			return fmt.Errorf("could not unmarshal multipart upload %s: %w", id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mu, nil
+}
+
+func (s *BoltMetaStore) ListMultipartUploads(ctx context.Context) ([]*MultipartUpload, error) {
+	var result []*MultipartUpload
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).ForEach(func(k, v []byte) error {
+			var mu MultipartUpload
+			if err := json.Unmarshal(v, &mu); err != nil {
+				return fmt.Errorf("could not unmarshal multipart upload %s: %w", k, err)
+			}
+			result = append(result, &mu)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read multipart uploads: %w", err)
+	}
+	return result, nil
+}
+
+func (s *BoltMetaStore) DeleteMultipartUpload(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		uploads := tx.Bucket(uploadsBucket)
+		if uploads.Get([]byte(id)) == nil {
+			return fmt.Errorf("multipart upload %s: %w", id, ErrNotFound)
+		}
+		if err := uploads.Delete([]byte(id)); err != nil {
+			return fmt.Errorf("could not remove multipart upload %s: %w", id, err)
+		}
+		return nil
+	})
+}
+
+// CreateResumableUpload - fails with ErrAlreadyExists when an upload with the id exists
+func (s *BoltMetaStore) CreateResumableUpload(ctx context.Context, ru *ResumableUpload) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(resumableBucket).Get([]byte(ru.ID)) != nil {
+			return fmt.Errorf("resumable upload %s: %w", ru.ID, ErrAlreadyExists)
+		}
+		return putResumableUpload(tx, ru)
+	})
+}
+
+func (s *BoltMetaStore) GetResumableUpload(ctx context.Context, id string) (*ResumableUpload, error) {
+	var ru *ResumableUpload
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ru, err = getResumableUpload(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ru, nil
+}
+
+func (s *BoltMetaStore) UpdateResumableUpload(
+	ctx context.Context,
+	id string,
+	update func(ru *ResumableUpload) (*ResumableUpload, error),
+) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		current, err := getResumableUpload(tx, id)
+		if err != nil {
+			return err
+		}
+		updated, err := update(current)
+		if err != nil {
+			return err
+		}
+		updated.ID = id
+		return putResumableUpload(tx, updated)
+	})
+}
+
+func (s *BoltMetaStore) ListResumableUploads(ctx context.Context) ([]*ResumableUpload, error) {
+	var result []*ResumableUpload
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(resumableBucket).ForEach(func(k, v []byte) error {
+			var ru ResumableUpload
+			if err := json.Unmarshal(v, &ru); err != nil {
+				return fmt.Errorf("could not unmarshal resumable upload %s: %w", k, err)
+			}
+			result = append(result, &ru)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read resumable uploads: %w", err)
+	}
+	return result, nil
+}
+
+func (s *BoltMetaStore) DeleteResumableUpload(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		uploads := tx.Bucket(resumableBucket)
+		if uploads.Get([]byte(id)) == nil {
+			return fmt.Errorf("resumable upload %s: %w", id, ErrNotFound)
+		}
+		if err := uploads.Delete([]byte(id)); err != nil {
+			return fmt.Errorf("could not remove resumable upload %s: %w", id, err)
+		}
+		return nil
+	})
+}
+
+func getResumableUpload(tx *bolt.Tx, id string) (*ResumableUpload, error) {
+	v := tx.Bucket(resumableBucket).Get([]byte(id))
+	if v == nil {
+		return nil, fmt.Errorf("resumable upload %s: %w", id, ErrNotFound)
+	}
+
+	var ru ResumableUpload
+	if err := json.Unmarshal(v, &ru); err != nil {
+		return nil, fmt.Errorf("could not unmarshal resumable upload %s: %w", id, err)
+	}
+	return &ru, nil
+}
+
+func putResumableUpload(tx *bolt.Tx, ru *ResumableUpload) error {
+	v, err := json.Marshal(ru)
+	if err != nil {
+		return fmt.Errorf("could not marshal resumable upload %s: %w", ru.ID, err)
+	}
+	if err := tx.Bucket(resumableBucket).Put([]byte(ru.ID), v); err != nil {
+		return fmt.Errorf("could not store resumable upload %s: %w", ru.ID, err)
+	}
+	return nil
+}
+
+func getBucket(tx *bolt.Tx, name string) (*Bucket, error) {
+	v := tx.Bucket(bucketsBucket).Get([]byte(name))
+	if v == nil {
+		return nil, fmt.Errorf("bucket %s: %w", name, ErrNotFound)
+	}
+
+	var b Bucket
+	if err := json.Unmarshal(v, &b); err != nil {
+		return nil, fmt.Errorf("could not unmarshal bucket %s: %w", name, err)
+	}
+	return &b, nil
+}
+
+func putBucket(tx *bolt.Tx, b *Bucket) error {
+	v, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("could not marshal bucket %s: %w", b.Name, err)
+	}
+	if err := tx.Bucket(bucketsBucket).Put([]byte(b.Name), v); err != nil {
+		return fmt.Errorf("could not store bucket %s: %w", b.Name, err)
+	}
+	return nil
+}
+
+func getPlan(tx *bolt.Tx, key multishard.Key) (*ShardPlan, error) {
+	b := tx.Bucket(plansBucket).Get([]byte(key))
+	if b == nil {
+		return nil, fmt.Errorf("shard plan for key %s: %w", key, ErrNotFound)
+	}
+
+	var plan ShardPlan
+	if err := json.Unmarshal(b, &plan); err != nil {
+		return nil, fmt.Errorf("could not unmarshal shard plan for key %s: %w", key, err)
+	}
+
+	return &plan, nil
+}
+
+// putPlan - stores the plan and moves its index entries from the servers of the previous plan
+func putPlan(tx *bolt.Tx, key multishard.Key, plan *ShardPlan) error {
+	if key == "" {
+		return errors.New("shard plan key is empty")
+	}
+
+	b, err := json.Marshal(plan)
+	if err != nil {
+		return fmt.Errorf("could not marshal shard plan for key %s: %w", key, err)
+	}
+
+	prev, err := getPlan(tx, key)
+	if err == nil {
+		if err := unindex(tx, key, prev); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if err := tx.Bucket(plansBucket).Put([]byte(key), b); err != nil {
+		return fmt.Errorf("could not store shard plan for key %s: %w", key, err)
+	}
+
+	servers := tx.Bucket(serversBucket)
+	for _, id := range plan.ServerIDs(key) {
+		if err := servers.Put(serverIndexKey(id, key), nil); err != nil {
+			return fmt.Errorf("could not index shard plan for key %s: %w", key, err)
+		}
+	}
+	if err := tx.Bucket(namesBucket).Put(nameIndexKey(key, plan), []byte(key)); err != nil {
+		return fmt.Errorf("could not index the name of shard plan for key %s: %w", key, err)
+	}
+	return nil
+}
+
+func unindex(tx *bolt.Tx, key multishard.Key, plan *ShardPlan) error {
+	servers := tx.Bucket(serversBucket)
+	for _, id := range plan.ServerIDs(key) {
+		if err := servers.Delete(serverIndexKey(id, key)); err != nil {
+			return fmt.Errorf("could not unindex shard plan for key %s: %w", key, err)
+		}
+	}
+	if err := tx.Bucket(namesBucket).Delete(nameIndexKey(key, plan)); err != nil {
+		return fmt.Errorf("could not unindex the name of shard plan for key %s: %w", key, err)
+	}
+	return nil
+}
+
+// indexNames - builds the name index of the plans stored before there was one
+func indexNames(tx *bolt.Tx) error {
+	names, err := tx.CreateBucket(namesBucket)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(plansBucket).ForEach(func(k, v []byte) error {
+		var plan ShardPlan
+		if err := json.Unmarshal(v, &plan); err != nil {
+			return fmt.Errorf("could not unmarshal shard plan for key %s: %w", k, err)
+		}
+		if err := names.Put(nameIndexKey(multishard.Key(k), &plan), k); err != nil {
+			return fmt.Errorf("could not index the name of shard plan for key %s: %w", k, err)
+		}
+		return nil
+	})
+}
+
+// nameIndexPrefix - every name index key of the files in the bucket whose names start with the prefix
+// starts with it, names hold no zero bytes, so shorter names sort first
+func nameIndexPrefix(bucket, prefix string) []byte {
+	return []byte(bucket + "\x00" + prefix)
+}
+
+// nameIndexKey - the file key makes the index keys of different plans recorded with the same name unique
+func nameIndexKey(key multishard.Key, plan *ShardPlan) []byte {
+	return append(append(nameIndexPrefix(keyBucket(key), FileName(key, plan)), 0), key...)
+}
+
+// keyBucket - the bucket of a file key, empty outside of buckets
+func keyBucket(key multishard.Key) string {
+	s := string(key)
+	if !strings.HasPrefix(s, "/") {
+		return ""
+	}
+	if i := strings.IndexByte(s[1:], '/'); i >= 0 {
+		return s[1 : i+1]
+	}
+	return s[1:]
+}
+
+func serverPrefix(server multishard.ServerIdx) []byte {
+	prefix := make([]byte, 8)
+	binary.BigEndian.PutUint64(prefix, uint64(server))
+	return prefix
+}
+
+func serverIndexKey(server multishard.ServerIdx, key multishard.Key) []byte {
+	return append(serverPrefix(server), key...)
+}
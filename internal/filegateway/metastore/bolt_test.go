@@ -0,0 +1,419 @@
+package metastore
+
+import (
+	"context"
+	"errors"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestBoltMetaStore(t *testing.T) *BoltMetaStore {
+	t.Helper()
+	s, err := NewBoltMetaStore(filepath.Join(t.TempDir(), "meta.db"), logger.NewStdoutLogger(logger.Dev, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func testPlan(servers ...int) *ShardPlan {
+	plan := &ShardPlan{ModifiedAt: time.Now().UTC().Truncate(time.Second)}
+	for i, server := range servers {
+		plan.Shards = append(plan.Shards, Shard{ChunkIdx: i, ServerIdx: server, Size: 10})
+		plan.OriginalSize += 10
+	}
+	return plan
+}
+
+func TestBoltMetaStore_IndexesPlansByServer(t *testing.T) {
+	s := newTestBoltMetaStore(t)
+	ctx := context.Background()
+
+	if err := s.Store(ctx, "a", testPlan(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, "b", testPlan(2, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertKeysByServer := func(server multishard.ServerIdx, expected ...multishard.Key) {
+		t.Helper()
+		keys, err := s.KeysByServer(ctx, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != len(expected) || (len(keys) > 0 && !reflect.DeepEqual(keys, expected)) {
+			t.Errorf("server %d: expected keys %v, got %v", server, expected, keys)
+		}
+	}
+
+	assertKeysByServer(1, "a")
+	assertKeysByServer(2, "a", "b")
+	assertKeysByServer(3, "b")
+
+	// the chunk on server 1 moves to server 3
+	err := s.UpdateShardPlan(ctx, "a", func(plan *ShardPlan) (*ShardPlan, error) {
+		plan.Shards[0].ServerIdx = 3
+		return plan, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertKeysByServer(1)
+	assertKeysByServer(3, "a", "b")
+
+	// a failed update changes nothing
+	errFailed := errors.New("failed")
+	err = s.UpdateShardPlan(ctx, "a", func(plan *ShardPlan) (*ShardPlan, error) {
+		return nil, errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("expected the error of the update, got %v", err)
+	}
+	assertKeysByServer(3, "a", "b")
+
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	assertKeysByServer(2, "a")
+	assertKeysByServer(3, "a")
+
+	if _, err := s.GetShardPlan(ctx, "b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := s.Delete(ctx, "b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestBoltMetaStore_ListPrefix(t *testing.T) {
+	s := newTestBoltMetaStore(t)
+	ctx := context.Background()
+
+	for _, key := range []multishard.Key{"docs/b", "docs/a", "docs/c", "img/a", "doc"} {
+		if err := s.Store(ctx, key, testPlan(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		prefix, after multishard.Key
+		limit         int
+		expected      []multishard.Key
+	}{
+		{expected: []multishard.Key{"doc", "docs/a", "docs/b", "docs/c", "img/a"}},
+		{prefix: "docs/", expected: []multishard.Key{"docs/a", "docs/b", "docs/c"}},
+		{prefix: "docs/", limit: 2, expected: []multishard.Key{"docs/a", "docs/b"}},
+		{prefix: "docs/", after: "docs/b", expected: []multishard.Key{"docs/c"}},
+		{prefix: "docs/", after: "docs/bb", expected: []multishard.Key{"docs/c"}},
+		{prefix: "docs/", after: "a", expected: []multishard.Key{"docs/a", "docs/b", "docs/c"}},
+		{prefix: "docs/", after: "docs/c"},
+		{prefix: "video/"},
+	}
+
+	for _, tc := range tt {
+		keys, err := s.ListPrefix(ctx, tc.prefix, tc.after, tc.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != len(tc.expected) || (len(keys) > 0 && !reflect.DeepEqual(keys, tc.expected)) {
+			t.Errorf("prefix %q after %q limit %d: expected %v, got %v", tc.prefix, tc.after, tc.limit, tc.expected, keys)
+		}
+	}
+}
+
+func TestMigrateMetaStore_ImportsTmpMetaStore(t *testing.T) {
+	dir := t.TempDir()
+	from := &TmpMetaStore{
+		lg:           logger.NewStdoutLogger(logger.Dev, "test"),
+		dir:          filepath.Join(dir, "metastore"),
+		deletionsDir: filepath.Join(dir, "pending_deletions"),
+		pendingDir:   filepath.Join(dir, "pending_uploads"),
+		bucketsDir:   filepath.Join(dir, "buckets"),
+		uploadsDir:   filepath.Join(dir, "multipart_uploads"),
+		resumableDir: filepath.Join(dir, "resumable_uploads"),
+	}
+	for _, d := range []string{from.dir, from.deletionsDir, from.pendingDir, from.bucketsDir, from.uploadsDir, from.resumableDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	plan := testPlan(1, 2)
+	if err := from.Store(ctx, "a", plan); err != nil {
+		t.Fatal(err)
+	}
+	pd := NewPendingDeletion("b", []Location{{Key: "b/0", ServerIdx: 3}})
+	if err := from.StorePendingDeletion(ctx, pd); err != nil {
+		t.Fatal(err)
+	}
+	bucket := &Bucket{Name: "photos", CreatedAt: time.Now().UTC().Truncate(time.Second), Settings: BucketSettings{ChunkSize: 1024}}
+	if err := from.CreateBucket(ctx, bucket); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.Store(ctx, "/photos/c", testPlan(4)); err != nil {
+		t.Fatal(err)
+	}
+	pu := NewPendingUpload("d")
+	pu.Locations = []Location{{Key: "d/0", ServerIdx: 1}}
+	if err := from.StorePendingUpload(ctx, pu); err != nil {
+		t.Fatal(err)
+	}
+	mu := &MultipartUpload{ID: "mu1", Bucket: "photos", Name: "e", CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	if err := from.CreateMultipartUpload(ctx, mu); err != nil {
+		t.Fatal(err)
+	}
+	ru := &ResumableUpload{ID: "ru1", Bucket: "photos", Name: "f", Length: 10}
+	if err := from.CreateResumableUpload(ctx, ru); err != nil {
+		t.Fatal(err)
+	}
+
+	to := newTestBoltMetaStore(t)
+	for i := 0; i < 2; i++ {
+		stats, err := MigrateMetaStore(ctx, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := MigrationStats{Plans: 2, PendingDeletions: 1, Buckets: 1, PendingUploads: 1, MultipartUploads: 1, ResumableUploads: 1}
+		if stats != expected {
+			t.Errorf("expected %+v to be migrated, got %+v", expected, stats)
+		}
+	}
+
+	migrated, err := to.GetShardPlan(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(migrated, plan) {
+		t.Errorf("expected %+v, got %+v", plan, migrated)
+	}
+	if keys, _ := to.KeysByServer(ctx, 2); len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("expected the migrated plan to be indexed, got %v", keys)
+	}
+
+	if _, err := to.GetShardPlan(ctx, "/photos/c"); err != nil {
+		t.Errorf("expected the plan of the file in the bucket to be migrated, got %v", err)
+	}
+	if migratedBucket, err := to.GetBucket(ctx, "photos"); err != nil || !reflect.DeepEqual(migratedBucket, bucket) {
+		t.Errorf("expected bucket %+v, got %+v, %v", bucket, migratedBucket, err)
+	}
+
+	deletions, err := to.ListPendingDeletions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deletions) != 1 || deletions[0].ID != pd.ID {
+		t.Errorf("expected pending deletion %s, got %+v", pd.ID, deletions)
+	}
+
+	uploads, err := to.ListPendingUploads(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 || uploads[0].ID != pu.ID || !reflect.DeepEqual(uploads[0].Locations, pu.Locations) {
+		t.Errorf("expected pending upload %+v, got %+v", pu, uploads)
+	}
+	if migratedMU, err := to.GetMultipartUpload(ctx, mu.ID); err != nil || !reflect.DeepEqual(migratedMU, mu) {
+		t.Errorf("expected multipart upload %+v, got %+v, %v", mu, migratedMU, err)
+	}
+	if migratedRU, err := to.GetResumableUpload(ctx, ru.ID); err != nil || migratedRU.Name != ru.Name || migratedRU.Length != ru.Length {
+		t.Errorf("expected resumable upload %+v, got %+v, %v", ru, migratedRU, err)
+	}
+}
+
+func TestBoltMetaStore_DeletesOnlyEmptyBuckets(t *testing.T) {
+	s := newTestBoltMetaStore(t)
+	ctx := context.Background()
+
+	for _, name := range []string{"photos", "photos2"} {
+		if err := s.CreateBucket(ctx, &Bucket{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.CreateBucket(ctx, &Bucket{Name: "photos"}); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("expected ErrAlreadyExists, got %v", err)
+	}
+	if err := s.Store(ctx, multishard.BucketPrefix("photos2")+"a", testPlan(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeleteBucket(ctx, "photos2"); !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("expected ErrNotEmpty, got %v", err)
+	}
+	// a file in a bucket with a longer name does not keep the bucket from being deleted
+	if err := s.DeleteBucket(ctx, "photos"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteBucket(ctx, "photos"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	buckets, err := s.ListBuckets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 || buckets[0].Name != "photos2" {
+		t.Errorf("expected only photos2 to be left, got %+v", buckets)
+	}
+}
+
+func TestBoltMetaStore_ScanNamesInNameOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta.db")
+	lg := logger.NewStdoutLogger(logger.Dev, "test")
+	s, err := NewBoltMetaStore(path, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// escaped bytes sort differently in keys than in names
+	for _, name := range []string{"a/b", "a-b", "a b", "a~", "aé", "b"} {
+		key, _ := multishard.ResolveKey(name)
+		plan := testPlan(1)
+		plan.Name = name
+		if err := s.Store(ctx, key, plan); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inBucket, _ := multishard.ObjectKey("photos", "a/c")
+	if err := s.Store(ctx, inBucket, testPlan(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	scanNames := func(bucket, prefix, after string) []string {
+		t.Helper()
+		var names []string
+		err := s.ScanNames(ctx, bucket, prefix, after, func(key multishard.Key, plan *ShardPlan) (bool, error) {
+			names = append(names, FileName(key, plan))
+			return true, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+
+	if names := scanNames("", "a", ""); !reflect.DeepEqual(names, []string{"a b", "a-b", "a/b", "a~", "aé"}) {
+		t.Errorf("expected names with the prefix in name order, got %v", names)
+	}
+	if names := scanNames("", "", "a/b"); !reflect.DeepEqual(names, []string{"a~", "aé", "b"}) {
+		t.Errorf("expected names after a/b, got %v", names)
+	}
+	if names := scanNames("photos", "", ""); !reflect.DeepEqual(names, []string{"a/c"}) {
+		t.Errorf("expected only the file in photos, got %v", names)
+	}
+
+	// a store without the name index gets it when it is opened
+	if err := s.db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(namesBucket) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewBoltMetaStore(path, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if names := scanNames("", "", ""); !reflect.DeepEqual(names, []string{"a b", "a-b", "a/b", "a~", "aé"}) {
+		t.Errorf("expected the rebuilt index without the deleted file, got %v", names)
+	}
+}
+
+func TestMigrateKeys_MovesPlansOfThePreviousScheme(t *testing.T) {
+	s := newTestBoltMetaStore(t)
+	ctx := context.Background()
+
+	// uploaded with a name under the previous scheme, its chunk is stored under the file key
+	named := testPlan(1)
+	named.Name = "photos/a.png"
+	if err := s.Store(ctx, "photos_a_png", named); err != nil {
+		t.Fatal(err)
+	}
+	// uploaded before names were recorded, its name cannot be told from its key
+	unnamed := testPlan(2)
+	if err := s.Store(ctx, "b_txt", unnamed); err != nil {
+		t.Fatal(err)
+	}
+	// uploaded before names were recorded without anything to replace, its key is its name
+	if err := s.Store(ctx, "readme", testPlan(4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, "50%", testPlan(5)); err != nil {
+		t.Fatal(err)
+	}
+	// its new key is taken by a file uploaded after the switch
+	conflicting := testPlan(3)
+	conflicting.Name = "c.txt"
+	if err := s.Store(ctx, "c_txt", conflicting); err != nil {
+		t.Fatal(err)
+	}
+	current := testPlan(3)
+	current.Name = "c.txt"
+	if err := s.Store(ctx, "c.txt", current); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := MigrateKeys(ctx, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != 2 || len(stats.Conflicts) != 1 || stats.Conflicts[0] != "c_txt" {
+		t.Errorf("expected 2 moved plans and a conflict of c_txt, got %+v", stats)
+	}
+	if len(stats.Unnamed) != 1 || stats.Unnamed[0] != "b_txt" {
+		t.Errorf("expected b_txt to be reported as unnamed, got %+v", stats.Unnamed)
+	}
+
+	moved, err := s.GetShardPlan(ctx, "photos%2Fa.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Shards[0].StorageKey("photos%2Fa.png") != "photos_a_png" {
+		t.Errorf("expected the chunk to stay under the old key, got %q", moved.Shards[0].StorageKey("photos%2Fa.png"))
+	}
+	if _, err := s.GetShardPlan(ctx, "photos_a_png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the old key to be gone, got %v", err)
+	}
+	if keys, _ := s.KeysByServer(ctx, 1); len(keys) != 1 || keys[0] != "photos%2Fa.png" {
+		t.Errorf("expected the index to follow the plan, got %v", keys)
+	}
+	if _, err := s.GetShardPlan(ctx, "b_txt"); err != nil {
+		t.Errorf("expected the unnamed plan to stay, got %v", err)
+	}
+	if plan, err := s.GetShardPlan(ctx, "readme"); err != nil || plan.Name != "readme" {
+		t.Errorf("expected the plan to stay with its key recorded as its name, got %+v, %v", plan, err)
+	}
+	if plan, err := s.GetShardPlan(ctx, "50%25"); err != nil || plan.Name != "50%" {
+		t.Errorf("expected the plan under the key of its name, got %+v, %v", plan, err)
+	}
+
+	// the original name of the unnamed plan is given
+	stats, err = MigrateKeys(ctx, s, map[multishard.Key]string{"b_txt": "docs/b.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != 1 || len(stats.Unnamed) != 0 {
+		t.Errorf("expected the named plan to move, got %+v", stats)
+	}
+	if plan, err := s.GetShardPlan(ctx, "docs%2Fb.txt"); err != nil || plan.Name != "docs/b.txt" {
+		t.Errorf("expected the plan under the key of its original name, got %+v, %v", plan, err)
+	}
+
+	// running it again changes nothing
+	if stats, err := MigrateKeys(ctx, s, nil); err != nil || stats.Moved != 0 || len(stats.Unnamed) != 0 {
+		t.Errorf("expected nothing to move on the second run, got %+v, %v", stats, err)
+	}
+}
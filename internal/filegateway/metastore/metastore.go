@@ -3,29 +3,128 @@ package metastore
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/denismitr/shardstore/internal/common/logger"
 	"github.com/denismitr/shardstore/internal/filegateway/multishard"
 	"io"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
-// TmpMetaStore - silly implementation only for local testing
-// meta store should be a normal database
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrNotEmpty      = errors.New("not empty")
+)
+
+// MetaStore - keeps shard plans of files and the chunks left to delete
+type MetaStore interface {
+	Store(ctx context.Context, key multishard.Key, plan *ShardPlan) error
+	GetShardPlan(ctx context.Context, key multishard.Key) (*ShardPlan, error)
+	UpdateShardPlan(ctx context.Context, key multishard.Key, update func(plan *ShardPlan) (*ShardPlan, error)) error
+	Delete(ctx context.Context, key multishard.Key) error
+	DeleteShardPlan(ctx context.Context, key multishard.Key, check func(plan *ShardPlan) error) error
+	MoveShardPlan(ctx context.Context, from, to multishard.Key, plan *ShardPlan) error
+
+	ListKeys(ctx context.Context) ([]multishard.Key, error)
+	ListPrefix(ctx context.Context, prefix, after multishard.Key, limit int) ([]multishard.Key, error)
+	Scan(ctx context.Context, prefix, after multishard.Key, fn ScanFunc) error
+	ScanNames(ctx context.Context, bucket, prefix, after string, fn ScanFunc) error
+	KeysByServer(ctx context.Context, server multishard.ServerIdx) ([]multishard.Key, error)
+
+	StorePendingDeletion(ctx context.Context, pd *PendingDeletion) error
+	ListPendingDeletions(ctx context.Context) ([]*PendingDeletion, error)
+	RemovePendingDeletion(ctx context.Context, id string) error
+
+	StorePendingUpload(ctx context.Context, pu *PendingUpload) error
+	ListPendingUploads(ctx context.Context) ([]*PendingUpload, error)
+	RemovePendingUpload(ctx context.Context, id string) error
+
+	CreateBucket(ctx context.Context, b *Bucket) error
+	GetBucket(ctx context.Context, name string) (*Bucket, error)
+	UpdateBucket(ctx context.Context, name string, update func(b *Bucket) (*Bucket, error)) error
+	ListBuckets(ctx context.Context) ([]*Bucket, error)
+	DeleteBucket(ctx context.Context, name string) error
+
+	CreateMultipartUpload(ctx context.Context, mu *MultipartUpload) error
+	GetMultipartUpload(ctx context.Context, id string) (*MultipartUpload, error)
+	ListMultipartUploads(ctx context.Context) ([]*MultipartUpload, error)
+	DeleteMultipartUpload(ctx context.Context, id string) error
+
+	CreateResumableUpload(ctx context.Context, ru *ResumableUpload) error
+	GetResumableUpload(ctx context.Context, id string) (*ResumableUpload, error)
+	UpdateResumableUpload(ctx context.Context, id string, update func(ru *ResumableUpload) (*ResumableUpload, error)) error
+	ListResumableUploads(ctx context.Context) ([]*ResumableUpload, error)
+	DeleteResumableUpload(ctx context.Context, id string) error
+}
+
+// ScanFunc - gets every scanned plan in the order of the scan, returns false to stop the scan
+type ScanFunc func(key multishard.Key, plan *ShardPlan) (bool, error)
+
+// FileName - the name the plan was uploaded under, for plans stored before it was recorded
+// it is decoded from the key, the key itself is the best guess when it cannot be decoded
+func FileName(key multishard.Key, plan *ShardPlan) string {
+	if plan.Name != "" {
+		return plan.Name
+	}
+	if name, err := multishard.DecodeKey(key); err == nil {
+		return name
+	}
+	return string(key)
+}
+
+// TmpMetaStore - silly implementation only for local testing, one json file per key,
+// BoltMetaStore is the real one, MigrateMetaStore imports what was stored here
 // should also support file servers statistics
 type TmpMetaStore struct {
-	lg  logger.Logger
-	mx  sync.Mutex // todo: lock should be key specific
-	dir string
+	lg           logger.Logger
+	mx           sync.Mutex // todo: lock should be key specific
+	dir          string
+	deletionsDir string
+	pendingDir   string
+	bucketsDir   string
+	uploadsDir   string
+	resumableDir string
 }
 
 func NewTmpMetaStore(appName string, lg logger.Logger) (*TmpMetaStore, error) {
 	dir := fmt.Sprintf("tmp/%s/metastore", appName)
-	if err := os.MkdirAll(dir, 0644); err != nil {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	deletionsDir := fmt.Sprintf("tmp/%s/pending_deletions", appName)
+	if err := os.MkdirAll(deletionsDir, 0755); err != nil {
+		return nil, err
+	}
+	pendingDir := fmt.Sprintf("tmp/%s/pending_uploads", appName)
+	if err := os.MkdirAll(pendingDir, 0755); err != nil {
+		return nil, err
+	}
+	bucketsDir := fmt.Sprintf("tmp/%s/buckets", appName)
+	if err := os.MkdirAll(bucketsDir, 0755); err != nil {
+		return nil, err
+	}
+	uploadsDir := fmt.Sprintf("tmp/%s/multipart_uploads", appName)
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		return nil, err
+	}
+	resumableDir := fmt.Sprintf("tmp/%s/resumable_uploads", appName)
+	if err := os.MkdirAll(resumableDir, 0755); err != nil {
 		return nil, err
 	}
-	return &TmpMetaStore{lg: lg, dir: dir}, nil
+	return &TmpMetaStore{
+		lg:           lg,
+		dir:          dir,
+		deletionsDir: deletionsDir,
+		pendingDir:   pendingDir,
+		bucketsDir:   bucketsDir,
+		uploadsDir:   uploadsDir,
+		resumableDir: resumableDir,
+	}, nil
 }
 
 type Shard struct {
@@ -33,73 +132,514 @@ type Shard struct {
 	ServerIdx int    `json:"server_idx"`
 	Size      int    `json:"size"`
 	Checksum  uint32 `json:"checksum"`
+
+	// Key - the chunk is stored under on its server,
+	// empty for plans where every chunk was stored under the file key
+	Key multishard.Key `json:"key,omitempty"`
+
+	// Replicas - all servers holding a copy of the chunk, ServerIdx being the first of them,
+	// empty for plans stored before chunks were replicated
+	Replicas []int `json:"replicas,omitempty"`
+
+	// Fragments - data and parity shards of an erasure coded chunk, in coding order
+	Fragments []Fragment `json:"fragments,omitempty"`
+}
+
+// Fragment - one of the data or parity shards an erasure coded chunk is split into
+type Fragment struct {
+	Idx       int            `json:"idx"`
+	ServerIdx int            `json:"server_idx"`
+	Key       multishard.Key `json:"key"`
+	Size      int            `json:"size"`
+	Checksum  uint32         `json:"checksum"`
+}
+
+// ErasureCoding - parameters the chunks of a plan were encoded with
+type ErasureCoding struct {
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+}
+
+// Location - a key on a server holding a copy or a fragment of a chunk
+type Location struct {
+	Key       multishard.Key `json:"key"`
+	ServerIdx int            `json:"server_idx"`
+}
+
+// Servers - every server holding a copy of the chunk
+func (s Shard) Servers() []int {
+	if len(s.Replicas) == 0 {
+		return []int{s.ServerIdx}
+	}
+	return s.Replicas
+}
+
+// StorageKey - key the chunk is stored under on its server
+func (s Shard) StorageKey(fileKey multishard.Key) multishard.Key {
+	if s.Key == "" {
+		return fileKey
+	}
+	return s.Key
+}
+
+// Locations - everything stored on servers for the chunk
+func (s Shard) Locations(fileKey multishard.Key) []Location {
+	if len(s.Fragments) > 0 {
+		result := make([]Location, len(s.Fragments))
+		for i, f := range s.Fragments {
+			result[i] = Location{Key: f.Key, ServerIdx: f.ServerIdx}
+		}
+		return result
+	}
+
+	servers := s.Servers()
+	result := make([]Location, len(servers))
+	for i, serverIdx := range servers {
+		result[i] = Location{Key: s.StorageKey(fileKey), ServerIdx: serverIdx}
+	}
+	return result
 }
 
 type ShardPlan struct {
+	// Name - the file name the plan was uploaded under,
+	// empty for plans stored before it was recorded
+	Name string `json:"name,omitempty"`
+
 	OriginalSize int `json:"original_size"`
 
+	// ModifiedAt - when the upload was completed,
+	// zero for plans stored before it was recorded
+	ModifiedAt time.Time `json:"modified_at"`
+
+	// CreatedAt - when the first upload of the file was completed, it is kept when the file is uploaded again,
+	// zero for plans stored before it was recorded
+	CreatedAt time.Time `json:"created_at,omitempty"`
+
+	// ContentType - as sent with the upload, empty when it was not
+	ContentType string `json:"content_type,omitempty"`
+
+	// ContentHash - hex encoded SHA-256 of the whole content
+	ContentHash string `json:"content_hash,omitempty"`
+
+	// UserMeta - arbitrary metadata sent with the upload, it can be replaced without uploading the content again
+	UserMeta map[string]string `json:"user_meta,omitempty"`
+
+	// Replicas - copies every chunk is meant to have, zero for the number the cluster is configured with
+	Replicas int `json:"replicas,omitempty"`
+
+	// Erasure - set when chunks are erasure coded instead of replicated
+	Erasure *ErasureCoding `json:"erasure,omitempty"`
+
+	// ChecksumAlgo - checksum of every chunk as confirmed by its servers,
+	// empty for plans stored before chunk checksums were recorded
+	ChecksumAlgo string `json:"checksum_algo,omitempty"`
+
 	// Shards represent a shard for every chunk
 	Shards []Shard `json:"shards"`
 }
 
+// Locations - everything stored on servers for the file
+func (p *ShardPlan) Locations(fileKey multishard.Key) []Location {
+	var result []Location
+	for _, shard := range p.Shards {
+		result = append(result, shard.Locations(fileKey)...)
+	}
+	return result
+}
+
+// ServerIDs - distinct servers holding chunks or fragments of the plan
+func (p *ShardPlan) ServerIDs(fileKey multishard.Key) []multishard.ServerIdx {
+	var result []multishard.ServerIdx
+	seen := make(map[multishard.ServerIdx]struct{})
+	for _, loc := range p.Locations(fileKey) {
+		id := multishard.ServerIdx(loc.ServerIdx)
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		result = append(result, id)
+	}
+	return result
+}
+
+// Unreferenced - locations of the file that the plan does not use
+func (p *ShardPlan) Unreferenced(fileKey multishard.Key, locations []Location) []Location {
+	inUse := make(map[Location]struct{}, len(p.Shards))
+	for _, loc := range p.Locations(fileKey) {
+		inUse[loc] = struct{}{}
+	}
+
+	var result []Location
+	for _, loc := range locations {
+		if _, ok := inUse[loc]; !ok {
+			result = append(result, loc)
+		}
+	}
+	return result
+}
+
+// Bucket - a namespace of files with settings of its own
+type Bucket struct {
+	Name      string         `json:"name"`
+	CreatedAt time.Time      `json:"created_at"`
+	Settings  BucketSettings `json:"settings"`
+}
+
+// BucketSettings - how files of the bucket are stored, zero values fall back to the configuration
+type BucketSettings struct {
+	ChunkSize int64 `json:"chunk_size,omitempty"`
+	// Redundancy - replication or erasure
+	Redundancy          string `json:"redundancy,omitempty"`
+	Replicas            int    `json:"replicas,omitempty"`
+	ErasureDataShards   int    `json:"erasure_data_shards,omitempty"`
+	ErasureParityShards int    `json:"erasure_parity_shards,omitempty"`
+	// MaxObjectSize - in bytes, larger uploads are refused
+	MaxObjectSize int64 `json:"max_object_size,omitempty"`
+	// DefaultContentType - of uploads that are sent without one
+	DefaultContentType string `json:"default_content_type,omitempty"`
+}
+
+// MultipartUpload - a file uploaded in parts, every part is stored as a plan of its own
+// under multishard.PartKey until the parts are put together into the plan of the file
+type MultipartUpload struct {
+	ID          string            `json:"id"`
+	Bucket      string            `json:"bucket"`
+	Name        string            `json:"name"`
+	ContentType string            `json:"content_type,omitempty"`
+	UserMeta    map[string]string `json:"user_meta,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// ResumableUpload - a file uploaded over several requests, every chunk that fills up is stored as a plan
+// of its own under multishard.SegmentKey, the plan of the file is committed once the last byte arrives
+type ResumableUpload struct {
+	ID          string            `json:"id"`
+	Bucket      string            `json:"bucket"`
+	Name        string            `json:"name"`
+	Length      int64             `json:"length"`
+	ContentType string            `json:"content_type,omitempty"`
+	UserMeta    map[string]string `json:"user_meta,omitempty"`
+	// Metadata - the Upload-Metadata header the upload was created with, returned as it was sent
+	Metadata string `json:"metadata,omitempty"`
+
+	// how every chunk is stored, settled when the upload is created
+	Redundancy          string `json:"redundancy"`
+	ChunkSize           int64  `json:"chunk_size"`
+	Replicas            int    `json:"replicas,omitempty"`
+	ErasureDataShards   int    `json:"erasure_data_shards,omitempty"`
+	ErasureParityShards int    `json:"erasure_parity_shards,omitempty"`
+
+	// Stored - bytes of the segments on the file servers, what has arrived after them waits on the gateway
+	Stored   int64 `json:"stored"`
+	Segments int   `json:"segments"`
+	// HashState - the marshaled SHA-256 of the stored bytes
+	HashState []byte `json:"hash_state,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PendingDeletion - chunks of a deleted file that could not be removed from their servers yet
+type PendingDeletion struct {
+	ID        string         `json:"id"`
+	Key       multishard.Key `json:"key"`
+	Locations []Location     `json:"locations"`
+	CreatedAt time.Time      `json:"created_at"`
+
+	// Shards - how records made before locations were introduced list the chunks
+	Shards []Shard `json:"shards,omitempty"`
+}
+
+// Pending - locations that still have to be removed
+func (pd *PendingDeletion) Pending() []Location {
+	result := append([]Location(nil), pd.Locations...)
+	for _, shard := range pd.Shards {
+		result = append(result, shard.Locations(pd.Key)...)
+	}
+	return result
+}
+
+// PendingUpload - chunks an upload that is still running may have written, recorded before they are written,
+// so the chunks of an upload that never finished because its gateway went down can be found and removed
+type PendingUpload struct {
+	ID        string         `json:"id"`
+	Key       multishard.Key `json:"key"`
+	Locations []Location     `json:"locations"`
+	StartedAt time.Time      `json:"started_at"`
+	// UpdatedAt - when the upload last went on to another chunk
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ShardPlanBuilder - collects shards of chunks that are uploaded concurrently,
+// the number of chunks does not have to be known upfront
 type ShardPlanBuilder struct {
-	key          string
-	clusterEntry *ShardPlan
-	mx           sync.Mutex
+	key     string
+	erasure *ErasureCoding
+	shards  []Shard
+	added   []bool
+	mx      sync.Mutex
 }
 
-func NewShardPlanBuilder(key multishard.Key, originalSize, chunks int) *ShardPlanBuilder {
+func NewShardPlanBuilder(key multishard.Key) *ShardPlanBuilder {
+	return &ShardPlanBuilder{key: string(key)}
+}
+
+// NewErasureCodedPlanBuilder - a builder of a plan whose chunks are split into fragments
+func NewErasureCodedPlanBuilder(key multishard.Key, dataShards, parityShards int) *ShardPlanBuilder {
 	return &ShardPlanBuilder{
-		key: string(key),
-		clusterEntry: &ShardPlan{
-			OriginalSize: originalSize,
-			Shards:       make([]Shard, chunks),
-		},
+		key:     string(key),
+		erasure: &ErasureCoding{DataShards: dataShards, ParityShards: parityShards},
 	}
 }
 
-// AddShard - adds a new shard to a cluster map
-func (b *ShardPlanBuilder) AddShard(chunkIdx, serverIdx, size int) error {
+// AddShard - adds a new shard to a cluster map, the shard carries the checksum of its chunk
+func (b *ShardPlanBuilder) AddShard(shard Shard) error {
 	b.mx.Lock()
 	defer b.mx.Unlock()
-	if chunkIdx > len(b.clusterEntry.Shards)-1 || chunkIdx < 0 {
-		return fmt.Errorf("invalid chunk idx %d for key %s", chunkIdx, b.key)
+	if shard.ChunkIdx < 0 {
+		return fmt.Errorf("invalid chunk idx %d for key %s", shard.ChunkIdx, b.key)
+	}
+	if b.erasure != nil && len(shard.Fragments) != b.erasure.DataShards+b.erasure.ParityShards {
+		return fmt.Errorf("chunk %d of key %s has %d fragments", shard.ChunkIdx, b.key, len(shard.Fragments))
 	}
 
-	b.clusterEntry.Shards[chunkIdx] = Shard{
-		ChunkIdx:  chunkIdx,
-		ServerIdx: serverIdx,
-		Size:      size,
+	for len(b.shards) <= shard.ChunkIdx {
+		b.shards = append(b.shards, Shard{})
+		b.added = append(b.added, false)
 	}
 
+	b.shards[shard.ChunkIdx] = shard
+	b.added[shard.ChunkIdx] = true
+
 	return nil
 }
 
-func (b *ShardPlanBuilder) Build() *ShardPlan {
-	return b.clusterEntry
+// Build - makes a plan out of the added shards, every chunk up to the last one must have a shard
+func (b *ShardPlanBuilder) Build() (*ShardPlan, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	plan := &ShardPlan{
+		Erasure:      b.erasure,
+		ChecksumAlgo: multishard.ChecksumAlgo,
+		Shards:       make([]Shard, len(b.shards)),
+	}
+	for i, shard := range b.shards {
+		if !b.added[i] {
+			return nil, fmt.Errorf("no shard for chunk %d of key %s", i, b.key)
+		}
+		plan.Shards[i] = shard
+		plan.OriginalSize += shard.Size
+	}
+
+	return plan, nil
 }
 
 func (s *TmpMetaStore) Store(ctx context.Context, key multishard.Key, plan *ShardPlan) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.store(key, plan)
+}
+
+// store - replaces the plan file at once, so readers never see a partially written plan
+func (s *TmpMetaStore) store(key multishard.Key, plan *ShardPlan) error {
 	b, err := json.Marshal(plan)
 	if err != nil {
-		return err //todo: wrap
+		return fmt.Errorf("could not marshal shard plan for key %s: %w", key, err)
 	}
+
+	filePath := s.planPath(key)
+	tmpPath := fmt.Sprintf("%s/.%s.tmp", s.dir, tmpFileName(string(key)))
+	if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+		return fmt.Errorf("could not write shard plan for key %s: %w", key, err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("could not replace shard plan for key %s: %w", key, err)
+	}
+	return nil
+}
+
+// UpdateShardPlan - replaces the plan of the key with what update makes of the current one,
+// nothing else can change the plan in between, an error from update leaves the plan as it is
+func (s *TmpMetaStore) UpdateShardPlan(
+	ctx context.Context,
+	key multishard.Key,
+	update func(plan *ShardPlan) (*ShardPlan, error),
+) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	filePath := fmt.Sprintf("%s/%s", s.dir, key)
-	if err := os.WriteFile(filePath, b, 0644); err != nil {
-		return err //todo: wrap
+
+	current, err := s.getShardPlan(key)
+	if err != nil {
+		return err
+	}
+
+	updated, err := update(current)
+	if err != nil {
+		return err
+	}
+
+	return s.store(key, updated)
+}
+
+// ListKeys - keys of all stored shard plans
+func (s *TmpMetaStore) ListKeys(ctx context.Context) ([]multishard.Key, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read shard plans: %w", err)
+	}
+
+	result := make([]multishard.Key, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		result = append(result, multishard.Key(strings.ReplaceAll(e.Name(), "\\", "/")))
+	}
+	return result, nil
+}
+
+func (s *TmpMetaStore) planPath(key multishard.Key) string {
+	return fmt.Sprintf("%s/%s", s.dir, tmpFileName(string(key)))
+}
+
+// tmpFileName - keys of files in buckets have slashes, they are replaced with backslashes
+// which keys never have, so that every plan stays a single file of the directory
+func tmpFileName(key string) string {
+	return strings.ReplaceAll(key, "/", "\\")
+}
+
+// ListPrefix - keys starting with the prefix that sort after the given key, in ascending order,
+// at most limit of them unless it is 0
+func (s *TmpMetaStore) ListPrefix(ctx context.Context, prefix, after multishard.Key, limit int) ([]multishard.Key, error) {
+	keys, err := s.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	var result []multishard.Key
+	for _, key := range keys {
+		if !strings.HasPrefix(string(key), string(prefix)) || key <= after {
+			continue
+		}
+		result = append(result, key)
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Scan - calls fn with the plans of the keys starting with the prefix that sort after the given key,
+// plans stored or deleted during the scan may or may not be seen
+func (s *TmpMetaStore) Scan(ctx context.Context, prefix, after multishard.Key, fn ScanFunc) error {
+	keys, err := s.ListPrefix(ctx, prefix, after, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		plan, err := s.GetShardPlan(ctx, key)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return err
+		}
+		if more, err := fn(key, plan); err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanNames - reads every plan and sorts the ones in the bucket by name
+func (s *TmpMetaStore) ScanNames(ctx context.Context, bucket, prefix, after string, fn ScanFunc) error {
+	keys, err := s.ListKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	type named struct {
+		name string
+		key  multishard.Key
+		plan *ShardPlan
+	}
+	var found []named
+	for _, key := range keys {
+		if keyBucket(key) != bucket {
+			continue
+		}
+		plan, err := s.GetShardPlan(ctx, key)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return err
+		}
+		name := FileName(key, plan)
+		if strings.HasPrefix(name, prefix) && name > after {
+			found = append(found, named{name: name, key: key, plan: plan})
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].name != found[j].name {
+			return found[i].name < found[j].name
+		}
+		return found[i].key < found[j].key
+	})
+	for _, f := range found {
+		if more, err := fn(f.key, f.plan); err != nil || !more {
+			return err
+		}
 	}
 	return nil
 }
 
+// KeysByServer - keys of the files with chunks or fragments on the server, reads every plan
+func (s *TmpMetaStore) KeysByServer(ctx context.Context, server multishard.ServerIdx) ([]multishard.Key, error) {
+	keys, err := s.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []multishard.Key
+	for _, key := range keys {
+		plan, err := s.GetShardPlan(ctx, key)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		for _, id := range plan.ServerIDs(key) {
+			if id == server {
+				result = append(result, key)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
 func (s *TmpMetaStore) GetShardPlan(ctx context.Context, key multishard.Key) (*ShardPlan, error) {
 	s.mx.Lock()
 	defer s.mx.Unlock()
+	return s.getShardPlan(key)
+}
 
-	filePath := fmt.Sprintf("%s/%s", s.dir, key)
+func (s *TmpMetaStore) getShardPlan(key multishard.Key) (*ShardPlan, error) {
+	filePath := s.planPath(key)
 	f, err := os.Open(filePath)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("shard plan for key %s: %w", key, ErrNotFound)
+		}
 		return nil, err // todo: wrap
 	}
 	defer f.Close()
@@ -114,9 +654,500 @@ func (s *TmpMetaStore) GetShardPlan(ctx context.Context, key multishard.Key) (*S
 		return nil, err // todo: wrap
 	}
 
-	if len(plan.Shards) == 0 {
-		return nil, fmt.Errorf("should have retrieved some shards")
+	return &plan, nil
+}
+
+// Delete - removes the shard plan of the key
+func (s *TmpMetaStore) Delete(ctx context.Context, key multishard.Key) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.delete(key)
+}
+
+// DeleteShardPlan - removes the plan of the key unless check returns an error for the current one
+func (s *TmpMetaStore) DeleteShardPlan(ctx context.Context, key multishard.Key, check func(plan *ShardPlan) error) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	current, err := s.getShardPlan(key)
+	if err != nil {
+		return err
+	}
+	if err := check(current); err != nil {
+		return err
 	}
 
-	return &plan, nil
+	return s.delete(key)
+}
+
+func (s *TmpMetaStore) delete(key multishard.Key) error {
+	if err := os.Remove(s.planPath(key)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("shard plan for key %s: %w", key, ErrNotFound)
+		}
+		return fmt.Errorf("could not remove shard plan for key %s: %w", key, err)
+	}
+	return nil
+}
+
+// MoveShardPlan - stores the plan under another key and removes the old one,
+// fails with ErrAlreadyExists when the other key has a plan
+func (s *TmpMetaStore) MoveShardPlan(ctx context.Context, from, to multishard.Key, plan *ShardPlan) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, err := s.getShardPlan(from); err != nil {
+		return err
+	}
+	if _, err := s.getShardPlan(to); err == nil {
+		return fmt.Errorf("shard plan for key %s: %w", to, ErrAlreadyExists)
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if err := s.store(to, plan); err != nil {
+		return err
+	}
+	if err := os.Remove(s.planPath(from)); err != nil {
+		return fmt.Errorf("could not remove shard plan for key %s: %w", from, err)
+	}
+	return nil
+}
+
+// NewPendingDeletion - a pending deletion with an id that is unique even across deletions of the same key
+func NewPendingDeletion(key multishard.Key, locations []Location) *PendingDeletion {
+	now := time.Now()
+	return &PendingDeletion{
+		ID:        fmt.Sprintf("%s.%d", key, now.UnixNano()),
+		Key:       key,
+		Locations: locations,
+		CreatedAt: now,
+	}
+}
+
+// StorePendingDeletion - records chunks that still have to be removed from their servers,
+// replaces the previous record with the same id
+func (s *TmpMetaStore) StorePendingDeletion(ctx context.Context, pd *PendingDeletion) error {
+	b, err := json.Marshal(pd)
+	if err != nil {
+		return fmt.Errorf("could not marshal pending deletion for key %s: %w", pd.Key, err)
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	filePath := fmt.Sprintf("%s/%s", s.deletionsDir, tmpFileName(pd.ID))
+	if err := os.WriteFile(filePath, b, 0644); err != nil {
+		return fmt.Errorf("could not store pending deletion for key %s: %w", pd.Key, err)
+	}
+	return nil
+}
+
+// ListPendingDeletions - all recorded pending deletions
+func (s *TmpMetaStore) ListPendingDeletions(ctx context.Context) ([]*PendingDeletion, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	entries, err := os.ReadDir(s.deletionsDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read pending deletions: %w", err)
+	}
+
+	result := make([]*PendingDeletion, 0, len(entries))
+	for _, e := range entries {
+		b, err := os.ReadFile(fmt.Sprintf("%s/%s", s.deletionsDir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read pending deletion %s: %w", e.Name(), err)
+		}
+
+		var pd PendingDeletion
+		if err := json.Unmarshal(b, &pd); err != nil {
+			s.lg.Error(fmt.Errorf("skipping malformed pending deletion %s: %w", e.Name(), err))
+			continue
+		}
+		result = append(result, &pd)
+	}
+
+	return result, nil
+}
+
+// RemovePendingDeletion - forgets the pending deletion once all its chunks are gone
+func (s *TmpMetaStore) RemovePendingDeletion(ctx context.Context, id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	filePath := fmt.Sprintf("%s/%s", s.deletionsDir, tmpFileName(id))
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove pending deletion %s: %w", id, err)
+	}
+	return nil
+}
+
+// NewPendingUpload - a pending upload with an id that is unique even across uploads of the same key
+func NewPendingUpload(key multishard.Key) *PendingUpload {
+	now := time.Now()
+	return &PendingUpload{
+		ID:        fmt.Sprintf("%s.%d", key, now.UnixNano()),
+		Key:       key,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// StorePendingUpload - records the chunks of an upload that is running, replaces the previous record with the same id
+func (s *TmpMetaStore) StorePendingUpload(ctx context.Context, pu *PendingUpload) error {
+	b, err := json.Marshal(pu)
+	if err != nil {
+		return fmt.Errorf("could not marshal pending upload for key %s: %w", pu.Key, err)
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	filePath := fmt.Sprintf("%s/%s", s.pendingDir, tmpFileName(pu.ID))
+	if err := os.WriteFile(filePath, b, 0644); err != nil {
+		return fmt.Errorf("could not store pending upload for key %s: %w", pu.Key, err)
+	}
+	return nil
+}
+
+// ListPendingUploads - all recorded pending uploads
+func (s *TmpMetaStore) ListPendingUploads(ctx context.Context) ([]*PendingUpload, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	entries, err := os.ReadDir(s.pendingDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read pending uploads: %w", err)
+	}
+
+	result := make([]*PendingUpload, 0, len(entries))
+	for _, e := range entries {
+		b, err := os.ReadFile(fmt.Sprintf("%s/%s", s.pendingDir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read pending upload %s: %w", e.Name(), err)
+		}
+
+		var pu PendingUpload
+		if err := json.Unmarshal(b, &pu); err != nil {
+			s.lg.Error(fmt.Errorf("skipping malformed pending upload %s: %w", e.Name(), err))
+			continue
+		}
+		result = append(result, &pu)
+	}
+
+	return result, nil
+}
+
+// RemovePendingUpload - forgets the pending upload once it is committed or its chunks are taken care of
+func (s *TmpMetaStore) RemovePendingUpload(ctx context.Context, id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	filePath := fmt.Sprintf("%s/%s", s.pendingDir, tmpFileName(id))
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove pending upload %s: %w", id, err)
+	}
+	return nil
+}
+
+// CreateBucket - fails with ErrAlreadyExists when the bucket exists
+func (s *TmpMetaStore) CreateBucket(ctx context.Context, b *Bucket) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, err := s.getBucket(b.Name); err == nil {
+		return fmt.Errorf("bucket %s: %w", b.Name, ErrAlreadyExists)
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return s.storeBucket(b)
+}
+
+func (s *TmpMetaStore) GetBucket(ctx context.Context, name string) (*Bucket, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.getBucket(name)
+}
+
+// UpdateBucket - replaces the bucket with what update makes of the current one
+func (s *TmpMetaStore) UpdateBucket(ctx context.Context, name string, update func(b *Bucket) (*Bucket, error)) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	current, err := s.getBucket(name)
+	if err != nil {
+		return err
+	}
+	updated, err := update(current)
+	if err != nil {
+		return err
+	}
+	updated.Name = name
+	return s.storeBucket(updated)
+}
+
+// ListBuckets - all buckets in name order
+func (s *TmpMetaStore) ListBuckets(ctx context.Context) ([]*Bucket, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	entries, err := os.ReadDir(s.bucketsDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read buckets: %w", err)
+	}
+
+	result := make([]*Bucket, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		b, err := s.getBucket(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+// DeleteBucket - fails with ErrNotEmpty while files are stored in the bucket,
+// an upload that is completed meanwhile can still leave a file behind
+func (s *TmpMetaStore) DeleteBucket(ctx context.Context, name string) error {
+	keys, err := s.ListPrefix(ctx, multishard.BucketPrefix(name), "", 1)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return fmt.Errorf("bucket %s: %w", name, ErrNotEmpty)
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if err := os.Remove(fmt.Sprintf("%s/%s", s.bucketsDir, name)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("bucket %s: %w", name, ErrNotFound)
+		}
+		return fmt.Errorf("could not remove bucket %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *TmpMetaStore) getBucket(name string) (*Bucket, error) {
+	b, err := os.ReadFile(fmt.Sprintf("%s/%s", s.bucketsDir, name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("bucket %s: %w", name, ErrNotFound)
+		}
+		return nil, fmt.Errorf("could not read bucket %s: %w", name, err)
+	}
+
+	var bucket Bucket
+	if err := json.Unmarshal(b, &bucket); err != nil {
+		return nil, fmt.Errorf("could not unmarshal bucket %s: %w", name, err)
+	}
+	return &bucket, nil
+}
+
+func (s *TmpMetaStore) storeBucket(bucket *Bucket) error {
+	b, err := json.Marshal(bucket)
+	if err != nil {
+		return fmt.Errorf("could not marshal bucket %s: %w", bucket.Name, err)
+	}
+	if err := os.WriteFile(fmt.Sprintf("%s/%s", s.bucketsDir, bucket.Name), b, 0644); err != nil {
+		return fmt.Errorf("could not store bucket %s: %w", bucket.Name, err)
+	}
+	return nil
+}
+
+// CreateMultipartUpload - fails with ErrAlreadyExists when an upload with the id exists
+func (s *TmpMetaStore) CreateMultipartUpload(ctx context.Context, mu *MultipartUpload) error {
+	b, err := json.Marshal(mu)
+	if err != nil {
+		return fmt.Errorf("could not marshal multipart upload %s: %w", mu.ID, err)
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	f, err := os.OpenFile(fmt.Sprintf("%s/%s", s.uploadsDir, mu.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("multipart upload %s: %w", mu.ID, ErrAlreadyExists)
+		}
+		return fmt.Errorf("could not store multipart upload %s: %w", mu.ID, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		return fmt.Errorf("could not store multipart upload %s: %w", mu.ID, err)
+	}
+	return nil
+}
+
+func (s *TmpMetaStore) GetMultipartUpload(ctx context.Context, id string) (*MultipartUpload, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	b, err := os.ReadFile(fmt.Sprintf("%s/%s", s.uploadsDir, id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("multipart upload %s: %w", id, ErrNotFound)
+		}
+		return nil, fmt.Errorf("could not read multipart upload %s: %w", id, err)
+	}
+
+	var mu MultipartUpload
+	if err := json.Unmarshal(b, &mu); err != nil {
+		return nil, fmt.Errorf("could not unmarshal multipart upload %s: %w", id, err)
+	}
+	return &mu, nil
+}
+
+func (s *TmpMetaStore) ListMultipartUploads(ctx context.Context) ([]*MultipartUpload, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	entries, err := os.ReadDir(s.uploadsDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read multipart uploads: %w", err)
+	}
+
+	result := make([]*MultipartUpload, 0, len(entries))
+	for _, e := range entries {
+		b, err := os.ReadFile(fmt.Sprintf("%s/%s", s.uploadsDir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read multipart upload %s: %w", e.Name(), err)
+		}
+		var mu MultipartUpload
+		if err := json.Unmarshal(b, &mu); err != nil {
+			return nil, fmt.Errorf("could not unmarshal multipart upload %s: %w", e.Name(), err)
+		}
+		result = append(result, &mu)
+	}
+	return result, nil
+}
+
+func (s *TmpMetaStore) DeleteMultipartUpload(ctx context.Context, id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if err := os.Remove(fmt.Sprintf("%s/%s", s.uploadsDir, id)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("multipart upload %s: %w", id, ErrNotFound)
+		}
+		return fmt.Errorf("could not remove multipart upload %s: %w", id, err)
+	}
+	return nil
+}
+
+// CreateResumableUpload - fails with ErrAlreadyExists when an upload with the id exists
+func (s *TmpMetaStore) CreateResumableUpload(ctx context.Context, ru *ResumableUpload) error {
+	b, err := json.Marshal(ru)
+	if err != nil {
+		return fmt.Errorf("could not marshal resumable upload %s: %w", ru.ID, err)
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	f, err := os.OpenFile(fmt.Sprintf("%s/%s", s.resumableDir, ru.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("resumable upload %s: %w", ru.ID, ErrAlreadyExists)
+		}
+		return fmt.Errorf("could not store resumable upload %s: %w", ru.ID, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		return fmt.Errorf("could not store resumable upload %s: %w", ru.ID, err)
+	}
+	return nil
+}
+
+func (s *TmpMetaStore) GetResumableUpload(ctx context.Context, id string) (*ResumableUpload, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.readResumableUpload(id)
+}
+
+func (s *TmpMetaStore) UpdateResumableUpload(
+	ctx context.Context,
+	id string,
+	update func(ru *ResumableUpload) (*ResumableUpload, error),
+) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	current, err := s.readResumableUpload(id)
+	if err != nil {
+		return err
+	}
+	updated, err := update(current)
+	if err != nil {
+		return err
+	}
+	updated.ID = id
+
+	b, err := json.Marshal(updated)
+	if err != nil {
+		return fmt.Errorf("could not marshal resumable upload %s: %w", id, err)
+	}
+	if err := os.WriteFile(fmt.Sprintf("%s/%s", s.resumableDir, id), b, 0644); err != nil {
+		return fmt.Errorf("could not store resumable upload %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *TmpMetaStore) ListResumableUploads(ctx context.Context) ([]*ResumableUpload, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	entries, err := os.ReadDir(s.resumableDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read resumable uploads: %w", err)
+	}
+
+	result := make([]*ResumableUpload, 0, len(entries))
+	for _, e := range entries {
+		ru, err := s.readResumableUpload(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ru)
+	}
+	return result, nil
+}
+
+func (s *TmpMetaStore) DeleteResumableUpload(ctx context.Context, id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if err := os.Remove(fmt.Sprintf("%s/%s", s.resumableDir, id)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("resumable upload %s: %w", id, ErrNotFound)
+		}
+		return fmt.Errorf("could not remove resumable upload %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *TmpMetaStore) readResumableUpload(id string) (*ResumableUpload, error) {
+	b, err := os.ReadFile(fmt.Sprintf("%s/%s", s.resumableDir, id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("resumable upload %s: %w", id, ErrNotFound)
+		}
+		return nil, fmt.Errorf("could not read resumable upload %s: %w", id, err)
+	}
+
+	var ru ResumableUpload
+	if err := json.Unmarshal(b, &ru); err != nil {
+		return nil, fmt.Errorf("could not unmarshal resumable upload %s: %w", id, err)
+	}
+	return &ru, nil
 }
@@ -0,0 +1,221 @@
+package metastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"strings"
+)
+
+// MigrationStats - what a migration copied
+type MigrationStats struct {
+	Plans            int
+	PendingDeletions int
+	Buckets          int
+	PendingUploads   int
+	MultipartUploads int
+	ResumableUploads int
+}
+
+// MigrateMetaStore - copies every bucket, shard plan, pending deletion and the records of running uploads
+// from one meta store to the other, so the cleanup still knows the chunks of uploads in flight and they can
+// go on against the destination. What the destination already has under the same key or id is replaced,
+// so a migration can be run again
+func MigrateMetaStore(ctx context.Context, from, to MetaStore) (MigrationStats, error) {
+	var stats MigrationStats
+
+	buckets, err := from.ListBuckets(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("could not list buckets to migrate: %w", err)
+	}
+	for _, b := range buckets {
+		err := to.CreateBucket(ctx, b)
+		if errors.Is(err, ErrAlreadyExists) {
+			err = to.UpdateBucket(ctx, b.Name, func(*Bucket) (*Bucket, error) { return b, nil })
+		}
+		if err != nil {
+			return stats, fmt.Errorf("could not migrate bucket %s: %w", b.Name, err)
+		}
+		stats.Buckets++
+	}
+
+	keys, err := from.ListKeys(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("could not list shard plans to migrate: %w", err)
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+
+		plan, err := from.GetShardPlan(ctx, key)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return stats, fmt.Errorf("could not read shard plan of %s: %w", key, err)
+		}
+		if err := to.Store(ctx, key, plan); err != nil {
+			return stats, fmt.Errorf("could not migrate shard plan of %s: %w", key, err)
+		}
+		stats.Plans++
+	}
+
+	deletions, err := from.ListPendingDeletions(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("could not list pending deletions to migrate: %w", err)
+	}
+	for _, pd := range deletions {
+		if err := to.StorePendingDeletion(ctx, pd); err != nil {
+			return stats, fmt.Errorf("could not migrate pending deletion %s: %w", pd.ID, err)
+		}
+		stats.PendingDeletions++
+	}
+
+	if err := migrateUploads(ctx, from, to, &stats); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// migrateUploads - copies the records of pending, multipart and resumable uploads
+func migrateUploads(ctx context.Context, from, to MetaStore, stats *MigrationStats) error {
+	pending, err := from.ListPendingUploads(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list pending uploads to migrate: %w", err)
+	}
+	for _, pu := range pending {
+		if err := to.StorePendingUpload(ctx, pu); err != nil {
+			return fmt.Errorf("could not migrate pending upload %s: %w", pu.ID, err)
+		}
+		stats.PendingUploads++
+	}
+
+	multipart, err := from.ListMultipartUploads(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list multipart uploads to migrate: %w", err)
+	}
+	for _, mu := range multipart {
+		err := to.CreateMultipartUpload(ctx, mu)
+		if errors.Is(err, ErrAlreadyExists) {
+			if err = to.DeleteMultipartUpload(ctx, mu.ID); err == nil {
+				err = to.CreateMultipartUpload(ctx, mu)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("could not migrate multipart upload %s: %w", mu.ID, err)
+		}
+		stats.MultipartUploads++
+	}
+
+	resumable, err := from.ListResumableUploads(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list resumable uploads to migrate: %w", err)
+	}
+	for _, ru := range resumable {
+		err := to.CreateResumableUpload(ctx, ru)
+		if errors.Is(err, ErrAlreadyExists) {
+			err = to.UpdateResumableUpload(ctx, ru.ID, func(*ResumableUpload) (*ResumableUpload, error) { return ru, nil })
+		}
+		if err != nil {
+			return fmt.Errorf("could not migrate resumable upload %s: %w", ru.ID, err)
+		}
+		stats.ResumableUploads++
+	}
+
+	return nil
+}
+
+// KeyMigrationStats - what a key migration did
+type KeyMigrationStats struct {
+	Moved int
+	// Conflicts - keys left as they are since the plan of another file is stored under their new key
+	Conflicts []multishard.Key
+	// Unnamed - keys with underscores left as they are since their plan was stored before names
+	// were recorded and no original name was given for them
+	Unnamed []multishard.Key
+}
+
+// MigrateKeys - moves plans stored under keys of the previous scheme, which replaced spaces, slashes
+// and dots with underscores, to the keys of their names. The name is the recorded one or else the one
+// names has for the key, a key without underscores is the name itself. What was replaced cannot be told
+// apart anymore, so plans with neither are left as they are and reported. Chunks stay where they are,
+// plans of chunks stored under the file key get it as the key of every chunk
+func MigrateKeys(ctx context.Context, store MetaStore, names map[multishard.Key]string) (KeyMigrationStats, error) {
+	var stats KeyMigrationStats
+
+	keys, err := store.ListKeys(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("could not list shard plans to migrate: %w", err)
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+
+		plan, err := store.GetShardPlan(ctx, key)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return stats, fmt.Errorf("could not read shard plan of %s: %w", key, err)
+		}
+
+		// files in buckets were stored under keys of the current scheme from the start
+		if strings.HasPrefix(string(key), "/") {
+			continue
+		}
+
+		name := plan.Name
+		if name == "" {
+			name = names[key]
+		}
+		if name == "" && !strings.Contains(string(key), "_") {
+			// nothing was replaced in the key
+			name = string(key)
+		}
+		if name == "" {
+			stats.Unnamed = append(stats.Unnamed, key)
+			continue
+		}
+		newKey, err := multishard.ResolveKey(name)
+		if err != nil {
+			return stats, fmt.Errorf("could not resolve the key of %q: %w", name, err)
+		}
+		if newKey == key {
+			// the name is recorded so the plan is not reported as unnamed again
+			if plan.Name == "" {
+				if err := store.UpdateShardPlan(ctx, key, func(current *ShardPlan) (*ShardPlan, error) {
+					next := *current
+					next.Name = name
+					return &next, nil
+				}); err != nil {
+					return stats, fmt.Errorf("could not record the name of %s: %w", key, err)
+				}
+			}
+			continue
+		}
+
+		plan.Name = name
+		for i := range plan.Shards {
+			if plan.Shards[i].Key == "" && len(plan.Shards[i].Fragments) == 0 {
+				plan.Shards[i].Key = key
+			}
+		}
+
+		if err := store.MoveShardPlan(ctx, key, newKey, plan); err != nil {
+			if errors.Is(err, ErrAlreadyExists) {
+				stats.Conflicts = append(stats.Conflicts, key)
+				continue
+			}
+			return stats, fmt.Errorf("could not move shard plan of %s to %s: %w", key, newKey, err)
+		}
+		stats.Moved++
+	}
+
+	return stats, nil
+}
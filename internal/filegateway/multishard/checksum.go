@@ -0,0 +1,21 @@
+package multishard
+
+import (
+	"hash"
+	"hash/crc32"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumAlgo - name of the checksum recorded in shard plans
+const ChecksumAlgo = "crc32c"
+
+// Checksum - CRC32C of the data, the same checksum file servers use
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+// NewChecksum - computes the same checksum as Checksum over streamed data
+func NewChecksum() hash.Hash32 {
+	return crc32.New(crcTable)
+}
@@ -4,25 +4,200 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
 var (
 	ErrInvalidFilename = errors.New("invalid file name")
+	ErrInvalidKey      = errors.New("invalid key")
+	ErrInvalidBucket   = errors.New("invalid bucket name")
 )
 
+// MaxFilenameLength - in bytes
+const MaxFilenameLength = 1024
+
+const upperHex = "0123456789ABCDEF"
+
 type Key string
 
-// ResolveKey - makes a key out of a filename
-// silly implementation
+// ResolveKey - makes a key out of a filename, different names never share a key and
+// DecodeKey gives the name back. Names may be hierarchical like photos/2024/a.png,
+// the separators are escaped so that they cannot be mistaken for the ones of chunk keys
 func ResolveKey(fileName string) (Key, error) {
 	if fileName == "" {
 		return "", fmt.Errorf("cannot build a storage key without filename: %w", ErrInvalidFilename)
 	}
+	if len(fileName) > MaxFilenameLength {
+		return "", fmt.Errorf("file name is longer than %d bytes: %w", MaxFilenameLength, ErrInvalidFilename)
+	}
+	if !utf8.ValidString(fileName) || strings.IndexByte(fileName, 0) >= 0 {
+		return "", fmt.Errorf("file name %q: %w", fileName, ErrInvalidFilename)
+	}
+
+	return KeyPrefix(fileName), nil
+}
+
+// ObjectKey - key of the file in the bucket, files outside of buckets are keyed by their name alone.
+// Keys of files in buckets start with a slash, ResolveKey escapes a leading one,
+// so neither the keys of different buckets nor the ones outside of buckets ever collide
+func ObjectKey(bucket, fileName string) (Key, error) {
+	key, err := ResolveKey(fileName)
+	if err != nil || bucket == "" {
+		return key, err
+	}
+	if err := ValidateBucketName(bucket); err != nil {
+		return "", err
+	}
+	return BucketPrefix(bucket) + key, nil
+}
+
+// BucketPrefix - every key of a file in the bucket starts with it
+func BucketPrefix(bucket string) Key {
+	return Key("/" + bucket + "/")
+}
+
+// BucketsEnd - sorts after every key of a file in a bucket and before every key outside of buckets
+const BucketsEnd Key = "/\xff"
+
+// uploadsPrefix - parts of multipart uploads are kept under it, bucket names cannot start with a dot,
+// so it is the prefix of no bucket
+const uploadsPrefix = "/.uploads/"
+
+// PartKey - key of a part of a multipart upload until the upload is completed
+func PartKey(uploadID string, partNumber int) Key {
+	return Key(fmt.Sprintf("%s%s/%05d", uploadsPrefix, uploadID, partNumber))
+}
+
+// PartsPrefix - every key of a part of the multipart upload starts with it
+func PartsPrefix(uploadID string) Key {
+	return Key(uploadsPrefix + uploadID + "/")
+}
+
+// resumablePrefix - chunks of resumable uploads are kept under it until the upload is completed
+const resumablePrefix = "/.resumable/"
+
+// SegmentKey - key of the n-th chunk that filled up in a resumable upload, stored as a plan of its own
+func SegmentKey(uploadID string, n int) Key {
+	return Key(fmt.Sprintf("%s%s/%08d", resumablePrefix, uploadID, n))
+}
+
+// SegmentsPrefix - every key of a segment of the resumable upload starts with it
+func SegmentsPrefix(uploadID string) Key {
+	return Key(resumablePrefix + uploadID + "/")
+}
+
+// ValidateBucketName - 3 to 63 lowercase letters, digits, dots and hyphens,
+// starting and ending with a letter or a digit, the names are valid in DNS and in S3
+func ValidateBucketName(name string) error {
+	if len(name) < 3 || len(name) > 63 {
+		return fmt.Errorf("%q has to be 3 to 63 characters long: %w", name, ErrInvalidBucket)
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case (c == '.' || c == '-') && i > 0 && i < len(name)-1:
+		default:
+			return fmt.Errorf("%q: %w", name, ErrInvalidBucket)
+		}
+	}
+	if strings.Contains(name, "..") {
+		return fmt.Errorf("%q: %w", name, ErrInvalidBucket)
+	}
+	return nil
+}
+
+// KeyPrefix - encodes the beginning of a name, keys of all names starting with it start with the result
+// since every byte is encoded on its own
+func KeyPrefix(prefix string) Key {
+	var sb strings.Builder
+	sb.Grow(len(prefix))
+	for i := 0; i < len(prefix); i++ {
+		c := prefix[i]
+		if shouldEscape(c, i) {
+			sb.WriteByte('%')
+			sb.WriteByte(upperHex[c>>4])
+			sb.WriteByte(upperHex[c&15])
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return Key(sb.String())
+}
+
+// shouldEscape - the escape character itself, separators of chunk keys, whitespace and anything
+// that is not printable ASCII, a leading dot would make a hidden file of the key on disk
+func shouldEscape(c byte, i int) bool {
+	switch {
+	case c == '%', c == '/', c == '\\':
+		return true
+	case c <= ' ', c >= 0x7f:
+		return true
+	case c == '.' && i == 0:
+		return true
+	}
+	return false
+}
+
+// DecodeKey - the file name the key was resolved from, the bucket part of the key is skipped
+func DecodeKey(key Key) (string, error) {
+	s := string(key)
+	if strings.HasPrefix(s, "/") {
+		i := strings.IndexByte(s[1:], '/')
+		if i < 0 {
+			return "", fmt.Errorf("%q has no bucket: %w", key, ErrInvalidKey)
+		}
+		s = s[i+2:]
+	}
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			if shouldEscape(c, sb.Len()) {
+				return "", fmt.Errorf("%q has an unescaped %q: %w", key, c, ErrInvalidKey)
+			}
+			sb.WriteByte(c)
+			continue
+		}
 
-	fileName = strings.ReplaceAll(fileName, " ", "_")
-	fileName = strings.ReplaceAll(fileName, "/", "_")
-	fileName = strings.ReplaceAll(fileName, ".", "_")
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("%q ends in an incomplete escape: %w", key, ErrInvalidKey)
+		}
+		hi, lo := strings.IndexByte(upperHex, s[i+1]), strings.IndexByte(upperHex, s[i+2])
+		if hi < 0 || lo < 0 {
+			return "", fmt.Errorf("%q has an invalid escape: %w", key, ErrInvalidKey)
+		}
+		b := byte(hi<<4 | lo)
+		if !shouldEscape(b, sb.Len()) {
+			// every name has exactly one key
+			return "", fmt.Errorf("%q escapes %q needlessly: %w", key, b, ErrInvalidKey)
+		}
+		sb.WriteByte(b)
+		i += 2
+	}
+
+	name := sb.String()
+	if name == "" || !utf8.ValidString(name) {
+		return "", fmt.Errorf("%q: %w", key, ErrInvalidKey)
+	}
+	return name, nil
+}
+
+// ChunkKey - where the chunk of the file is placed on the hash ring,
+// chunks stored before uploads had generations are stored under it as well
+func ChunkKey(key Key, chunkIdx ChunkIdx) Key {
+	return Key(fmt.Sprintf("%s/%d", key, chunkIdx))
+}
+
+// UploadChunkKey - key a single chunk of one upload of the file is stored under on its server,
+// so that several chunks of one file can live on the same server and an upload of the file
+// never overwrites the chunks of the previous one before its plan replaces the previous plan
+func UploadChunkKey(key Key, generation string, chunkIdx ChunkIdx) Key {
+	return Key(fmt.Sprintf("%s/%d.%s", key, chunkIdx, generation))
+}
 
-	// logic with buckets would require extra work - this is a temp solution
-	return Key(fmt.Sprintf("%s", fileName)), nil
+// FragmentKey - key a data or parity fragment of an erasure coded chunk of one upload of the file is stored under
+func FragmentKey(key Key, generation string, chunkIdx ChunkIdx, fragmentIdx int) Key {
+	return Key(fmt.Sprintf("%s/%d.%s/%d", key, chunkIdx, generation, fragmentIdx))
 }
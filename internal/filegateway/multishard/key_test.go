@@ -0,0 +1,109 @@
+package multishard
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestResolveKey_IsCollisionFreeAndReversible(t *testing.T) {
+	names := []string{
+		"a.png", "a_png", "a png", "a/png", "a%2Fpng", "a\\png",
+		".hidden", "..", "photos/2024/a.png", "photos/2024/", "naïve résumé.txt", "a/0",
+	}
+
+	seen := make(map[Key]string)
+	for _, name := range names {
+		key, err := ResolveKey(name)
+		if err != nil {
+			t.Fatalf("ResolveKey(%q) error = %v", name, err)
+		}
+		if other, ok := seen[key]; ok {
+			t.Errorf("%q and %q share key %q", name, other, key)
+		}
+		seen[key] = name
+
+		if strings.ContainsAny(string(key), "/ ") || strings.HasPrefix(string(key), ".") {
+			t.Errorf("key %q of %q cannot be used as a chunk key prefix or a file name", key, name)
+		}
+
+		decoded, err := DecodeKey(key)
+		if err != nil || decoded != name {
+			t.Errorf("DecodeKey(%q) = %q, %v, want %q", key, decoded, err, name)
+		}
+	}
+
+	// a chunk key of one file is never the key of another
+	for _, chunk := range []Key{ChunkKey("a", 0), UploadChunkKey("a", "1f", 0), FragmentKey("a", "1f", 0, 1)} {
+		if _, ok := seen[chunk]; ok {
+			t.Errorf("chunk key %q is the key of a file", chunk)
+		}
+	}
+}
+
+func TestKeyPrefix_PrefixesKeysOfNamesWithThePrefix(t *testing.T) {
+	for _, name := range []string{"photos/2024/a.png", ".config/app", "100% done"} {
+		key, _ := ResolveKey(name)
+		for i := 1; i <= len(name); i++ {
+			if prefix := KeyPrefix(name[:i]); !strings.HasPrefix(string(key), string(prefix)) {
+				t.Errorf("key %q of %q does not start with %q of %q", key, name, prefix, name[:i])
+			}
+		}
+	}
+}
+
+func TestResolveKey_RejectsInvalidNames(t *testing.T) {
+	for _, name := range []string{"", "nul\x00byte", "\xff\xfe", strings.Repeat("a", MaxFilenameLength+1)} {
+		if _, err := ResolveKey(name); !errors.Is(err, ErrInvalidFilename) {
+			t.Errorf("ResolveKey(%q) error = %v, want ErrInvalidFilename", name, err)
+		}
+	}
+}
+
+func TestDecodeKey_RejectsKeysNoNameResolvesTo(t *testing.T) {
+	for _, key := range []Key{"", "a/b", "a b", ".a", "a%2", "a%2f", "a%41", "a%ZZ"} {
+		if name, err := DecodeKey(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("DecodeKey(%q) = %q, %v, want ErrInvalidKey", key, name, err)
+		}
+	}
+}
+
+func TestObjectKey_NamespacesKeysByBucket(t *testing.T) {
+	plain, _ := ObjectKey("", "photos/a.png")
+	inBucket, _ := ObjectKey("photos", "a.png")
+	inOther, _ := ObjectKey("photos2", "a.png")
+	slashed, _ := ObjectKey("", "/photos/a.png")
+
+	keys := map[Key]bool{plain: true, inBucket: true, inOther: true, slashed: true}
+	if len(keys) != 4 {
+		t.Fatalf("keys collide: %v", keys)
+	}
+
+	for _, key := range []Key{inBucket, inOther} {
+		if key <= "/" || key >= BucketsEnd {
+			t.Errorf("key %q of a file in a bucket sorts outside of buckets", key)
+		}
+	}
+	for _, key := range []Key{plain, slashed} {
+		if key > "/" && key < BucketsEnd {
+			t.Errorf("key %q of a file outside of buckets sorts among buckets", key)
+		}
+	}
+
+	if name, err := DecodeKey(inBucket); err != nil || name != "a.png" {
+		t.Errorf("DecodeKey(%q) = %q, %v, want a.png", inBucket, name, err)
+	}
+}
+
+func TestValidateBucketName(t *testing.T) {
+	for _, name := range []string{"abc", "my-bucket.v2", "0day"} {
+		if err := ValidateBucketName(name); err != nil {
+			t.Errorf("ValidateBucketName(%q) error = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "ab", "My-Bucket", "-abc", "abc.", "a..b", "a/b", "a_b", strings.Repeat("a", 64)} {
+		if err := ValidateBucketName(name); !errors.Is(err, ErrInvalidBucket) {
+			t.Errorf("ValidateBucketName(%q) error = %v, want ErrInvalidBucket", name, err)
+		}
+	}
+}
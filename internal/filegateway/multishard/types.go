@@ -1,7 +1,8 @@
 package multishard
 
 type (
-	ChunkIdx  int
+	ChunkIdx int
+	// ServerIdx - stable id of a file server, its FS_ID
 	ServerIdx int
 	ShardMap  map[ChunkIdx]ServerIdx
 )
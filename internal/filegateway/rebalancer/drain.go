@@ -0,0 +1,135 @@
+package rebalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/shardmanager"
+	"github.com/denismitr/shardstore/internal/filegateway/topology"
+	"time"
+)
+
+var (
+	ErrNotDraining = errors.New("server is not draining")
+	ErrCannotDrain = errors.New("server cannot be drained")
+)
+
+// DrainStatus - whether anything still points at a draining server
+type DrainStatus struct {
+	ServerID multishard.ServerIdx `json:"server_id"`
+	Draining bool                 `json:"draining"`
+
+	// Files - files with chunks or fragments on the server
+	Files int `json:"files"`
+	// References - chunk copies and fragments on the server referenced by shard plans
+	References int `json:"references"`
+	// Uploads - running uploads that write chunks to the server, their plans will reference it
+	Uploads int `json:"uploads"`
+
+	// SafeToRemove - the server drains, no rebalance is running, no upload writes to it
+	// and no shard plan references it
+	SafeToRemove bool      `json:"safe_to_remove"`
+	CheckedAt    time.Time `json:"checked_at"`
+}
+
+// Drain - stops placing new chunks on the server and starts a rebalance that moves its chunks away,
+// the server is marked as draining in the saved topology so it keeps draining after a restart
+func (r *Rebalancer) Drain(ctx context.Context, server multishard.ServerIdx) error {
+	r.topologyMx.Lock()
+	defer r.topologyMx.Unlock()
+
+	topo, err := r.topologies.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("could not load cluster topology: %w", err)
+	}
+
+	if err := topo.Drain(server); err != nil {
+		return err
+	}
+
+	// a server that drains already is off the ring
+	if _, err := r.shardManager.RemoveServer(server); err != nil {
+		if errors.Is(err, shardmanager.ErrInvalidNumberOfServers) {
+			return fmt.Errorf("%w: %w", ErrCannotDrain, err)
+		}
+		if !errors.Is(err, shardmanager.ErrUnknownServer) {
+			return fmt.Errorf("could not take server %d off the ring: %w", server, err)
+		}
+	}
+
+	if err := r.topologies.Save(ctx, topo); err != nil {
+		return fmt.Errorf("could not save cluster topology: %w", err)
+	}
+
+	r.lg.Debugf("server %d is draining, cluster topology version %d", server, topo.Version)
+	r.queue()
+	return nil
+}
+
+// DrainStatus - counts references to the draining server in the shard plans of the files indexed on it
+// and the running uploads that write to it
+func (r *Rebalancer) DrainStatus(ctx context.Context, server multishard.ServerIdx) (*DrainStatus, error) {
+	topo, err := r.topologies.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not load cluster topology: %w", err)
+	}
+
+	s, ok := topo.Server(server)
+	if !ok {
+		return nil, fmt.Errorf("server %d: %w", server, topology.ErrUnknownServer)
+	}
+	if !s.Draining {
+		return nil, fmt.Errorf("server %d: %w", server, ErrNotDraining)
+	}
+
+	// uploads that chose their servers before the drain took the server off the ring can still
+	// commit plans that reference it, they are recorded as pending before they write to it and
+	// until their plan is committed, so they are looked at before the plans to miss none of them
+	running := r.Progress().Running
+
+	status := &DrainStatus{ServerID: server, Draining: true}
+	uploads, err := r.metaStore.ListPendingUploads(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list pending uploads: %w", err)
+	}
+	for _, pu := range uploads {
+		for _, loc := range pu.Locations {
+			if multishard.ServerIdx(loc.ServerIdx) == server {
+				status.Uploads++
+				break
+			}
+		}
+	}
+
+	keys, err := r.metaStore.KeysByServer(ctx, server)
+	if err != nil {
+		return nil, fmt.Errorf("could not list files on server %d: %w", server, err)
+	}
+
+	for _, key := range keys {
+		plan, err := r.metaStore.GetShardPlan(ctx, key)
+		if err != nil {
+			if errors.Is(err, metastore.ErrNotFound) {
+				continue
+			}
+			return nil, fmt.Errorf("could not get shard plan of %s: %w", key, err)
+		}
+
+		n := 0
+		for _, loc := range plan.Locations(key) {
+			if multishard.ServerIdx(loc.ServerIdx) == server {
+				n++
+			}
+		}
+		if n > 0 {
+			status.Files++
+			status.References += n
+		}
+	}
+
+	status.SafeToRemove = status.References == 0 && status.Uploads == 0 && !running && !r.Progress().Running
+	status.CheckedAt = time.Now().UTC()
+	return status, nil
+}
@@ -0,0 +1,522 @@
+package rebalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/common/throttle"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/remotestore"
+	"github.com/denismitr/shardstore/internal/filegateway/shardmanager"
+	"github.com/denismitr/shardstore/internal/filegateway/topology"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAlreadyRunning = errors.New("rebalance is already running")
+	ErrIncomplete     = errors.New("some chunks could not be moved")
+
+	errPlanChanged = errors.New("shard plan changed during rebalance")
+)
+
+// progressLogEvery - how many files are rebalanced between progress log lines
+const progressLogEvery = 100
+
+type shardManager interface {
+	ResolveReplicas(key multishard.Key, chunkIdx multishard.ChunkIdx) ([]multishard.ServerIdx, error)
+	ResolveServers(key multishard.Key, chunkIdx multishard.ChunkIdx, n int) ([]multishard.ServerIdx, error)
+	RemoveServer(server multishard.ServerIdx) ([]shardmanager.MovedRange, error)
+}
+
+type remoteStorage interface {
+	Get(ctx context.Context, key multishard.Key, serverID multishard.ServerIdx, w io.Writer) (int, error)
+	Put(ctx context.Context, key multishard.Key, serverID multishard.ServerIdx, r io.Reader) (uint32, error)
+	Delete(ctx context.Context, key multishard.Key, serverID multishard.ServerIdx) error
+}
+
+type metaStorage interface {
+	ListKeys(ctx context.Context) ([]multishard.Key, error)
+	KeysByServer(ctx context.Context, server multishard.ServerIdx) ([]multishard.Key, error)
+	GetShardPlan(ctx context.Context, key multishard.Key) (*metastore.ShardPlan, error)
+	UpdateShardPlan(
+		ctx context.Context,
+		key multishard.Key,
+		update func(plan *metastore.ShardPlan) (*metastore.ShardPlan, error),
+	) error
+	StorePendingDeletion(ctx context.Context, pd *metastore.PendingDeletion) error
+	ListPendingUploads(ctx context.Context) ([]*metastore.PendingUpload, error)
+}
+
+type topologyStorage interface {
+	Load(ctx context.Context) (*topology.Topology, error)
+	Save(ctx context.Context, t *topology.Topology) error
+}
+
+// Progress - how far the current or the last rebalance got
+type Progress struct {
+	Running     bool      `json:"running"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Files       int       `json:"files"`
+	Scanned     int       `json:"scanned"`
+	MovedChunks int       `json:"moved_chunks"`
+	MovedBytes  int64     `json:"moved_bytes"`
+	Failed      int       `json:"failed"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Rebalancer - moves chunks to the servers that own them after the cluster changed
+type Rebalancer struct {
+	cfg          *config.Config
+	lg           logger.Logger
+	shardManager shardManager
+	remoteStore  remoteStorage
+	metaStore    metaStorage
+	topologies   topologyStorage
+
+	trigger chan struct{}
+
+	mx       sync.Mutex
+	progress Progress
+
+	// topologyMx - serializes changes of the saved topology
+	topologyMx sync.Mutex
+}
+
+func NewRebalancer(
+	cfg *config.Config,
+	shardManager shardManager,
+	remoteStore remoteStorage,
+	metaStore metaStorage,
+	topologies topologyStorage,
+	lg logger.Logger,
+) *Rebalancer {
+	return &Rebalancer{
+		cfg:          cfg,
+		lg:           lg,
+		shardManager: shardManager,
+		remoteStore:  remoteStore,
+		metaStore:    metaStore,
+		topologies:   topologies,
+		trigger:      make(chan struct{}, 1),
+	}
+}
+
+// Trigger - asks the background loop to start a rebalance
+func (r *Rebalancer) Trigger() error {
+	if r.Progress().Running {
+		return ErrAlreadyRunning
+	}
+
+	r.queue()
+	return nil
+}
+
+// queue - makes the background loop run a rebalance once it is done with the current one
+func (r *Rebalancer) queue() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+		// one is already queued
+	}
+}
+
+// RunBackground - runs a rebalance every time one is triggered until the context is done
+func (r *Rebalancer) RunBackground(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.trigger:
+			if _, err := r.Run(ctx); err != nil && ctx.Err() == nil {
+				r.lg.Error(fmt.Errorf("rebalance failed: %w", err))
+			}
+		}
+	}
+}
+
+// Progress - a snapshot of the progress of the current or the last rebalance
+func (r *Rebalancer) Progress() Progress {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.progress
+}
+
+func (r *Rebalancer) report(f func(p *Progress)) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	f(&r.progress)
+}
+
+// Run - walks every shard plan, copies chunks to their current owners, updates the plan
+// and then deletes the old copies, the copying rate is limited by FG_REBALANCE_RATE,
+// a rebalance that moved everything clears the pending rebalance of the topology it started with
+func (r *Rebalancer) Run(ctx context.Context) (Progress, error) {
+	r.mx.Lock()
+	if r.progress.Running {
+		r.mx.Unlock()
+		return Progress{}, ErrAlreadyRunning
+	}
+	r.progress = Progress{Running: true, StartedAt: time.Now().UTC()}
+	r.mx.Unlock()
+
+	err := r.run(ctx)
+
+	r.report(func(p *Progress) {
+		p.Running = false
+		p.FinishedAt = time.Now().UTC()
+		if err != nil {
+			p.Error = err.Error()
+		}
+	})
+
+	progress := r.Progress()
+	r.lg.Debugf(
+		"rebalance finished: %d of %d files scanned, %d chunks moved, %d bytes copied, %d failed",
+		progress.Scanned, progress.Files, progress.MovedChunks, progress.MovedBytes, progress.Failed,
+	)
+
+	return progress, err
+}
+
+func (r *Rebalancer) run(ctx context.Context) error {
+	topo, err := r.topologies.Load(ctx)
+	if err != nil && !errors.Is(err, topology.ErrNotFound) {
+		return fmt.Errorf("could not load cluster topology: %w", err)
+	}
+
+	keys, err := r.metaStore.ListKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list files to rebalance: %w", err)
+	}
+	r.report(func(p *Progress) { p.Files = len(keys) })
+
+	t := throttle.New(r.cfg.RebalanceRate)
+	for i, key := range keys {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		moved, bytesMoved, failed, err := r.rebalanceFile(ctx, t, key)
+		if err != nil {
+			r.lg.Error(fmt.Errorf("could not rebalance %s: %w", key, err))
+			if failed == 0 {
+				// the file could not even be looked at
+				failed = 1
+			}
+		}
+		r.report(func(p *Progress) {
+			p.Scanned++
+			p.MovedChunks += moved
+			p.MovedBytes += bytesMoved
+			p.Failed += failed
+		})
+
+		if (i+1)%progressLogEvery == 0 {
+			progress := r.Progress()
+			r.lg.Debugf("rebalance: %d of %d files scanned, %d chunks moved", progress.Scanned, progress.Files, progress.MovedChunks)
+		}
+	}
+
+	if failed := r.Progress().Failed; failed > 0 {
+		return fmt.Errorf("%d chunks are left on their previous servers: %w", failed, ErrIncomplete)
+	}
+
+	if topo != nil && topo.RebalancePending {
+		return r.completeTopology(ctx, topo.Version)
+	}
+	return nil
+}
+
+// completeTopology - clears the pending rebalance unless the topology changed again meanwhile
+func (r *Rebalancer) completeTopology(ctx context.Context, version int) error {
+	r.topologyMx.Lock()
+	defer r.topologyMx.Unlock()
+
+	topo, err := r.topologies.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("could not load cluster topology: %w", err)
+	}
+	if topo.Version != version {
+		return nil
+	}
+
+	topo.RebalancePending = false
+	topo.UpdatedAt = time.Now().UTC()
+	if err := r.topologies.Save(ctx, topo); err != nil {
+		return fmt.Errorf("could not save cluster topology: %w", err)
+	}
+	return nil
+}
+
+// rebalanceFile - moves the chunks of the file to their owners unless its plan changed meanwhile, returns moved chunks, copied bytes and failed chunks
+func (r *Rebalancer) rebalanceFile(ctx context.Context, t *throttle.Throttle, key multishard.Key) (int, int64, int, error) {
+	plan, err := r.metaStore.GetShardPlan(ctx, key)
+	if err != nil {
+		if errors.Is(err, metastore.ErrNotFound) {
+			return 0, 0, 0, nil
+		}
+		return 0, 0, 0, err
+	}
+
+	updated := *plan
+	updated.Shards = append([]metastore.Shard(nil), plan.Shards...)
+
+	var copied []metastore.Location
+	var bytesCopied int64
+	var firstErr error
+	moved, failed := 0, 0
+	for i, shard := range plan.Shards {
+		target, locations, n, err := r.moveShard(ctx, t, key, plan, shard)
+		copied = append(copied, locations...)
+		bytesCopied += n
+		if err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if !sameLocations(target.Locations(key), shard.Locations(key)) {
+			updated.Shards[i] = target
+			moved++
+		}
+	}
+
+	if moved == 0 {
+		r.discard(ctx, key, copied)
+		return 0, bytesCopied, failed, firstErr
+	}
+
+	err = r.metaStore.UpdateShardPlan(ctx, key, func(current *metastore.ShardPlan) (*metastore.ShardPlan, error) {
+		if !samePlan(key, current, plan) {
+			return nil, errPlanChanged
+		}
+		// anything but the shards could have been changed meanwhile
+		next := *current
+		next.Shards = updated.Shards
+		return &next, nil
+	})
+	if err != nil {
+		// the copies are not referenced by any plan
+		r.discard(ctx, key, copied)
+		if errors.Is(err, errPlanChanged) || errors.Is(err, metastore.ErrNotFound) {
+			return 0, bytesCopied, 0, nil
+		}
+		return 0, bytesCopied, failed + moved, fmt.Errorf("could not update shard plan: %w", err)
+	}
+
+	r.deleteStale(ctx, key, updated.Unreferenced(key, plan.Locations(key)))
+
+	return moved, bytesCopied, failed, firstErr
+}
+
+// moveShard - copies the chunk or its fragments to the servers that own them now,
+// returns the shard as it is after the move, the locations written and the bytes copied
+func (r *Rebalancer) moveShard(
+	ctx context.Context,
+	t *throttle.Throttle,
+	key multishard.Key,
+	plan *metastore.ShardPlan,
+	shard metastore.Shard,
+) (metastore.Shard, []metastore.Location, int64, error) {
+	if len(shard.Fragments) > 0 {
+		return r.moveFragments(ctx, t, key, shard)
+	}
+
+	owners, err := r.resolveOwners(key, plan, shard)
+	if err != nil {
+		return shard, nil, 0, err
+	}
+
+	// chunks of plans that stored every chunk under the file key get a key of their own,
+	// otherwise they would overwrite other chunks of the file on their new servers
+	targetKey := shard.Key
+	if targetKey == "" {
+		targetKey = multishard.ChunkKey(key, multishard.ChunkIdx(shard.ChunkIdx))
+	}
+
+	current := make(map[multishard.ServerIdx]bool, len(shard.Servers()))
+	if targetKey == shard.StorageKey(key) {
+		for _, server := range shard.Servers() {
+			current[multishard.ServerIdx(server)] = true
+		}
+	}
+
+	var missing []multishard.ServerIdx
+	for _, owner := range owners {
+		if !current[owner] {
+			missing = append(missing, owner)
+		}
+	}
+
+	target := shard
+	target.Key = targetKey
+	target.ServerIdx = int(owners[0])
+	target.Replicas = make([]int, len(owners))
+	for i, owner := range owners {
+		target.Replicas[i] = int(owner)
+	}
+
+	if len(missing) == 0 {
+		if len(current) > len(owners) {
+			// every owner has a copy already, the ones on servers that are not owners are dropped
+			return target, nil, 0, nil
+		}
+		return shard, nil, 0, nil
+	}
+
+	data, err := r.fetchChunk(ctx, key, plan, shard)
+	if err != nil {
+		return shard, nil, 0, err
+	}
+
+	var copied []metastore.Location
+	var n int64
+	for _, server := range missing {
+		if err := r.copyTo(ctx, t, targetKey, server, data); err != nil {
+			return shard, copied, n, fmt.Errorf("could not copy chunk %d to server %d: %w", shard.ChunkIdx, server, err)
+		}
+		copied = append(copied, metastore.Location{Key: targetKey, ServerIdx: int(server)})
+		n += int64(len(data))
+	}
+
+	return target, copied, n, nil
+}
+
+// resolveOwners - servers that should hold copies of the chunk, as many as the plan was uploaded with
+func (r *Rebalancer) resolveOwners(key multishard.Key, plan *metastore.ShardPlan, shard metastore.Shard) ([]multishard.ServerIdx, error) {
+	if plan.Replicas > 0 {
+		return r.shardManager.ResolveServers(key, multishard.ChunkIdx(shard.ChunkIdx), plan.Replicas)
+	}
+	return r.shardManager.ResolveReplicas(key, multishard.ChunkIdx(shard.ChunkIdx))
+}
+
+// moveFragments - copies every fragment of an erasure coded chunk that is not on its owner
+func (r *Rebalancer) moveFragments(
+	ctx context.Context,
+	t *throttle.Throttle,
+	key multishard.Key,
+	shard metastore.Shard,
+) (metastore.Shard, []metastore.Location, int64, error) {
+	owners, err := r.shardManager.ResolveServers(key, multishard.ChunkIdx(shard.ChunkIdx), len(shard.Fragments))
+	if err != nil {
+		return shard, nil, 0, err
+	}
+
+	target := shard
+	target.Fragments = append([]metastore.Fragment(nil), shard.Fragments...)
+	var copied []metastore.Location
+	var n int64
+	for i, f := range shard.Fragments {
+		if multishard.ServerIdx(f.ServerIdx) == owners[i] {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if _, err := r.remoteStore.Get(ctx, f.Key, multishard.ServerIdx(f.ServerIdx), &buf); err != nil {
+			return shard, copied, n, fmt.Errorf("could not get fragment %s from server %d: %w", f.Key, f.ServerIdx, err)
+		}
+		if buf.Len() != f.Size || multishard.Checksum(buf.Bytes()) != f.Checksum {
+			return shard, copied, n, fmt.Errorf("fragment %s on server %d does not match its checksum", f.Key, f.ServerIdx)
+		}
+
+		if err := r.copyTo(ctx, t, f.Key, owners[i], buf.Bytes()); err != nil {
+			return shard, copied, n, fmt.Errorf("could not copy fragment %s to server %d: %w", f.Key, owners[i], err)
+		}
+		copied = append(copied, metastore.Location{Key: f.Key, ServerIdx: int(owners[i])})
+		n += int64(buf.Len())
+		target.Fragments[i].ServerIdx = int(owners[i])
+	}
+
+	target.ServerIdx = target.Fragments[0].ServerIdx
+	return target, copied, n, nil
+}
+
+// fetchChunk - reads the chunk from the first of its replicas that has an intact copy
+func (r *Rebalancer) fetchChunk(ctx context.Context, key multishard.Key, plan *metastore.ShardPlan, shard metastore.Shard) ([]byte, error) {
+	var lastErr error
+	for _, server := range shard.Servers() {
+		var buf bytes.Buffer
+		if _, err := r.remoteStore.Get(ctx, shard.StorageKey(key), multishard.ServerIdx(server), &buf); err != nil {
+			lastErr = err
+			continue
+		}
+		if buf.Len() != shard.Size {
+			lastErr = fmt.Errorf("copy on server %d has %d bytes instead of %d", server, buf.Len(), shard.Size)
+			continue
+		}
+		if plan.ChecksumAlgo == multishard.ChecksumAlgo && multishard.Checksum(buf.Bytes()) != shard.Checksum {
+			lastErr = fmt.Errorf("copy on server %d does not match its checksum", server)
+			continue
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("no intact copy of chunk %d: %w", shard.ChunkIdx, lastErr)
+}
+
+func (r *Rebalancer) copyTo(ctx context.Context, t *throttle.Throttle, key multishard.Key, server multishard.ServerIdx, data []byte) error {
+	if err := t.Wait(ctx, len(data)); err != nil {
+		return err
+	}
+	_, err := r.remoteStore.Put(ctx, key, server, bytes.NewReader(data))
+	return err
+}
+
+// deleteStale - removes copies the updated plan no longer uses, the ones that fail are left to the cleanup,
+// copies on servers that left the cluster cannot be reached anymore and are forgotten
+func (r *Rebalancer) deleteStale(ctx context.Context, key multishard.Key, locations []metastore.Location) {
+	var remaining []metastore.Location
+	for _, loc := range locations {
+		err := r.remoteStore.Delete(ctx, loc.Key, multishard.ServerIdx(loc.ServerIdx))
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, remotestore.ErrServerIDInvalid) {
+			r.lg.Debugf("server %d of %s is not in the cluster anymore, leaving it as is", loc.ServerIdx, loc.Key)
+			continue
+		}
+		r.lg.Error(fmt.Errorf("could not delete %s of %s from server %d: %w", loc.Key, key, loc.ServerIdx, err))
+		remaining = append(remaining, loc)
+	}
+
+	r.discard(ctx, key, remaining)
+}
+
+// discard - hands the locations over to the cleanup of pending deletions,
+// which skips any of them a plan references by then
+func (r *Rebalancer) discard(ctx context.Context, key multishard.Key, locations []metastore.Location) {
+	if len(locations) == 0 {
+		return
+	}
+	if err := r.metaStore.StorePendingDeletion(ctx, metastore.NewPendingDeletion(key, locations)); err != nil {
+		r.lg.Error(fmt.Errorf("could not record %d locations of %s left behind by rebalance: %w", len(locations), key, err))
+	}
+}
+
+// samePlan - whether the plan still describes the same upload stored in the same places
+func samePlan(key multishard.Key, a, b *metastore.ShardPlan) bool {
+	if !a.ModifiedAt.Equal(b.ModifiedAt) || a.OriginalSize != b.OriginalSize {
+		return false
+	}
+
+	return sameLocations(a.Locations(key), b.Locations(key))
+}
+
+func sameLocations(a, b []metastore.Location) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,345 @@
+package rebalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/shardmanager"
+	"github.com/denismitr/shardstore/internal/filegateway/topology"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeShardManager - every chunk is owned by the first servers
+type fakeShardManager struct {
+	servers  []multishard.ServerIdx
+	replicas int
+}
+
+func (sm *fakeShardManager) ResolveReplicas(key multishard.Key, chunkIdx multishard.ChunkIdx) ([]multishard.ServerIdx, error) {
+	return sm.ResolveServers(key, chunkIdx, sm.replicas)
+}
+
+func (sm *fakeShardManager) ResolveServers(_ multishard.Key, _ multishard.ChunkIdx, n int) ([]multishard.ServerIdx, error) {
+	if n > len(sm.servers) {
+		return nil, shardmanager.ErrInvalidNumberOfServers
+	}
+	return sm.servers[:n], nil
+}
+
+func (sm *fakeShardManager) RemoveServer(server multishard.ServerIdx) ([]shardmanager.MovedRange, error) {
+	for i, s := range sm.servers {
+		if s == server {
+			if len(sm.servers)-1 < sm.replicas {
+				return nil, shardmanager.ErrInvalidNumberOfServers
+			}
+			sm.servers = append(sm.servers[:i:i], sm.servers[i+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, shardmanager.ErrUnknownServer
+}
+
+type location struct {
+	key    multishard.Key
+	server multishard.ServerIdx
+}
+
+type fakeRemoteStore struct {
+	mx      sync.Mutex
+	chunks  map[location][]byte
+	deleted []location
+}
+
+func (s *fakeRemoteStore) Get(_ context.Context, key multishard.Key, serverID multishard.ServerIdx, w io.Writer) (int, error) {
+	s.mx.Lock()
+	data, ok := s.chunks[location{key, serverID}]
+	s.mx.Unlock()
+	if !ok {
+		return 0, errors.New("no such chunk")
+	}
+	return w.Write(data)
+}
+
+func (s *fakeRemoteStore) Put(_ context.Context, key multishard.Key, serverID multishard.ServerIdx, r io.Reader) (uint32, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	s.mx.Lock()
+	s.chunks[location{key, serverID}] = data
+	s.mx.Unlock()
+	return multishard.Checksum(data), nil
+}
+
+func (s *fakeRemoteStore) Delete(_ context.Context, key multishard.Key, serverID multishard.ServerIdx) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.chunks, location{key, serverID})
+	s.deleted = append(s.deleted, location{key, serverID})
+	return nil
+}
+
+// fakeMetaStore - onUpdate runs before an update is applied, to change the plan under the rebalancer
+type fakeMetaStore struct {
+	plans    map[multishard.Key]*metastore.ShardPlan
+	pending  []*metastore.PendingDeletion
+	uploads  []*metastore.PendingUpload
+	onUpdate func()
+}
+
+func (s *fakeMetaStore) ListKeys(_ context.Context) ([]multishard.Key, error) {
+	var keys []multishard.Key
+	for key := range s.plans {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *fakeMetaStore) KeysByServer(_ context.Context, server multishard.ServerIdx) ([]multishard.Key, error) {
+	var keys []multishard.Key
+	for key, plan := range s.plans {
+		for _, id := range plan.ServerIDs(key) {
+			if id == server {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (s *fakeMetaStore) GetShardPlan(_ context.Context, key multishard.Key) (*metastore.ShardPlan, error) {
+	plan, ok := s.plans[key]
+	if !ok {
+		return nil, metastore.ErrNotFound
+	}
+	return plan, nil
+}
+
+func (s *fakeMetaStore) UpdateShardPlan(
+	_ context.Context,
+	key multishard.Key,
+	update func(plan *metastore.ShardPlan) (*metastore.ShardPlan, error),
+) error {
+	if s.onUpdate != nil {
+		s.onUpdate()
+	}
+	plan, err := update(s.plans[key])
+	if err != nil {
+		return err
+	}
+	s.plans[key] = plan
+	return nil
+}
+
+func (s *fakeMetaStore) StorePendingDeletion(_ context.Context, pd *metastore.PendingDeletion) error {
+	s.pending = append(s.pending, pd)
+	return nil
+}
+
+func (s *fakeMetaStore) ListPendingUploads(_ context.Context) ([]*metastore.PendingUpload, error) {
+	return s.uploads, nil
+}
+
+type fakeTopologies struct {
+	topo *topology.Topology
+}
+
+func (s *fakeTopologies) Load(_ context.Context) (*topology.Topology, error) {
+	if s.topo == nil {
+		return nil, topology.ErrNotFound
+	}
+	t := *s.topo
+	t.Servers = append([]topology.Server(nil), s.topo.Servers...)
+	return &t, nil
+}
+
+func (s *fakeTopologies) Save(_ context.Context, t *topology.Topology) error {
+	s.topo = t
+	return nil
+}
+
+const testKey = multishard.Key("file")
+
+func newTestCluster(data []byte) (*fakeRemoteStore, *fakeMetaStore) {
+	chunkKey := multishard.ChunkKey(testKey, 0)
+	rs := &fakeRemoteStore{chunks: map[location][]byte{{chunkKey, 1}: data}}
+	ms := &fakeMetaStore{plans: map[multishard.Key]*metastore.ShardPlan{
+		testKey: {
+			OriginalSize: len(data),
+			ModifiedAt:   time.Now().UTC(),
+			ChecksumAlgo: multishard.ChecksumAlgo,
+			Shards: []metastore.Shard{{
+				ChunkIdx:  0,
+				ServerIdx: 1,
+				Size:      len(data),
+				Checksum:  multishard.Checksum(data),
+				Key:       chunkKey,
+			}},
+		},
+	}}
+	return rs, ms
+}
+
+func TestRebalancer_MovesChunksToTheirOwners(t *testing.T) {
+	data := []byte("chunk that has to move")
+	rs, ms := newTestCluster(data)
+	topologies := &fakeTopologies{topo: &topology.Topology{Version: 2, RebalancePending: true}}
+
+	rb := NewRebalancer(&config.Config{}, &fakeShardManager{servers: []multishard.ServerIdx{2}, replicas: 1}, rs, ms, topologies, logger.NewStdoutLogger(logger.Dev, "test"))
+	progress, err := rb.Run(context.Background())
+	if err != nil {
+		t.Fatalf("rebalance failed: %v", err)
+	}
+	if progress.MovedChunks != 1 || progress.MovedBytes != int64(len(data)) {
+		t.Errorf("expected 1 chunk of %d bytes to be moved, got %+v", len(data), progress)
+	}
+
+	chunkKey := multishard.ChunkKey(testKey, 0)
+	if got := rs.chunks[location{chunkKey, 2}]; !bytes.Equal(got, data) {
+		t.Errorf("expected the chunk on server 2, got %q", got)
+	}
+	if _, ok := rs.chunks[location{chunkKey, 1}]; ok {
+		t.Errorf("expected the chunk to be deleted from server 1")
+	}
+	if shard := ms.plans[testKey].Shards[0]; shard.ServerIdx != 2 {
+		t.Errorf("expected the plan to point at server 2, got %d", shard.ServerIdx)
+	}
+	if topologies.topo.RebalancePending {
+		t.Errorf("expected the pending rebalance to be cleared")
+	}
+
+	// nothing is left to move
+	progress, err = rb.Run(context.Background())
+	if err != nil {
+		t.Fatalf("second rebalance failed: %v", err)
+	}
+	if progress.MovedChunks != 0 {
+		t.Errorf("expected nothing to move on the second run, got %d chunks", progress.MovedChunks)
+	}
+}
+
+func TestRebalancer_DoesNotOverwriteAPlanChangedMeanwhile(t *testing.T) {
+	data := []byte("chunk that was uploaded again")
+	rs, ms := newTestCluster(data)
+	reuploaded := *ms.plans[testKey]
+	reuploaded.ModifiedAt = reuploaded.ModifiedAt.Add(time.Second)
+	ms.onUpdate = func() { ms.plans[testKey] = &reuploaded }
+
+	rb := NewRebalancer(&config.Config{}, &fakeShardManager{servers: []multishard.ServerIdx{2}, replicas: 1}, rs, ms, &fakeTopologies{}, logger.NewStdoutLogger(logger.Dev, "test"))
+	if _, err := rb.Run(context.Background()); err != nil {
+		t.Fatalf("rebalance failed: %v", err)
+	}
+
+	if ms.plans[testKey] != &reuploaded {
+		t.Fatalf("expected the new upload to be kept")
+	}
+	if _, ok := rs.chunks[location{multishard.ChunkKey(testKey, 0), 1}]; !ok {
+		t.Errorf("expected the chunk the new plan references to be kept")
+	}
+	if len(ms.pending) != 1 || len(ms.pending[0].Locations) != 1 || ms.pending[0].Locations[0].ServerIdx != 2 {
+		t.Errorf("expected the unused copy on server 2 to be left to the cleanup, got %+v", ms.pending)
+	}
+}
+
+func TestRebalancer_DrainMovesEverythingOffTheServer(t *testing.T) {
+	data := []byte("chunk on a server that is retired")
+	rs, ms := newTestCluster(data)
+	chunkKey := multishard.ChunkKey(testKey, 0)
+	rs.chunks[location{chunkKey, 2}] = data
+	ms.plans[testKey].Shards[0].Replicas = []int{1, 2}
+
+	topologies := &fakeTopologies{topo: &topology.Topology{
+		Version: 1,
+		Servers: []topology.Server{{ID: 1, Weight: 1}, {ID: 2, Weight: 1}, {ID: 3, Weight: 1}},
+	}}
+	sm := &fakeShardManager{servers: []multishard.ServerIdx{1, 2, 3}, replicas: 2}
+	rb := NewRebalancer(&config.Config{}, sm, rs, ms, topologies, logger.NewStdoutLogger(logger.Dev, "test"))
+	ctx := context.Background()
+
+	if _, err := rb.DrainStatus(ctx, 1); !errors.Is(err, ErrNotDraining) {
+		t.Fatalf("expected ErrNotDraining, got %v", err)
+	}
+	if err := rb.Drain(ctx, 4); !errors.Is(err, topology.ErrUnknownServer) {
+		t.Fatalf("expected ErrUnknownServer, got %v", err)
+	}
+
+	if err := rb.Drain(ctx, 1); err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+	if topologies.topo.Version != 2 || !topologies.topo.RebalancePending {
+		t.Errorf("expected version 2 with a pending rebalance, got %+v", topologies.topo)
+	}
+	if err := rb.Drain(ctx, 2); !errors.Is(err, ErrCannotDrain) {
+		t.Errorf("expected ErrCannotDrain with only 2 servers left for 2 replicas, got %v", err)
+	}
+
+	status, err := rb.DrainStatus(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.SafeToRemove || status.Files != 1 || status.References != 1 {
+		t.Errorf("expected server 1 to be referenced by 1 file, got %+v", status)
+	}
+
+	if _, err := rb.Run(ctx); err != nil {
+		t.Fatalf("rebalance failed: %v", err)
+	}
+
+	// an upload that chose server 1 before the drain has not committed its plan yet
+	running := metastore.NewPendingUpload("other.txt")
+	running.Locations = []metastore.Location{{Key: "other.txt/0.1f", ServerIdx: 1}}
+	ms.uploads = []*metastore.PendingUpload{running}
+	status, err = rb.DrainStatus(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.SafeToRemove || status.References != 0 || status.Uploads != 1 {
+		t.Errorf("expected the running upload to keep server 1 from being removed, got %+v", status)
+	}
+
+	ms.uploads = nil
+	status, err = rb.DrainStatus(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.SafeToRemove || status.References != 0 {
+		t.Errorf("expected server 1 to be safe to remove, got %+v", status)
+	}
+	if _, ok := rs.chunks[location{chunkKey, 1}]; ok {
+		t.Errorf("expected the chunk to be deleted from server 1")
+	}
+	if got := rs.chunks[location{chunkKey, 3}]; !bytes.Equal(got, data) {
+		t.Errorf("expected the chunk to be copied to server 3, got %q", got)
+	}
+	if replicas := ms.plans[testKey].Shards[0].Replicas; len(replicas) != 2 || replicas[0] != 2 || replicas[1] != 3 {
+		t.Errorf("expected the chunk on servers 2 and 3, got %v", replicas)
+	}
+}
+
+func TestRebalancer_KeepsTheReplicasThePlanWasUploadedWith(t *testing.T) {
+	data := []byte("chunk of a bucket with more replicas")
+	rs, ms := newTestCluster(data)
+	ms.plans[testKey].Replicas = 2
+
+	sm := &fakeShardManager{servers: []multishard.ServerIdx{1, 2, 3}, replicas: 1}
+	rb := NewRebalancer(&config.Config{}, sm, rs, ms, &fakeTopologies{}, logger.NewStdoutLogger(logger.Dev, "test"))
+	if _, err := rb.Run(context.Background()); err != nil {
+		t.Fatalf("rebalance failed: %v", err)
+	}
+
+	shard := ms.plans[testKey].Shards[0]
+	if len(shard.Replicas) != 2 || shard.Replicas[0] != 1 || shard.Replicas[1] != 2 {
+		t.Errorf("expected copies on servers 1 and 2, got %v", shard.Replicas)
+	}
+	if got := rs.chunks[location{multishard.ChunkKey(testKey, 0), 2}]; !bytes.Equal(got, data) {
+		t.Errorf("expected the missing copy on server 2, got %q", got)
+	}
+}
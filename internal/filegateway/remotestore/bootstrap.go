@@ -11,19 +11,44 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 )
 
-func bootstrapClients(cfg *config.Config) (map[multishard.ServerIdx]storeserverv1.FileServiceClient, error) {
+// bootstrapClients - connects to every configured server and asks for its id,
+// clients are known by the ids, so the order of the addresses does not matter
+func bootstrapClients(cfg *config.Config) (map[multishard.ServerIdx]storeserverv1.FileServiceClient, []Server, error) {
 	result := make(map[multishard.ServerIdx]storeserverv1.FileServiceClient, len(cfg.StorageServers))
-	for idx, remoteServer := range cfg.StorageServers {
+	servers := make([]Server, 0, len(cfg.StorageServers))
+	for _, remoteServer := range cfg.StorageServers {
 		conn, err := connect(cfg, remoteServer)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		result[multishard.ServerIdx(idx)] = storeserverv1.NewFileServiceClient(conn)
 		closer.Add(func() error {
 			return conn.Close()
 		})
+
+		client := storeserverv1.NewFileServiceClient(conn)
+		id, err := serverID(cfg, client)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not identify remote storage server %s: %w", remoteServer, err)
+		}
+		if _, ok := result[id]; ok {
+			return nil, nil, fmt.Errorf("remote storage server %s has id %d of another server: %w", remoteServer, id, ErrDuplicateServerID)
+		}
+
+		result[id] = client
+		servers = append(servers, Server{ID: id, Addr: remoteServer})
+	}
+	return result, servers, nil
+}
+
+func serverID(cfg *config.Config, client storeserverv1.FileServiceClient) (multishard.ServerIdx, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.StorageServerTimeout)
+	defer cancel()
+
+	resp, err := client.Info(ctx, &storeserverv1.InfoRequest{})
+	if err != nil {
+		return 0, err
 	}
-	return result, nil
+	return multishard.ServerIdx(resp.Id), nil
 }
 
 func connect(cfg *config.Config, remoteServer string) (*grpc.ClientConn, error) {
@@ -8,67 +8,129 @@ import (
 	"github.com/denismitr/shardstore/internal/filegateway/config"
 	"github.com/denismitr/shardstore/internal/filegateway/multishard"
 	storeserverv1 "github.com/denismitr/shardstore/pkg/storeserver/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
 	"sync"
+	"time"
 )
 
 type GRPCStore struct {
-	cfg    *config.Config
-	client map[multishard.ServerIdx]storeserverv1.FileServiceClient
-	mx     sync.RWMutex
-	lg     logger.Logger
+	cfg     *config.Config
+	client  map[multishard.ServerIdx]storeserverv1.FileServiceClient
+	servers []Server
+	mx      sync.RWMutex
+	lg      logger.Logger
+}
+
+// Server - a file server the store is connected to
+type Server struct {
+	ID   multishard.ServerIdx
+	Addr string
 }
 
 func NewGRPCStore(
 	cfg *config.Config,
 	lg logger.Logger,
 ) (*GRPCStore, error) {
-	clients, err := bootstrapClients(cfg)
+	clients, servers, err := bootstrapClients(cfg)
 	if err != nil {
 		return nil, err
 	}
-	return &GRPCStore{cfg: cfg, client: clients, lg: lg}, nil
+	return &GRPCStore{cfg: cfg, client: clients, servers: servers, lg: lg}, nil
+}
+
+// Servers - ids and addresses of the connected servers in the configured order
+func (s *GRPCStore) Servers() []Server {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return append([]Server(nil), s.servers...)
 }
 
 var (
-	ErrServerIDInvalid = errors.New("server id is invalid")
+	ErrServerIDInvalid   = errors.New("server id is invalid")
+	ErrChecksumMismatch  = errors.New("checksum mismatch")
+	ErrDuplicateServerID = errors.New("duplicate server id")
+	ErrChunkNotFound     = errors.New("chunk not found")
 )
 
 const bufSize = 4 * 1024
 
+// ChunkStat - what a file server knows about a stored chunk
+type ChunkStat struct {
+	Size       int64
+	Checksum   uint32
+	ModifiedAt time.Time
+}
+
+// ListedChunk - a chunk a file server holds
+type ListedChunk struct {
+	Key multishard.Key
+	ChunkStat
+}
+
+// Put - streams the value to the server and returns its checksum, the checksum of what was sent
+// goes with the last message so the server discards the value instead of committing it when
+// what it received does not match, a value a server that does not check it committed is deleted
 func (s *GRPCStore) Put(
 	ctx context.Context,
 	key multishard.Key,
 	serverIdx multishard.ServerIdx,
 	r io.Reader,
-) error {
+) (uint32, error) {
 	s.mx.RLock()
 	client, ok := s.client[serverIdx]
 	if !ok {
 		s.mx.RUnlock()
-		return ErrServerIDInvalid // todo: wrap
+		return 0, ErrServerIDInvalid // todo: wrap
 	}
 	s.mx.RUnlock()
 
+	// cancelling the stream is the only way to make the server discard a partial upload,
+	// closing it would commit whatever was sent so far
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// todo: key into the outgoing context
 	upload, err := client.Upload(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to obtain upload client: %w", err)
+		return 0, fmt.Errorf("failed to obtain upload client: %w", err)
+	}
+
+	h := multishard.NewChecksum()
+	if err := s.doUpload(ctx, key, io.TeeReader(r, h), upload); err != nil {
+		s.lg.Error(err)
+		return 0, err
 	}
 
-	if err := s.doUpload(ctx, key, r, upload); err != nil {
+	if err := upload.Send(&storeserverv1.UploadRequest{
+		Key:         string(key),
+		Checksum:    h.Sum32(),
+		HasChecksum: true,
+	}); err != nil {
 		s.lg.Error(err)
-		if errCloseSend := upload.CloseSend(); errCloseSend != nil {
-			s.lg.Error(errCloseSend)
+		return 0, fmt.Errorf("failed to send the checksum of key %s: %w", key, err)
+	}
+
+	resp, err := upload.CloseAndRecv()
+	if err != nil {
+		if status.Code(err) == codes.DataLoss {
+			return 0, fmt.Errorf("server %d discarded key %s: %s: %w", serverIdx, key, status.Convert(err).Message(), ErrChecksumMismatch)
 		}
-		return err
+		return 0, fmt.Errorf("failed to close and recv the upload of key %s: %w", key, err)
 	}
 
-	if _, err := upload.CloseAndRecv(); err != nil {
-		s.lg.Error(fmt.Errorf("failed to close and recv the upload: %w", err))
+	if resp.Checksum != h.Sum32() {
+		if errDelete := s.Delete(ctx, key, serverIdx); errDelete != nil {
+			s.lg.Error(fmt.Errorf("could not delete key %s with a checksum mismatch: %w", key, errDelete))
+		}
+		return 0, fmt.Errorf(
+			"server %d received key %s with checksum %08x, sent %08x: %w",
+			serverIdx, key, resp.Checksum, h.Sum32(), ErrChecksumMismatch,
+		)
 	}
 
-	return nil
+	return h.Sum32(), nil
 }
 
 func (s *GRPCStore) doUpload(
@@ -102,11 +164,24 @@ func (s *GRPCStore) doUpload(
 	}
 }
 
+// Get - streams the whole chunk into the writer
 func (s *GRPCStore) Get(
 	ctx context.Context,
 	key multishard.Key,
 	serverID multishard.ServerIdx,
 	w io.Writer,
+) (int, error) {
+	return s.GetRange(ctx, key, serverID, 0, 0, w)
+}
+
+// GetRange - streams length bytes of the chunk starting at offset into the writer,
+// zero length streams up to the end of the chunk
+func (s *GRPCStore) GetRange(
+	ctx context.Context,
+	key multishard.Key,
+	serverID multishard.ServerIdx,
+	offset, length int64,
+	w io.Writer,
 ) (int, error) {
 	s.mx.RLock()
 	client, ok := s.client[serverID]
@@ -117,7 +192,9 @@ func (s *GRPCStore) Get(
 	s.mx.RUnlock()
 
 	stream, err := client.Download(ctx, &storeserverv1.DownloadRequest{
-		Key: string(key),
+		Key:    string(key),
+		Offset: offset,
+		Length: length,
 	})
 	if err != nil {
 		return 0, fmt.Errorf("could not get the download stream for server %d: %w", serverID, err) // todo: wrap
@@ -146,3 +223,105 @@ func (s *GRPCStore) Get(
 		}
 	}
 }
+
+// Delete - removes the key from the server, a key that is already gone is not an error
+func (s *GRPCStore) Delete(
+	ctx context.Context,
+	key multishard.Key,
+	serverID multishard.ServerIdx,
+) error {
+	s.mx.RLock()
+	client, ok := s.client[serverID]
+	if !ok {
+		s.mx.RUnlock()
+		return ErrServerIDInvalid // todo: wrap
+	}
+	s.mx.RUnlock()
+
+	if _, err := client.Delete(ctx, &storeserverv1.DeleteRequest{Key: string(key)}); err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		return fmt.Errorf("could not delete key %s from server %d: %w", key, serverID, err)
+	}
+
+	return nil
+}
+
+// Stat - describes the chunk stored under the key without downloading it
+func (s *GRPCStore) Stat(
+	ctx context.Context,
+	key multishard.Key,
+	serverID multishard.ServerIdx,
+) (*ChunkStat, error) {
+	s.mx.RLock()
+	client, ok := s.client[serverID]
+	if !ok {
+		s.mx.RUnlock()
+		return nil, ErrServerIDInvalid // todo: wrap
+	}
+	s.mx.RUnlock()
+
+	resp, err := client.Stat(ctx, &storeserverv1.StatRequest{Key: string(key)})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, fmt.Errorf("could not stat key %s on server %d: %w", key, serverID, ErrChunkNotFound)
+		}
+		return nil, fmt.Errorf("could not stat key %s on server %d: %w", key, serverID, err)
+	}
+
+	return &ChunkStat{
+		Size:       resp.Size,
+		Checksum:   resp.Checksum,
+		ModifiedAt: time.Unix(0, resp.ModifiedAt),
+	}, nil
+}
+
+// List - calls fn with every chunk the server holds under the prefix in key order,
+// an error of fn stops the listing and is returned
+func (s *GRPCStore) List(
+	ctx context.Context,
+	serverID multishard.ServerIdx,
+	prefix multishard.Key,
+	fn func(chunk ListedChunk) error,
+) error {
+	s.mx.RLock()
+	client, ok := s.client[serverID]
+	if !ok {
+		s.mx.RUnlock()
+		return ErrServerIDInvalid // todo: wrap
+	}
+	s.mx.RUnlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.List(ctx, &storeserverv1.ListRequest{Prefix: string(prefix)})
+	if err != nil {
+		return fmt.Errorf("could not list keys on server %d: %w", serverID, err)
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("could not list keys on server %d: %w", serverID, err)
+		}
+
+		for _, e := range resp.Entries {
+			chunk := ListedChunk{
+				Key: multishard.Key(e.Key),
+				ChunkStat: ChunkStat{
+					Size:       e.Size,
+					Checksum:   e.Checksum,
+					ModifiedAt: time.Unix(0, e.ModifiedAt),
+				},
+			}
+			if err := fn(chunk); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package shardmanager
+
+import (
+	"encoding/binary"
+	hash "github.com/cespare/xxhash/v2"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"sort"
+)
+
+// ring - consistent hash ring, every server owns as many virtual nodes as its weight allows,
+// a position on the ring is owned by the servers of the next virtual nodes clockwise
+type ring struct {
+	vnodes  int
+	weights map[multishard.ServerIdx]int
+	points  []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint64
+	server multishard.ServerIdx
+}
+
+func newRing(vnodes int) *ring {
+	if vnodes <= 0 {
+		vnodes = 1
+	}
+	return &ring{vnodes: vnodes, weights: map[multishard.ServerIdx]int{}}
+}
+
+// add - places the virtual nodes of the server on the ring, re-adding a server changes its weight
+func (r *ring) add(server multishard.ServerIdx, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	r.weights[server] = weight
+	r.rebuild()
+}
+
+// remove - takes all virtual nodes of the server off the ring
+func (r *ring) remove(server multishard.ServerIdx) {
+	delete(r.weights, server)
+	r.rebuild()
+}
+
+func (r *ring) size() int {
+	return len(r.weights)
+}
+
+func (r *ring) clone() *ring {
+	c := &ring{vnodes: r.vnodes, weights: make(map[multishard.ServerIdx]int, len(r.weights))}
+	for server, weight := range r.weights {
+		c.weights[server] = weight
+	}
+	c.points = append([]ringPoint(nil), r.points...)
+	return c
+}
+
+func (r *ring) rebuild() {
+	r.points = r.points[:0]
+	for server, weight := range r.weights {
+		for i := 0; i < r.vnodes*weight; i++ {
+			r.points = append(r.points, ringPoint{hash: vnodeHash(server, i), server: server})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].server < r.points[j].server
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+}
+
+// owners - up to n distinct servers of the virtual nodes clockwise from the position
+func (r *ring) owners(position uint64, n int) []multishard.ServerIdx {
+	if len(r.points) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.weights) {
+		n = len(r.weights)
+	}
+
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= position })
+	result := make([]multishard.ServerIdx, 0, n)
+	seen := make(map[multishard.ServerIdx]struct{}, n)
+	for i := 0; i < len(r.points) && len(result) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if _, ok := seen[p.server]; ok {
+			continue
+		}
+		seen[p.server] = struct{}{}
+		result = append(result, p.server)
+	}
+
+	return result
+}
+
+func vnodeHash(server multishard.ServerIdx, vnode int) uint64 {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(server))
+	binary.BigEndian.PutUint64(buf[8:], uint64(vnode))
+	return hash.Sum64(buf)
+}
+
+// KeyRange - an arc of the ring, positions after Start up to and including End,
+// it wraps around zero when End is less than Start
+type KeyRange struct {
+	Start uint64
+	End   uint64
+}
+
+// Contains - whether the position falls into the range
+func (kr KeyRange) Contains(position uint64) bool {
+	if kr.Start < kr.End {
+		return position > kr.Start && position <= kr.End
+	}
+	return position > kr.Start || position <= kr.End
+}
+
+// MovedRange - a range of positions whose owners change with the membership
+type MovedRange struct {
+	KeyRange
+	From []multishard.ServerIdx
+	To   []multishard.ServerIdx
+}
+
+// movedRanges - ranges owned by different servers on the two rings, n servers per position,
+// ownership can only change at virtual nodes of either ring, so comparing the arcs between them is enough
+func movedRanges(before, after *ring, n int) []MovedRange {
+	boundaries := make([]uint64, 0, len(before.points)+len(after.points))
+	for _, p := range before.points {
+		boundaries = append(boundaries, p.hash)
+	}
+	for _, p := range after.points {
+		boundaries = append(boundaries, p.hash)
+	}
+	if len(boundaries) == 0 {
+		return nil
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+
+	var result []MovedRange
+	for i, end := range boundaries {
+		start := boundaries[(i+len(boundaries)-1)%len(boundaries)]
+		if start == end && len(boundaries) > 1 {
+			continue
+		}
+
+		// every position of the arc is owned the same way as its end
+		from, to := before.owners(end, n), after.owners(end, n)
+		if sameServers(from, to) {
+			continue
+		}
+
+		if last := len(result) - 1; last >= 0 && result[last].End == start &&
+			sameServers(result[last].From, from) && sameServers(result[last].To, to) {
+			result[last].End = end
+			continue
+		}
+		result = append(result, MovedRange{KeyRange: KeyRange{Start: start, End: end}, From: from, To: to})
+	}
+
+	return result
+}
+
+// sameServers - whether both hold the same servers, the order does not matter
+// since no data has to move when only the order of replicas changes
+func sameServers(a, b []multishard.ServerIdx) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if x == y {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -7,45 +7,120 @@ import (
 	"github.com/denismitr/shardstore/internal/common/logger"
 	"github.com/denismitr/shardstore/internal/filegateway/config"
 	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/topology"
+	"sync"
 )
 
 type ShardManager struct {
-	cfg     *config.Config
-	lg      logger.Logger
-	servers int
+	cfg      *config.Config
+	lg       logger.Logger
+	replicas int
+
+	mx   sync.RWMutex
+	ring *ring
 }
 
-func NewShardManager(cfg *config.Config, lg logger.Logger) (*ShardManager, error) {
-	if len(cfg.StorageServers) < int(cfg.NumberOfChunks) {
-		return nil, fmt.Errorf("less servers than number of chunks: %w", ErrInvalidNumberOfServers)
+var (
+	ErrInvalidNumberOfServers = errors.New("invalid number of servers")
+	ErrInvalidWriteQuorum     = errors.New("invalid write quorum")
+	ErrUnknownServer          = errors.New("unknown server")
+)
+
+// NewShardManager - places chunks on the servers of the topology by their ids and weights,
+// draining servers get no chunks
+func NewShardManager(cfg *config.Config, servers []topology.Server, lg logger.Logger) (*ShardManager, error) {
+	replicas := cfg.Replicas
+	if replicas <= 0 {
+		replicas = 1
+	}
+
+	if cfg.WriteQuorum > replicas {
+		return nil, fmt.Errorf("write quorum %d is greater than %d replicas: %w", cfg.WriteQuorum, replicas, ErrInvalidWriteQuorum)
+	}
+
+	r := newRing(cfg.VirtualNodes)
+	seen := make(map[multishard.ServerIdx]struct{}, len(servers))
+	for _, s := range servers {
+		if _, ok := seen[s.ID]; ok {
+			return nil, fmt.Errorf("server %d is listed twice: %w", s.ID, ErrInvalidNumberOfServers)
+		}
+		seen[s.ID] = struct{}{}
+		if s.Draining {
+			continue
+		}
+
+		weight := s.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		r.weights[s.ID] = weight
+	}
+	r.rebuild()
+
+	if r.size() < replicas {
+		return nil, fmt.Errorf("%d servers that are not draining for %d replicas: %w", r.size(), replicas, ErrInvalidNumberOfServers)
 	}
 
 	return &ShardManager{
-		cfg:     cfg,
-		lg:      lg,
-		servers: len(cfg.StorageServers),
+		cfg:      cfg,
+		lg:       lg,
+		replicas: replicas,
+		ring:     r,
 	}, nil
 }
 
-var ErrInvalidNumberOfServers = errors.New("invalid number of servers")
+// Position - where the chunk of the key is on the hash ring
+func Position(key multishard.Key, chunkIdx multishard.ChunkIdx) uint64 {
+	return hash.Sum64String(string(multishard.ChunkKey(key, chunkIdx)))
+}
+
+// ResolveReplicas - resolves an ordered set of distinct servers for copies of a chunk of the key
+func (sm *ShardManager) ResolveReplicas(key multishard.Key, chunkIdx multishard.ChunkIdx) ([]multishard.ServerIdx, error) {
+	return sm.ResolveServers(key, chunkIdx, sm.replicas)
+}
 
-func (sm *ShardManager) ResolveShardMap(key multishard.Key) (multishard.ShardMap, error) {
-	chunks := int(sm.cfg.NumberOfChunks)
-	if sm.servers < chunks {
-		return nil, fmt.Errorf("less servers than chunks: %w", ErrInvalidNumberOfServers) // todo: wrap
+// ResolveServers - resolves an ordered set of n distinct servers for a chunk of the key,
+// the servers of the next virtual nodes clockwise from the position of the chunk on the ring
+func (sm *ShardManager) ResolveServers(key multishard.Key, chunkIdx multishard.ChunkIdx, n int) ([]multishard.ServerIdx, error) {
+	if chunkIdx < 0 {
+		return nil, fmt.Errorf("invalid chunk idx %d for key %s", chunkIdx, key)
 	}
 
-	serverIdx := hash.Sum64String(string(key)) % uint64(sm.servers)
-	ms := make(multishard.ShardMap, chunks)
+	sm.mx.RLock()
+	defer sm.mx.RUnlock()
 
-	for chunkIdx := 0; chunkIdx < chunks; chunkIdx++ {
-		ms[multishard.ChunkIdx(chunkIdx)] = multishard.ServerIdx(serverIdx)
-		if serverIdx < uint64(sm.servers)-1 {
-			serverIdx++
-		} else {
-			serverIdx = 0
-		}
+	if n <= 0 || n > sm.ring.size() {
+		return nil, fmt.Errorf("cannot place %d pieces of a chunk on %d servers: %w", n, sm.ring.size(), ErrInvalidNumberOfServers)
+	}
+
+	return sm.ring.owners(Position(key, chunkIdx), n), nil
+}
+
+// AddServer - puts the server on the ring with the given weight or changes its weight,
+// returns the ranges of positions whose replicas change because of it
+func (sm *ShardManager) AddServer(server multishard.ServerIdx, weight int) []MovedRange {
+	sm.mx.Lock()
+	defer sm.mx.Unlock()
+
+	before := sm.ring.clone()
+	sm.ring.add(server, weight)
+	return movedRanges(before, sm.ring, sm.replicas)
+}
+
+// RemoveServer - takes the server off the ring,
+// returns the ranges of positions whose replicas change because of it
+func (sm *ShardManager) RemoveServer(server multishard.ServerIdx) ([]MovedRange, error) {
+	sm.mx.Lock()
+	defer sm.mx.Unlock()
+
+	if _, ok := sm.ring.weights[server]; !ok {
+		return nil, fmt.Errorf("server %d: %w", server, ErrUnknownServer)
+	}
+	if sm.ring.size()-1 < sm.replicas {
+		return nil, fmt.Errorf("%d servers would be left for %d replicas: %w", sm.ring.size()-1, sm.replicas, ErrInvalidNumberOfServers)
 	}
 
-	return ms, nil
+	before := sm.ring.clone()
+	sm.ring.remove(server)
+	return movedRanges(before, sm.ring, sm.replicas), nil
 }
@@ -1,93 +1,186 @@
 package shardmanager
 
 import (
+	"errors"
+	"fmt"
 	"github.com/denismitr/shardstore/internal/common/logger"
 	"github.com/denismitr/shardstore/internal/filegateway/config"
 	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/denismitr/shardstore/internal/filegateway/topology"
 	"reflect"
 	"testing"
 )
 
-func TestShardManager_GetMultiShard(t *testing.T) {
-	type fields struct {
-		cfg *config.Config
-		lg  logger.Logger
-	}
-
-	type args struct {
-		key multishard.Key
-	}
-
-	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		want    multishard.ShardMap
-		wantErr bool
-	}{
-		{
-			name: "3 servers and 3 chunks",
-			fields: fields{
-				lg: logger.NewStdoutLogger(logger.Dev, "test"),
-				cfg: &config.Config{
-					StorageServers: make([]string, 3),
-					NumberOfChunks: 3,
-				},
-			},
-			wantErr: false,
-			want:    multishard.ShardMap{0: 1, 1: 2, 2: 0},
-			args: args{
-				key: "1_png",
-			},
-		},
-		{
-			name: "8 servers and 3 chunks",
-			fields: fields{
-				lg: logger.NewStdoutLogger(logger.Dev, "test"),
-				cfg: &config.Config{
-					StorageServers: make([]string, 8),
-					NumberOfChunks: 3,
-				},
-			},
-			wantErr: false,
-			want:    multishard.ShardMap{0: 7, 1: 0, 2: 1},
-			args: args{
-				key: "2_png",
-			},
-		},
-		{
-			name: "10 servers and 3 chunks different key",
-			fields: fields{
-				lg: logger.NewStdoutLogger(logger.Dev, "test"),
-				cfg: &config.Config{
-					StorageServers: make([]string, 10),
-					NumberOfChunks: 3,
-				},
-			},
-			wantErr: false,
-			want:    multishard.ShardMap{0: 2, 1: 3, 2: 4},
-			args: args{
-				key: "my_text_txt",
-			},
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			sm, err := NewShardManager(tt.fields.cfg, tt.fields.lg)
-			if (err != nil) != tt.wantErr {
-				t.Fatalf("unexpected error: %s", err.Error())
+// testServers - servers with ids 0..n-1 and the given weights, all 1 when none are given
+func testServers(n int, weights ...int) []topology.Server {
+	result := make([]topology.Server, n)
+	for i := range result {
+		result[i] = topology.Server{ID: multishard.ServerIdx(i), Weight: 1}
+		if len(weights) > 0 {
+			result[i].Weight = weights[i]
+		}
+	}
+	return result
+}
+
+func newTestShardManager(t *testing.T, cfg *config.Config, servers []topology.Server) *ShardManager {
+	t.Helper()
+	if cfg.VirtualNodes == 0 {
+		cfg.VirtualNodes = 128
+	}
+	sm, err := NewShardManager(cfg, servers, logger.NewStdoutLogger(logger.Dev, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sm
+}
+
+// placements - the servers of the first chunks of many keys
+func placements(t *testing.T, sm *ShardManager, keys int) map[multishard.Key][]multishard.ServerIdx {
+	t.Helper()
+	result := make(map[multishard.Key][]multishard.ServerIdx, keys)
+	for i := 0; i < keys; i++ {
+		key := multishard.Key(fmt.Sprintf("file_%d_txt", i))
+		servers, err := sm.ResolveReplicas(key, 0)
+		if err != nil {
+			t.Fatalf("ResolveReplicas() error = %v", err)
+		}
+		result[key] = servers
+	}
+	return result
+}
+
+func TestShardManager_ResolveReplicasIsStable(t *testing.T) {
+	cfg := &config.Config{Replicas: 2}
+	first, second := newTestShardManager(t, cfg, testServers(5)), newTestShardManager(t, cfg, testServers(5))
+
+	for chunkIdx := 0; chunkIdx < 10; chunkIdx++ {
+		a, err := first.ResolveReplicas("1_png", multishard.ChunkIdx(chunkIdx))
+		if err != nil {
+			t.Fatalf("ResolveReplicas() error = %v", err)
+		}
+		b, err := second.ResolveReplicas("1_png", multishard.ChunkIdx(chunkIdx))
+		if err != nil {
+			t.Fatalf("ResolveReplicas() error = %v", err)
+		}
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("chunk %d resolved to %v and %v by managers with the same servers", chunkIdx, a, b)
+		}
+	}
+}
+
+func TestShardManager_ResolveReplicasAreDistinct(t *testing.T) {
+	sm := newTestShardManager(t, &config.Config{Replicas: 3, WriteQuorum: 2}, testServers(3))
+
+	for key, servers := range placements(t, sm, 100) {
+		seen := map[multishard.ServerIdx]bool{}
+		for _, server := range servers {
+			if seen[server] {
+				t.Fatalf("%s resolved to %v, want distinct servers", key, servers)
 			}
+			seen[server] = true
+		}
+		if len(servers) != 3 {
+			t.Fatalf("%s resolved to %v, want 3 servers", key, servers)
+		}
+	}
 
-			got, err := sm.ResolveShardMap(tt.args.key)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("ResolveShardMap() error = %v, wantErr %v", err, tt.wantErr)
-				return
+	if _, err := sm.ResolveServers("1_png", 0, 4); !errors.Is(err, ErrInvalidNumberOfServers) {
+		t.Errorf("ResolveServers() error = %v, want %v", err, ErrInvalidNumberOfServers)
+	}
+}
+
+func TestShardManager_ServerWeights(t *testing.T) {
+	sm := newTestShardManager(t, &config.Config{}, testServers(3, 2, 1, 1))
+
+	counts := map[multishard.ServerIdx]int{}
+	for _, servers := range placements(t, sm, 10000) {
+		counts[servers[0]]++
+	}
+
+	// server 0 has half of the weight
+	if counts[0] < 4000 || counts[0] > 6000 {
+		t.Errorf("server 0 with double weight got %d of 10000 chunks, want about half", counts[0])
+	}
+}
+
+func TestShardManager_MembershipChangesMoveOnlyTheirShare(t *testing.T) {
+	const keys = 10000
+	sm := newTestShardManager(t, &config.Config{Replicas: 2}, testServers(4))
+	before := placements(t, sm, keys)
+
+	moved := sm.AddServer(4, 1)
+	after := placements(t, sm, keys)
+	assertMoves(t, before, after, moved, 4)
+
+	moved, err := sm.RemoveServer(1)
+	if err != nil {
+		t.Fatalf("RemoveServer() error = %v", err)
+	}
+	assertMoves(t, after, placements(t, sm, keys), moved, 1)
+
+	if _, err := sm.RemoveServer(1); !errors.Is(err, ErrUnknownServer) {
+		t.Errorf("RemoveServer() error = %v, want %v", err, ErrUnknownServer)
+	}
+}
+
+// assertMoves - only chunks involving the server change their replicas, roughly their share of them,
+// and the moved ranges cover exactly the chunks that changed
+func assertMoves(t *testing.T, before, after map[multishard.Key][]multishard.ServerIdx, moved []MovedRange, server multishard.ServerIdx) {
+	t.Helper()
+
+	changed := 0
+	for key, was := range before {
+		now := after[key]
+		inRange := false
+		for _, mr := range moved {
+			if mr.Contains(Position(key, 0)) {
+				inRange = true
+				break
 			}
+		}
 
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("ResolveShardMap() got = %v, want %v", got, tt.want)
+		if sameServers(was, now) {
+			if inRange {
+				t.Fatalf("%s stays on %v but is in a moved range", key, now)
 			}
-		})
+			continue
+		}
+
+		changed++
+		if !inRange {
+			t.Fatalf("%s moved from %v to %v outside the moved ranges", key, was, now)
+		}
+		if !containsServer(was, server) && !containsServer(now, server) {
+			t.Fatalf("%s moved from %v to %v without server %d being involved", key, was, now, server)
+		}
+	}
+
+	// with 2 replicas on 4 or 5 servers a server holds about 2/5 of the chunks
+	if changed < len(before)/5 || changed > len(before)*3/5 {
+		t.Errorf("%d of %d chunks changed their replicas, want about 2/5 of them", changed, len(before))
+	}
+}
+
+func containsServer(servers []multishard.ServerIdx, server multishard.ServerIdx) bool {
+	for _, s := range servers {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNewShardManager_RejectsInvalidReplication(t *testing.T) {
+	lg := logger.NewStdoutLogger(logger.Dev, "test")
+
+	_, err := NewShardManager(&config.Config{Replicas: 3}, testServers(2), lg)
+	if !errors.Is(err, ErrInvalidNumberOfServers) {
+		t.Errorf("NewShardManager() error = %v, want %v", err, ErrInvalidNumberOfServers)
+	}
+
+	_, err = NewShardManager(&config.Config{Replicas: 2, WriteQuorum: 3}, testServers(3), lg)
+	if !errors.Is(err, ErrInvalidWriteQuorum) {
+		t.Errorf("NewShardManager() error = %v, want %v", err, ErrInvalidWriteQuorum)
 	}
 }
@@ -0,0 +1,207 @@
+package topology
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound             = errors.New("topology not found")
+	ErrInvalidServerWeights = errors.New("invalid server weights")
+	ErrUnknownServer        = errors.New("unknown server")
+)
+
+// Server - a file server of the cluster, known by its stable id rather than its address
+type Server struct {
+	ID     multishard.ServerIdx `json:"id"`
+	Addr   string               `json:"addr"`
+	Weight int                  `json:"weight"`
+
+	// Draining - no new chunks are placed on the server and the ones it has are moved away,
+	// it can be removed from the cluster once no shard plan references it
+	Draining bool `json:"draining,omitempty"`
+}
+
+// Topology - servers of the cluster, chunks are placed according to their ids and weights
+type Topology struct {
+	Version   int       `json:"version"`
+	Servers   []Server  `json:"servers"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// RebalancePending - servers changed since chunks were last moved to their owners
+	RebalancePending bool `json:"rebalance_pending"`
+}
+
+// New - topology of the servers, weights are given in the order of the servers, all 1 when empty
+func New(servers []Server, weights []int) (*Topology, error) {
+	if len(weights) > 0 && len(weights) != len(servers) {
+		return nil, fmt.Errorf("%d weights for %d servers: %w", len(weights), len(servers), ErrInvalidServerWeights)
+	}
+
+	t := &Topology{Servers: make([]Server, len(servers))}
+	for i, s := range servers {
+		s.Weight = 1
+		if len(weights) > 0 {
+			if weights[i] <= 0 {
+				return nil, fmt.Errorf("weight %d of server %d: %w", weights[i], s.ID, ErrInvalidServerWeights)
+			}
+			s.Weight = weights[i]
+		}
+		t.Servers[i] = s
+	}
+
+	return t, nil
+}
+
+// Differs - whether the servers, their weights or draining changed, a new address of a server is not a change
+func (t *Topology) Differs(prev *Topology) bool {
+	if prev == nil || len(prev.Servers) != len(t.Servers) {
+		return true
+	}
+
+	for _, s := range t.Servers {
+		p, ok := prev.Server(s.ID)
+		if !ok || p.Weight != s.Weight || p.Draining != s.Draining {
+			return true
+		}
+	}
+	return false
+}
+
+// Follow - makes the topology the successor of the previous one,
+// a change of servers bumps the version and leaves a rebalance pending
+// until chunks are moved to their new owners
+func (t *Topology) Follow(prev *Topology) {
+	t.UpdatedAt = time.Now().UTC()
+	if prev == nil {
+		t.Version = 1
+		return
+	}
+
+	// draining is not configured, it carries over for as long as the server stays in the cluster
+	for i, s := range t.Servers {
+		if p, ok := prev.Server(s.ID); ok {
+			t.Servers[i].Draining = p.Draining
+		}
+	}
+
+	t.Version = prev.Version
+	t.RebalancePending = prev.RebalancePending
+	if t.Differs(prev) {
+		t.Version++
+		t.RebalancePending = true
+	}
+}
+
+// Drain - marks the server as draining, bumps the version and leaves a rebalance pending,
+// draining a server that already drains changes nothing
+func (t *Topology) Drain(id multishard.ServerIdx) error {
+	for i, s := range t.Servers {
+		if s.ID != id {
+			continue
+		}
+		if s.Draining {
+			return nil
+		}
+
+		t.Servers[i].Draining = true
+		t.Version++
+		t.RebalancePending = true
+		t.UpdatedAt = time.Now().UTC()
+		return nil
+	}
+	return fmt.Errorf("server %d: %w", id, ErrUnknownServer)
+}
+
+// Server - the server with the id
+func (t *Topology) Server(id multishard.ServerIdx) (Server, bool) {
+	for _, s := range t.Servers {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return Server{}, false
+}
+
+// Active - servers new chunks can be placed on
+func (t *Topology) Active() []Server {
+	var result []Server
+	for _, s := range t.Servers {
+		if !s.Draining {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// IDs - ids of all servers in ascending order
+func (t *Topology) IDs() []multishard.ServerIdx {
+	result := make([]multishard.ServerIdx, len(t.Servers))
+	for i, s := range t.Servers {
+		result[i] = s.ID
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// FileStore - keeps the topology in a json file next to the meta store
+type FileStore struct {
+	mx   sync.Mutex
+	path string
+}
+
+func NewFileStore(appName string) (*FileStore, error) {
+	dir := fmt.Sprintf("tmp/%s", appName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{path: filepath.Join(dir, "topology.json")}, nil
+}
+
+// Load - the last saved topology
+func (s *FileStore) Load(_ context.Context) (*Topology, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("could not read topology: %w", err)
+	}
+
+	var t Topology
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("could not unmarshal topology: %w", err)
+	}
+	return &t, nil
+}
+
+// Save - replaces the saved topology, a crash leaves either the old or the new one
+func (s *FileStore) Save(_ context.Context, t *Topology) error {
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal topology: %w", err)
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("could not write topology: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("could not replace topology: %w", err)
+	}
+	return nil
+}
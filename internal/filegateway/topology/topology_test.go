@@ -0,0 +1,103 @@
+package topology
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestNew_ValidatesWeights(t *testing.T) {
+	servers := []Server{{ID: 1, Addr: "a"}, {ID: 2, Addr: "b"}}
+
+	topo, err := New(servers, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range topo.Servers {
+		if s.Weight != 1 {
+			t.Errorf("expected default weight 1 for server %d, got %d", s.ID, s.Weight)
+		}
+	}
+
+	for _, weights := range [][]int{{1}, {1, 0}, {1, -2}} {
+		if _, err := New(servers, weights); !errors.Is(err, ErrInvalidServerWeights) {
+			t.Errorf("weights %v: expected ErrInvalidServerWeights, got %v", weights, err)
+		}
+	}
+}
+
+func TestTopology_Follow(t *testing.T) {
+	first, _ := New([]Server{{ID: 1, Addr: "a"}, {ID: 2, Addr: "b"}}, nil)
+	first.Follow(nil)
+	if first.Version != 1 || first.RebalancePending {
+		t.Fatalf("expected version 1 without a pending rebalance, got %+v", first)
+	}
+
+	moved, _ := New([]Server{{ID: 2, Addr: "c"}, {ID: 1, Addr: "d"}}, nil)
+	moved.Follow(first)
+	if moved.Version != 1 || moved.RebalancePending {
+		t.Errorf("new addresses must not change the topology, got %+v", moved)
+	}
+
+	grown, _ := New([]Server{{ID: 1, Addr: "a"}, {ID: 2, Addr: "b"}, {ID: 3, Addr: "c"}}, nil)
+	grown.Follow(moved)
+	if grown.Version != 2 || !grown.RebalancePending {
+		t.Errorf("expected version 2 with a pending rebalance, got %+v", grown)
+	}
+
+	reweighted, _ := New([]Server{{ID: 1, Addr: "a"}, {ID: 2, Addr: "b"}, {ID: 3, Addr: "c"}}, []int{1, 1, 2})
+	reweighted.Follow(grown)
+	if reweighted.Version != 3 || !reweighted.RebalancePending {
+		t.Errorf("expected version 3 with a pending rebalance, got %+v", reweighted)
+	}
+}
+
+func TestTopology_DrainingCarriesOver(t *testing.T) {
+	first, _ := New([]Server{{ID: 1, Addr: "a"}, {ID: 2, Addr: "b"}, {ID: 3, Addr: "c"}}, nil)
+	first.Follow(nil)
+	if err := first.Drain(4); !errors.Is(err, ErrUnknownServer) {
+		t.Fatalf("expected ErrUnknownServer, got %v", err)
+	}
+	if err := first.Drain(2); err != nil {
+		t.Fatal(err)
+	}
+	if first.Version != 2 || !first.RebalancePending || len(first.Active()) != 2 {
+		t.Fatalf("expected version 2 with 2 active servers, got %+v", first)
+	}
+
+	restarted, _ := New([]Server{{ID: 1, Addr: "a"}, {ID: 2, Addr: "b"}, {ID: 3, Addr: "c"}}, nil)
+	restarted.Follow(first)
+	if s, _ := restarted.Server(2); !s.Draining || restarted.Version != 2 {
+		t.Errorf("expected server 2 to keep draining in version 2, got %+v", restarted)
+	}
+
+	removed, _ := New([]Server{{ID: 1, Addr: "a"}, {ID: 3, Addr: "c"}}, nil)
+	removed.Follow(restarted)
+	if removed.Version != 3 || len(removed.Active()) != 2 {
+		t.Errorf("expected version 3 without server 2, got %+v", removed)
+	}
+}
+
+func TestFileStore_SaveAndLoad(t *testing.T) {
+	s := &FileStore{path: filepath.Join(t.TempDir(), "topology.json")}
+	ctx := context.Background()
+
+	if _, err := s.Load(ctx); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	topo, _ := New([]Server{{ID: 7, Addr: "a"}}, []int{3})
+	topo.Follow(nil)
+	if err := s.Save(ctx, topo); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := s.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Version != 1 || len(loaded.Servers) != 1 || loaded.Servers[0] != topo.Servers[0] {
+		t.Errorf("expected %+v, got %+v", topo, loaded)
+	}
+}
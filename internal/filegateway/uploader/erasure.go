@@ -0,0 +1,134 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"github.com/klauspost/reedsolomon"
+	"io"
+	"sync"
+)
+
+// uploadErasureCoded - reads the file a chunk at a time, splits every chunk into data fragments,
+// adds parity fragments and stores all of them on distinct servers,
+// only a single chunk along with its parity is held in memory
+func (u *Uploader) uploadErasureCoded(
+	ctx context.Context,
+	t *uploadTracker,
+	key multishard.Key,
+	r io.Reader,
+	opts UploadOptions,
+) (*metastore.ShardPlanBuilder, error) {
+	dataShards, parityShards := opts.ErasureDataShards, opts.ErasureParityShards
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, fmt.Errorf("invalid erasure coding with %d data and %d parity shards: %w", dataShards, parityShards, err)
+	}
+
+	// enough capacity for the encoder to place parity fragments right after the data
+	fragmentSize := (opts.ChunkSize + int64(dataShards) - 1) / int64(dataShards)
+	buf := make([]byte, opts.ChunkSize, fragmentSize*int64(dataShards+parityShards))
+
+	planBuilder := metastore.NewErasureCodedPlanBuilder(key, dataShards, parityShards)
+	chunks := 0
+	for ; ; chunks++ {
+		n, err := io.ReadFull(r, buf[:opts.ChunkSize])
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("failed reading uploaded file: %w", err)
+		}
+
+		shard, errWrite := u.writeStripe(ctx, t, enc, key, chunks, buf[:n])
+		if errWrite != nil {
+			return nil, errWrite
+		}
+		if errAdd := planBuilder.AddShard(shard); errAdd != nil {
+			return nil, errAdd
+		}
+
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			chunks++
+			break
+		}
+	}
+
+	return planBuilder, nil
+}
+
+// writeStripe - encodes the chunk and writes all its fragments in parallel,
+// every fragment has to be written for the chunk to keep its full redundancy
+func (u *Uploader) writeStripe(
+	ctx context.Context,
+	t *uploadTracker,
+	enc reedsolomon.Encoder,
+	key multishard.Key,
+	chunkIdx int,
+	data []byte,
+) (metastore.Shard, error) {
+	// taken before the split since the encoder may use the buffer of the chunk
+	checksum := multishard.Checksum(data)
+	fragments, err := enc.Split(data)
+	if err != nil {
+		return metastore.Shard{}, fmt.Errorf("could not split chunk %d: %w", chunkIdx, err)
+	}
+	if err := enc.Encode(fragments); err != nil {
+		return metastore.Shard{}, fmt.Errorf("could not encode chunk %d: %w", chunkIdx, err)
+	}
+
+	servers, err := u.shardManager.ResolveServers(key, multishard.ChunkIdx(chunkIdx), len(fragments))
+	if err != nil {
+		return metastore.Shard{}, err
+	}
+
+	shard := metastore.Shard{
+		ChunkIdx:  chunkIdx,
+		ServerIdx: int(servers[0]),
+		Size:      len(data),
+		Checksum:  checksum,
+		Key:       multishard.UploadChunkKey(key, t.generation, multishard.ChunkIdx(chunkIdx)),
+		Fragments: make([]metastore.Fragment, len(fragments)),
+	}
+
+	locations := make([]metastore.Location, len(fragments))
+	for i, fragment := range fragments {
+		shard.Fragments[i] = metastore.Fragment{
+			Idx:       i,
+			ServerIdx: int(servers[i]),
+			Key:       multishard.FragmentKey(key, t.generation, multishard.ChunkIdx(chunkIdx), i),
+			Size:      len(fragment),
+			Checksum:  multishard.Checksum(fragment),
+		}
+		locations[i] = metastore.Location{Key: shard.Fragments[i].Key, ServerIdx: shard.Fragments[i].ServerIdx}
+	}
+	if err := u.intend(ctx, t, locations...); err != nil {
+		return metastore.Shard{}, err
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(fragments))
+	for i, fragment := range fragments {
+		wg.Add(1)
+		t.start()
+		go func(f metastore.Fragment, fragment []byte) {
+			defer wg.Done()
+			_, err := u.remoteStore.Put(ctx, f.Key, multishard.ServerIdx(f.ServerIdx), bytes.NewReader(fragment))
+			t.done(metastore.Location{Key: f.Key, ServerIdx: f.ServerIdx}, err)
+			if err != nil {
+				errCh <- fmt.Errorf("could not upload fragment %d of chunk %d to server %d: %w", f.Idx, chunkIdx, f.ServerIdx, err)
+			}
+		}(shard.Fragments[i], fragment)
+	}
+
+	wg.Wait()
+	close(errCh)
+	if err := <-errCh; err != nil {
+		return metastore.Shard{}, err
+	}
+
+	return shard, nil
+}
@@ -0,0 +1,240 @@
+package uploader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"io"
+	"strings"
+	"time"
+)
+
+// MaxPartNumber - parts of a multipart upload are numbered from 1 up to it
+const MaxPartNumber = 10000
+
+var (
+	ErrNoSuchUpload = errors.New("no such upload")
+	ErrInvalidPart  = errors.New("invalid part")
+)
+
+// CompletedPart - a part the completed file is made of, with the etag its upload returned
+type CompletedPart struct {
+	Number int
+	ETag   string
+}
+
+// PartETag - identifies the content of an uploaded part
+func PartETag(plan *metastore.ShardPlan) string {
+	return `"` + plan.ContentHash + `"`
+}
+
+// CreateMultipartUpload - starts an upload of the file in parts, the content type and user metadata
+// of the options are given to the file once it is completed
+func (u *Uploader) CreateMultipartUpload(
+	ctx context.Context,
+	bucket, fileName string,
+	opts UploadOptions,
+) (*metastore.MultipartUpload, error) {
+	if _, err := multishard.ObjectKey(bucket, fileName); err != nil {
+		return nil, err
+	}
+	if err := validateUserMeta(opts.UserMeta); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("could not generate multipart upload id: %w", err)
+	}
+
+	mu := &metastore.MultipartUpload{
+		ID:          hex.EncodeToString(id),
+		Bucket:      bucket,
+		Name:        fileName,
+		ContentType: opts.ContentType,
+		UserMeta:    opts.UserMeta,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := u.metaStore.CreateMultipartUpload(ctx, mu); err != nil {
+		return nil, fmt.Errorf("could not create multipart upload of %s: %w", fileName, err)
+	}
+	return mu, nil
+}
+
+// GetMultipartUpload - fails with ErrNoSuchUpload when the upload was completed, aborted or never existed
+func (u *Uploader) GetMultipartUpload(ctx context.Context, uploadID string) (*metastore.MultipartUpload, error) {
+	if !validUploadID(uploadID) {
+		return nil, fmt.Errorf("%q: %w", uploadID, ErrNoSuchUpload)
+	}
+
+	mu, err := u.metaStore.GetMultipartUpload(ctx, uploadID)
+	if err != nil {
+		if errors.Is(err, metastore.ErrNotFound) {
+			return nil, fmt.Errorf("%s: %w", uploadID, ErrNoSuchUpload)
+		}
+		return nil, err
+	}
+	return mu, nil
+}
+
+// UploadPart - stores the part like a file of its own, uploading a part with the same number again replaces it
+func (u *Uploader) UploadPart(
+	ctx context.Context,
+	uploadID string,
+	partNumber int,
+	r io.Reader,
+	opts UploadOptions,
+) (*metastore.ShardPlan, error) {
+	mu, err := u.GetMultipartUpload(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if partNumber < 1 || partNumber > MaxPartNumber {
+		return nil, fmt.Errorf("part number %d is out of 1..%d: %w", partNumber, MaxPartNumber, ErrInvalidPart)
+	}
+
+	opts.ContentType, opts.UserMeta = "", nil
+	return u.upload(ctx, multishard.PartKey(mu.ID, partNumber), mu.Name, r, opts)
+}
+
+// CompleteMultipartUpload - puts the parts together into the plan of the file, their chunks stay where they are,
+// parts that were uploaded but are not listed are deleted
+func (u *Uploader) CompleteMultipartUpload(
+	ctx context.Context,
+	uploadID string,
+	parts []CompletedPart,
+) (*metastore.ShardPlan, error) {
+	mu, err := u.GetMultipartUpload(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no parts to complete %s with: %w", uploadID, ErrInvalidPart)
+	}
+
+	key, err := multishard.ObjectKey(mu.Bucket, mu.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &metastore.ShardPlan{
+		Name:        mu.Name,
+		ContentType: mu.ContentType,
+		UserMeta:    mu.UserMeta,
+	}
+	for i, part := range parts {
+		if i > 0 && part.Number <= parts[i-1].Number {
+			return nil, fmt.Errorf("part %d follows part %d: %w", part.Number, parts[i-1].Number, ErrInvalidPart)
+		}
+
+		partPlan, err := u.metaStore.GetShardPlan(ctx, multishard.PartKey(uploadID, part.Number))
+		if err != nil {
+			if errors.Is(err, metastore.ErrNotFound) {
+				return nil, fmt.Errorf("part %d was not uploaded: %w", part.Number, ErrInvalidPart)
+			}
+			return nil, err
+		}
+		if strings.Trim(part.ETag, `"`) != partPlan.ContentHash {
+			return nil, fmt.Errorf("part %d has another etag: %w", part.Number, ErrInvalidPart)
+		}
+		if err := appendPart(plan, partPlan, i == 0); err != nil {
+			return nil, fmt.Errorf("part %d: %w", part.Number, err)
+		}
+	}
+
+	if err := u.commit(ctx, key, plan); err != nil {
+		return nil, err
+	}
+	if err := u.metaStore.DeleteMultipartUpload(ctx, uploadID); err != nil {
+		u.lg.Error(fmt.Errorf("could not remove completed multipart upload %s: %w", uploadID, err))
+	}
+
+	listed := make(map[multishard.Key]bool, len(parts))
+	for _, part := range parts {
+		listed[multishard.PartKey(uploadID, part.Number)] = true
+	}
+	u.removePlans(ctx, multishard.PartsPrefix(uploadID), func(key multishard.Key) bool { return listed[key] })
+
+	return plan, nil
+}
+
+// AbortMultipartUpload - deletes every uploaded part along with the upload
+func (u *Uploader) AbortMultipartUpload(ctx context.Context, uploadID string) error {
+	mu, err := u.GetMultipartUpload(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+
+	if err := u.metaStore.DeleteMultipartUpload(ctx, mu.ID); err != nil {
+		return fmt.Errorf("could not abort multipart upload %s: %w", mu.ID, err)
+	}
+	u.removePlans(ctx, multishard.PartsPrefix(mu.ID), nil)
+	return nil
+}
+
+// appendPart - adds the chunks of the part after the ones of the plan,
+// all the parts have to be protected the same way since the plan has a single erasure coding
+func appendPart(plan, part *metastore.ShardPlan, first bool) error {
+	if first {
+		plan.Erasure = part.Erasure
+		plan.Replicas = part.Replicas
+		plan.ChecksumAlgo = part.ChecksumAlgo
+	} else if !sameErasure(plan.Erasure, part.Erasure) || plan.ChecksumAlgo != part.ChecksumAlgo {
+		return fmt.Errorf("redundancy differs from the first part: %w", ErrInvalidPart)
+	}
+
+	for _, shard := range part.Shards {
+		shard.ChunkIdx = len(plan.Shards)
+		plan.Shards = append(plan.Shards, shard)
+		plan.OriginalSize += shard.Size
+	}
+	return nil
+}
+
+func sameErasure(a, b *metastore.ErasureCoding) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// removePlans - forgets the plans of the parts or segments under the prefix, chunks of the ones
+// that are not kept are handed over to the cleanup of pending deletions, nothing is kept when keep is nil
+func (u *Uploader) removePlans(ctx context.Context, prefix multishard.Key, keep func(key multishard.Key) bool) {
+	keys, err := u.metaStore.ListPrefix(ctx, prefix, "", 0)
+	if err != nil {
+		u.lg.Error(fmt.Errorf("could not list plans under %s: %w", prefix, err))
+		return
+	}
+
+	for _, key := range keys {
+		if keep == nil || !keep(key) {
+			plan, err := u.metaStore.GetShardPlan(ctx, key)
+			if err != nil {
+				u.lg.Error(fmt.Errorf("could not read plan %s: %w", key, err))
+				continue
+			}
+			pd := metastore.NewPendingDeletion(key, plan.Locations(key))
+			if err := u.metaStore.StorePendingDeletion(ctx, pd); err != nil {
+				u.lg.Error(fmt.Errorf("could not record chunks of %s: %w", key, err))
+				continue
+			}
+		}
+		if err := u.metaStore.Delete(ctx, key); err != nil && !errors.Is(err, metastore.ErrNotFound) {
+			u.lg.Error(fmt.Errorf("could not remove plan %s: %w", key, err))
+		}
+	}
+}
+
+// validUploadID - ids are generated as 32 hex characters, anything else cannot be one
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil && strings.ToLower(id) == id
+}
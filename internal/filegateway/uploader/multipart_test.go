@@ -0,0 +1,126 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"path/filepath"
+	"testing"
+)
+
+func newMultipartTestUploader(t *testing.T) (*Uploader, *fakeRemoteStore, *metastore.BoltMetaStore) {
+	t.Helper()
+	lg := logger.NewStdoutLogger(logger.Dev, "test")
+	ms, err := metastore.NewBoltMetaStore(filepath.Join(t.TempDir(), "meta.db"), lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ms.Close() })
+
+	rs := &fakeRemoteStore{chunks: map[location][]byte{}, down: map[multishard.ServerIdx]bool{}}
+	u := NewUploader(
+		&config.Config{ChunkSize: 4, WriteQuorum: 1, Redundancy: string(Replication)},
+		fakeShardManager{servers: 3, replicas: 1},
+		rs,
+		ms,
+		lg,
+	)
+	return u, rs, ms
+}
+
+func TestUploader_MultipartUploadPutsPartsTogether(t *testing.T) {
+	u, rs, ms := newMultipartTestUploader(t)
+	ctx := context.Background()
+
+	mu, err := u.CreateMultipartUpload(ctx, "photos", "a.bin", UploadOptions{ContentType: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := map[int][]byte{1: []byte("first part"), 2: []byte("unused part"), 3: []byte("last")}
+	etags := map[int]string{}
+	for n, content := range contents {
+		plan, err := u.UploadPart(ctx, mu.ID, n, bytes.NewReader(content), UploadOptions{})
+		if err != nil {
+			t.Fatalf("UploadPart(%d) error = %v", n, err)
+		}
+		etags[n] = PartETag(plan)
+	}
+
+	parts := []CompletedPart{{Number: 3, ETag: etags[3]}, {Number: 1, ETag: etags[1]}}
+	if _, err := u.CompleteMultipartUpload(ctx, mu.ID, parts); !errors.Is(err, ErrInvalidPart) {
+		t.Errorf("expected parts out of order to be refused, got %v", err)
+	}
+	parts = []CompletedPart{{Number: 1, ETag: etags[1]}, {Number: 3, ETag: etags[2]}}
+	if _, err := u.CompleteMultipartUpload(ctx, mu.ID, parts); !errors.Is(err, ErrInvalidPart) {
+		t.Errorf("expected a part with another etag to be refused, got %v", err)
+	}
+
+	parts = []CompletedPart{{Number: 1, ETag: etags[1]}, {Number: 3, ETag: etags[3]}}
+	if _, err := u.CompleteMultipartUpload(ctx, mu.ID, parts); err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := multishard.ObjectKey("photos", "a.bin")
+	plan, err := ms.GetShardPlan(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.ContentType != "image/png" || plan.Name != "a.bin" {
+		t.Errorf("expected the name and content type of the upload, got %+v", plan)
+	}
+	var got []byte
+	for i, shard := range plan.Shards {
+		if shard.ChunkIdx != i {
+			t.Errorf("chunk %d has index %d", i, shard.ChunkIdx)
+		}
+		got = append(got, rs.get(shard.Key, multishard.ServerIdx(shard.ServerIdx))...)
+	}
+	if want := "first partlast"; string(got) != want || plan.OriginalSize != len(want) {
+		t.Errorf("completed file = %q of %d bytes, want %q", got, plan.OriginalSize, want)
+	}
+
+	if keys, _ := ms.ListPrefix(ctx, multishard.PartsPrefix(mu.ID), "", 0); len(keys) != 0 {
+		t.Errorf("expected the parts to be forgotten, got %v", keys)
+	}
+	deletions, _ := ms.ListPendingDeletions(ctx)
+	if len(deletions) != 1 || deletions[0].Key != multishard.PartKey(mu.ID, 2) {
+		t.Errorf("expected the chunks of the unused part to be deleted, got %+v", deletions)
+	}
+	if _, err := u.UploadPart(ctx, mu.ID, 4, bytes.NewReader([]byte("late")), UploadOptions{}); !errors.Is(err, ErrNoSuchUpload) {
+		t.Errorf("expected the completed upload to be gone, got %v", err)
+	}
+}
+
+func TestUploader_AbortMultipartUploadDeletesParts(t *testing.T) {
+	u, _, ms := newMultipartTestUploader(t)
+	ctx := context.Background()
+
+	mu, err := u.CreateMultipartUpload(ctx, "", "a.bin", UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.UploadPart(ctx, mu.ID, 1, bytes.NewReader([]byte("part")), UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.AbortMultipartUpload(ctx, mu.ID); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := ms.ListPrefix(ctx, multishard.PartsPrefix(mu.ID), "", 0); len(keys) != 0 {
+		t.Errorf("expected the parts to be forgotten, got %v", keys)
+	}
+	if deletions, _ := ms.ListPendingDeletions(ctx); len(deletions) != 1 {
+		t.Errorf("expected the chunks of the part to be deleted, got %+v", deletions)
+	}
+	if err := u.AbortMultipartUpload(ctx, mu.ID); !errors.Is(err, ErrNoSuchUpload) {
+		t.Errorf("expected ErrNoSuchUpload, got %v", err)
+	}
+	if err := u.AbortMultipartUpload(ctx, "../../etc"); !errors.Is(err, ErrNoSuchUpload) {
+		t.Errorf("expected ErrNoSuchUpload for a malformed id, got %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package uploader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"sync"
+	"time"
+)
+
+// uploadTracker - chunks of a running upload, the ones it is about to write are recorded
+// in the meta store before they are written and the ones that were written are kept in memory,
+// so a failed upload can remove what it wrote and the janitor what an upload of a crashed gateway wrote
+type uploadTracker struct {
+	record *metastore.PendingUpload
+	stored bool
+
+	// generation - random id of the upload in the keys of its chunks,
+	// they never collide with the chunks of other uploads of the same file
+	generation string
+
+	// replicated - writes of the replicated chunks, some of them may go on after the plan is committed
+	replicated []*chunkWrite
+
+	wg      sync.WaitGroup
+	mx      sync.Mutex
+	written []metastore.Location
+}
+
+func newUploadTracker(key multishard.Key) (*uploadTracker, error) {
+	generation := make([]byte, 8)
+	if _, err := rand.Read(generation); err != nil {
+		return nil, fmt.Errorf("could not generate upload generation: %w", err)
+	}
+	return &uploadTracker{record: metastore.NewPendingUpload(key), generation: hex.EncodeToString(generation)}, nil
+}
+
+// intend - records the locations before anything is written to them
+func (u *Uploader) intend(ctx context.Context, t *uploadTracker, locations ...metastore.Location) error {
+	t.record.Locations = append(t.record.Locations, locations...)
+	t.record.UpdatedAt = time.Now()
+	if err := u.metaStore.StorePendingUpload(ctx, t.record); err != nil {
+		return fmt.Errorf("could not record pending upload of %s: %w", t.record.Key, err)
+	}
+	t.stored = true
+	return nil
+}
+
+// start - a write to one of the recorded locations begins
+func (t *uploadTracker) start() {
+	t.wg.Add(1)
+}
+
+// done - the write started before has finished
+func (t *uploadTracker) done(loc metastore.Location, err error) {
+	defer t.wg.Done()
+	if err != nil {
+		return
+	}
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.written = append(t.written, loc)
+}
+
+// finishUpload - the plan of the upload is committed and its chunks are referenced by it
+func (u *Uploader) finishUpload(ctx context.Context, t *uploadTracker) {
+	if !t.stored {
+		return
+	}
+	if err := u.metaStore.RemovePendingUpload(ctx, t.record.ID); err != nil {
+		u.lg.Error(fmt.Errorf("could not remove pending upload of %s: %w", t.record.Key, err))
+	}
+}
+
+// settleUpload - waits for the replicas slower than the write quorum, they are given FG_STORAGE_SERVER_TIMEOUT
+// after the upload returned, adds the ones that succeeded meanwhile to the committed plan and then drops
+// the record of the upload. Chunks left with fewer copies than asked for are repaired by the garbage collector
+func (u *Uploader) settleUpload(key multishard.Key, t *uploadTracker, cancelWrites context.CancelFunc) {
+	defer u.settling.Done()
+
+	if u.cfg.StorageServerTimeout > 0 {
+		timer := time.AfterFunc(u.cfg.StorageServerTimeout, cancelWrites)
+		defer timer.Stop()
+	}
+	t.wg.Wait()
+	cancelWrites()
+
+	ctx, cancel := u.compensationContext()
+	defer cancel()
+
+	late := make(map[multishard.Key][]int)
+	for _, c := range t.replicated {
+		if servers := c.late(); len(servers) > 0 {
+			late[c.key] = servers
+		}
+	}
+
+	if len(late) > 0 {
+		err := u.metaStore.UpdateShardPlan(ctx, key, func(plan *metastore.ShardPlan) (*metastore.ShardPlan, error) {
+			next := *plan
+			next.Shards = append([]metastore.Shard(nil), plan.Shards...)
+			for i, shard := range next.Shards {
+				// chunk keys are unique to the upload, a plan of another upload has none of them
+				if servers, ok := late[shard.Key]; ok {
+					next.Shards[i].Replicas = append(append([]int(nil), shard.Replicas...), servers...)
+				}
+			}
+			return &next, nil
+		})
+		if err != nil {
+			// the copies are not referenced, the garbage collector removes them
+			u.lg.Error(fmt.Errorf("could not add replicas of %d chunks of %s written after the upload: %w", len(late), key, err))
+		}
+	}
+
+	u.finishUpload(ctx, t)
+}
+
+// abandonUpload - removes the chunks a failed upload wrote once all its writes are over, the context of the upload
+// has to be cancelled by then. Its chunks are keyed by its own generation, so the committed plan of the key
+// never references them and keeps its own chunks intact, chunks that cannot be removed now are left for the cleanup
+func (u *Uploader) abandonUpload(t *uploadTracker) {
+	if !t.stored {
+		return
+	}
+	t.wg.Wait()
+
+	// the context of the upload is done, typically because the client went away
+	ctx, cancel := u.compensationContext()
+	defer cancel()
+
+	key := t.record.Key
+	orphaned := t.written
+	plan, err := u.metaStore.GetShardPlan(ctx, key)
+	switch {
+	case err == nil:
+		orphaned = plan.Unreferenced(key, orphaned)
+	case !errors.Is(err, metastore.ErrNotFound):
+		u.lg.Error(fmt.Errorf("could not check shard plan of %s, its failed upload is left for the janitor: %w", key, err))
+		return
+	}
+
+	remaining := u.deleteLocations(ctx, key, orphaned)
+	if len(remaining) > 0 {
+		if err := u.metaStore.StorePendingDeletion(ctx, metastore.NewPendingDeletion(key, remaining)); err != nil {
+			u.lg.Error(fmt.Errorf("could not record %d chunks of the failed upload of %s, left for the janitor: %w", len(remaining), key, err))
+			return
+		}
+	}
+
+	if err := u.metaStore.RemovePendingUpload(ctx, t.record.ID); err != nil {
+		u.lg.Error(fmt.Errorf("could not remove pending upload of %s: %w", key, err))
+	}
+}
+
+// compensationContext - deletes of a failed upload are bounded by the storage server timeout
+func (u *Uploader) compensationContext() (context.Context, context.CancelFunc) {
+	if u.cfg.StorageServerTimeout > 0 {
+		return context.WithTimeout(context.Background(), u.cfg.StorageServerTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// deleteLocations - removes chunk copies and fragments in parallel and returns the ones that failed
+func (u *Uploader) deleteLocations(ctx context.Context, key multishard.Key, locations []metastore.Location) []metastore.Location {
+	var mx sync.Mutex
+	var remaining []metastore.Location
+	var wg sync.WaitGroup
+
+	for _, loc := range locations {
+		wg.Add(1)
+		go func(loc metastore.Location) {
+			defer wg.Done()
+
+			if err := u.remoteStore.Delete(ctx, loc.Key, multishard.ServerIdx(loc.ServerIdx)); err != nil {
+				u.lg.Error(fmt.Errorf("could not delete %s of the failed upload of %s from server %d: %w", loc.Key, key, loc.ServerIdx, err))
+				mx.Lock()
+				remaining = append(remaining, loc)
+				mx.Unlock()
+			}
+		}(loc)
+	}
+
+	wg.Wait()
+	return remaining
+}
+
+// CleanupPendingUploads - hands the chunks of uploads that did not go on for the grace period over to the cleanup
+// of pending deletions, which leaves alone the ones the committed plan of the key references.
+// Such uploads were running on a gateway that went down, the ones of a running gateway remove their own records
+func (u *Uploader) CleanupPendingUploads(ctx context.Context) error {
+	if u.cfg.PendingUploadGrace <= 0 {
+		return nil
+	}
+
+	uploads, err := u.metaStore.ListPendingUploads(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, pu := range uploads {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(pu.UpdatedAt) < u.cfg.PendingUploadGrace {
+			continue
+		}
+
+		if len(pu.Locations) > 0 {
+			pd := metastore.NewPendingDeletion(pu.Key, pu.Locations)
+			if err := u.metaStore.StorePendingDeletion(ctx, pd); err != nil {
+				u.lg.Error(fmt.Errorf("could not hand over chunks of the abandoned upload of %s: %w", pu.Key, err))
+				continue
+			}
+		}
+		if err := u.metaStore.RemovePendingUpload(ctx, pu.ID); err != nil {
+			u.lg.Error(err)
+			continue
+		}
+		u.lg.Debugf("chunks of the upload of %s started at %s were abandoned", pu.Key, pu.StartedAt)
+	}
+
+	return nil
+}
+
+// RunPendingUploadsCleanup - cleans up abandoned uploads every cleanup interval until the context is done
+func (u *Uploader) RunPendingUploadsCleanup(ctx context.Context) {
+	if u.cfg.CleanupInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(u.cfg.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := u.CleanupPendingUploads(ctx); err != nil && ctx.Err() == nil {
+				u.lg.Error(fmt.Errorf("pending uploads cleanup failed: %w", err))
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+var errConnectionLost = errors.New("connection lost")
+
+func TestUploader_FailedUploadRemovesWrittenChunks(t *testing.T) {
+	u, rs, ms := newTestUploader(4, 3)
+	ctx := context.Background()
+
+	if err := u.Upload(ctx, "", "file.txt", bytes.NewReader([]byte("committed")), UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	u.settling.Wait()
+	committed := ms.plan
+
+	// two chunks are written before the client goes away in the middle of the third one
+	r := io.MultiReader(bytes.NewReader([]byte("0123456789")), iotest.ErrReader(errConnectionLost))
+	if err := u.Upload(ctx, "", "other.txt", r, UploadOptions{}); !errors.Is(err, errConnectionLost) {
+		t.Fatalf("Upload() error = %v, want the read error", err)
+	}
+
+	referenced := make(map[location]bool)
+	for _, loc := range committed.Locations("file.txt") {
+		referenced[location{key: loc.Key, serverIdx: multishard.ServerIdx(loc.ServerIdx)}] = true
+	}
+	rs.mx.Lock()
+	for loc := range rs.chunks {
+		if !referenced[loc] {
+			t.Errorf("chunk %s of the failed upload was left on server %d", loc.key, loc.serverIdx)
+		}
+	}
+	rs.mx.Unlock()
+
+	if ms.plan != committed {
+		t.Errorf("expected the committed plan to be left as it is")
+	}
+	if len(ms.uploads) != 0 || len(ms.pending) != 0 {
+		t.Errorf("expected nothing left to clean up, got uploads %+v and deletions %+v", ms.uploads, ms.pending)
+	}
+}
+
+func TestUploader_FailedUploadLeavesChunksOfCommittedPlan(t *testing.T) {
+	u, rs, ms := newTestUploader(4, 3)
+	ctx := context.Background()
+
+	if err := u.Upload(ctx, "", "file.txt", bytes.NewReader([]byte("12345678")), UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	u.settling.Wait()
+	committed := ms.plan
+
+	// the second upload of the file writes chunk 0 to the same server as the first one and fails on chunk 1
+	rs.down[1] = true
+	if err := u.Upload(ctx, "", "file.txt", bytes.NewReader([]byte("abcdefgh")), UploadOptions{}); !errors.Is(err, ErrQuorumNotReached) {
+		t.Fatalf("Upload() error = %v, want %v", err, ErrQuorumNotReached)
+	}
+
+	if ms.plan != committed {
+		t.Fatalf("expected the committed plan to be left as it is")
+	}
+	if got := download(t, rs, "file.txt", committed); got != "12345678" {
+		t.Errorf("expected the chunks of the committed plan to keep the first upload, got %q", got)
+	}
+	if len(ms.uploads) != 0 {
+		t.Errorf("expected the pending upload to be removed, got %+v", ms.uploads)
+	}
+}
+
+func TestUploader_CleanupPendingUploadsHandsOverAbandonedChunks(t *testing.T) {
+	u, _, ms := newTestUploader(4, 3)
+	u.cfg.PendingUploadGrace = time.Hour
+	ctx := context.Background()
+
+	abandoned := metastore.NewPendingUpload("crashed.txt")
+	abandoned.Locations = []metastore.Location{{Key: "crashed.txt/0", ServerIdx: 2}}
+	abandoned.UpdatedAt = time.Now().Add(-2 * time.Hour)
+	running := metastore.NewPendingUpload("running.txt")
+	running.Locations = []metastore.Location{{Key: "running.txt/0", ServerIdx: 1}}
+	for _, pu := range []*metastore.PendingUpload{abandoned, running} {
+		if err := ms.StorePendingUpload(ctx, pu); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := u.CleanupPendingUploads(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ms.uploads[running.ID]; !ok || len(ms.uploads) != 1 {
+		t.Errorf("expected only the running upload to be left, got %+v", ms.uploads)
+	}
+	if len(ms.pending) != 1 || ms.pending[0].Key != "crashed.txt" || len(ms.pending[0].Locations) != 1 ||
+		ms.pending[0].Locations[0] != (metastore.Location{Key: "crashed.txt/0", ServerIdx: 2}) {
+		t.Errorf("pending deletions = %+v, want the chunk of the abandoned upload", ms.pending)
+	}
+}
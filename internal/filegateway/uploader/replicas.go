@@ -0,0 +1,216 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQuorumNotReached = errors.New("write quorum not reached")
+	ErrReplicaStalled   = errors.New("replica stopped taking the chunk")
+)
+
+// replicaWriter - feeds the same chunk to all of its replicas at once, a replica that fails
+// or does not take a piece within the timeout is left behind as long as the quorum can still be reached
+type replicaWriter struct {
+	writers []*io.PipeWriter
+	cancels []context.CancelFunc
+	failed  []bool
+	alive   int
+	quorum  int
+	timeout time.Duration
+}
+
+// replicaWrite - outcome of feeding a piece to one replica
+type replicaWrite struct {
+	replica int
+	err     error
+}
+
+func newReplicaWriter(writers []*io.PipeWriter, cancels []context.CancelFunc, quorum int, timeout time.Duration) *replicaWriter {
+	return &replicaWriter{
+		writers: writers,
+		cancels: cancels,
+		failed:  make([]bool, len(writers)),
+		alive:   len(writers),
+		quorum:  quorum,
+		timeout: timeout,
+	}
+}
+
+func (rw *replicaWriter) Write(p []byte) (int, error) {
+	results := make(chan replicaWrite, len(rw.writers))
+	pending := 0
+	for i, w := range rw.writers {
+		if rw.failed[i] {
+			continue
+		}
+		pending++
+		go func(i int, w *io.PipeWriter) {
+			_, err := w.Write(p)
+			results <- replicaWrite{replica: i, err: err}
+		}(i, w)
+	}
+
+	var timeout <-chan time.Time
+	if rw.timeout > 0 {
+		timer := time.NewTimer(rw.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var lastErr error
+	done := make([]bool, len(rw.writers))
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			done[res.replica] = true
+			if res.err != nil && !rw.failed[res.replica] {
+				rw.drop(res.replica, res.err)
+				lastErr = res.err
+			}
+		case <-timeout:
+			// the stalled writes return once their pipes are closed, p is not reused before
+			for i := range rw.writers {
+				if !rw.failed[i] && !done[i] {
+					lastErr = fmt.Errorf("no progress in %s: %w", rw.timeout, ErrReplicaStalled)
+					rw.drop(i, lastErr)
+				}
+			}
+			timeout = nil
+		}
+	}
+
+	if rw.alive < rw.quorum {
+		return 0, fmt.Errorf("%d of %d replicas left: %w: %v", rw.alive, len(rw.writers), ErrQuorumNotReached, lastErr)
+	}
+
+	return len(p), nil
+}
+
+// drop - leaves the replica behind, its upload is cancelled so that it does not commit
+func (rw *replicaWriter) drop(replica int, err error) {
+	rw.failed[replica] = true
+	rw.alive--
+	_ = rw.writers[replica].CloseWithError(err)
+	rw.cancels[replica]()
+}
+
+// close - ends the chunk for replicas that are still being written
+func (rw *replicaWriter) close() {
+	for i, w := range rw.writers {
+		if !rw.failed[i] {
+			_ = w.Close()
+		}
+	}
+}
+
+// abort - makes sure no replica commits what was written so far
+func (rw *replicaWriter) abort(err error) {
+	for _, w := range rw.writers {
+		_ = w.CloseWithError(err)
+	}
+}
+
+// chunkWrite - tracks acknowledgements of a chunk from its replicas
+type chunkWrite struct {
+	idx      int
+	key      multishard.Key
+	replicas []multishard.ServerIdx
+	quorum   int
+
+	mx       sync.Mutex
+	size     int
+	acked    []bool
+	planned  []bool
+	checksum uint32
+	nAcked   int
+	nFailed  int
+	err      error
+	ready    chan struct{}
+}
+
+func newChunkWrite(idx int, key multishard.Key, replicas []multishard.ServerIdx, quorum int) *chunkWrite {
+	return &chunkWrite{
+		idx:      idx,
+		key:      key,
+		replicas: replicas,
+		quorum:   quorum,
+		acked:    make([]bool, len(replicas)),
+		ready:    make(chan struct{}),
+	}
+}
+
+// ack - records the outcome of writing the replica along with the checksum the replica confirmed,
+// returns an error once the chunk has failed so many replicas that the quorum cannot be reached
+func (c *chunkWrite) ack(replica int, checksum uint32, err error) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	finished := c.nAcked >= c.quorum || c.err != nil
+	if err == nil {
+		// every replica was fed the same bytes, so each confirms the same checksum
+		c.acked[replica] = true
+		c.checksum = checksum
+		c.nAcked++
+	} else {
+		c.nFailed++
+		if !finished && c.nFailed > len(c.replicas)-c.quorum {
+			c.err = fmt.Errorf("chunk %d failed on %d of %d replicas: %w: %v", c.idx, c.nFailed, len(c.replicas), ErrQuorumNotReached, err)
+		}
+	}
+
+	if !finished && (c.nAcked >= c.quorum || c.err != nil) {
+		close(c.ready)
+	}
+
+	return c.err
+}
+
+// wait - blocks until the quorum acknowledges the chunk
+// and returns the replicas that did so far, in replica order, and the chunk checksum
+func (c *chunkWrite) wait(ctx context.Context) ([]int, uint32, error) {
+	select {
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case <-c.ready:
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.err != nil {
+		return nil, 0, c.err
+	}
+
+	servers := make([]int, 0, c.nAcked)
+	c.planned = append([]bool(nil), c.acked...)
+	for i, ok := range c.acked {
+		if ok {
+			servers = append(servers, int(c.replicas[i]))
+		}
+	}
+	return servers, c.checksum, nil
+}
+
+// late - replicas that acknowledged the chunk after wait returned the ones for the plan
+func (c *chunkWrite) late() []int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.planned == nil {
+		return nil
+	}
+	var servers []int
+	for i, ok := range c.acked {
+		if ok && !c.planned[i] {
+			servers = append(servers, int(c.replicas[i]))
+		}
+	}
+	return servers
+}
@@ -0,0 +1,488 @@
+package uploader
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrOffsetMismatch = errors.New("offset does not match the received bytes")
+	ErrUploadLocked   = errors.New("upload is being written by another request")
+	ErrExpired        = errors.New("upload expired")
+)
+
+// CreateResumableUpload - starts an upload of length bytes that is sent over as many requests as it takes,
+// the content type and user metadata of the options are given to the file once it is completed
+func (u *Uploader) CreateResumableUpload(
+	ctx context.Context,
+	bucket, fileName string,
+	length int64,
+	metadata string,
+	opts UploadOptions,
+) (*metastore.ResumableUpload, error) {
+	if _, err := multishard.ObjectKey(bucket, fileName); err != nil {
+		return nil, err
+	}
+	if err := validateUserMeta(opts.UserMeta); err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("%d: %w", length, ErrInvalidLength)
+	}
+
+	opts = u.withDefaults(opts)
+	if opts.ChunkSize <= 0 {
+		return nil, fmt.Errorf("chunk size %d: %w", opts.ChunkSize, ErrInvalidChunkSize)
+	}
+	if opts.Redundancy != Replication && opts.Redundancy != ErasureCoding {
+		return nil, fmt.Errorf("%q: %w", opts.Redundancy, ErrInvalidRedundancy)
+	}
+
+	if err := os.MkdirAll(u.cfg.ResumableUploadPath(), 0755); err != nil {
+		return nil, fmt.Errorf("could not create resumable upload directory: %w", err)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("could not generate resumable upload id: %w", err)
+	}
+
+	now := time.Now().UTC()
+	ru := &metastore.ResumableUpload{
+		ID:                  hex.EncodeToString(id),
+		Bucket:              bucket,
+		Name:                fileName,
+		Length:              length,
+		ContentType:         opts.ContentType,
+		UserMeta:            opts.UserMeta,
+		Metadata:            metadata,
+		Redundancy:          string(opts.Redundancy),
+		ChunkSize:           opts.ChunkSize,
+		Replicas:            opts.Replicas,
+		ErasureDataShards:   opts.ErasureDataShards,
+		ErasureParityShards: opts.ErasureParityShards,
+		CreatedAt:           now,
+		ExpiresAt:           u.resumableExpiry(now),
+	}
+	if err := u.metaStore.CreateResumableUpload(ctx, ru); err != nil {
+		return nil, fmt.Errorf("could not create resumable upload of %s: %w", fileName, err)
+	}
+
+	if length == 0 {
+		// an empty file has all its bytes already, clients do not send any
+		if err := u.completeResumable(ctx, ru); err != nil {
+			return nil, err
+		}
+	}
+	return ru, nil
+}
+
+// GetResumableUpload - the upload with the offset of the next byte it expects,
+// fails with ErrNoSuchUpload when the upload was completed, terminated or never existed
+func (u *Uploader) GetResumableUpload(ctx context.Context, uploadID string) (*metastore.ResumableUpload, int64, error) {
+	ru, err := u.getResumableUpload(ctx, uploadID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tailSize, err := u.tailSize(ru)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ru, resumableOffset(ru, tailSize), nil
+}
+
+// WriteResumable - appends what the reader has, up to the length of the upload, at the offset, which has to be
+// the offset of the next expected byte. Bytes wait on the gateway until they fill a chunk, which is then stored
+// on the file servers, the plan of the file is committed when the last byte arrives.
+// What was received is kept even when reading fails halfway, the returned offset is where to resume from
+func (u *Uploader) WriteResumable(ctx context.Context, uploadID string, offset int64, r io.Reader) (int64, error) {
+	if !u.acquireResumable(uploadID) {
+		return 0, fmt.Errorf("%s: %w", uploadID, ErrUploadLocked)
+	}
+	defer u.releaseResumable(uploadID)
+
+	ru, err := u.getResumableUpload(ctx, uploadID)
+	if err != nil {
+		return 0, err
+	}
+	tailSize, err := u.tailSize(ru)
+	if err != nil {
+		return 0, err
+	}
+	if expected := resumableOffset(ru, tailSize); offset != expected {
+		return expected, fmt.Errorf("offset %d of %s, expected %d: %w", offset, uploadID, expected, ErrOffsetMismatch)
+	}
+	if ru.Stored+tailSize == ru.Length {
+		// the last byte is resent after a failed commit, it was received before
+		_, _ = io.CopyN(io.Discard, r, 1)
+	}
+
+	var readErr error
+	for ru.Stored < ru.Length {
+		room := ru.ChunkSize - tailSize
+		if left := ru.Length - ru.Stored - tailSize; left < room {
+			room = left
+		}
+
+		n, err := u.appendTail(ru, r, room)
+		tailSize += n
+		if err != nil {
+			readErr = err
+			break
+		}
+		if n < room {
+			break
+		}
+
+		// the chunk is full or it is the last one
+		if err := u.storeSegment(ctx, ru, tailSize); err != nil {
+			return resumableOffset(ru, tailSize), err
+		}
+		tailSize = 0
+	}
+
+	if ru.Stored == ru.Length {
+		if err := u.completeResumable(ctx, ru); err != nil {
+			return resumableOffset(ru, 0), err
+		}
+		return ru.Length, readErr
+	}
+
+	if err := u.metaStore.UpdateResumableUpload(ctx, uploadID, func(current *metastore.ResumableUpload) (*metastore.ResumableUpload, error) {
+		current.ExpiresAt = u.resumableExpiry(time.Now().UTC())
+		return current, nil
+	}); err != nil {
+		u.lg.Error(fmt.Errorf("could not extend resumable upload %s: %w", uploadID, err))
+	}
+
+	return resumableOffset(ru, tailSize), readErr
+}
+
+// appendTail - appends up to n bytes of the reader to the bytes waiting for the next segment,
+// what was appended is synced to disk before it is acknowledged
+func (u *Uploader) appendTail(ru *metastore.ResumableUpload, r io.Reader, n int64) (int64, error) {
+	tail, err := os.OpenFile(u.tailPath(ru), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("could not open resumable upload %s: %w", ru.ID, err)
+	}
+	defer tail.Close()
+
+	written, err := io.CopyN(tail, r, n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = fmt.Errorf("failed reading uploaded content: %w", err)
+	} else {
+		err = nil
+	}
+
+	if errSync := tail.Sync(); errSync != nil {
+		return 0, fmt.Errorf("could not keep resumable upload %s: %w", ru.ID, errSync)
+	}
+	return written, err
+}
+
+// TerminateResumableUpload - deletes what was received of the upload, expired or not
+func (u *Uploader) TerminateResumableUpload(ctx context.Context, uploadID string) error {
+	if !u.acquireResumable(uploadID) {
+		return fmt.Errorf("%s: %w", uploadID, ErrUploadLocked)
+	}
+	defer u.releaseResumable(uploadID)
+
+	if !validUploadID(uploadID) {
+		return fmt.Errorf("%q: %w", uploadID, ErrNoSuchUpload)
+	}
+	if err := u.metaStore.DeleteResumableUpload(ctx, uploadID); err != nil {
+		if errors.Is(err, metastore.ErrNotFound) {
+			return fmt.Errorf("%s: %w", uploadID, ErrNoSuchUpload)
+		}
+		return fmt.Errorf("could not terminate resumable upload %s: %w", uploadID, err)
+	}
+
+	u.removePlans(ctx, multishard.SegmentsPrefix(uploadID), nil)
+	u.removeTails(uploadID)
+	return nil
+}
+
+// ExpireResumableUploads - terminates uploads that were not written to before they expired
+// and removes waiting bytes that outlived their uploads
+func (u *Uploader) ExpireResumableUploads(ctx context.Context) error {
+	uploads, err := u.metaStore.ListResumableUploads(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, ru := range uploads {
+		if ru.ExpiresAt.IsZero() || now.Before(ru.ExpiresAt) {
+			continue
+		}
+		if err := u.TerminateResumableUpload(ctx, ru.ID); err != nil &&
+			!errors.Is(err, ErrUploadLocked) && !errors.Is(err, ErrNoSuchUpload) {
+			return err
+		}
+		u.lg.Debugf("resumable upload %s of %s expired", ru.ID, ru.Name)
+	}
+
+	if u.cfg.ResumableUploadExpiry <= 0 {
+		return nil
+	}
+
+	// left behind by a crash after the upload was completed or terminated,
+	// any upload that is still alive writes its file more often
+	entries, err := os.ReadDir(u.cfg.ResumableUploadPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("could not read resumable uploads: %w", err)
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || now.Sub(info.ModTime()) < u.cfg.ResumableUploadExpiry {
+			continue
+		}
+		if err := os.Remove(filepath.Join(u.cfg.ResumableUploadPath(), e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			u.lg.Error(fmt.Errorf("could not remove abandoned upload file %s: %w", e.Name(), err))
+		}
+	}
+
+	return nil
+}
+
+// RunResumableExpiry - expires abandoned resumable uploads every cleanup interval until the context is done
+func (u *Uploader) RunResumableExpiry(ctx context.Context) {
+	if u.cfg.CleanupInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(u.cfg.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := u.ExpireResumableUploads(ctx); err != nil && ctx.Err() == nil {
+				u.lg.Error(fmt.Errorf("resumable uploads expiry failed: %w", err))
+			}
+		}
+	}
+}
+
+func (u *Uploader) getResumableUpload(ctx context.Context, uploadID string) (*metastore.ResumableUpload, error) {
+	if !validUploadID(uploadID) {
+		return nil, fmt.Errorf("%q: %w", uploadID, ErrNoSuchUpload)
+	}
+
+	ru, err := u.metaStore.GetResumableUpload(ctx, uploadID)
+	if err != nil {
+		if errors.Is(err, metastore.ErrNotFound) {
+			return nil, fmt.Errorf("%s: %w", uploadID, ErrNoSuchUpload)
+		}
+		return nil, err
+	}
+	if !ru.ExpiresAt.IsZero() && time.Now().After(ru.ExpiresAt) {
+		return nil, fmt.Errorf("%s: %w", uploadID, ErrExpired)
+	}
+	return ru, nil
+}
+
+// storeSegment - stores the waiting bytes as the next segment of the upload, the record moves on to the
+// next segment only once the segment is stored, so a failure leaves the bytes waiting to be stored again
+func (u *Uploader) storeSegment(ctx context.Context, ru *metastore.ResumableUpload, size int64) error {
+	h, err := restoreHash(ru.HashState)
+	if err != nil {
+		return fmt.Errorf("resumable upload %s: %w", ru.ID, err)
+	}
+
+	tail, err := os.Open(u.tailPath(ru))
+	if err != nil {
+		return fmt.Errorf("could not open resumable upload %s: %w", ru.ID, err)
+	}
+	defer tail.Close()
+
+	opts := UploadOptions{
+		Redundancy:          Redundancy(ru.Redundancy),
+		ChunkSize:           ru.ChunkSize,
+		Replicas:            ru.Replicas,
+		ErasureDataShards:   ru.ErasureDataShards,
+		ErasureParityShards: ru.ErasureParityShards,
+	}
+	content := io.TeeReader(io.NewSectionReader(tail, 0, size), h)
+	if _, err := u.upload(ctx, multishard.SegmentKey(ru.ID, ru.Segments), ru.Name, content, opts); err != nil {
+		return fmt.Errorf("could not store segment %d of resumable upload %s: %w", ru.Segments, ru.ID, err)
+	}
+
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("could not keep the content hash of resumable upload %s: %w", ru.ID, err)
+	}
+
+	prevTail := u.tailPath(ru)
+	err = u.metaStore.UpdateResumableUpload(ctx, ru.ID, func(current *metastore.ResumableUpload) (*metastore.ResumableUpload, error) {
+		if current.Segments != ru.Segments {
+			return nil, fmt.Errorf("segment %d was stored meanwhile: %w", ru.Segments, ErrOffsetMismatch)
+		}
+		current.Stored += size
+		current.Segments++
+		current.HashState = state
+		current.ExpiresAt = u.resumableExpiry(time.Now().UTC())
+		return current, nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not update resumable upload %s: %w", ru.ID, err)
+	}
+
+	ru.Stored += size
+	ru.Segments++
+	ru.HashState = state
+	if err := os.Remove(prevTail); err != nil && !errors.Is(err, os.ErrNotExist) {
+		u.lg.Error(fmt.Errorf("could not remove stored bytes of resumable upload %s: %w", ru.ID, err))
+	}
+	return nil
+}
+
+// completeResumable - puts the segments together into the plan of the file, their chunks stay where they are
+func (u *Uploader) completeResumable(ctx context.Context, ru *metastore.ResumableUpload) error {
+	key, err := multishard.ObjectKey(ru.Bucket, ru.Name)
+	if err != nil {
+		return err
+	}
+
+	h, err := restoreHash(ru.HashState)
+	if err != nil {
+		return fmt.Errorf("resumable upload %s: %w", ru.ID, err)
+	}
+
+	plan := &metastore.ShardPlan{
+		Name:        ru.Name,
+		ContentType: ru.ContentType,
+		ContentHash: hex.EncodeToString(h.Sum(nil)),
+		UserMeta:    ru.UserMeta,
+	}
+	for i := 0; i < ru.Segments; i++ {
+		segment, err := u.metaStore.GetShardPlan(ctx, multishard.SegmentKey(ru.ID, i))
+		if err != nil {
+			return fmt.Errorf("could not read segment %d of resumable upload %s: %w", i, ru.ID, err)
+		}
+		if err := appendPart(plan, segment, i == 0); err != nil {
+			return fmt.Errorf("segment %d of resumable upload %s: %w", i, ru.ID, err)
+		}
+	}
+	if Redundancy(ru.Redundancy) == Replication {
+		plan.Replicas = ru.Replicas
+	}
+
+	if err := u.commit(ctx, key, plan); err != nil {
+		return err
+	}
+	if err := u.metaStore.DeleteResumableUpload(ctx, ru.ID); err != nil {
+		u.lg.Error(fmt.Errorf("could not remove completed resumable upload %s: %w", ru.ID, err))
+	}
+
+	// the chunks of the segments are the chunks of the file now
+	u.removePlans(ctx, multishard.SegmentsPrefix(ru.ID), func(multishard.Key) bool { return true })
+	u.removeTails(ru.ID)
+	return nil
+}
+
+// tailSize - how many bytes wait for the next segment
+func (u *Uploader) tailSize(ru *metastore.ResumableUpload) (int64, error) {
+	info, err := os.Stat(u.tailPath(ru))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("could not check resumable upload %s: %w", ru.ID, err)
+	}
+	return info.Size(), nil
+}
+
+// resumableOffset - the last byte is acknowledged only along with the committed file,
+// so a client that resends it after a failed commit gets the file committed again
+func resumableOffset(ru *metastore.ResumableUpload, tailSize int64) int64 {
+	if offset := ru.Stored + tailSize; offset < ru.Length {
+		return offset
+	}
+	return ru.Length - 1
+}
+
+// tailPath - bytes received after the stored segments, the file is named after the segment they will be,
+// so bytes that were stored before a crash are never taken for bytes of the next segment
+func (u *Uploader) tailPath(ru *metastore.ResumableUpload) string {
+	return filepath.Join(u.cfg.ResumableUploadPath(), ru.ID+"."+strconv.Itoa(ru.Segments))
+}
+
+func (u *Uploader) removeTails(uploadID string) {
+	entries, err := os.ReadDir(u.cfg.ResumableUploadPath())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			u.lg.Error(fmt.Errorf("could not read resumable uploads: %w", err))
+		}
+		return
+	}
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), uploadID+".") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(u.cfg.ResumableUploadPath(), e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			u.lg.Error(fmt.Errorf("could not remove bytes of resumable upload %s: %w", uploadID, err))
+		}
+	}
+}
+
+// resumableExpiry - when an upload that is not written to from now on expires, zero for never
+func (u *Uploader) resumableExpiry(now time.Time) time.Time {
+	if u.cfg.ResumableUploadExpiry <= 0 {
+		return time.Time{}
+	}
+	return now.Add(u.cfg.ResumableUploadExpiry)
+}
+
+// acquireResumable - requests that write the same upload are handled one at a time,
+// a request finding the upload busy fails rather than waits for a connection that may be gone
+func (u *Uploader) acquireResumable(uploadID string) bool {
+	u.resumableMx.Lock()
+	defer u.resumableMx.Unlock()
+
+	if u.resumableBusy[uploadID] {
+		return false
+	}
+	u.resumableBusy[uploadID] = true
+	return true
+}
+
+func (u *Uploader) releaseResumable(uploadID string) {
+	u.resumableMx.Lock()
+	defer u.resumableMx.Unlock()
+
+	delete(u.resumableBusy, uploadID)
+}
+
+// restoreHash - the SHA-256 of the stored bytes, a new one when nothing is stored yet
+func restoreHash(state []byte) (hash.Hash, error) {
+	h := sha256.New()
+	if len(state) == 0 {
+		return h, nil
+	}
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, fmt.Errorf("could not restore the content hash: %w", err)
+	}
+	return h, nil
+}
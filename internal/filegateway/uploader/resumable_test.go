@@ -0,0 +1,170 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newResumableTestUploader(t *testing.T) (*Uploader, *fakeRemoteStore, *metastore.BoltMetaStore) {
+	t.Helper()
+	lg := logger.NewStdoutLogger(logger.Dev, "test")
+	ms, err := metastore.NewBoltMetaStore(filepath.Join(t.TempDir(), "meta.db"), lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ms.Close() })
+
+	rs := &fakeRemoteStore{chunks: map[location][]byte{}, down: map[multishard.ServerIdx]bool{}}
+	u := NewUploader(
+		&config.Config{
+			ChunkSize:             4,
+			WriteQuorum:           1,
+			Redundancy:            string(Replication),
+			ResumableUploadDir:    t.TempDir(),
+			ResumableUploadExpiry: time.Hour,
+		},
+		fakeShardManager{servers: 3, replicas: 1},
+		rs,
+		ms,
+		lg,
+	)
+	return u, rs, ms
+}
+
+func TestUploader_ResumableUploadCommitsOnLastByte(t *testing.T) {
+	u, rs, ms := newResumableTestUploader(t)
+	ctx := context.Background()
+	content := []byte("resumable content")
+
+	ru, err := u.CreateResumableUpload(ctx, "photos", "a.bin", int64(len(content)), "", UploadOptions{ContentType: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pieces do not line up with the chunks
+	offset := int64(0)
+	for _, end := range []int{3, 9, 16} {
+		next, err := u.WriteResumable(ctx, ru.ID, offset, bytes.NewReader(content[offset:end]))
+		if err != nil {
+			t.Fatalf("WriteResumable(%d) error = %v", offset, err)
+		}
+		if next != int64(end) {
+			t.Fatalf("WriteResumable(%d) = %d, want %d", offset, next, end)
+		}
+		offset = next
+	}
+
+	if _, err := u.WriteResumable(ctx, ru.ID, 3, bytes.NewReader(content[3:])); !errors.Is(err, ErrOffsetMismatch) {
+		t.Errorf("expected a write at a past offset to be refused, got %v", err)
+	}
+
+	key, _ := multishard.ObjectKey("photos", "a.bin")
+	if _, err := ms.GetShardPlan(ctx, key); !errors.Is(err, metastore.ErrNotFound) {
+		t.Fatalf("expected no file before the last byte, got %v", err)
+	}
+	if _, got, err := u.GetResumableUpload(ctx, ru.ID); err != nil || got != 16 {
+		t.Fatalf("GetResumableUpload() offset = %d, %v, want 16", got, err)
+	}
+
+	if next, err := u.WriteResumable(ctx, ru.ID, offset, bytes.NewReader(content[offset:])); err != nil || next != int64(len(content)) {
+		t.Fatalf("last WriteResumable() = %d, %v", next, err)
+	}
+
+	plan, err := ms.GetShardPlan(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	if plan.ContentHash != hex.EncodeToString(sum[:]) || plan.ContentType != "image/png" || plan.OriginalSize != len(content) {
+		t.Errorf("expected the hash, content type and size of the content, got %+v", plan)
+	}
+	var got []byte
+	for i, shard := range plan.Shards {
+		if shard.ChunkIdx != i {
+			t.Errorf("chunk %d has index %d", i, shard.ChunkIdx)
+		}
+		got = append(got, rs.get(shard.Key, multishard.ServerIdx(shard.ServerIdx))...)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("chunks add up to %q, want %q", got, content)
+	}
+
+	if _, _, err := u.GetResumableUpload(ctx, ru.ID); !errors.Is(err, ErrNoSuchUpload) {
+		t.Errorf("expected a completed upload to be gone, got %v", err)
+	}
+	if segments, _ := ms.ListPrefix(ctx, multishard.SegmentsPrefix(ru.ID), "", 0); len(segments) != 0 {
+		t.Errorf("expected no segment plans to be left, got %v", segments)
+	}
+}
+
+func TestUploader_ResumableUploadOfEmptyFileCommitsRightAway(t *testing.T) {
+	u, _, ms := newResumableTestUploader(t)
+	ctx := context.Background()
+
+	ru, err := u.CreateResumableUpload(ctx, "photos", "empty.bin", 0, "", UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := multishard.ObjectKey("photos", "empty.bin")
+	plan, err := ms.GetShardPlan(ctx, key)
+	if err != nil {
+		t.Fatalf("expected the empty file to be stored, got %v", err)
+	}
+	if plan.OriginalSize != 0 || len(plan.Shards) != 0 || plan.Name != "empty.bin" {
+		t.Errorf("expected an empty plan of empty.bin, got %+v", plan)
+	}
+	if _, _, err := u.GetResumableUpload(ctx, ru.ID); !errors.Is(err, ErrNoSuchUpload) {
+		t.Errorf("expected the completed upload to be gone, got %v", err)
+	}
+
+	if _, err := u.CreateResumableUpload(ctx, "photos", "negative.bin", -1, "", UploadOptions{}); !errors.Is(err, ErrInvalidLength) {
+		t.Errorf("CreateResumableUpload(-1) error = %v, want %v", err, ErrInvalidLength)
+	}
+}
+
+func TestUploader_ResumableUploadExpires(t *testing.T) {
+	u, _, ms := newResumableTestUploader(t)
+	ctx := context.Background()
+
+	ru, err := u.CreateResumableUpload(ctx, "", "a.bin", 10, "", UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.WriteResumable(ctx, ru.ID, 0, bytes.NewReader([]byte("abcdef"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ms.UpdateResumableUpload(ctx, ru.ID, func(current *metastore.ResumableUpload) (*metastore.ResumableUpload, error) {
+		current.ExpiresAt = time.Now().Add(-time.Minute)
+		return current, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.WriteResumable(ctx, ru.ID, 6, bytes.NewReader([]byte("ghij"))); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected an expired upload to be refused, got %v", err)
+	}
+
+	if err := u.ExpireResumableUploads(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := u.GetResumableUpload(ctx, ru.ID); !errors.Is(err, ErrNoSuchUpload) {
+		t.Errorf("expected the expired upload to be gone, got %v", err)
+	}
+	if segments, _ := ms.ListPrefix(ctx, multishard.SegmentsPrefix(ru.ID), "", 0); len(segments) != 0 {
+		t.Errorf("expected the stored segment to be handed to cleanup, got %v", segments)
+	}
+	if pending, _ := ms.ListPendingDeletions(ctx); len(pending) == 0 {
+		t.Errorf("expected the chunks of the stored segment to be left for cleanup")
+	}
+}
@@ -1,7 +1,10 @@
 package uploader
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/denismitr/shardstore/internal/common/logger"
@@ -9,7 +12,7 @@ import (
 	"github.com/denismitr/shardstore/internal/filegateway/metastore"
 	"github.com/denismitr/shardstore/internal/filegateway/multishard"
 	"io"
-	"mime/multipart"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,11 +21,49 @@ const (
 	maxBufSize = 4 * 1024
 )
 
+var (
+	ErrInvalidLength     = errors.New("invalid upload length")
+	ErrInvalidRedundancy = errors.New("invalid redundancy")
+	ErrInvalidMetadata   = errors.New("invalid user metadata")
+	ErrInvalidChunkSize  = errors.New("invalid chunk size")
+)
+
+// maxUserMetaSize - how many bytes of keys and values user metadata can have in total
+const maxUserMetaSize = 2048
+
+// Redundancy - how chunks of an upload are protected against losing a server
+type Redundancy string
+
+const (
+	// Replication - every chunk is copied to several servers
+	Replication Redundancy = "replication"
+	// ErasureCoding - every chunk is split into data fragments and parity fragments are added,
+	// any data shards worth of fragments are enough to restore the chunk
+	ErasureCoding Redundancy = "erasure"
+)
+
+// UploadOptions - settings of a single upload, zero values fall back to the configuration
+type UploadOptions struct {
+	Redundancy Redundancy
+	ChunkSize  int64
+	// Replicas - copies of every replicated chunk, the shard manager decides when it is zero
+	Replicas            int
+	ErasureDataShards   int
+	ErasureParityShards int
+
+	// ContentType - of the uploaded content, the one of the file extension is used when it is empty
+	ContentType string
+	// UserMeta - arbitrary metadata returned along with the file
+	UserMeta map[string]string
+}
+
 type shardManager interface {
-	// ResolveShardMap - resolves a shard map for a given key
+	// ResolveReplicas - resolves an ordered set of servers for a chunk of a given key
 	// todo: in case we need to distribute data according to the current servers capacity
 	// todo: we probably should pass the metadata summary with statistics on server data distribution
-	ResolveShardMap(key multishard.Key) (multishard.ShardMap, error)
+	ResolveReplicas(key multishard.Key, chunkIdx multishard.ChunkIdx) ([]multishard.ServerIdx, error)
+	// ResolveServers - resolves n distinct servers for pieces of a chunk of a given key
+	ResolveServers(key multishard.Key, chunkIdx multishard.ChunkIdx, n int) ([]multishard.ServerIdx, error)
 }
 
 type remoteStorage interface {
@@ -31,6 +72,11 @@ type remoteStorage interface {
 		key multishard.Key,
 		serverID multishard.ServerIdx,
 		r io.Reader,
+	) (uint32, error)
+	Delete(
+		ctx context.Context,
+		key multishard.Key,
+		serverID multishard.ServerIdx,
 	) error
 }
 
@@ -38,6 +84,32 @@ type remoteStorage interface {
 // and statistics on servers
 type metaStorage interface {
 	Store(ctx context.Context, key multishard.Key, entry *metastore.ShardPlan) error
+	GetShardPlan(ctx context.Context, key multishard.Key) (*metastore.ShardPlan, error)
+	UpdateShardPlan(
+		ctx context.Context,
+		key multishard.Key,
+		update func(plan *metastore.ShardPlan) (*metastore.ShardPlan, error),
+	) error
+	Delete(ctx context.Context, key multishard.Key) error
+	ListPrefix(ctx context.Context, prefix, after multishard.Key, limit int) ([]multishard.Key, error)
+	StorePendingDeletion(ctx context.Context, pd *metastore.PendingDeletion) error
+	StorePendingUpload(ctx context.Context, pu *metastore.PendingUpload) error
+	ListPendingUploads(ctx context.Context) ([]*metastore.PendingUpload, error)
+	RemovePendingUpload(ctx context.Context, id string) error
+
+	CreateMultipartUpload(ctx context.Context, mu *metastore.MultipartUpload) error
+	GetMultipartUpload(ctx context.Context, id string) (*metastore.MultipartUpload, error)
+	DeleteMultipartUpload(ctx context.Context, id string) error
+
+	CreateResumableUpload(ctx context.Context, ru *metastore.ResumableUpload) error
+	GetResumableUpload(ctx context.Context, id string) (*metastore.ResumableUpload, error)
+	UpdateResumableUpload(
+		ctx context.Context,
+		id string,
+		update func(ru *metastore.ResumableUpload) (*metastore.ResumableUpload, error),
+	) error
+	ListResumableUploads(ctx context.Context) ([]*metastore.ResumableUpload, error)
+	DeleteResumableUpload(ctx context.Context, id string) error
 }
 
 type Uploader struct {
@@ -46,6 +118,13 @@ type Uploader struct {
 	shardManager shardManager
 	remoteStore  remoteStorage
 	metaStore    metaStorage
+
+	// settling - uploads that returned while replicas slower than the write quorum are still being written
+	settling sync.WaitGroup
+
+	// resumableBusy - resumable uploads that a request is writing
+	resumableMx   sync.Mutex
+	resumableBusy map[string]bool
 }
 
 func NewUploader(
@@ -56,183 +135,330 @@ func NewUploader(
 	lg logger.Logger,
 ) *Uploader {
 	return &Uploader{
-		cfg:          cfg,
-		lg:           lg,
-		shardManager: shardManager,
-		remoteStore:  remoteStore,
-		metaStore:    metaStore,
+		cfg:           cfg,
+		lg:            lg,
+		shardManager:  shardManager,
+		remoteStore:   remoteStore,
+		metaStore:     metaStore,
+		resumableBusy: make(map[string]bool),
 	}
 }
 
+// Upload - cuts the streamed file into chunks of the configured size on the fly,
+// every chunk is stored while the rest of the file is still being read,
+// so memory use does not depend on the file size. The file is stored outside of buckets
+// when the bucket is empty
 func (u *Uploader) Upload(
 	ctx context.Context,
-	f multipart.File,
-	h *multipart.FileHeader,
+	bucket string,
+	fileName string,
+	r io.Reader,
+	opts UploadOptions,
 ) error {
-	errCh := make(chan error, 1)
-	doneCh := make(chan struct{}, 1)
-
-	key, err := multishard.ResolveKey(h.Filename)
+	key, err := multishard.ObjectKey(bucket, fileName)
 	if err != nil {
 		return err
 	}
 
-	// build the shard information with chunks and corresponding servers
-	planBuilder := metastore.NewShardPlanBuilder(key, int(h.Size), len(u.cfg.StorageServers))
+	_, err = u.upload(ctx, key, fileName, r, opts)
+	return err
+}
+
+// upload - stores the content and the plan of the file under the key,
+// when it fails the chunks it has written are removed again
+func (u *Uploader) upload(
+	ctx context.Context,
+	key multishard.Key,
+	fileName string,
+	r io.Reader,
+	opts UploadOptions,
+) (_ *metastore.ShardPlan, err error) {
+	if err := validateUserMeta(opts.UserMeta); err != nil {
+		return nil, err
+	}
 
-	multiShard, err := u.shardManager.ResolveShardMap(key)
+	opts = u.withDefaults(opts)
+	if opts.ChunkSize <= 0 {
+		return nil, fmt.Errorf("chunk size %d: %w", opts.ChunkSize, ErrInvalidChunkSize)
+	}
+
+	t, err := newUploadTracker(key)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	chunkSize := h.Size / u.cfg.NumberOfChunks
-	remainder := (h.Size % u.cfg.NumberOfChunks) != 0
 
-	var wg sync.WaitGroup
-	wg.Add(int(u.cfg.NumberOfChunks))
-	for i := int64(0); i < u.cfg.NumberOfChunks; i++ {
-		hasResidualBytes := i == u.cfg.NumberOfChunks-1 && remainder
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		go func(chunkIdx int64, hasResidualBytes bool) {
-			defer wg.Done()
+	// replicas slower than the write quorum go on after the upload returned,
+	// so chunks are written on a context of their own that the upload cancels until its plan is committed
+	writeCtx, cancelWrites := context.WithCancel(context.Background())
+	committed, watching := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(watching)
+		select {
+		case <-ctx.Done():
+			cancelWrites()
+		case <-committed:
+		}
+	}()
+	defer func() {
+		if err == nil {
+			close(committed)
+			<-watching
+		}
+	}()
+	defer func() {
+		if err != nil {
+			// writes that are still running stop before what they wrote is removed
+			cancel()
+			cancelWrites()
+			u.abandonUpload(t)
+			return
+		}
+		u.settling.Add(1)
+		go u.settleUpload(key, t, cancelWrites)
+	}()
 
-			serverIdx := multiShard[multishard.ChunkIdx(chunkIdx)]
-			offset := chunkSize * chunkIdx
-			size := chunkSize
-			if hasResidualBytes {
-				size += h.Size - (u.cfg.NumberOfChunks * chunkSize)
-			}
-			if err := u.uploadChunk(
-				ctx,
-				key,
-				f,
-				serverIdx,
-				int(size),
-				offset,
-			); err != nil {
-				errCh <- err
-				return
-			}
+	contentHash := sha256.New()
+	br := bufio.NewReaderSize(io.TeeReader(r, contentHash), maxBufSize)
 
-			// add shard info
-			if err := planBuilder.AddShard(int(chunkIdx), int(serverIdx), int(size)); err != nil {
-				errCh <- err
-				return
-			}
-		}(i, hasResidualBytes)
+	// build the shard information with chunks and corresponding servers
+	var planBuilder *metastore.ShardPlanBuilder
+	switch opts.Redundancy {
+	case Replication:
+		planBuilder, err = u.uploadReplicated(ctx, writeCtx, cancel, t, key, br, opts)
+	case ErasureCoding:
+		planBuilder, err = u.uploadErasureCoded(ctx, t, key, br, opts)
+	default:
+		return nil, fmt.Errorf("%q: %w", opts.Redundancy, ErrInvalidRedundancy)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upload of %s failed: %w", fileName, err)
 	}
 
-	go func() {
-		wg.Wait()
-		close(doneCh)
-	}()
+	plan, err := planBuilder.Build()
+	if err != nil {
+		return nil, fmt.Errorf("upload could not be accomplished: %w", err)
+	}
 
-	select {
-	case err := <-errCh:
-		return fmt.Errorf("upload failed: %w", err)
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-doneCh:
-		// save metadata about the key and associated shards
-		if err := u.metaStore.Store(ctx, key, planBuilder.Build()); err != nil {
-			return fmt.Errorf("upload could not be accomplished: %w", err)
-		}
-		return nil
+	// save metadata about the key and associated shards
+	plan.Name = fileName
+	plan.ContentType = opts.ContentType
+	plan.ContentHash = hex.EncodeToString(contentHash.Sum(nil))
+	plan.UserMeta = opts.UserMeta
+	if opts.Redundancy == Replication {
+		plan.Replicas = opts.Replicas
+	}
+	if err := u.commit(ctx, key, plan); err != nil {
+		return nil, err
 	}
+
+	return plan, nil
 }
 
-func (u *Uploader) uploadChunk(
-	parentCtx context.Context,
-	key multishard.Key,
-	f multipart.File,
-	serverID multishard.ServerIdx,
-	size int,
-	offset int64,
-) error {
-	if size == 0 {
-		return fmt.Errorf("how can size be 0")
+// commit - stores the plan in place of the previous one of the key,
+// the creation time of the previous one is kept and its chunks that are not reused are deleted
+func (u *Uploader) commit(ctx context.Context, key multishard.Key, plan *metastore.ShardPlan) error {
+	prev, err := u.metaStore.GetShardPlan(ctx, key)
+	if err != nil && !errors.Is(err, metastore.ErrNotFound) {
+		return fmt.Errorf("could not check the previous shard plan of %s: %w", key, err)
 	}
 
-	var wg sync.WaitGroup
-	readyCh := make(chan struct{})
-	errCh := make(chan error, 1)
-	r, w := io.Pipe()
+	plan.ModifiedAt = time.Now().UTC()
+	plan.CreatedAt = plan.ModifiedAt
+	if prev != nil && !prev.CreatedAt.IsZero() {
+		plan.CreatedAt = prev.CreatedAt
+	}
+	if err := u.metaStore.Store(ctx, key, plan); err != nil {
+		return fmt.Errorf("upload could not be accomplished: %w", err)
+	}
 
-	// cancel will be called on function exit, thus remoteStorage.Put will receive done signal
-	// in case write was not finished
-	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
-	defer cancel()
+	if prev != nil {
+		u.replaced(ctx, key, prev, plan)
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := u.remoteStore.Put(ctx, key, serverID, r); err != nil {
-			u.lg.Error(err)
-			errCh <- err
-		}
-	}()
+	return nil
+}
 
-	wg.Add(1)
-	go func() {
-		defer func() {
-			if err := w.Close(); err != nil {
-				u.lg.Error(fmt.Errorf("failed closing the writer: %w", err))
-			}
-			wg.Done()
-		}()
+// withDefaults - fills what the options leave out from the configuration
+func (u *Uploader) withDefaults(opts UploadOptions) UploadOptions {
+	if opts.Redundancy == "" {
+		opts.Redundancy = Redundancy(u.cfg.Redundancy)
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = u.cfg.ChunkSize
+	}
+	if opts.ErasureDataShards == 0 {
+		opts.ErasureDataShards = u.cfg.ErasureDataShards
+	}
+	if opts.ErasureParityShards == 0 {
+		opts.ErasureParityShards = u.cfg.ErasureParityShards
+	}
+	return opts
+}
 
-		if err := u.send(f, w, size, offset); err != nil {
-			u.lg.Error(err)
-			errCh <- err
-		}
-	}()
+// UpdateUserMeta - replaces the user metadata of the file, its content stays as it is
+func (u *Uploader) UpdateUserMeta(ctx context.Context, bucket, fileName string, meta map[string]string) error {
+	key, err := multishard.ObjectKey(bucket, fileName)
+	if err != nil {
+		return err
+	}
+	if err := validateUserMeta(meta); err != nil {
+		return err
+	}
 
-	go func() {
-		wg.Wait()
-		close(readyCh)
-	}()
+	err = u.metaStore.UpdateShardPlan(ctx, key, func(plan *metastore.ShardPlan) (*metastore.ShardPlan, error) {
+		plan.UserMeta = meta
+		return plan, nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not update metadata of %s: %w", fileName, err)
+	}
+	return nil
+}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-readyCh:
-		return nil
-	case err := <-errCh:
-		return err
+// validateUserMeta - keys have to be valid header names since metadata is sent as X-Meta-* headers
+func validateUserMeta(meta map[string]string) error {
+	size := 0
+	for k, v := range meta {
+		if k == "" || strings.ContainsAny(k, " \t\r\n:") || strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("key %q: %w", k, ErrInvalidMetadata)
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxUserMetaSize {
+		return fmt.Errorf("%d bytes exceed %d: %w", size, maxUserMetaSize, ErrInvalidMetadata)
 	}
+	return nil
 }
 
-func (u *Uploader) send(f multipart.File, w io.Writer, size int, offset int64) error {
-	bufSize := minBufSize(size, maxBufSize)
-	readBuf := make([]byte, bufSize)
+// uploadReplicated - sends every chunk to all its replicas as it is read, a chunk is done
+// once the write quorum acknowledges it, the writes run on writeCtx and go on after the upload returned
+func (u *Uploader) uploadReplicated(
+	ctx context.Context,
+	writeCtx context.Context,
+	cancel context.CancelFunc,
+	t *uploadTracker,
+	key multishard.Key,
+	br *bufio.Reader,
+	opts UploadOptions,
+) (*metastore.ShardPlanBuilder, error) {
+	var writes []*chunkWrite
+	for chunkIdx := 0; ; chunkIdx++ {
+		if _, err := br.Peek(1); err != nil {
+			if !errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("failed reading uploaded file: %w", err)
+			}
+			break
+		}
 
-	totalBytesWritten := 0
-	for {
-		if totalBytesWritten >= size {
-			return nil
+		replicas, err := u.resolveReplicas(key, multishard.ChunkIdx(chunkIdx), opts.Replicas)
+		if err != nil {
+			return nil, err
 		}
 
-		n, err := f.ReadAt(readBuf, offset)
-		if err != nil && !errors.Is(err, io.EOF) {
-			return fmt.Errorf("failed reading from offset %d: %w", offset, err)
+		chunkKey := multishard.UploadChunkKey(key, t.generation, multishard.ChunkIdx(chunkIdx))
+		c := newChunkWrite(chunkIdx, chunkKey, replicas, u.writeQuorum(len(replicas)))
+		writes = append(writes, c)
+		t.replicated = append(t.replicated, c)
+
+		locations := make([]metastore.Location, len(replicas))
+		for i, serverIdx := range replicas {
+			locations[i] = metastore.Location{Key: c.key, ServerIdx: int(serverIdx)}
+		}
+		if err := u.intend(ctx, t, locations...); err != nil {
+			return nil, err
 		}
 
-		if size < totalBytesWritten+n {
-			u.lg.Debugf("writing last bytes")
-			n = size - totalBytesWritten
+		rw := u.writeReplicas(writeCtx, cancel, t, c)
+		n, err := io.CopyN(rw, br, opts.ChunkSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			// whatever was sent of the current chunk must not be committed
+			rw.abort(err)
+			return nil, fmt.Errorf("failed sending chunk %d: %w", chunkIdx, err)
 		}
+		rw.close()
+		c.size = int(n)
+	}
 
-		if _, err := w.Write(readBuf[:n]); err != nil {
-			return fmt.Errorf("cannot write payload: %w", err)
+	// the plan gets the replicas that acknowledged so far, settleUpload adds the slower ones
+	planBuilder := metastore.NewShardPlanBuilder(key)
+	for _, c := range writes {
+		servers, checksum, err := c.wait(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not upload chunk %d: %w", c.idx, err)
+		}
+		if err := planBuilder.AddShard(metastore.Shard{
+			ChunkIdx:  c.idx,
+			ServerIdx: servers[0],
+			Size:      c.size,
+			Checksum:  checksum,
+			Key:       c.key,
+			Replicas:  servers,
+		}); err != nil {
+			return nil, err
 		}
+	}
 
-		totalBytesWritten += n
-		offset += int64(n)
+	return planBuilder, nil
+}
+
+// resolveReplicas - servers of the chunk, as many as the upload asks for or else as the shard manager is configured with
+func (u *Uploader) resolveReplicas(key multishard.Key, chunkIdx multishard.ChunkIdx, n int) ([]multishard.ServerIdx, error) {
+	if n > 0 {
+		return u.shardManager.ResolveServers(key, chunkIdx, n)
 	}
+	return u.shardManager.ResolveReplicas(key, chunkIdx)
 }
 
-func minBufSize(chunkSize, maxBufSize int) int {
-	if chunkSize < maxBufSize {
-		return chunkSize
+// writeReplicas - starts uploads of the chunk to all its replicas and returns a writer that feeds all of them,
+// a replica that takes no piece within FG_STORAGE_SERVER_TIMEOUT is dropped
+func (u *Uploader) writeReplicas(ctx context.Context, cancel context.CancelFunc, t *uploadTracker, c *chunkWrite) *replicaWriter {
+	writers := make([]*io.PipeWriter, len(c.replicas))
+	cancels := make([]context.CancelFunc, len(c.replicas))
+	for i, serverIdx := range c.replicas {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		replicaCtx, cancelReplica := context.WithCancel(ctx)
+		cancels[i] = cancelReplica
+
+		t.start()
+		go func(i int, serverIdx multishard.ServerIdx) {
+			defer cancelReplica()
+			checksum, err := u.remoteStore.Put(replicaCtx, c.key, serverIdx, pr)
+			t.done(metastore.Location{Key: c.key, ServerIdx: int(serverIdx)}, err)
+			if err != nil {
+				u.lg.Error(fmt.Errorf("could not upload chunk %d to server %d: %w", c.idx, serverIdx, err))
+				// unblocks the writing side
+				_ = pr.CloseWithError(err)
+			}
+			if errChunk := c.ack(i, checksum, err); errChunk != nil {
+				cancel()
+			}
+		}(i, serverIdx)
+	}
+
+	return newReplicaWriter(writers, cancels, c.quorum, u.cfg.StorageServerTimeout)
+}
+
+// writeQuorum - number of replicas that have to acknowledge a chunk
+func (u *Uploader) writeQuorum(replicas int) int {
+	if u.cfg.WriteQuorum <= 0 || u.cfg.WriteQuorum > replicas {
+		return replicas
+	}
+	return u.cfg.WriteQuorum
+}
+
+// replaced - hands the chunks of the previous upload over to the cleanup of pending deletions,
+// the new upload stored its chunks under keys of its own
+func (u *Uploader) replaced(ctx context.Context, key multishard.Key, prev, plan *metastore.ShardPlan) {
+	stale := plan.Unreferenced(key, prev.Locations(key))
+	if len(stale) == 0 {
+		return
+	}
+
+	if err := u.metaStore.StorePendingDeletion(ctx, metastore.NewPendingDeletion(key, stale)); err != nil {
+		u.lg.Error(fmt.Errorf("could not record %d replaced chunks of %s: %w", len(stale), key, err))
 	}
-	return maxBufSize
 }
@@ -0,0 +1,665 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filegateway/config"
+	"github.com/denismitr/shardstore/internal/filegateway/metastore"
+	"github.com/denismitr/shardstore/internal/filegateway/multishard"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+type fakeShardManager struct {
+	servers  int
+	replicas int
+}
+
+func (sm fakeShardManager) ResolveReplicas(key multishard.Key, chunkIdx multishard.ChunkIdx) ([]multishard.ServerIdx, error) {
+	return sm.ResolveServers(key, chunkIdx, sm.replicas)
+}
+
+func (sm fakeShardManager) ResolveServers(_ multishard.Key, chunkIdx multishard.ChunkIdx, n int) ([]multishard.ServerIdx, error) {
+	result := make([]multishard.ServerIdx, n)
+	for i := range result {
+		result[i] = multishard.ServerIdx((int(chunkIdx) + i) % sm.servers)
+	}
+	return result, nil
+}
+
+type location struct {
+	key       multishard.Key
+	serverIdx multishard.ServerIdx
+}
+
+// fakeRemoteStore - puts to servers of hold do not complete before their channel is closed,
+// the ones to stalled servers stop reading after the first byte until they are cancelled
+type fakeRemoteStore struct {
+	mx      sync.Mutex
+	chunks  map[location][]byte
+	down    map[multishard.ServerIdx]bool
+	hold    map[multishard.ServerIdx]chan struct{}
+	stalled map[multishard.ServerIdx]bool
+}
+
+var errServerDown = errors.New("server is down")
+
+func (s *fakeRemoteStore) Put(ctx context.Context, key multishard.Key, serverID multishard.ServerIdx, r io.Reader) (uint32, error) {
+	if s.down[serverID] {
+		return 0, errServerDown
+	}
+	if s.stalled[serverID] {
+		if _, err := r.Read(make([]byte, 1)); err != nil {
+			return 0, err
+		}
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if hold, ok := s.hold[serverID]; ok {
+		select {
+		case <-hold:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.chunks[location{key: key, serverIdx: serverID}] = b
+	return multishard.Checksum(b), nil
+}
+
+func (s *fakeRemoteStore) Delete(_ context.Context, key multishard.Key, serverID multishard.ServerIdx) error {
+	if s.down[serverID] {
+		return errServerDown
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.chunks, location{key: key, serverIdx: serverID})
+	return nil
+}
+
+func (s *fakeRemoteStore) get(key multishard.Key, serverID multishard.ServerIdx) []byte {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.chunks[location{key: key, serverIdx: serverID}]
+}
+
+type fakeMetaStore struct {
+	mx      sync.Mutex
+	plan    *metastore.ShardPlan
+	pending []*metastore.PendingDeletion
+	uploads map[string]metastore.PendingUpload
+}
+
+func (s *fakeMetaStore) Store(_ context.Context, _ multishard.Key, plan *metastore.ShardPlan) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.plan = plan
+	return nil
+}
+
+func (s *fakeMetaStore) GetShardPlan(_ context.Context, key multishard.Key) (*metastore.ShardPlan, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.getShardPlan(key)
+}
+
+func (s *fakeMetaStore) getShardPlan(key multishard.Key) (*metastore.ShardPlan, error) {
+	if s.plan == nil {
+		return nil, fmt.Errorf("shard plan for key %s: %w", key, metastore.ErrNotFound)
+	}
+	return s.plan, nil
+}
+
+func (s *fakeMetaStore) UpdateShardPlan(
+	_ context.Context,
+	key multishard.Key,
+	update func(plan *metastore.ShardPlan) (*metastore.ShardPlan, error),
+) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	plan, err := s.getShardPlan(key)
+	if err != nil {
+		return err
+	}
+	updated, err := update(plan)
+	if err != nil {
+		return err
+	}
+	s.plan = updated
+	return nil
+}
+
+func (s *fakeMetaStore) StorePendingDeletion(_ context.Context, pd *metastore.PendingDeletion) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.pending = append(s.pending, pd)
+	return nil
+}
+
+func (s *fakeMetaStore) StorePendingUpload(_ context.Context, pu *metastore.PendingUpload) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.uploads[pu.ID] = *pu
+	return nil
+}
+
+func (s *fakeMetaStore) ListPendingUploads(context.Context) ([]*metastore.PendingUpload, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	var result []*metastore.PendingUpload
+	for id := range s.uploads {
+		pu := s.uploads[id]
+		result = append(result, &pu)
+	}
+	return result, nil
+}
+
+func (s *fakeMetaStore) RemovePendingUpload(_ context.Context, id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.uploads, id)
+	return nil
+}
+
+func (s *fakeMetaStore) Delete(_ context.Context, _ multishard.Key) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.plan = nil
+	return nil
+}
+
+func (s *fakeMetaStore) ListPrefix(context.Context, multishard.Key, multishard.Key, int) ([]multishard.Key, error) {
+	return nil, nil
+}
+
+func (s *fakeMetaStore) CreateMultipartUpload(context.Context, *metastore.MultipartUpload) error {
+	return errors.New("multipart uploads are not supported by the fake")
+}
+
+func (s *fakeMetaStore) GetMultipartUpload(_ context.Context, id string) (*metastore.MultipartUpload, error) {
+	return nil, fmt.Errorf("multipart upload %s: %w", id, metastore.ErrNotFound)
+}
+
+func (s *fakeMetaStore) DeleteMultipartUpload(_ context.Context, id string) error {
+	return fmt.Errorf("multipart upload %s: %w", id, metastore.ErrNotFound)
+}
+
+func (s *fakeMetaStore) CreateResumableUpload(context.Context, *metastore.ResumableUpload) error {
+	return errors.New("resumable uploads are not supported by the fake")
+}
+
+func (s *fakeMetaStore) GetResumableUpload(_ context.Context, id string) (*metastore.ResumableUpload, error) {
+	return nil, fmt.Errorf("resumable upload %s: %w", id, metastore.ErrNotFound)
+}
+
+func (s *fakeMetaStore) UpdateResumableUpload(
+	_ context.Context,
+	id string,
+	_ func(ru *metastore.ResumableUpload) (*metastore.ResumableUpload, error),
+) error {
+	return fmt.Errorf("resumable upload %s: %w", id, metastore.ErrNotFound)
+}
+
+func (s *fakeMetaStore) ListResumableUploads(context.Context) ([]*metastore.ResumableUpload, error) {
+	return nil, nil
+}
+
+func (s *fakeMetaStore) DeleteResumableUpload(_ context.Context, id string) error {
+	return fmt.Errorf("resumable upload %s: %w", id, metastore.ErrNotFound)
+}
+
+func newTestUploader(chunkSize int64, servers int) (*Uploader, *fakeRemoteStore, *fakeMetaStore) {
+	return newReplicatedTestUploader(chunkSize, servers, 1, 1)
+}
+
+func newReplicatedTestUploader(chunkSize int64, servers, replicas, quorum int) (*Uploader, *fakeRemoteStore, *fakeMetaStore) {
+	rs := &fakeRemoteStore{chunks: map[location][]byte{}, down: map[multishard.ServerIdx]bool{}}
+	ms := &fakeMetaStore{uploads: map[string]metastore.PendingUpload{}}
+	u := NewUploader(
+		&config.Config{ChunkSize: chunkSize, WriteQuorum: quorum, Redundancy: string(Replication), ErasureDataShards: 2, ErasureParityShards: 1},
+		fakeShardManager{servers: servers, replicas: replicas},
+		rs,
+		ms,
+		logger.NewStdoutLogger(logger.Dev, "test"),
+	)
+	return u, rs, ms
+}
+
+// download - the content of the plan as its chunks are stored, every chunk has to match its checksum
+func download(t *testing.T, rs *fakeRemoteStore, key multishard.Key, plan *metastore.ShardPlan) string {
+	t.Helper()
+	var content []byte
+	for _, shard := range plan.Shards {
+		for _, loc := range shard.Locations(key) {
+			chunk := rs.get(loc.Key, multishard.ServerIdx(loc.ServerIdx))
+			if len(chunk) != shard.Size || multishard.Checksum(chunk) != shard.Checksum {
+				t.Fatalf("chunk %d on server %d does not match the plan: %q", shard.ChunkIdx, loc.ServerIdx, chunk)
+			}
+		}
+		content = append(content, rs.get(shard.Locations(key)[0].Key, multishard.ServerIdx(shard.ServerIdx))...)
+	}
+	return string(content)
+}
+
+func sameLocations(a, b []metastore.Location) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUploader_UploadCutsStreamIntoChunks(t *testing.T) {
+	// more chunks than servers, so some chunks share a server
+	u, rs, ms := newTestUploader(10, 2)
+	content := bytes.Repeat([]byte("0123456789"), 2)
+	content = append(content, []byte("tail")...)
+
+	// a reader that hands out a few bytes at a time like a network body
+	r := io.MultiReader(bytes.NewReader(content[:7]), bytes.NewReader(content[7:15]), bytes.NewReader(content[15:]))
+	if err := u.Upload(context.Background(), "", "file.txt", r, UploadOptions{}); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	u.settling.Wait()
+
+	if ms.plan == nil || ms.plan.OriginalSize != len(content) || len(ms.plan.Shards) != 3 {
+		t.Fatalf("stored plan = %+v, want 3 shards and size %d", ms.plan, len(content))
+	}
+	if ms.plan.ChecksumAlgo != multishard.ChecksumAlgo {
+		t.Errorf("stored plan checksum algo = %q, want %q", ms.plan.ChecksumAlgo, multishard.ChecksumAlgo)
+	}
+
+	var got []byte
+	for i, shard := range ms.plan.Shards {
+		chunk := rs.get(shard.Key, multishard.ServerIdx(shard.ServerIdx))
+		if len(chunk) != shard.Size {
+			t.Errorf("chunk %d has %d bytes, plan says %d", i, len(chunk), shard.Size)
+		}
+		if multishard.Checksum(chunk) != shard.Checksum {
+			t.Errorf("chunk %d has checksum %08x, plan says %08x", i, multishard.Checksum(chunk), shard.Checksum)
+		}
+		got = append(got, chunk...)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("chunks add up to %q, want %q", got, content)
+	}
+}
+
+func TestUploader_UploadHandsReplacedChunksToCleanup(t *testing.T) {
+	u, _, ms := newTestUploader(4, 2)
+
+	if err := u.Upload(context.Background(), "", "file.txt", bytes.NewReader(make([]byte, 12)), UploadOptions{}); err != nil {
+		t.Fatalf("first Upload() error = %v", err)
+	}
+	u.settling.Wait()
+	first := ms.plan
+	if err := u.Upload(context.Background(), "", "file.txt", bytes.NewReader(make([]byte, 5)), UploadOptions{}); err != nil {
+		t.Fatalf("second Upload() error = %v", err)
+	}
+	u.settling.Wait()
+
+	if len(ms.plan.Shards) != 2 {
+		t.Fatalf("stored plan has %d shards, want 2", len(ms.plan.Shards))
+	}
+	if len(ms.pending) != 1 || !sameLocations(ms.pending[0].Locations, first.Locations("file.txt")) {
+		t.Fatalf("pending deletions = %+v, want every chunk of the first upload", ms.pending)
+	}
+}
+
+func TestUploader_FailedReuploadKeepsPreviousVersion(t *testing.T) {
+	u, rs, ms := newTestUploader(4, 3)
+	ctx := context.Background()
+
+	if err := u.Upload(ctx, "", "file.txt", bytes.NewReader([]byte("first version")), UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	u.settling.Wait()
+	committed := ms.plan
+
+	// the new version fails once two of its chunks are written over the servers of the committed ones
+	r := io.MultiReader(bytes.NewReader([]byte("SECOND V")), iotest.ErrReader(errConnectionLost))
+	if err := u.Upload(ctx, "", "file.txt", r, UploadOptions{}); !errors.Is(err, errConnectionLost) {
+		t.Fatalf("Upload() error = %v, want the read error", err)
+	}
+
+	if ms.plan != committed {
+		t.Fatalf("expected the committed plan to be left as it is")
+	}
+	if got := download(t, rs, "file.txt", committed); got != "first version" {
+		t.Errorf("committed version downloads as %q", got)
+	}
+}
+
+func TestUploader_UploadStoresEmptyFileWithoutChunks(t *testing.T) {
+	for _, redundancy := range []Redundancy{Replication, ErasureCoding} {
+		u, rs, ms := newReplicatedTestUploader(8, 3, 1, 1)
+
+		if err := u.Upload(context.Background(), "", "empty.txt", bytes.NewReader(nil), UploadOptions{Redundancy: redundancy}); err != nil {
+			t.Fatalf("Upload(%s) error = %v", redundancy, err)
+		}
+		u.settling.Wait()
+
+		if ms.plan == nil || ms.plan.OriginalSize != 0 || len(ms.plan.Shards) != 0 {
+			t.Fatalf("%s: expected a plan without shards, got %+v", redundancy, ms.plan)
+		}
+		sum := sha256.Sum256(nil)
+		if ms.plan.ContentHash != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: content hash = %s, want the hash of no content", redundancy, ms.plan.ContentHash)
+		}
+		if len(rs.chunks) != 0 || len(ms.uploads) != 0 {
+			t.Errorf("%s: expected nothing to be written, got chunks %v and uploads %+v", redundancy, rs.chunks, ms.uploads)
+		}
+	}
+}
+
+func TestUploader_UploadWritesAllReplicas(t *testing.T) {
+	u, rs, ms := newReplicatedTestUploader(4, 3, 3, 2)
+	content := []byte("replicated")
+
+	if err := u.Upload(context.Background(), "", "file.txt", bytes.NewReader(content), UploadOptions{}); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	u.settling.Wait()
+
+	for _, shard := range ms.plan.Shards {
+		if len(shard.Replicas) < 2 {
+			t.Errorf("chunk %d has replicas %v, want at least the quorum", shard.ChunkIdx, shard.Replicas)
+		}
+		for _, serverIdx := range shard.Replicas {
+			chunk := rs.get(shard.Key, multishard.ServerIdx(serverIdx))
+			if want := content[shard.ChunkIdx*4 : shard.ChunkIdx*4+shard.Size]; !bytes.Equal(chunk, want) {
+				t.Errorf("chunk %d on server %d = %q, want %q", shard.ChunkIdx, serverIdx, chunk, want)
+			}
+		}
+	}
+}
+
+func TestUploader_UploadToleratesReplicaFailureWithinQuorum(t *testing.T) {
+	u, rs, ms := newReplicatedTestUploader(4, 3, 3, 2)
+	rs.down[1] = true
+
+	if err := u.Upload(context.Background(), "", "file.txt", bytes.NewReader([]byte("replicated")), UploadOptions{}); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	u.settling.Wait()
+
+	for _, shard := range ms.plan.Shards {
+		for _, serverIdx := range shard.Replicas {
+			if serverIdx == 1 {
+				t.Errorf("chunk %d lists server 1 that is down among its replicas %v", shard.ChunkIdx, shard.Replicas)
+			}
+		}
+	}
+}
+
+func TestUploader_SlowReplicasAreAddedToThePlan(t *testing.T) {
+	u, rs, ms := newReplicatedTestUploader(4, 3, 3, 2)
+	release := make(chan struct{})
+	rs.hold = map[multishard.ServerIdx]chan struct{}{2: release}
+
+	if err := u.Upload(context.Background(), "", "file.txt", bytes.NewReader([]byte("replicated")), UploadOptions{}); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	ms.mx.Lock()
+	for _, shard := range ms.plan.Shards {
+		if len(shard.Replicas) != 2 {
+			t.Errorf("chunk %d was committed with replicas %v, want the two that acknowledged", shard.ChunkIdx, shard.Replicas)
+		}
+	}
+	ms.mx.Unlock()
+
+	close(release)
+	u.settling.Wait()
+
+	for _, shard := range ms.plan.Shards {
+		if len(shard.Replicas) != 3 {
+			t.Errorf("chunk %d has replicas %v after the slow one finished, want all three", shard.ChunkIdx, shard.Replicas)
+		}
+	}
+	if got := download(t, rs, "file.txt", ms.plan); got != "replicated" {
+		t.Errorf("file downloads as %q", got)
+	}
+	if len(ms.uploads) != 0 {
+		t.Errorf("expected the pending upload to be removed, got %+v", ms.uploads)
+	}
+}
+
+func TestUploader_ReplicasSlowerThanTheTimeoutAreLeftOut(t *testing.T) {
+	u, rs, ms := newReplicatedTestUploader(4, 3, 3, 2)
+	u.cfg.StorageServerTimeout = 10 * time.Millisecond
+	rs.hold = map[multishard.ServerIdx]chan struct{}{2: make(chan struct{})}
+
+	if err := u.Upload(context.Background(), "", "file.txt", bytes.NewReader([]byte("replicated")), UploadOptions{}); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	u.settling.Wait()
+
+	for _, shard := range ms.plan.Shards {
+		for _, serverIdx := range shard.Replicas {
+			if serverIdx == 2 {
+				t.Errorf("chunk %d lists server 2 that never acknowledged among its replicas %v", shard.ChunkIdx, shard.Replicas)
+			}
+		}
+	}
+	if len(ms.uploads) != 0 {
+		t.Errorf("expected the pending upload to be removed, got %+v", ms.uploads)
+	}
+}
+
+func TestUploader_ReplicaThatStopsReadingIsDropped(t *testing.T) {
+	u, rs, ms := newReplicatedTestUploader(16000, 3, 3, 2)
+	u.cfg.StorageServerTimeout = 20 * time.Millisecond
+	rs.stalled = map[multishard.ServerIdx]bool{2: true}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- u.Upload(context.Background(), "", "file.txt", strings.NewReader(strings.Repeat("x", 40000)), UploadOptions{})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Upload() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload hangs on the stalled replica")
+	}
+	u.settling.Wait()
+
+	for _, shard := range ms.plan.Shards {
+		for _, serverIdx := range shard.Replicas {
+			if serverIdx == 2 {
+				t.Errorf("chunk %d lists the stalled server 2 among its replicas %v", shard.ChunkIdx, shard.Replicas)
+			}
+		}
+	}
+	if got := download(t, rs, "file.txt", ms.plan); got != strings.Repeat("x", 40000) {
+		t.Errorf("file downloads as %d bytes", len(got))
+	}
+}
+
+func TestUploader_CancelledUploadDoesNotWaitForStalledReplica(t *testing.T) {
+	u, rs, ms := newReplicatedTestUploader(16000, 3, 3, 3)
+	u.cfg.StorageServerTimeout = 0
+	rs.stalled = map[multishard.ServerIdx]bool{2: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- u.Upload(ctx, "", "file.txt", strings.NewReader(strings.Repeat("x", 40000)), UploadOptions{})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the cancelled upload to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled upload hangs on the stalled replica")
+	}
+	if ms.plan != nil {
+		t.Errorf("expected no plan to be stored")
+	}
+}
+
+func TestUploader_UploadFailsWithoutQuorum(t *testing.T) {
+	u, rs, ms := newReplicatedTestUploader(4, 3, 3, 2)
+	rs.down[0] = true
+	rs.down[1] = true
+
+	err := u.Upload(context.Background(), "", "file.txt", bytes.NewReader([]byte("replicated")), UploadOptions{})
+	if !errors.Is(err, ErrQuorumNotReached) {
+		t.Fatalf("Upload() error = %v, want %v", err, ErrQuorumNotReached)
+	}
+	if ms.plan != nil {
+		t.Errorf("expected no plan to be stored")
+	}
+}
+
+func TestUploader_UploadErasureCoded(t *testing.T) {
+	u, rs, ms := newReplicatedTestUploader(8, 3, 1, 1)
+	content := []byte("erasure coded content")
+
+	if err := u.Upload(context.Background(), "", "file.txt", bytes.NewReader(content), UploadOptions{Redundancy: ErasureCoding}); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	u.settling.Wait()
+
+	if ms.plan.Erasure == nil || ms.plan.Erasure.DataShards != 2 || ms.plan.Erasure.ParityShards != 1 {
+		t.Fatalf("stored plan erasure coding = %+v, want 2 data and 1 parity shards", ms.plan.Erasure)
+	}
+	if ms.plan.OriginalSize != len(content) || len(ms.plan.Shards) != 3 {
+		t.Fatalf("stored plan has size %d and %d shards, want %d and 3", ms.plan.OriginalSize, len(ms.plan.Shards), len(content))
+	}
+
+	var got []byte
+	for _, shard := range ms.plan.Shards {
+		servers := map[int]bool{}
+		var data []byte
+		for i, f := range shard.Fragments {
+			servers[f.ServerIdx] = true
+			fragment := rs.get(f.Key, multishard.ServerIdx(f.ServerIdx))
+			if len(fragment) != f.Size || multishard.Checksum(fragment) != f.Checksum {
+				t.Errorf("fragment %s does not match its size and checksum", f.Key)
+			}
+			if i < ms.plan.Erasure.DataShards {
+				data = append(data, fragment...)
+			}
+		}
+		if len(servers) != len(shard.Fragments) {
+			t.Errorf("fragments of chunk %d share servers: %+v", shard.ChunkIdx, shard.Fragments)
+		}
+		got = append(got, data[:shard.Size]...)
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Errorf("data fragments add up to %q, want %q", got, content)
+	}
+}
+
+func TestUploader_UploadRejectsUnknownRedundancy(t *testing.T) {
+	u, _, _ := newTestUploader(4, 2)
+
+	err := u.Upload(context.Background(), "", "file.txt", bytes.NewReader([]byte("data")), UploadOptions{Redundancy: "mirroring"})
+	if !errors.Is(err, ErrInvalidRedundancy) {
+		t.Fatalf("Upload() error = %v, want %v", err, ErrInvalidRedundancy)
+	}
+}
+
+func TestUploader_RecordsObjectMetadata(t *testing.T) {
+	u, _, ms := newTestUploader(10, 2)
+	ctx := context.Background()
+
+	content := []byte("some content to hash")
+	opts := UploadOptions{ContentType: "text/plain", UserMeta: map[string]string{"color": "blue"}}
+	if err := u.Upload(ctx, "", "file.txt", bytes.NewReader(content), opts); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	u.settling.Wait()
+
+	sum := sha256.Sum256(content)
+	if ms.plan.ContentHash != hex.EncodeToString(sum[:]) {
+		t.Errorf("content hash = %s, want %x", ms.plan.ContentHash, sum)
+	}
+	if ms.plan.ContentType != "text/plain" || ms.plan.UserMeta["color"] != "blue" {
+		t.Errorf("stored plan = %+v, want the content type and user metadata of the upload", ms.plan)
+	}
+	if ms.plan.CreatedAt.IsZero() || !ms.plan.CreatedAt.Equal(ms.plan.ModifiedAt) {
+		t.Errorf("created at = %v, want the modification time %v", ms.plan.CreatedAt, ms.plan.ModifiedAt)
+	}
+
+	createdAt := ms.plan.CreatedAt
+	if err := u.Upload(ctx, "", "file.txt", bytes.NewReader(content), UploadOptions{}); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	u.settling.Wait()
+	if !ms.plan.CreatedAt.Equal(createdAt) || ms.plan.UserMeta != nil {
+		t.Errorf("stored plan = %+v, want creation time %v kept and no user metadata", ms.plan, createdAt)
+	}
+
+	shards := ms.plan.Shards
+	if err := u.UpdateUserMeta(ctx, "", "file.txt", map[string]string{"size": "large"}); err != nil {
+		t.Fatalf("UpdateUserMeta() error = %v", err)
+	}
+	if ms.plan.UserMeta["size"] != "large" || len(ms.plan.Shards) != len(shards) {
+		t.Errorf("stored plan = %+v, want new user metadata and the same shards", ms.plan)
+	}
+
+	for _, meta := range []map[string]string{{"bad key": "x"}, {"k": "line\nbreak"}, {"k": string(bytes.Repeat([]byte("x"), maxUserMetaSize))}} {
+		if err := u.UpdateUserMeta(ctx, "", "file.txt", meta); !errors.Is(err, ErrInvalidMetadata) {
+			t.Errorf("UpdateUserMeta(%v) error = %v, want ErrInvalidMetadata", meta, err)
+		}
+	}
+}
+
+func TestUploader_UploadToBucketWithItsOwnSettings(t *testing.T) {
+	u, rs, ms := newReplicatedTestUploader(10, 4, 1, 0)
+	content := []byte("0123456789abcdef")
+
+	opts := UploadOptions{ChunkSize: 4, Replicas: 3}
+	if err := u.Upload(context.Background(), "photos", "file.txt", bytes.NewReader(content), opts); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	u.settling.Wait()
+
+	if len(ms.plan.Shards) != 4 || ms.plan.Replicas != 3 {
+		t.Fatalf("stored plan = %+v, want 4 chunks of 3 replicas", ms.plan)
+	}
+	for i, shard := range ms.plan.Shards {
+		if !strings.HasPrefix(string(shard.Key), "/photos/file.txt/") {
+			t.Errorf("chunk %d is stored under %q, outside of the bucket", i, shard.Key)
+		}
+		if len(shard.Replicas) != 3 {
+			t.Errorf("chunk %d has replicas %v, want 3", i, shard.Replicas)
+		}
+		for _, server := range shard.Replicas {
+			if got := rs.get(shard.Key, multishard.ServerIdx(server)); !bytes.Equal(got, content[i*4:i*4+4]) {
+				t.Errorf("chunk %d on server %d = %q", i, server, got)
+			}
+		}
+	}
+
+	err := u.Upload(context.Background(), "Not A Bucket", "file.txt", bytes.NewReader(content), UploadOptions{})
+	if !errors.Is(err, multishard.ErrInvalidBucket) {
+		t.Errorf("Upload() error = %v, want ErrInvalidBucket", err)
+	}
+}
@@ -1,9 +1,28 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type Config struct {
-	AppName       string `env:"FS_APP_NAME" envDefault:"filestore"`
-	ID            uint   `env:"FS_ID"`
-	AppEnv        string `env:"FS_APP_ENV"  envDefault:"local"`
-	GRPCPort      uint   `env:"FS_GRPC_PORT" envDefault:"9000"`
-	ReflectionAPI bool   `env:"FS_REFLECTION_API" envDefault:"true"`
+	AppName                string        `env:"FS_APP_NAME" envDefault:"filestore"`
+	ID                     uint          `env:"FS_ID"`
+	AppEnv                 string        `env:"FS_APP_ENV"  envDefault:"local"`
+	GRPCPort               uint          `env:"FS_GRPC_PORT" envDefault:"9000"`
+	ReflectionAPI          bool          `env:"FS_REFLECTION_API" envDefault:"true"`
+	DataDir                string        `env:"FS_DATA_DIR"`
+	MaxSegmentSize         int64         `env:"FS_MAX_SEGMENT_SIZE" envDefault:"67108864"` // 64Mb
+	CompactionInterval     time.Duration `env:"FS_COMPACTION_INTERVAL" envDefault:"10m"`
+	CompactionMinDeadRatio float64       `env:"FS_COMPACTION_MIN_DEAD_RATIO" envDefault:"0.5"`
+	CompactionRate         int64         `env:"FS_COMPACTION_RATE" envDefault:"8388608"` // 8Mb per second
+}
+
+// StorageDir - directory where data segments are kept,
+// falls back to tmp/<app name>/filestore when FS_DATA_DIR is not set
+func (c *Config) StorageDir() string {
+	if c.DataDir != "" {
+		return c.DataDir
+	}
+	return fmt.Sprintf("tmp/%s/filestore", c.AppName)
 }
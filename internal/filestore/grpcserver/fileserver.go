@@ -1,22 +1,43 @@
 package grpcserver
 
 import (
+	"context"
 	"errors"
 	"github.com/denismitr/shardstore/internal/common/logger"
 	"github.com/denismitr/shardstore/internal/filestore/config"
+	"github.com/denismitr/shardstore/internal/filestore/storage/tfs"
 	storeserverv1 "github.com/denismitr/shardstore/pkg/storeserver/v1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"hash/crc32"
 	"io"
 )
 
 const (
 	readChunkSize = 4 * 1024
+	// listBatchSize - keys per message of a listing
+	listBatchSize = 1000
 )
 
+// crcTable - CRC32C, the checksum the storage keeps for values
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type storageFactory interface {
-	GetWriter(appName, key string) (io.Writer, func() error, error)
-	GetReader(appName, key string) (io.Reader, func() error, error)
+	// GetWriter - returns a writer along with commit and abort functions,
+	// exactly one of them has to be called to release the writer
+	GetWriter(ctx context.Context, key string) (io.Writer, func() error, func() error, error)
+	GetReader(ctx context.Context, key string) (io.Reader, func() error, error)
+	// GetRangeReader - returns a reader of length bytes of the value starting at offset,
+	// zero length reads up to the end of the value
+	GetRangeReader(ctx context.Context, key string, offset, length int64) (io.Reader, func() error, error)
+	Delete(ctx context.Context, key string) error
+	Stat(key string) (tfs.KeyStat, error)
+	// Keys - live keys with the prefix sorting after the given one, in ascending order
+	Keys(prefix, after string) []string
+}
+
+type compactor interface {
+	Compact(ctx context.Context, opts tfs.CompactOptions) (tfs.CompactionStats, error)
 }
 
 type FileServer struct {
@@ -25,23 +46,33 @@ type FileServer struct {
 	cfg            *config.Config
 	lg             logger.Logger
 	storageFactory storageFactory
+	compactor      compactor
 }
 
 func NewFileServer(
 	cfg *config.Config,
 	lg logger.Logger,
 	sf storageFactory,
+	c compactor,
 ) *FileServer {
-	return &FileServer{cfg: cfg, lg: lg, storageFactory: sf}
+	return &FileServer{cfg: cfg, lg: lg, storageFactory: sf, compactor: c}
 }
 
+// Upload - stores the streamed payload under the key from the first message,
+// the value is committed only when the client closes the stream cleanly
+// and what was received matches the checksum the client sent, if it sent one,
+// any other outcome discards everything received so far,
+// the response carries the checksum of the received value for the client to compare
 func (fs *FileServer) Upload(stream storeserverv1.FileService_UploadServer) error {
 	var writer io.Writer
-	var wCloser func() error
+	checksum := crc32.New(crcTable)
+	var expected *uint32
+	var commit, abort func() error
+	committed := false
 	defer func() {
-		if writer != nil {
-			if errClose := wCloser(); errClose != nil {
-				fs.lg.Error(errClose)
+		if writer != nil && !committed {
+			if errAbort := abort(); errAbort != nil {
+				fs.lg.Error(errAbort)
 			}
 		}
 	}()
@@ -50,13 +81,27 @@ func (fs *FileServer) Upload(stream storeserverv1.FileService_UploadServer) erro
 	fs.lg.Debugf("%s received upload request", fs.cfg.AppName)
 	for {
 		if ctx.Err() != nil {
-			return status.Errorf(codes.Internal, ctx.Err().Error())
+			return status.FromContextError(ctx.Err()).Err()
 		}
 
 		req, err := stream.Recv()
 		if err != nil {
 			if err == io.EOF {
-				return stream.SendAndClose(&storeserverv1.UploadResponse{})
+				if expected != nil && *expected != checksum.Sum32() {
+					return status.Errorf(
+						codes.DataLoss,
+						"app %s received a value with checksum %08x, the client sent %08x",
+						fs.cfg.AppName, checksum.Sum32(), *expected,
+					)
+				}
+				if writer != nil {
+					committed = true
+					if errCommit := commit(); errCommit != nil {
+						fs.lg.Error(errCommit)
+						return status.Error(codes.Internal, errCommit.Error())
+					}
+				}
+				return stream.SendAndClose(&storeserverv1.UploadResponse{Checksum: checksum.Sum32()})
 			}
 
 			fs.lg.Error(err)
@@ -67,11 +112,13 @@ func (fs *FileServer) Upload(stream storeserverv1.FileService_UploadServer) erro
 			var errStore error
 			// todo:  key should come from request(incoming context) header
 			// todo: in that case writer can be instantiated in the beginning of the function
-			writer, wCloser, errStore = fs.storageFactory.GetWriter(fs.cfg.AppName, req.Key)
+			var w io.Writer
+			w, commit, abort, errStore = fs.storageFactory.GetWriter(ctx, req.Key)
 			if errStore != nil {
 				fs.lg.Error(errStore)
-				return status.Error(codes.Internal, errStore.Error())
+				return storageError(errStore)
 			}
+			writer = io.MultiWriter(w, checksum)
 			fs.lg.Debugf("writer created in %s for key %s", fs.cfg.AppName, req.Key)
 		}
 
@@ -79,6 +126,11 @@ func (fs *FileServer) Upload(stream storeserverv1.FileService_UploadServer) erro
 			fs.lg.Error(err)
 			return status.Error(codes.Internal, err.Error())
 		}
+
+		if req.GetHasChecksum() {
+			sum := req.GetChecksum()
+			expected = &sum
+		}
 	}
 }
 
@@ -87,9 +139,18 @@ func (fs *FileServer) Download(
 	stream storeserverv1.FileService_DownloadServer,
 ) error {
 	ctx := stream.Context()
-	rc, closer, err := fs.storageFactory.GetReader(fs.cfg.AppName, req.Key)
+	rc, closer, err := fs.openValue(ctx, req)
 	if err != nil {
-		return status.Errorf(codes.Internal, "app %s failed to obtain reader for key: %s", fs.cfg.AppName, req.Key, err)
+		if errors.Is(err, tfs.ErrKeyNotFound) {
+			return status.Errorf(codes.NotFound, "app %s has no key %s", fs.cfg.AppName, req.Key)
+		}
+		if errors.Is(err, tfs.ErrInvalidRange) {
+			return status.Errorf(codes.OutOfRange, "app %s: %s", fs.cfg.AppName, err)
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return status.FromContextError(ctxErr).Err()
+		}
+		return status.Errorf(codes.Internal, "app %s failed to obtain reader for key %s: %s", fs.cfg.AppName, req.Key, err)
 	}
 
 	defer func() {
@@ -98,27 +159,172 @@ func (fs *FileServer) Download(
 		}
 	}()
 
-	chunk := &storeserverv1.DownloadResponse{Payload: make([]byte, readChunkSize)}
+	buf := make([]byte, readChunkSize)
 	for {
 		if ctx.Err() != nil {
 			return status.Errorf(codes.Internal, ctx.Err().Error())
 		}
 
-		n, err := rc.Read(chunk.Payload)
+		n, err := rc.Read(buf)
+		if n > 0 {
+			errStream := stream.Send(&storeserverv1.DownloadResponse{Payload: buf[:n]})
+			if errStream != nil {
+				return status.Errorf(codes.Internal, "stream send failed: %s", errStream.Error())
+			}
+		}
+
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
+			} else if errors.Is(err, tfs.ErrCorruptedEntry) {
+				return status.Errorf(codes.DataLoss, "file read failed: %s", err.Error())
 			} else {
 				return status.Errorf(codes.Internal, "file read failed: %s", err.Error())
 			}
 		}
+	}
 
-		chunk.Payload = chunk.Payload[:n]
-		errStream := stream.Send(chunk)
-		if errStream != nil {
-			return status.Errorf(codes.Internal, "stream send failed: %s", errStream.Error())
+	return nil
+}
+
+// openValue - opens the whole value unless the request asks for a range of it
+func (fs *FileServer) openValue(ctx context.Context, req *storeserverv1.DownloadRequest) (io.Reader, func() error, error) {
+	if req.Offset == 0 && req.Length == 0 {
+		return fs.storageFactory.GetReader(ctx, req.Key)
+	}
+	return fs.storageFactory.GetRangeReader(ctx, req.Key, req.Offset, req.Length)
+}
+
+// Delete - removes the key from the storage
+func (fs *FileServer) Delete(
+	ctx context.Context,
+	req *storeserverv1.DeleteRequest,
+) (*storeserverv1.DeleteResponse, error) {
+	fs.lg.Debugf("%s received delete request for key %s", fs.cfg.AppName, req.Key)
+	if err := fs.storageFactory.Delete(ctx, req.Key); err != nil {
+		if errors.Is(err, tfs.ErrKeyNotFound) {
+			return nil, status.Errorf(codes.NotFound, "app %s has no key %s", fs.cfg.AppName, req.Key)
 		}
+		fs.lg.Error(err)
+		return nil, storageError(err)
 	}
 
-	return nil
+	return &storeserverv1.DeleteResponse{}, nil
+}
+
+// Stat - size, checksum and modification time of the value stored under the key
+func (fs *FileServer) Stat(
+	_ context.Context,
+	req *storeserverv1.StatRequest,
+) (*storeserverv1.StatResponse, error) {
+	st, err := fs.storageFactory.Stat(req.Key)
+	if err != nil {
+		if errors.Is(err, tfs.ErrKeyNotFound) {
+			return nil, status.Errorf(codes.NotFound, "app %s has no key %s", fs.cfg.AppName, req.Key)
+		}
+		fs.lg.Error(err)
+		return nil, storageError(err)
+	}
+
+	return &storeserverv1.StatResponse{
+		Size:       st.Size,
+		Checksum:   st.Checksum,
+		ModifiedAt: st.ModifiedAt.UnixNano(),
+	}, nil
+}
+
+// List - streams the stored keys in batches, keys deleted while the listing runs are left out
+func (fs *FileServer) List(
+	req *storeserverv1.ListRequest,
+	stream storeserverv1.FileService_ListServer,
+) error {
+	ctx := stream.Context()
+	keys := fs.storageFactory.Keys(req.Prefix, req.StartAfter)
+	fs.lg.Debugf("%s lists %d keys with prefix %q", fs.cfg.AppName, len(keys), req.Prefix)
+
+	batch := make([]*storeserverv1.ListEntry, 0, listBatchSize)
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := stream.Send(&storeserverv1.ListResponse{Entries: batch}); err != nil {
+			return status.Errorf(codes.Internal, "stream send failed: %s", err.Error())
+		}
+		batch = make([]*storeserverv1.ListEntry, 0, listBatchSize)
+		return nil
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+
+		st, err := fs.storageFactory.Stat(key)
+		if err != nil {
+			if errors.Is(err, tfs.ErrKeyNotFound) {
+				continue
+			}
+			fs.lg.Error(err)
+			return storageError(err)
+		}
+
+		batch = append(batch, &storeserverv1.ListEntry{
+			Key:        key,
+			Size:       st.Size,
+			Checksum:   st.Checksum,
+			ModifiedAt: st.ModifiedAt.UnixNano(),
+		})
+		if len(batch) == listBatchSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return send()
+}
+
+// Info - the stable id of the server that gateways know it by
+func (fs *FileServer) Info(
+	_ context.Context,
+	_ *storeserverv1.InfoRequest,
+) (*storeserverv1.InfoResponse, error) {
+	return &storeserverv1.InfoResponse{Id: uint64(fs.cfg.ID), AppName: fs.cfg.AppName}, nil
+}
+
+// Compact - merges data segments on demand, in addition to the scheduled compaction
+func (fs *FileServer) Compact(
+	ctx context.Context,
+	req *storeserverv1.CompactRequest,
+) (*storeserverv1.CompactResponse, error) {
+	fs.lg.Debugf("%s received compaction request with min dead ratio %f", fs.cfg.AppName, req.MinDeadRatio)
+	stats, err := fs.compactor.Compact(ctx, tfs.CompactOptions{
+		MinDeadRatio: req.MinDeadRatio,
+		All:          req.AllSegments,
+	})
+	if err != nil {
+		if errors.Is(err, tfs.ErrCompactionInProgress) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		fs.lg.Error(err)
+		return nil, storageError(err)
+	}
+
+	return &storeserverv1.CompactResponse{
+		SegmentsCompacted: uint32(stats.SegmentsCompacted),
+		SegmentsWritten:   uint32(stats.SegmentsWritten),
+		ReclaimedBytes:    stats.ReclaimedBytes,
+	}, nil
+}
+
+// storageError - converts a storage error into a grpc status
+func storageError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, tfs.ErrInvalidKey):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
 }
@@ -0,0 +1,330 @@
+package grpcserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filestore/config"
+	"github.com/denismitr/shardstore/internal/filestore/storage/tfs"
+	storeserverv1 "github.com/denismitr/shardstore/pkg/storeserver/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testValueSize = 64 * 1024
+
+func startTestServer(t *testing.T) (storeserverv1.FileServiceClient, *tfs.KeyDir) {
+	t.Helper()
+
+	cfg := &config.Config{AppName: "test", DataDir: t.TempDir(), MaxSegmentSize: 1024 * 1024}
+	lg := logger.NewStdoutLogger(logger.Prod, "test")
+	kd, err := tfs.NewKeyDir(cfg, lg)
+	if err != nil {
+		t.Fatalf("could not open keydir: %s", err)
+	}
+
+	l := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	storeserverv1.RegisterFileServiceServer(s, NewFileServer(cfg, lg, kd, kd))
+	go func() {
+		_ = s.Serve(l)
+	}()
+
+	conn, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("could not dial test server: %s", err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+		s.Stop()
+		_ = kd.Close()
+	})
+
+	return storeserverv1.NewFileServiceClient(conn), kd
+}
+
+func upload(ctx context.Context, client storeserverv1.FileServiceClient, key string, value []byte) error {
+	stream, err := client.Upload(ctx)
+	if err != nil {
+		return err
+	}
+
+	for offset := 0; offset < len(value); offset += readChunkSize {
+		end := offset + readChunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		if err := stream.Send(&storeserverv1.UploadRequest{Key: key, Payload: value[offset:end]}); err != nil {
+			return err
+		}
+	}
+
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+func download(ctx context.Context, client storeserverv1.FileServiceClient, key string) ([]byte, error) {
+	stream, err := client.Download(ctx, &storeserverv1.DownloadRequest{Key: key})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return buf.Bytes(), nil
+			}
+			return nil, err
+		}
+		buf.Write(resp.Payload)
+	}
+}
+
+func TestFileServer_ConcurrentUploadAndDownloadOfOneKey(t *testing.T) {
+	client, _ := startTestServer(t)
+	ctx := context.Background()
+	key := "same_key"
+
+	if err := upload(ctx, client, key, bytes.Repeat([]byte{'a'}, testValueSize)); err != nil {
+		t.Fatalf("initial upload failed: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 64)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(b byte) {
+			defer wg.Done()
+			if err := upload(ctx, client, key, bytes.Repeat([]byte{b}, testValueSize)); err != nil {
+				errCh <- err
+			}
+		}(byte('b' + i))
+	}
+
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := download(ctx, client, key)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if len(got) != testValueSize {
+				errCh <- errors.New("downloaded value has unexpected size")
+				return
+			}
+			if !bytes.Equal(got, bytes.Repeat(got[:1], testValueSize)) {
+				errCh <- errors.New("downloaded value mixes bytes of different uploads")
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+}
+
+func TestFileServer_BlockedDownloadGivesUpOnCancel(t *testing.T) {
+	client, kd := startTestServer(t)
+	key := "locked_key"
+
+	if err := upload(context.Background(), client, key, []byte("value")); err != nil {
+		t.Fatalf("initial upload failed: %s", err)
+	}
+
+	_, _, release, err := kd.GetWriter(context.Background(), key)
+	if err != nil {
+		t.Fatalf("could not lock key for write: %s", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = download(ctx, client, key)
+	if code := status.Code(err); code != codes.DeadlineExceeded && code != codes.Canceled {
+		t.Fatalf("download of a locked key error = %v, want deadline exceeded or canceled", err)
+	}
+}
+
+func TestFileServer_CancelledUploadIsNotCommitted(t *testing.T) {
+	client, _ := startTestServer(t)
+	key := "cancelled_key"
+	original := []byte("original")
+
+	if err := upload(context.Background(), client, key, original); err != nil {
+		t.Fatalf("initial upload failed: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Upload(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&storeserverv1.UploadRequest{Key: key, Payload: []byte("trunc")}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		got, err := download(context.Background(), client, key)
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+		if !bytes.Equal(got, original) {
+			t.Fatalf("download = %q, want %q", got, original)
+		}
+		// the aborted upload releases the key lock once the server notices the cancellation
+		if time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFileServer_UploadRespondsWithChecksumOfValue(t *testing.T) {
+	client, _ := startTestServer(t)
+	key := "checksummed_key"
+	value := bytes.Repeat([]byte("checksum"), testValueSize/8)
+
+	stream, err := client.Upload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset := 0; offset < len(value); offset += readChunkSize {
+		if err := stream.Send(&storeserverv1.UploadRequest{Key: key, Payload: value[offset : offset+readChunkSize]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	want := crc32.Checksum(value, crcTable)
+	if resp.Checksum != want {
+		t.Errorf("upload checksum = %08x, want %08x", resp.Checksum, want)
+	}
+
+	st, err := client.Stat(context.Background(), &storeserverv1.StatRequest{Key: key})
+	if err != nil {
+		t.Fatalf("stat failed: %s", err)
+	}
+	if st.Checksum != want {
+		t.Errorf("stat checksum = %08x, want the upload checksum %08x", st.Checksum, want)
+	}
+}
+
+func TestFileServer_UploadWithWrongChecksumIsNotCommitted(t *testing.T) {
+	client, _ := startTestServer(t)
+	ctx := context.Background()
+	key := "verified_key"
+	original := []byte("original")
+
+	if err := upload(ctx, client, key, original); err != nil {
+		t.Fatalf("initial upload failed: %s", err)
+	}
+
+	send := func(value []byte, checksum uint32) error {
+		stream, err := client.Upload(ctx)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&storeserverv1.UploadRequest{Key: key, Payload: value}); err != nil {
+			return err
+		}
+		if err := stream.Send(&storeserverv1.UploadRequest{Key: key, Checksum: checksum, HasChecksum: true}); err != nil {
+			return err
+		}
+		_, err = stream.CloseAndRecv()
+		return err
+	}
+
+	corrupt := []byte("corrupt")
+	if err := send(corrupt, crc32.Checksum([]byte("intended"), crcTable)); status.Code(err) != codes.DataLoss {
+		t.Fatalf("upload with a wrong checksum error = %v, want %s", err, codes.DataLoss)
+	}
+	got, err := download(ctx, client, key)
+	if err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	if !bytes.Equal(got, original) {
+		t.Fatalf("download = %q after a rejected upload, want %q", got, original)
+	}
+
+	if err := send(corrupt, crc32.Checksum(corrupt, crcTable)); err != nil {
+		t.Fatalf("upload with a matching checksum failed: %s", err)
+	}
+	if got, err := download(ctx, client, key); err != nil || !bytes.Equal(got, corrupt) {
+		t.Fatalf("download = %q, %v, want %q", got, err, corrupt)
+	}
+}
+
+func TestFileServer_ListStreamsKeysInOrder(t *testing.T) {
+	client, _ := startTestServer(t)
+	ctx := context.Background()
+
+	keys := []string{"/b/file/1", "/b/file/0", "/a/file/0", "/b/other/0"}
+	for i, key := range keys {
+		if err := upload(ctx, client, key, bytes.Repeat([]byte{'x'}, i+1)); err != nil {
+			t.Fatalf("upload of %s failed: %s", key, err)
+		}
+	}
+	if _, err := client.Delete(ctx, &storeserverv1.DeleteRequest{Key: "/b/other/0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(prefix, startAfter string) []*storeserverv1.ListEntry {
+		stream, err := client.List(ctx, &storeserverv1.ListRequest{Prefix: prefix, StartAfter: startAfter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []*storeserverv1.ListEntry
+		for {
+			resp, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return result
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, resp.Entries...)
+		}
+	}
+
+	entries := list("/b/", "")
+	if len(entries) != 2 || entries[0].Key != "/b/file/0" || entries[1].Key != "/b/file/1" {
+		t.Fatalf("List(/b/) = %v, want the live keys of the prefix in order", entries)
+	}
+	if entries[0].Size != 2 || entries[0].Checksum != crc32.Checksum([]byte("xx"), crcTable) || entries[0].ModifiedAt == 0 {
+		t.Errorf("entry = %+v, want the size, checksum and modification time of the value", entries[0])
+	}
+
+	if entries := list("", "/b/file/0"); len(entries) != 1 || entries[0].Key != "/b/file/1" {
+		t.Errorf("List() after /b/file/0 = %v, want only /b/file/1", entries)
+	}
+}
@@ -0,0 +1,494 @@
+package tfs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/common/throttle"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestName - lists the segments a compaction is removing, once it is in place
+// their removal is finished on start, so a crash never leaves only some of them behind
+const manifestName = "compaction.manifest"
+
+var ErrCompactionInProgress = errors.New("compaction is already in progress")
+
+type compactionSettings struct {
+	interval     time.Duration
+	minDeadRatio float64
+	rate         int64
+}
+
+// CompactOptions - what a compaction run should pick
+type CompactOptions struct {
+	// MinDeadRatio - sealed segments with a smaller share of dead bytes are left alone,
+	// a non-positive value falls back to the configured one
+	MinDeadRatio float64
+
+	// All - merge all sealed segments regardless of their dead bytes,
+	// which is the only way to get rid of tombstones of deleted keys
+	All bool
+}
+
+// CompactionStats - outcome of a single compaction run
+type CompactionStats struct {
+	SegmentsCompacted int
+	SegmentsWritten   int
+	ReclaimedBytes    int64
+}
+
+// movedEntry - a live record copied by compaction from one location to another
+type movedEntry struct {
+	from entry
+	to   entry
+}
+
+// mergeOutput - a segment written by compaction along with its hint file
+type mergeOutput struct {
+	seg   *segment
+	hints *hintWriter
+	moved []movedEntry
+}
+
+func (kd *KeyDir) compactionLoop() {
+	defer kd.wg.Done()
+
+	ticker := time.NewTicker(kd.compaction.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-kd.ctx.Done():
+			return
+		case <-ticker.C:
+			stats, err := kd.Compact(kd.ctx, CompactOptions{})
+			if err != nil {
+				if !errors.Is(err, ErrCompactionInProgress) && kd.ctx.Err() == nil {
+					kd.lg.Error(fmt.Errorf("scheduled compaction failed: %w", err))
+				}
+				continue
+			}
+			if stats.SegmentsCompacted > 0 {
+				kd.lg.Debugf(
+					"scheduled compaction merged %d segments into %d and reclaimed %d bytes",
+					stats.SegmentsCompacted, stats.SegmentsWritten, stats.ReclaimedBytes,
+				)
+			}
+		}
+	}
+}
+
+// Compact - rewrites live records of sealed segments with enough dead bytes
+// into new segments with hint files and swaps them in, readers are never blocked
+func (kd *KeyDir) Compact(ctx context.Context, opts CompactOptions) (CompactionStats, error) {
+	if !kd.compactionMx.TryLock() {
+		return CompactionStats{}, ErrCompactionInProgress
+	}
+	defer kd.compactionMx.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-kd.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	minDeadRatio := opts.MinDeadRatio
+	if minDeadRatio <= 0 {
+		minDeadRatio = kd.compaction.minDeadRatio
+	}
+	if opts.All {
+		minDeadRatio = 0
+	}
+
+	if err := kd.finishRemovals(); err != nil {
+		return CompactionStats{}, err
+	}
+
+	candidates, allSealed := kd.pickSegments(minDeadRatio)
+	if len(candidates) == 0 {
+		return CompactionStats{}, nil
+	}
+
+	// a tombstone can only be dropped when no segment left behind
+	// may still hold a value it shadows
+	outputs, dropped, err := kd.merge(ctx, kd.liveEntries(candidates), allSealed)
+	if err != nil {
+		for _, out := range outputs {
+			out.discard()
+		}
+		return CompactionStats{}, err
+	}
+
+	stats := CompactionStats{SegmentsCompacted: len(candidates), SegmentsWritten: len(outputs)}
+	for _, s := range candidates {
+		stats.ReclaimedBytes += s.size
+	}
+	for _, out := range outputs {
+		stats.ReclaimedBytes -= out.seg.size
+	}
+
+	// with the tombstones dropped a value they shadow comes back
+	// when only some of the candidates are removed
+	if err := kd.writeManifest(candidates); err != nil {
+		for _, out := range outputs {
+			out.discard()
+		}
+		return CompactionStats{}, err
+	}
+
+	kd.swap(candidates, outputs, dropped)
+	kd.removeSegments(candidates)
+
+	return stats, nil
+}
+
+// pickSegments - sealed segments with enough dead bytes in ascending order
+// and whether these are all the sealed segments there are
+func (kd *KeyDir) pickSegments(minDeadRatio float64) ([]*segment, bool) {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+
+	var result []*segment
+	sealed := 0
+	for _, s := range kd.segments {
+		if s == kd.active {
+			continue
+		}
+		sealed++
+		if s.deadRatio() >= minDeadRatio {
+			result = append(result, s)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result, len(result) == sealed
+}
+
+// liveEntries - keydir entries pointing to the given segments, in on-disk order
+func (kd *KeyDir) liveEntries(segments []*segment) []entry {
+	ids := make(map[uint32]struct{}, len(segments))
+	for _, s := range segments {
+		ids[s.id] = struct{}{}
+	}
+
+	kd.mu.RLock()
+	var result []entry
+	for _, e := range kd.keys {
+		if _, ok := ids[e.segmentID]; ok {
+			result = append(result, e)
+		}
+	}
+	kd.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].segmentID != result[j].segmentID {
+			return result[i].segmentID < result[j].segmentID
+		}
+		return result[i].valueOffset < result[j].valueOffset
+	})
+	return result
+}
+
+// merge - copies the records into new segments, records are copied as is
+// so that their checksums and timestamps stay intact,
+// returns the tombstones that were dropped instead of being copied
+func (kd *KeyDir) merge(ctx context.Context, live []entry, dropTombstones bool) ([]*mergeOutput, []entry, error) {
+	var outputs []*mergeOutput
+	var dropped []entry
+	var out *mergeOutput
+	t := throttle.New(kd.compaction.rate)
+	buf := make([]byte, readBufSize)
+
+	for _, e := range live {
+		if e.tombstone && dropTombstones {
+			dropped = append(dropped, e)
+			continue
+		}
+
+		kd.mu.RLock()
+		src, ok := kd.segments[e.segmentID]
+		kd.mu.RUnlock()
+		if !ok {
+			continue
+		}
+
+		if out == nil || (out.seg.size > 0 && out.seg.size+e.recordSize() > kd.maxSegmentSize) {
+			next, err := kd.newMergeOutput()
+			if err != nil {
+				return outputs, nil, err
+			}
+			outputs = append(outputs, next)
+			out = next
+		}
+
+		offset := out.seg.size
+		r := io.NewSectionReader(src.file, e.recordOffset(), e.recordSize())
+		for pos := offset; ; {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if _, errWrite := out.seg.file.WriteAt(buf[:n], pos); errWrite != nil {
+					return outputs, nil, fmt.Errorf("could not write to merge segment %s: %w", out.seg.path, errWrite)
+				}
+				pos += int64(n)
+				if errWait := t.Wait(ctx, n); errWait != nil {
+					return outputs, nil, errWait
+				}
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return outputs, nil, fmt.Errorf("could not read record of key %s: %w", e.key, err)
+			}
+		}
+
+		moved := e
+		moved.segmentID = out.seg.id
+		moved.valueOffset = offset + headerSize + int64(len(e.key))
+		if err := out.hints.add(moved); err != nil {
+			return outputs, nil, err
+		}
+		out.seg.size += e.recordSize()
+		out.moved = append(out.moved, movedEntry{from: e, to: moved})
+	}
+
+	for _, out := range outputs {
+		if err := out.publish(kd.dir); err != nil {
+			return outputs, nil, err
+		}
+	}
+
+	return outputs, dropped, syncDir(kd.dir)
+}
+
+func (kd *KeyDir) newMergeOutput() (*mergeOutput, error) {
+	id := kd.allocSegmentID()
+	p := segmentPath(kd.dir, id) + mergeExt
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not create merge segment %s: %w", p, err)
+	}
+
+	hints, err := newHintWriter(hintPath(kd.dir, id) + mergeExt)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(p)
+		return nil, err
+	}
+
+	return &mergeOutput{
+		seg:   &segment{id: id, path: p, file: f, hinted: true},
+		hints: hints,
+	}, nil
+}
+
+// publish - makes the merged segment durable and moves it into place,
+// the hint file goes first so that a data file never shows up without it
+func (out *mergeOutput) publish(dir string) error {
+	if err := out.seg.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync merge segment %s: %w", out.seg.path, err)
+	}
+	if err := out.hints.finish(); err != nil {
+		return err
+	}
+
+	hp := hintPath(dir, out.seg.id)
+	if err := os.Rename(hp+mergeExt, hp); err != nil {
+		return fmt.Errorf("could not move hint file %s into place: %w", hp, err)
+	}
+
+	p := segmentPath(dir, out.seg.id)
+	if err := os.Rename(out.seg.path, p); err != nil {
+		return fmt.Errorf("could not move merge segment %s into place: %w", p, err)
+	}
+	out.seg.path = p
+
+	return nil
+}
+
+// discard - removes everything written for an unfinished merge
+func (out *mergeOutput) discard() {
+	out.hints.discard()
+	_ = os.Remove(hintPath(filepath.Dir(out.seg.path), out.seg.id))
+	_ = out.seg.file.Close()
+	_ = os.Remove(out.seg.path)
+}
+
+// swap - points the keydir to the merged records unless they were overwritten meanwhile
+// and forgets the compacted segments along with the dropped tombstones
+func (kd *KeyDir) swap(compacted []*segment, outputs []*mergeOutput, dropped []entry) {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	for _, e := range dropped {
+		cur, ok := kd.keys[e.key]
+		if ok && cur.segmentID == e.segmentID && cur.valueOffset == e.valueOffset {
+			delete(kd.keys, e.key)
+		}
+	}
+
+	for _, out := range outputs {
+		kd.segments[out.seg.id] = out.seg
+		for _, m := range out.moved {
+			cur, ok := kd.keys[m.from.key]
+			if !ok || cur.segmentID != m.from.segmentID || cur.valueOffset != m.from.valueOffset {
+				continue
+			}
+			kd.keys[m.from.key] = m.to
+			out.seg.live += m.to.recordSize()
+		}
+	}
+
+	for _, s := range compacted {
+		delete(kd.segments, s.id)
+	}
+}
+
+// removeSegments - deletes files of compacted segments,
+// readers still holding them keep reading until they are done
+func (kd *KeyDir) removeSegments(compacted []*segment) {
+	failed := false
+	for _, s := range compacted {
+		if s.hinted {
+			if err := os.Remove(hintPath(kd.dir, s.id)); err != nil {
+				kd.lg.Error(fmt.Errorf("could not remove hint file of segment %d: %w", s.id, err))
+				failed = true
+			}
+		}
+		if err := os.Remove(s.path); err != nil {
+			kd.lg.Error(fmt.Errorf("could not remove compacted segment %s: %w", s.path, err))
+			failed = true
+		}
+		if err := s.retire(); err != nil {
+			kd.lg.Error(err)
+		}
+	}
+
+	// the manifest is left for the next compaction or start to finish what failed
+	if failed {
+		return
+	}
+	if err := syncDir(kd.dir); err != nil {
+		kd.lg.Error(err)
+		return
+	}
+	if err := os.Remove(filepath.Join(kd.dir, manifestName)); err != nil {
+		kd.lg.Error(fmt.Errorf("could not remove compaction manifest: %w", err))
+		return
+	}
+	if err := syncDir(kd.dir); err != nil {
+		kd.lg.Error(err)
+	}
+}
+
+// writeManifest - durably records the ids of the segments about to be removed
+func (kd *KeyDir) writeManifest(compacted []*segment) error {
+	var sb strings.Builder
+	for _, s := range compacted {
+		sb.WriteString(strconv.FormatUint(uint64(s.id), 10))
+		sb.WriteByte('\n')
+	}
+
+	p := filepath.Join(kd.dir, manifestName)
+	f, err := os.OpenFile(p+mergeExt, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create compaction manifest: %w", err)
+	}
+	if _, err := f.WriteString(sb.String()); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("could not write compaction manifest: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("could not sync compaction manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close compaction manifest: %w", err)
+	}
+
+	if err := os.Rename(p+mergeExt, p); err != nil {
+		return fmt.Errorf("could not move compaction manifest into place: %w", err)
+	}
+	return syncDir(kd.dir)
+}
+
+// finishRemovals - removes the rest of the segments listed in the manifest of a compaction
+// interrupted by a crash or a failed removal, what they held had been merged before the manifest was written,
+// segment ids are never reused, so the listed ones are gone from the keydir
+func (kd *KeyDir) finishRemovals() error {
+	p := filepath.Join(kd.dir, manifestName)
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("could not open compaction manifest: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		id, err := strconv.ParseUint(sc.Text(), 10, 32)
+		if err != nil {
+			return fmt.Errorf("compaction manifest lists %q: %w", sc.Text(), err)
+		}
+		for _, name := range []string{hintPath(kd.dir, uint32(id)), segmentPath(kd.dir, uint32(id))} {
+			if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("could not remove compacted segment file %s: %w", name, err)
+			}
+		}
+		kd.lg.Debugf("finished removing compacted segment %d", id)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("could not read compaction manifest: %w", err)
+	}
+
+	if err := syncDir(kd.dir); err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil {
+		return fmt.Errorf("could not remove compaction manifest: %w", err)
+	}
+	return syncDir(kd.dir)
+}
+
+// sweepMerges - removes leftovers of merges interrupted by a crash:
+// unfinished merge files and hint files without a data segment
+func (kd *KeyDir) sweepMerges() error {
+	entries, err := os.ReadDir(kd.dir)
+	if err != nil {
+		return fmt.Errorf("could not read dir %s: %w", kd.dir, err)
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		orphanHint := false
+		if strings.HasSuffix(name, hintExt) {
+			_, errStat := os.Stat(filepath.Join(kd.dir, strings.TrimSuffix(name, hintExt)+segmentExt))
+			orphanHint = errors.Is(errStat, os.ErrNotExist)
+		}
+
+		if !strings.HasSuffix(name, mergeExt) && !orphanHint {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(kd.dir, name)); err != nil {
+			return fmt.Errorf("could not remove merge leftover %s: %w", name, err)
+		}
+		kd.lg.Debugf("removed merge leftover %s", name)
+	}
+
+	return nil
+}
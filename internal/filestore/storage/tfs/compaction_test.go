@@ -0,0 +1,180 @@
+package tfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKeyDir_Compact(t *testing.T) {
+	dir := t.TempDir()
+	kd := openTestKeyDir(t, dir, 128)
+
+	want := map[string][]byte{}
+	for round := 0; round < 5; round++ {
+		for _, key := range []string{"a", "b", "c"} {
+			want[key] = bytes.Repeat([]byte{byte('0' + round)}, 50)
+			put(t, kd, key, want[key])
+		}
+	}
+	put(t, kd, "stable", []byte("never overwritten"))
+	want["stable"] = []byte("never overwritten")
+
+	// a reader opened before compaction keeps reading the old segment
+	r, release, err := kd.GetReader(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := kd.Compact(context.Background(), CompactOptions{MinDeadRatio: 0.5})
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if stats.SegmentsCompacted == 0 || stats.ReclaimedBytes <= 0 {
+		t.Fatalf("Compact() stats = %+v, expected segments to be compacted", stats)
+	}
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading during compaction failed: %s", err)
+	}
+	if !bytes.Equal(got, want["a"]) {
+		t.Errorf("reader opened before compaction got %q, want %q", got, want["a"])
+	}
+	if err := release(); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range want {
+		if got := get(t, kd, key); !bytes.Equal(got, value) {
+			t.Errorf("after compaction get(%s) = %q, want %q", key, got, value)
+		}
+	}
+	_ = kd.Close()
+
+	hints := 0
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), hintExt) {
+			hints++
+		}
+	}
+	if hints != stats.SegmentsWritten {
+		t.Errorf("found %d hint files, want %d", hints, stats.SegmentsWritten)
+	}
+
+	kd = openTestKeyDir(t, dir, 128)
+	defer kd.Close()
+	for key, value := range want {
+		if got := get(t, kd, key); !bytes.Equal(got, value) {
+			t.Errorf("after reopen get(%s) = %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestKeyDir_DeleteSurvivesCompactionAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	kd := openTestKeyDir(t, dir, 64)
+
+	put(t, kd, "deleted", bytes.Repeat([]byte{'d'}, 40))
+	put(t, kd, "kept", bytes.Repeat([]byte{'k'}, 40))
+	if err := kd.Delete(context.Background(), "deleted"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := kd.Delete(context.Background(), "deleted"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("second Delete() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	// pushes the tombstone out of the active segment
+	put(t, kd, "filler", bytes.Repeat([]byte{'f'}, 40))
+
+	if _, err := kd.Compact(context.Background(), CompactOptions{All: true}); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	kd.mu.RLock()
+	_, tombstoneLeft := kd.keys["deleted"]
+	kd.mu.RUnlock()
+	if tombstoneLeft {
+		t.Errorf("expected full compaction to drop the tombstone")
+	}
+	_ = kd.Close()
+
+	kd = openTestKeyDir(t, dir, 64)
+	defer kd.Close()
+
+	if _, _, err := kd.GetReader(context.Background(), "deleted"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetReader(deleted) error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if got := get(t, kd, "kept"); !bytes.Equal(got, bytes.Repeat([]byte{'k'}, 40)) {
+		t.Errorf("get(kept) = %q", got)
+	}
+}
+
+func TestKeyDir_CrashBetweenRemovalsDoesNotBringDeletedKeysBack(t *testing.T) {
+	dir := t.TempDir()
+	// a value and a tombstone fit into a segment, two values do not
+	kd := openTestKeyDir(t, dir, 128)
+	ctx := context.Background()
+
+	put(t, kd, "deleted", bytes.Repeat([]byte{'d'}, 40))
+	put(t, kd, "kept", bytes.Repeat([]byte{'k'}, 40))
+	// moves the value into a merged segment with an id above the active one
+	if _, err := kd.Compact(ctx, CompactOptions{All: true}); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	kd.mu.RLock()
+	valueSegment := kd.keys["deleted"].segmentID
+	kd.mu.RUnlock()
+
+	if err := kd.Delete(ctx, "deleted"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	put(t, kd, "filler", bytes.Repeat([]byte{'f'}, 40))
+	kd.mu.RLock()
+	tombstoneSegment := kd.keys["deleted"].segmentID
+	kd.mu.RUnlock()
+	if tombstoneSegment >= valueSegment {
+		t.Fatalf("expected the tombstone in segment %d to sort before the value in segment %d", tombstoneSegment, valueSegment)
+	}
+
+	// the steps of a full compaction up to a crash right after the segment of the tombstone is removed
+	candidates, allSealed := kd.pickSegments(0)
+	if !allSealed {
+		t.Fatalf("expected all sealed segments to be picked")
+	}
+	outputs, _, err := kd.merge(ctx, kd.liveEntries(candidates), true)
+	if err != nil {
+		t.Fatalf("merge() error = %v", err)
+	}
+	for _, out := range outputs {
+		_ = out.seg.file.Close()
+	}
+	if err := kd.writeManifest(candidates); err != nil {
+		t.Fatalf("writeManifest() error = %v", err)
+	}
+	_ = os.Remove(hintPath(dir, tombstoneSegment))
+	if err := os.Remove(segmentPath(dir, tombstoneSegment)); err != nil {
+		t.Fatal(err)
+	}
+	_ = kd.Close()
+
+	kd = openTestKeyDir(t, dir, 128)
+	defer kd.Close()
+
+	if _, _, err := kd.GetReader(ctx, "deleted"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetReader(deleted) error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if got := get(t, kd, "kept"); !bytes.Equal(got, bytes.Repeat([]byte{'k'}, 40)) {
+		t.Errorf("get(kept) = %q", got)
+	}
+	if _, err := os.Stat(segmentPath(dir, valueSegment)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the segment of the value to be removed on start, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package tfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// every hint entry looks like
+// | tstamp int64 | key size uint32 | value size uint64 | value offset int64 | value crc uint32 | key |
+// so that the keydir of a compacted segment can be loaded without reading values
+const (
+	hintExt        = ".hint"
+	hintHeaderSize = 8 + 4 + 8 + 8 + 4
+)
+
+func hintPath(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d%s", id, hintExt))
+}
+
+type hintWriter struct {
+	file *os.File
+	buf  *bufio.Writer
+}
+
+func newHintWriter(path string) (*hintWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not create hint file %s: %w", path, err)
+	}
+	return &hintWriter{file: f, buf: bufio.NewWriter(f)}, nil
+}
+
+func (hw *hintWriter) add(e entry) error {
+	key := e.key
+	valueSize := uint64(e.valueSize)
+	if e.tombstone {
+		valueSize = tombstoneMarker
+	}
+
+	hb := make([]byte, hintHeaderSize)
+	binary.BigEndian.PutUint64(hb[0:8], uint64(e.tstamp))
+	binary.BigEndian.PutUint32(hb[8:12], uint32(len(key)))
+	binary.BigEndian.PutUint64(hb[12:20], valueSize)
+	binary.BigEndian.PutUint64(hb[20:28], uint64(e.valueOffset))
+	binary.BigEndian.PutUint32(hb[28:32], e.checksum)
+	if _, err := hw.buf.Write(hb); err != nil {
+		return fmt.Errorf("could not write hint for key %s: %w", key, err)
+	}
+	if _, err := hw.buf.WriteString(key); err != nil {
+		return fmt.Errorf("could not write hint for key %s: %w", key, err)
+	}
+	return nil
+}
+
+// finish - flushes, syncs and closes the hint file
+func (hw *hintWriter) finish() error {
+	if err := hw.buf.Flush(); err != nil {
+		_ = hw.file.Close()
+		return fmt.Errorf("could not flush hint file %s: %w", hw.file.Name(), err)
+	}
+	if err := hw.file.Sync(); err != nil {
+		_ = hw.file.Close()
+		return fmt.Errorf("could not sync hint file %s: %w", hw.file.Name(), err)
+	}
+	return hw.file.Close()
+}
+
+func (hw *hintWriter) discard() {
+	_ = hw.file.Close()
+	_ = os.Remove(hw.file.Name())
+}
+
+// readHints - walks all entries of a hint file
+func readHints(path string, fn func(rec scannedRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open hint file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	hb := make([]byte, hintHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, hb); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("could not read hint file %s: %w", path, err)
+		}
+
+		keySize := binary.BigEndian.Uint32(hb[8:12])
+		key := make([]byte, keySize)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return fmt.Errorf("could not read hint file %s: %w", path, err)
+		}
+
+		h := header{keySize: keySize, valueSize: binary.BigEndian.Uint64(hb[12:20])}
+		fn(scannedRecord{
+			key:         string(key),
+			tstamp:      int64(binary.BigEndian.Uint64(hb[0:8])),
+			valueOffset: int64(binary.BigEndian.Uint64(hb[20:28])),
+			valueSize:   h.valueLen(),
+			recordSize:  h.recordSize(),
+			tombstone:   h.isTombstone(),
+			checksum:    binary.BigEndian.Uint32(hb[28:32]),
+		})
+	}
+}
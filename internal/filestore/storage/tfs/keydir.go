@@ -1,38 +1,590 @@
 package tfs
 
-import "io"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filestore/config"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
 
-// KeyDir - a storage implementation based on a local filesystem
+const (
+	readBufSize = 32 * 1024
+	maxKeySize  = 4 * 1024
+	stagingDir  = "staging"
+)
+
+// entry - keydir entry, points to the latest value of a key
+type entry struct {
+	key         string
+	segmentID   uint32
+	valueOffset int64
+	valueSize   int64
+	tstamp      int64
+	tombstone   bool
+	checksum    uint32
+}
+
+// KeyStat - what is known about the latest value of a key without reading it
+type KeyStat struct {
+	Size       int64
+	Checksum   uint32
+	ModifiedAt time.Time
+}
+
+func (e entry) recordOffset() int64 {
+	return e.valueOffset - headerSize - int64(len(e.key))
+}
+
+func (e entry) recordSize() int64 {
+	return headerSize + int64(len(e.key)) + e.valueSize
+}
+
+// KeyDir - a Bitcask-like storage engine based on a local filesystem,
+// values are appended to data segments and an in-memory keydir
+// maps every key to the location of its latest value
 type KeyDir struct {
-	// todo: mutex by key
+	lg             logger.Logger
+	dir            string
+	maxSegmentSize int64
+	locks          *lockManager
+
+	compaction   compactionSettings
+	compactionMx sync.Mutex
+	ctx          context.Context
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+
+	// writeMu serializes appends to the active segment
+	writeMu sync.Mutex
+	// lastTstamp - the newest record timestamp, records are stamped after it
+	// even when the wall clock steps back, guarded by writeMu
+	lastTstamp int64
+
+	// mu guards keys, segments, active and nextID
+	mu       sync.RWMutex
+	keys     map[string]entry
+	segments map[uint32]*segment
+	active   *segment
+	nextID   uint32
 }
 
-func NewKeyDir() *KeyDir {
-	return &KeyDir{}
+// NewKeyDir - opens the storage in the configured directory,
+// rebuilds the keydir from hint files and segments
+// and starts scheduled compaction if it is enabled
+func NewKeyDir(cfg *config.Config, lg logger.Logger) (*KeyDir, error) {
+	dir := cfg.StorageDir()
+	if err := os.MkdirAll(filepath.Join(dir, stagingDir), 0755); err != nil {
+		return nil, fmt.Errorf("could not create storage dir %s: %w", dir, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	kd := &KeyDir{
+		lg:             lg,
+		dir:            dir,
+		maxSegmentSize: cfg.MaxSegmentSize,
+		locks:          newLockManager(),
+		compaction: compactionSettings{
+			interval:     cfg.CompactionInterval,
+			minDeadRatio: cfg.CompactionMinDeadRatio,
+			rate:         cfg.CompactionRate,
+		},
+		ctx:      ctx,
+		cancel:   cancel,
+		keys:     make(map[string]entry),
+		segments: make(map[uint32]*segment),
+		nextID:   1,
+	}
+
+	if err := kd.load(); err != nil {
+		_ = kd.Close()
+		return nil, err
+	}
+
+	if kd.compaction.interval > 0 {
+		kd.wg.Add(1)
+		go kd.compactionLoop()
+	}
+
+	return kd, nil
 }
 
-func (kd *KeyDir) GetReader(appName, key string) (io.Reader, func() error, error) {
-	// todo: lock the key for read
-	f, err := newTmpFileReader(appName, key)
+func (kd *KeyDir) load() error {
+	if err := kd.sweepStaging(); err != nil {
+		return err
+	}
+
+	if err := kd.finishRemovals(); err != nil {
+		return err
+	}
+
+	if err := kd.sweepMerges(); err != nil {
+		return err
+	}
+
+	ids, err := listSegmentIDs(kd.dir)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	closer := func() error {
-		// todo: release lock
-		return f.Close()
+
+	// the last segment without a hint file was the active one,
+	// it is the only one that can legitimately have a torn tail
+	var lastPlainID uint32
+	for _, id := range ids {
+		if _, err := os.Stat(hintPath(kd.dir, id)); errors.Is(err, os.ErrNotExist) {
+			lastPlainID = id
+		}
+	}
+
+	var lastPlain *segment
+	for _, id := range ids {
+		s, err := openSegment(kd.dir, id)
+		if err != nil {
+			return err
+		}
+		kd.segments[id] = s
+		if id >= kd.nextID {
+			kd.nextID = id + 1
+		}
+
+		if id != lastPlainID {
+			if errHint := readHints(hintPath(kd.dir, id), func(rec scannedRecord) { kd.index(s, rec) }); errHint == nil {
+				s.hinted = true
+				continue
+			} else if !errors.Is(errHint, os.ErrNotExist) {
+				kd.lg.Error(fmt.Errorf("falling back to scanning segment %s: %w", s.path, errHint))
+			}
+		}
+
+		validSize, err := s.scan(func(rec scannedRecord) { kd.index(s, rec) })
+		if err != nil {
+			return err
+		}
+
+		if validSize < s.size {
+			if id == lastPlainID {
+				kd.lg.Debugf("truncating torn tail of segment %s from %d to %d bytes", s.path, s.size, validSize)
+				if err := s.truncate(validSize); err != nil {
+					return err
+				}
+			} else {
+				kd.lg.Error(fmt.Errorf("segment %s is corrupted after %d bytes: %w", s.path, validSize, ErrCorruptedEntry))
+			}
+		}
+
+		if id == lastPlainID {
+			lastPlain = s
+		}
+	}
+
+	if lastPlain == nil {
+		if lastPlain, err = openSegment(kd.dir, kd.nextID); err != nil {
+			return err
+		}
+		kd.segments[lastPlain.id] = lastPlain
+		kd.nextID++
+	}
+
+	if err := syncDir(kd.dir); err != nil {
+		return err
+	}
+
+	kd.active = lastPlain
+	kd.lg.Debugf("keydir loaded %d keys from %d segments in %s", len(kd.keys), len(kd.segments), kd.dir)
+
+	return nil
+}
+
+// index - points the keydir to the record unless it already knows a newer one,
+// tombstones are kept in the keydir as well so that compaction knows about them,
+// must be called with mu held
+func (kd *KeyDir) index(s *segment, rec scannedRecord) {
+	if existing, ok := kd.keys[rec.key]; ok {
+		if existing.tstamp > rec.tstamp {
+			return
+		}
+		if old, ok := kd.segments[existing.segmentID]; ok {
+			old.live -= existing.recordSize()
+		}
+	}
+
+	if rec.tstamp > kd.lastTstamp {
+		kd.lastTstamp = rec.tstamp
+	}
+
+	kd.keys[rec.key] = entry{
+		key:         rec.key,
+		segmentID:   s.id,
+		valueOffset: rec.valueOffset,
+		valueSize:   rec.valueSize,
+		tstamp:      rec.tstamp,
+		tombstone:   rec.tombstone,
+		checksum:    rec.checksum,
+	}
+	s.live += rec.recordSize
+}
+
+// sweepStaging - removes staging files left behind by uploads
+// that were interrupted by a crash or a restart
+func (kd *KeyDir) sweepStaging() error {
+	dir := filepath.Join(kd.dir, stagingDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not read staging dir %s: %w", dir, err)
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return fmt.Errorf("could not remove stale staging file %s: %w", e.Name(), err)
+		}
+		kd.lg.Debugf("removed stale staging file %s", e.Name())
 	}
-	return f, closer, nil
+
+	return syncDir(dir)
+}
+
+// GetReader - returns a reader of the latest value of the key,
+// the key stays locked for reading until the closer is called
+func (kd *KeyDir) GetReader(ctx context.Context, key string) (io.Reader, func() error, error) {
+	return kd.openReader(ctx, key, newRecordReader)
+}
+
+// GetRangeReader - returns a reader of length bytes of the latest value of the key starting at offset,
+// zero length reads up to the end of the value,
+// the record checksum covers the whole value, so only a range spanning all of it is verified
+func (kd *KeyDir) GetRangeReader(ctx context.Context, key string, offset, length int64) (io.Reader, func() error, error) {
+	return kd.openReader(ctx, key, func(s *segment, e entry) (io.Reader, error) {
+		if length == 0 {
+			length = e.valueSize - offset
+		}
+		if offset < 0 || length < 0 || offset+length > e.valueSize {
+			return nil, fmt.Errorf(
+				"range of %d bytes at %d of key %s with %d bytes: %w",
+				length, offset, key, e.valueSize, ErrInvalidRange,
+			)
+		}
+		if offset == 0 && length == e.valueSize {
+			return newRecordReader(s, e)
+		}
+		return newRangeReader(s, e, offset, length)
+	})
 }
 
-func (kd *KeyDir) GetWriter(appName, key string) (io.Writer, func() error, error) {
-	// todo: lock the key for read
-	f, err := newTmpFileWriter(appName, key)
+// openReader - finds the latest value of the key and opens it with the given function
+// while holding the key and its segment
+func (kd *KeyDir) openReader(
+	ctx context.Context,
+	key string,
+	open func(s *segment, e entry) (io.Reader, error),
+) (io.Reader, func() error, error) {
+	unlock, err := kd.locks.RLock(ctx, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not lock key %s for read: %w", key, err)
+	}
+
+	kd.mu.RLock()
+	e, ok := kd.keys[key]
+	var s *segment
+	if ok {
+		s = kd.segments[e.segmentID]
+		s.acquire()
+	}
+	kd.mu.RUnlock()
+
+	if !ok {
+		unlock()
+		return nil, nil, fmt.Errorf("key %s: %w", key, ErrKeyNotFound)
+	}
+
+	if e.tombstone {
+		if errRelease := s.release(); errRelease != nil {
+			kd.lg.Error(errRelease)
+		}
+		unlock()
+		return nil, nil, fmt.Errorf("key %s: %w", key, ErrKeyNotFound)
+	}
+
+	r, err := open(s, e)
 	if err != nil {
+		if errRelease := s.release(); errRelease != nil {
+			kd.lg.Error(errRelease)
+		}
+		unlock()
 		return nil, nil, err
 	}
+
 	closer := func() error {
-		// todo: release lock
-		return f.Close()
+		defer unlock()
+		return s.release()
+	}
+
+	return r, closer, nil
+}
+
+// Stat - size, checksum and modification time of the latest value of the key
+func (kd *KeyDir) Stat(key string) (KeyStat, error) {
+	kd.mu.RLock()
+	e, ok := kd.keys[key]
+	kd.mu.RUnlock()
+
+	if !ok || e.tombstone {
+		return KeyStat{}, fmt.Errorf("key %s: %w", key, ErrKeyNotFound)
+	}
+
+	return KeyStat{
+		Size:       e.valueSize,
+		Checksum:   e.checksum,
+		ModifiedAt: time.Unix(0, e.tstamp),
+	}, nil
+}
+
+// Keys - live keys starting with the prefix that sort after the given key, in ascending order,
+// a snapshot of the keydir at the time of the call
+func (kd *KeyDir) Keys(prefix, after string) []string {
+	kd.mu.RLock()
+	result := make([]string, 0, len(kd.keys))
+	for key, e := range kd.keys {
+		if e.tombstone || !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		result = append(result, key)
+	}
+	kd.mu.RUnlock()
+
+	sort.Strings(result)
+	return result
+}
+
+// GetWriter - returns a writer for a new value of the key that is staged aside,
+// commit makes the value durable and visible to readers, abort throws it away,
+// the key stays locked for writing until one of them is called
+func (kd *KeyDir) GetWriter(ctx context.Context, key string) (io.Writer, func() error, func() error, error) {
+	if key == "" || len(key) > maxKeySize {
+		return nil, nil, nil, fmt.Errorf("key %q: %w", key, ErrInvalidKey)
+	}
+
+	unlock, err := kd.locks.Lock(ctx, key)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not lock key %s for write: %w", key, err)
+	}
+
+	sw, err := newStagingWriter(filepath.Join(kd.dir, stagingDir), key)
+	if err != nil {
+		unlock()
+		return nil, nil, nil, err
+	}
+
+	var once sync.Once
+	finish := func(publish bool) (err error) {
+		once.Do(func() {
+			defer unlock()
+			defer func() {
+				if errDiscard := sw.discard(); errDiscard != nil {
+					kd.lg.Error(errDiscard)
+				}
+			}()
+			if publish {
+				err = kd.commit(sw)
+			}
+		})
+		return err
+	}
+
+	commit := func() error { return finish(true) }
+	abort := func() error { return finish(false) }
+
+	return sw, commit, abort, nil
+}
+
+// commit - appends the staged value as a new record to the active segment,
+// a record torn by a crash fails its checksum and is cut off on the next start
+func (kd *KeyDir) commit(sw *stagingWriter) error {
+	if err := sw.sync(); err != nil {
+		return err
+	}
+
+	h := header{
+		keySize:   uint32(len(sw.key)),
+		valueSize: uint64(sw.size),
+	}
+
+	return kd.append(&h, sw.key, sw.file)
+}
+
+// Delete - appends a tombstone for the key, the space taken by its value
+// is reclaimed by compaction
+func (kd *KeyDir) Delete(ctx context.Context, key string) error {
+	unlock, err := kd.locks.Lock(ctx, key)
+	if err != nil {
+		return fmt.Errorf("could not lock key %s for delete: %w", key, err)
+	}
+	defer unlock()
+
+	kd.mu.RLock()
+	e, ok := kd.keys[key]
+	kd.mu.RUnlock()
+	if !ok || e.tombstone {
+		return fmt.Errorf("key %s: %w", key, ErrKeyNotFound)
+	}
+
+	h := header{
+		keySize:   uint32(len(key)),
+		valueSize: tombstoneMarker,
+	}
+
+	return kd.append(&h, key, nil)
+}
+
+// append - stamps the record, writes it to the active segment and indexes it
+func (kd *KeyDir) append(h *header, key string, value io.ReaderAt) error {
+	kd.writeMu.Lock()
+	defer kd.writeMu.Unlock()
+
+	// the keydir keeps the record with the newest timestamp, so they must never go back
+	h.tstamp = time.Now().UnixNano()
+	if h.tstamp <= kd.lastTstamp {
+		h.tstamp = kd.lastTstamp + 1
+	}
+
+	if kd.active.size > 0 && kd.active.size+h.recordSize() > kd.maxSegmentSize {
+		if err := kd.rotate(); err != nil {
+			return err
+		}
+	}
+
+	s := kd.active
+	offset := s.size
+	checksum, err := kd.appendRecord(s, offset, h, []byte(key), value)
+	if err != nil {
+		if errTruncate := s.truncate(offset); errTruncate != nil {
+			kd.lg.Error(errTruncate)
+		}
+		return err
+	}
+
+	kd.mu.Lock()
+	s.size = offset + h.recordSize()
+	kd.index(s, scannedRecord{
+		key:         key,
+		tstamp:      h.tstamp,
+		valueOffset: offset + headerSize + int64(len(key)),
+		valueSize:   h.valueLen(),
+		recordSize:  h.recordSize(),
+		tombstone:   h.isTombstone(),
+		checksum:    checksum,
+	})
+	kd.mu.Unlock()
+
+	return nil
+}
+
+// appendRecord - writes the record at the offset and returns the checksum of its value
+func (kd *KeyDir) appendRecord(s *segment, offset int64, h *header, key []byte, value io.ReaderAt) (uint32, error) {
+	var valueCRC uint32
+	crc := h.crcPrefix(key)
+	pos := offset + headerSize
+	if _, err := s.file.WriteAt(key, pos); err != nil {
+		return 0, fmt.Errorf("could not write key to %s: %w", s.path, err)
+	}
+	pos += int64(len(key))
+
+	if value != nil {
+		buf := make([]byte, readBufSize)
+		vr := io.NewSectionReader(value, 0, h.valueLen())
+		for {
+			n, err := vr.Read(buf)
+			if n > 0 {
+				if _, errWrite := s.file.WriteAt(buf[:n], pos); errWrite != nil {
+					return 0, fmt.Errorf("could not write value to %s: %w", s.path, errWrite)
+				}
+				crc = crc32.Update(crc, crcTable, buf[:n])
+				valueCRC = crc32.Update(valueCRC, crcTable, buf[:n])
+				pos += int64(n)
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return 0, fmt.Errorf("could not read staged value: %w", err)
+			}
+		}
+	}
+
+	h.crc = crc
+	hb := make([]byte, headerSize)
+	h.encode(hb)
+	if _, err := s.file.WriteAt(hb, offset); err != nil {
+		return 0, fmt.Errorf("could not write header to %s: %w", s.path, err)
+	}
+
+	if err := s.file.Sync(); err != nil {
+		return 0, fmt.Errorf("could not sync segment %s: %w", s.path, err)
+	}
+
+	return valueCRC, nil
+}
+
+// rotate - seals the active segment and starts a new one,
+// must be called with writeMu held
+func (kd *KeyDir) rotate() error {
+	next, err := openSegment(kd.dir, kd.allocSegmentID())
+	if err != nil {
+		return err
+	}
+	if err := syncDir(kd.dir); err != nil {
+		_ = next.close()
+		return err
+	}
+
+	kd.mu.Lock()
+	kd.segments[next.id] = next
+	kd.active = next
+	kd.mu.Unlock()
+
+	kd.lg.Debugf("rotated to segment %s", next.path)
+	return nil
+}
+
+func (kd *KeyDir) allocSegmentID() uint32 {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	id := kd.nextID
+	kd.nextID++
+	return id
+}
+
+// Close - stops compaction and closes all segment files
+func (kd *KeyDir) Close() error {
+	kd.cancel()
+	kd.wg.Wait()
+
+	// waits for a compaction triggered outside the schedule to notice the cancellation
+	kd.compactionMx.Lock()
+	defer kd.compactionMx.Unlock()
+
+	kd.writeMu.Lock()
+	defer kd.writeMu.Unlock()
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	var result error
+	for id, s := range kd.segments {
+		if err := s.close(); err != nil {
+			result = errors.Join(result, err)
+		}
+		delete(kd.segments, id)
 	}
-	return f, closer, nil
+
+	return result
 }
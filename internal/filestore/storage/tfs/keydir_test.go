@@ -0,0 +1,308 @@
+package tfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/denismitr/shardstore/internal/common/logger"
+	"github.com/denismitr/shardstore/internal/filestore/config"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestKeyDir(t *testing.T, dir string, maxSegmentSize int64) *KeyDir {
+	t.Helper()
+	kd, err := NewKeyDir(&config.Config{DataDir: dir, MaxSegmentSize: maxSegmentSize}, logger.NewStdoutLogger(logger.Dev, "test"))
+	if err != nil {
+		t.Fatalf("could not open keydir: %s", err)
+	}
+	return kd
+}
+
+func put(t *testing.T, kd *KeyDir, key string, value []byte) {
+	t.Helper()
+	w, commit, _, err := kd.GetWriter(context.Background(), key)
+	if err != nil {
+		t.Fatalf("GetWriter(%s) error = %v", key, err)
+	}
+	if _, err := w.Write(value); err != nil {
+		t.Fatalf("Write(%s) error = %v", key, err)
+	}
+	if err := commit(); err != nil {
+		t.Fatalf("commit(%s) error = %v", key, err)
+	}
+}
+
+func get(t *testing.T, kd *KeyDir, key string) []byte {
+	t.Helper()
+	r, closer, err := kd.GetReader(context.Background(), key)
+	if err != nil {
+		t.Fatalf("GetReader(%s) error = %v", key, err)
+	}
+	defer closer()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll(%s) error = %v", key, err)
+	}
+	return b
+}
+
+func TestKeyDir_PutGet(t *testing.T) {
+	kd := openTestKeyDir(t, t.TempDir(), 1024)
+	defer kd.Close()
+
+	put(t, kd, "a", []byte("first"))
+	put(t, kd, "b", []byte("second"))
+	put(t, kd, "a", []byte("overwritten"))
+
+	if got := get(t, kd, "a"); !bytes.Equal(got, []byte("overwritten")) {
+		t.Errorf("get(a) = %q, want %q", got, "overwritten")
+	}
+	if got := get(t, kd, "b"); !bytes.Equal(got, []byte("second")) {
+		t.Errorf("get(b) = %q, want %q", got, "second")
+	}
+
+	if _, _, err := kd.GetReader(context.Background(), "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetReader(missing) error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestKeyDir_GetRangeReader(t *testing.T) {
+	kd := openTestKeyDir(t, t.TempDir(), 1024)
+	defer kd.Close()
+
+	put(t, kd, "other", []byte("unrelated"))
+	put(t, kd, "a", []byte("0123456789"))
+
+	tt := []struct {
+		name           string
+		offset, length int64
+		want           string
+		err            error
+	}{
+		{name: "middle", offset: 2, length: 3, want: "234"},
+		{name: "up to the end", offset: 7, length: 0, want: "789"},
+		{name: "whole value", offset: 0, length: 10, want: "0123456789"},
+		{name: "past the end", offset: 8, length: 3, err: ErrInvalidRange},
+		{name: "negative offset", offset: -1, length: 3, err: ErrInvalidRange},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r, closer, err := kd.GetRangeReader(context.Background(), "a", tc.offset, tc.length)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("GetRangeReader() error = %v, want %v", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetRangeReader() error = %v", err)
+			}
+			defer closer()
+
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("GetRangeReader() read %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestKeyDir_RotationAndRebuild(t *testing.T) {
+	dir := t.TempDir()
+	kd := openTestKeyDir(t, dir, 64)
+
+	values := map[string][]byte{}
+	for i := 0; i < 10; i++ {
+		key := string(rune('a' + i))
+		values[key] = bytes.Repeat([]byte{byte(i)}, 40)
+		put(t, kd, key, values[key])
+	}
+	values["c"] = []byte("updated")
+	put(t, kd, "c", values["c"])
+
+	if err := kd.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	ids, err := listSegmentIDs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) < 2 {
+		t.Fatalf("expected segments to rotate, got %d segment(s)", len(ids))
+	}
+
+	kd = openTestKeyDir(t, dir, 64)
+	defer kd.Close()
+
+	for key, want := range values {
+		if got := get(t, kd, key); !bytes.Equal(got, want) {
+			t.Errorf("after rebuild get(%s) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestKeyDir_WritesAfterTheClockStepsBackAreIndexed(t *testing.T) {
+	dir := t.TempDir()
+	kd := openTestKeyDir(t, dir, 1024)
+	ctx := context.Background()
+
+	// records written while the clock was an hour ahead
+	ahead := time.Now().Add(time.Hour).UnixNano()
+	kd.writeMu.Lock()
+	kd.lastTstamp = ahead
+	kd.writeMu.Unlock()
+	put(t, kd, "a", []byte("written ahead"))
+
+	put(t, kd, "a", []byte("written after"))
+	if got := get(t, kd, "a"); string(got) != "written after" {
+		t.Errorf("get(a) = %q, want the later value", got)
+	}
+	put(t, kd, "b", []byte("deleted"))
+	if err := kd.Delete(ctx, "b"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, _, err := kd.GetReader(ctx, "b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetReader(b) error = %v, want %v", err, ErrKeyNotFound)
+	}
+	_ = kd.Close()
+
+	// the newest timestamp is taken from the records on start
+	kd = openTestKeyDir(t, dir, 1024)
+	defer kd.Close()
+	put(t, kd, "a", []byte("written after reopen"))
+	if got := get(t, kd, "a"); string(got) != "written after reopen" {
+		t.Errorf("after reopen get(a) = %q, want the latest value", got)
+	}
+	if _, _, err := kd.GetReader(ctx, "b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("after reopen GetReader(b) error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestKeyDir_TornTailIsTruncated(t *testing.T) {
+	dir := t.TempDir()
+	kd := openTestKeyDir(t, dir, 1024)
+	put(t, kd, "a", []byte("complete"))
+	validSize := kd.active.size
+	if err := kd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(segmentPath(dir, 1), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("half written record")); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	kd = openTestKeyDir(t, dir, 1024)
+	defer kd.Close()
+
+	if kd.active.size != validSize {
+		t.Errorf("active segment size = %d, want %d", kd.active.size, validSize)
+	}
+	if got := get(t, kd, "a"); !bytes.Equal(got, []byte("complete")) {
+		t.Errorf("get(a) = %q, want %q", got, "complete")
+	}
+}
+
+func TestKeyDir_AbortedWriteIsDiscarded(t *testing.T) {
+	dir := t.TempDir()
+	kd := openTestKeyDir(t, dir, 1024)
+	put(t, kd, "a", []byte("original"))
+
+	w, _, abort, err := kd.GetWriter(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	if err := abort(); err != nil {
+		t.Fatalf("abort() error = %v", err)
+	}
+
+	if got := get(t, kd, "a"); !bytes.Equal(got, []byte("original")) {
+		t.Errorf("get(a) = %q, want %q", got, "original")
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, stagingDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected staging dir to be empty, got %d file(s)", len(entries))
+	}
+	_ = kd.Close()
+}
+
+func TestKeyDir_StaleStagingFilesAreSwept(t *testing.T) {
+	dir := t.TempDir()
+	kd := openTestKeyDir(t, dir, 1024)
+	if _, _, _, err := kd.GetWriter(context.Background(), "crashed"); err != nil {
+		t.Fatal(err)
+	}
+	_ = kd.Close()
+
+	kd = openTestKeyDir(t, dir, 1024)
+	defer kd.Close()
+
+	entries, err := os.ReadDir(filepath.Join(dir, stagingDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected stale staging files to be removed, got %d file(s)", len(entries))
+	}
+	if _, _, err := kd.GetReader(context.Background(), "crashed"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetReader(crashed) error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestKeyDir_StatSurvivesCompactionAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	kd := openTestKeyDir(t, dir, 64)
+
+	value := bytes.Repeat([]byte{'s'}, 40)
+	put(t, kd, "stat", value)
+	put(t, kd, "filler", bytes.Repeat([]byte{'f'}, 40))
+
+	want, err := kd.Stat("stat")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if want.Size != int64(len(value)) || want.Checksum != crc32.Checksum(value, crcTable) {
+		t.Fatalf("Stat() = %+v, want size %d and checksum %d", want, len(value), crc32.Checksum(value, crcTable))
+	}
+
+	if _, err := kd.Compact(context.Background(), CompactOptions{All: true}); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	_ = kd.Close()
+
+	kd = openTestKeyDir(t, dir, 64)
+	defer kd.Close()
+
+	got, err := kd.Stat("stat")
+	if err != nil {
+		t.Fatalf("Stat() after reopen error = %v", err)
+	}
+	if got.Size != want.Size || got.Checksum != want.Checksum || !got.ModifiedAt.Equal(want.ModifiedAt) {
+		t.Errorf("Stat() after reopen = %+v, want %+v", got, want)
+	}
+
+	if _, err := kd.Stat("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Stat(missing) error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
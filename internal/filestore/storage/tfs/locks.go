@@ -0,0 +1,109 @@
+package tfs
+
+import (
+	"context"
+	"sync"
+)
+
+// keyLock - state of a single key lock,
+// changed is closed and replaced every time the state changes to wake up the waiters
+type keyLock struct {
+	readers        int
+	writer         bool
+	waitingWriters int
+	refs           int
+	changed        chan struct{}
+}
+
+func (kl *keyLock) notify() {
+	close(kl.changed)
+	kl.changed = make(chan struct{})
+}
+
+// lockManager - per key read/write locks that can be abandoned
+// when the context is done, writers take precedence over new readers
+type lockManager struct {
+	mx    sync.Mutex
+	locks map[string]*keyLock
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{locks: make(map[string]*keyLock)}
+}
+
+// RLock - acquires a shared lock on the key
+func (lm *lockManager) RLock(ctx context.Context, key string) (func(), error) {
+	return lm.lock(ctx, key, false)
+}
+
+// Lock - acquires an exclusive lock on the key
+func (lm *lockManager) Lock(ctx context.Context, key string) (func(), error) {
+	return lm.lock(ctx, key, true)
+}
+
+func (lm *lockManager) lock(ctx context.Context, key string, exclusive bool) (func(), error) {
+	lm.mx.Lock()
+	kl, ok := lm.locks[key]
+	if !ok {
+		kl = &keyLock{changed: make(chan struct{})}
+		lm.locks[key] = kl
+	}
+	kl.refs++
+	if exclusive {
+		kl.waitingWriters++
+	}
+
+	for {
+		if exclusive && !kl.writer && kl.readers == 0 {
+			kl.waitingWriters--
+			kl.writer = true
+			break
+		}
+
+		if !exclusive && !kl.writer && kl.waitingWriters == 0 {
+			kl.readers++
+			break
+		}
+
+		changed := kl.changed
+		lm.mx.Unlock()
+
+		select {
+		case <-changed:
+			lm.mx.Lock()
+		case <-ctx.Done():
+			lm.mx.Lock()
+			if exclusive {
+				kl.waitingWriters--
+				kl.notify()
+			}
+			lm.release(key, kl)
+			lm.mx.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	lm.mx.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			lm.mx.Lock()
+			defer lm.mx.Unlock()
+			if exclusive {
+				kl.writer = false
+			} else {
+				kl.readers--
+			}
+			kl.notify()
+			lm.release(key, kl)
+		})
+	}, nil
+}
+
+// release - drops a reference to the key lock, must be called with mx held
+func (lm *lockManager) release(key string, kl *keyLock) {
+	kl.refs--
+	if kl.refs == 0 {
+		delete(lm.locks, key)
+	}
+}
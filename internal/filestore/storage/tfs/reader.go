@@ -1,37 +1,64 @@
 package tfs
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"path"
+	"hash/crc32"
+	"io"
 )
 
-type tmpFileReader struct {
-	key  string
-	dir  string
-	file *os.File
+// recordReader - reads a value straight from its segment
+// and verifies the record checksum once the value is read to the end
+type recordReader struct {
+	key      string
+	section  *io.SectionReader
+	crc      uint32
+	expected uint32
 }
 
-func newTmpFileReader(serverName, key string) (*tmpFileReader, error) {
-	dir := fmt.Sprintf("tmp/%s/filestore", serverName)
-	filePath := path.Join(dir, key)
-
-	f, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
+func newRecordReader(s *segment, e entry) (io.Reader, error) {
+	h, err := readEntryHeader(s, e)
 	if err != nil {
 		return nil, err
 	}
 
-	return &tmpFileReader{
-		key:  key,
-		dir:  dir,
-		file: f,
+	return &recordReader{
+		key:      e.key,
+		section:  io.NewSectionReader(s.file, e.valueOffset, e.valueSize),
+		crc:      h.crcPrefix([]byte(e.key)),
+		expected: h.crc,
 	}, nil
 }
 
-func (t *tmpFileReader) Read(p []byte) (n int, err error) {
-	return t.file.Read(p)
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.section.Read(p)
+	r.crc = crc32.Update(r.crc, crcTable, p[:n])
+	if errors.Is(err, io.EOF) && r.crc != r.expected {
+		return n, fmt.Errorf("checksum mismatch for key %s: %w", r.key, ErrCorruptedEntry)
+	}
+	return n, err
 }
 
-func (t *tmpFileReader) Close() error {
-	return t.file.Close()
+// newRangeReader - reads a part of a value straight from its segment,
+// the header is still checked to make sure the entry points at the record of the key
+func newRangeReader(s *segment, e entry, offset, length int64) (io.Reader, error) {
+	if _, err := readEntryHeader(s, e); err != nil {
+		return nil, err
+	}
+
+	return io.NewSectionReader(s.file, e.valueOffset+offset, length), nil
+}
+
+func readEntryHeader(s *segment, e entry) (header, error) {
+	hb := make([]byte, headerSize)
+	if _, err := s.file.ReadAt(hb, e.recordOffset()); err != nil {
+		return header{}, fmt.Errorf("could not read header of key %s: %w", e.key, err)
+	}
+
+	h := decodeHeader(hb)
+	if int64(h.valueSize) != e.valueSize || int(h.keySize) != len(e.key) {
+		return header{}, fmt.Errorf("header mismatch for key %s: %w", e.key, ErrCorruptedEntry)
+	}
+
+	return h, nil
 }
@@ -0,0 +1,74 @@
+package tfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// every record in a data segment looks like
+// | crc uint32 | tstamp int64 | key size uint32 | value size uint64 | key | value |
+// crc covers everything that follows it, header fields included,
+// a tombstone is a record without a value that has the value size set to tombstoneMarker
+const (
+	headerSize      = 4 + 8 + 4 + 8
+	tombstoneMarker = ^uint64(0)
+)
+
+var (
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrCorruptedEntry = errors.New("corrupted entry")
+	ErrInvalidKey     = errors.New("invalid key")
+	ErrInvalidRange   = errors.New("invalid range")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type header struct {
+	crc       uint32
+	tstamp    int64
+	keySize   uint32
+	valueSize uint64
+}
+
+func (h *header) encode(buf []byte) {
+	binary.BigEndian.PutUint32(buf[0:4], h.crc)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(h.tstamp))
+	binary.BigEndian.PutUint32(buf[12:16], h.keySize)
+	binary.BigEndian.PutUint64(buf[16:24], h.valueSize)
+}
+
+func decodeHeader(buf []byte) header {
+	return header{
+		crc:       binary.BigEndian.Uint32(buf[0:4]),
+		tstamp:    int64(binary.BigEndian.Uint64(buf[4:12])),
+		keySize:   binary.BigEndian.Uint32(buf[12:16]),
+		valueSize: binary.BigEndian.Uint64(buf[16:24]),
+	}
+}
+
+func (h *header) isTombstone() bool {
+	return h.valueSize == tombstoneMarker
+}
+
+// valueLen - number of value bytes that follow the key
+func (h *header) valueLen() int64 {
+	if h.isTombstone() {
+		return 0
+	}
+	return int64(h.valueSize)
+}
+
+// recordSize - total size of a record on disk
+func (h *header) recordSize() int64 {
+	return headerSize + int64(h.keySize) + h.valueLen()
+}
+
+// crcPrefix - checksum of the header fields (without crc itself) and the key,
+// value bytes are added on top of it with crc32.Update
+func (h *header) crcPrefix(key []byte) uint32 {
+	buf := make([]byte, headerSize)
+	h.encode(buf)
+	crc := crc32.Update(0, crcTable, buf[4:])
+	return crc32.Update(crc, crcTable, key)
+}
@@ -0,0 +1,228 @@
+package tfs
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentExt = ".data"
+	mergeExt   = ".merge"
+)
+
+// segment - a single append-only data file,
+// only the active segment is ever written to, the rest are sealed
+type segment struct {
+	id   uint32
+	path string
+	file *os.File
+	size int64
+
+	// live - bytes taken by records the keydir points to, guarded by KeyDir.mu
+	live int64
+
+	// hinted - the segment was produced by compaction and has a hint file
+	hinted bool
+
+	refMx   sync.Mutex
+	refs    int
+	retired bool
+}
+
+func segmentPath(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d%s", id, segmentExt))
+}
+
+func openSegment(dir string, id uint32) (*segment, error) {
+	p := segmentPath(dir, id)
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open segment %s: %w", p, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("could not stat segment %s: %w", p, err)
+	}
+
+	return &segment{id: id, path: p, file: f, size: info.Size()}, nil
+}
+
+// listSegmentIDs - ids of all data segments in the dir in ascending order
+func listSegmentIDs(dir string) ([]uint32, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read dir %s: %w", dir, err)
+	}
+
+	var ids []uint32
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), segmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), segmentExt), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// scannedRecord - a record found while scanning a segment
+type scannedRecord struct {
+	key         string
+	tstamp      int64
+	valueOffset int64
+	valueSize   int64
+	recordSize  int64
+	tombstone   bool
+	// checksum - CRC32C of the value alone
+	checksum uint32
+}
+
+// scan - walks all records of the segment and verifies their checksums,
+// returns the offset right after the last valid record,
+// everything past it is a torn or corrupted tail
+func (s *segment) scan(fn func(rec scannedRecord)) (int64, error) {
+	var offset int64
+	hb := make([]byte, headerSize)
+	for offset < s.size {
+		if _, err := s.file.ReadAt(hb, offset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return offset, nil
+			}
+			return offset, fmt.Errorf("could not read header in %s at %d: %w", s.path, offset, err)
+		}
+
+		h := decodeHeader(hb)
+		if offset+h.recordSize() > s.size {
+			return offset, nil
+		}
+
+		key := make([]byte, h.keySize)
+		if _, err := s.file.ReadAt(key, offset+headerSize); err != nil {
+			return offset, fmt.Errorf("could not read key in %s at %d: %w", s.path, offset, err)
+		}
+
+		valueOffset := offset + headerSize + int64(h.keySize)
+		sum, valueSum, err := checksums(s.file, h.crcPrefix(key), valueOffset, h.valueLen())
+		if err != nil {
+			return offset, fmt.Errorf("could not read value in %s at %d: %w", s.path, offset, err)
+		}
+		if sum != h.crc {
+			return offset, nil
+		}
+
+		fn(scannedRecord{
+			key:         string(key),
+			tstamp:      h.tstamp,
+			valueOffset: valueOffset,
+			valueSize:   h.valueLen(),
+			recordSize:  h.recordSize(),
+			tombstone:   h.isTombstone(),
+			checksum:    valueSum,
+		})
+
+		offset += h.recordSize()
+	}
+
+	return offset, nil
+}
+
+// checksums - continues the record checksum over the value
+// and computes the checksum of the value alone in the same pass
+func checksums(r io.ReaderAt, crc uint32, offset, size int64) (uint32, uint32, error) {
+	var valueCRC uint32
+	buf := make([]byte, readBufSize)
+	sr := io.NewSectionReader(r, offset, size)
+	for {
+		n, err := sr.Read(buf)
+		crc = crc32.Update(crc, crcTable, buf[:n])
+		valueCRC = crc32.Update(valueCRC, crcTable, buf[:n])
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return crc, valueCRC, nil
+			}
+			return 0, 0, err
+		}
+	}
+}
+
+// syncDir - makes file creations and removals in the dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("could not open dir %s: %w", dir, err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("could not sync dir %s: %w", dir, err)
+	}
+	return nil
+}
+
+// deadRatio - share of the segment taken by overwritten records
+func (s *segment) deadRatio() float64 {
+	if s.size == 0 {
+		return 0
+	}
+	return float64(s.size-s.live) / float64(s.size)
+}
+
+// acquire - keeps the segment file open while a reader uses it
+func (s *segment) acquire() {
+	s.refMx.Lock()
+	s.refs++
+	s.refMx.Unlock()
+}
+
+func (s *segment) release() error {
+	s.refMx.Lock()
+	defer s.refMx.Unlock()
+	s.refs--
+	if s.retired && s.refs == 0 {
+		return s.close()
+	}
+	return nil
+}
+
+// retire - closes the segment file as soon as the last reader is done with it,
+// the file itself has to be removed from the dir beforehand
+func (s *segment) retire() error {
+	s.refMx.Lock()
+	defer s.refMx.Unlock()
+	s.retired = true
+	if s.refs == 0 {
+		return s.close()
+	}
+	return nil
+}
+
+func (s *segment) truncate(size int64) error {
+	if err := s.file.Truncate(size); err != nil {
+		return fmt.Errorf("could not truncate segment %s to %d: %w", s.path, size, err)
+	}
+	s.size = size
+	return s.file.Sync()
+}
+
+func (s *segment) close() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("could not close segment %s: %w", s.path, err)
+	}
+	return nil
+}
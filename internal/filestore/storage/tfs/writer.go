@@ -3,56 +3,52 @@ package tfs
 import (
 	"fmt"
 	"os"
-	"path"
 )
 
-type tmpFileWriter struct {
+// stagingWriter - accumulates a value in a staging file,
+// since the value size has to be known before a record can be appended to a segment
+type stagingWriter struct {
 	key  string
-	dir  string
+	size int64
 	file *os.File
 }
 
-func newTmpFileWriter(serverName, key string) (*tmpFileWriter, error) {
-	dir := fmt.Sprintf("tmp/%s/filestore", serverName)
-	if err := os.MkdirAll(dir, 0644); err != nil {
-		return nil, err
-	}
-
-	filePath := path.Join(dir, key)
-
-	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+func newStagingWriter(dir, key string) (*stagingWriter, error) {
+	f, err := os.CreateTemp(dir, "*.staging")
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("could not create staging file for key %s: %w", key, err)
 	}
 
-	return &tmpFileWriter{
+	return &stagingWriter{
 		key:  key,
-		dir:  dir,
 		file: f,
 	}, nil
 }
 
-func (fs *tmpFileWriter) Write(chunk []byte) (int, error) {
-	n, err := fs.file.Write(chunk)
+func (sw *stagingWriter) Write(chunk []byte) (int, error) {
+	n, err := sw.file.Write(chunk)
+	sw.size += int64(n)
 	if err != nil {
-		return 0, fmt.Errorf("failed to write to %s: %w", fs.file.Name(), err)
-	}
-	if err := fs.file.Sync(); err != nil {
-		return n, fmt.Errorf("could not sync file %s: %w", fs.file.Name(), err)
+		return n, fmt.Errorf("failed to write to %s: %w", sw.file.Name(), err)
 	}
 	return n, nil
 }
 
-func (fs *tmpFileWriter) Sync() error {
-	if err := fs.file.Sync(); err != nil {
-		return fmt.Errorf("could not sync file %s: %w", fs.file.Name(), err)
+// sync - flushes the staged value to disk
+func (sw *stagingWriter) sync() error {
+	if err := sw.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync staging file %s: %w", sw.file.Name(), err)
 	}
 	return nil
 }
 
-func (fs *tmpFileWriter) Close() error {
-	if err := fs.file.Close(); err != nil {
-		return fmt.Errorf("could not close file %s: %w", fs.file.Name(), err)
+// discard - closes and removes the staging file
+func (sw *stagingWriter) discard() error {
+	if err := sw.file.Close(); err != nil {
+		return fmt.Errorf("could not close staging file %s: %w", sw.file.Name(), err)
+	}
+	if err := os.Remove(sw.file.Name()); err != nil {
+		return fmt.Errorf("could not remove staging file %s: %w", sw.file.Name(), err)
 	}
 	return nil
 }